@@ -0,0 +1,229 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/btcutil/hdkeychain"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/gin-gonic/gin"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/test/bufconn"
+
+	"github.com/sawdustofmind/bitcoin-wallet/backend/config"
+	"github.com/sawdustofmind/bitcoin-wallet/backend/db"
+	"github.com/sawdustofmind/bitcoin-wallet/backend/grpcapi"
+	"github.com/sawdustofmind/bitcoin-wallet/backend/proto/walletv1"
+	"github.com/sawdustofmind/bitcoin-wallet/backend/wallet"
+)
+
+// accountsConnector is a database holding the default wallet discovering
+// accounts, with two accounts imported.
+type accountsConnector struct {
+	keys []string
+}
+
+func (c accountsConnector) Connect(context.Context) (driver.Conn, error) { return accountsConn(c), nil }
+func (c accountsConnector) Driver() driver.Driver                        { return c }
+func (c accountsConnector) Open(string) (driver.Conn, error)             { return accountsConn(c), nil }
+
+type accountsConn accountsConnector
+
+func (accountsConn) Prepare(string) (driver.Stmt, error) { return nil, errors.New("not supported") }
+func (accountsConn) Close() error                        { return nil }
+func (accountsConn) Begin() (driver.Tx, error)           { return nil, errors.New("not supported") }
+
+func (c accountsConn) QueryContext(_ context.Context, query string, _ []driver.NamedValue) (driver.Rows, error) {
+	if !strings.HasPrefix(query, "SELECT id, name, xpub") {
+		return nil, fmt.Errorf("unexpected query %q", query)
+	}
+	return &fakeRows{
+		columns: []string{"id", "name", "xpub", "descriptor", "change_descriptor", "script_type", "node_wallet", "created_at", "change_index",
+			"account_discovery", "account_keys", "accounts"},
+		values: []driver.Value{wallet.DefaultWalletID, "default", nil, nil, nil, wallet.ScriptP2WPKH, "mywallet", time.Now(), int64(0),
+			true, `{"` + strings.Join(c.keys, `","`) + `"}`, int64(2)},
+	}, nil
+}
+
+func (accountsConn) ExecContext(context.Context, string, []driver.NamedValue) (driver.Result, error) {
+	return driver.RowsAffected(1), nil
+}
+
+// accountKeys returns the keys of BIP84 accounts 0 to n-1 of a test seed.
+func accountKeys(t *testing.T, n int) []string {
+	t.Helper()
+	master, err := hdkeychain.NewMaster(bytes.Repeat([]byte{0x84}, 32), &chaincfg.RegressionNetParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := make([]string, n)
+	for i := range keys {
+		k := master
+		for _, step := range []uint32{84, 1, uint32(i)} {
+			if k, err = k.Derive(hdkeychain.HardenedKeyStart + step); err != nil {
+				t.Fatal(err)
+			}
+		}
+		pub, err := k.Neuter()
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys[i] = fmt.Sprintf("[d34db33f/84h/1h/%dh]%s", i, pub)
+	}
+	return keys
+}
+
+// accountsBitcoind answers for a node wallet holding one output in each
+// of accounts 0 and 1 and one it cannot place.
+func accountsBitcoind(t *testing.T) *httptest.Server {
+	utxos := []map[string]interface{}{
+		{"txid": "aa", "vout": 0, "address": "bcrt1qa", "scriptPubKey": "0014aa", "amount": 0.5, "confirmations": 3, "spendable": false,
+			"desc": "wpkh([d34db33f/84h/1h/0h/0/2]02aa)#00000000"},
+		{"txid": "bb", "vout": 1, "address": "bcrt1qb", "scriptPubKey": "0014bb", "amount": 1.25, "confirmations": 7, "spendable": false,
+			"desc": "wpkh([d34db33f/84h/1h/1h/1/0]02bb)#00000000"},
+		{"txid": "cc", "vout": 0, "address": "bcrt1qc", "scriptPubKey": "0014cc", "amount": 0.001, "confirmations": 1, "spendable": false,
+			"desc": "addr(bcrt1qc)#00000000"},
+	}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			ID     json.RawMessage `json:"id"`
+			Method string          `json:"method"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("bad RPC request: %v", err)
+			return
+		}
+		var result interface{}
+		switch req.Method {
+		case "getblockchaininfo":
+			result = map[string]interface{}{"chain": "regtest", "blocks": 0}
+		case "createwallet":
+			result = map[string]string{"name": "mywallet"}
+		case "importdescriptors":
+			result = []map[string]bool{{"success": true}}
+		case "getbalances":
+			result = map[string]interface{}{"mine": map[string]float64{"trusted": 1.751, "untrusted_pending": 0, "immature": 0}}
+		case "listunspent":
+			result = utxos
+		default:
+			t.Errorf("unexpected RPC %s", req.Method)
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"result": result, "error": nil, "id": req.ID})
+	}))
+}
+
+func TestAccountsGRPCMatchesREST(t *testing.T) {
+	node := accountsBitcoind(t)
+	defer node.Close()
+	database := db.Open(accountsConnector{keys: accountKeys(t, 3)})
+	defer database.Close()
+
+	ctx := context.Background()
+	m, err := wallet.NewManager(ctx, config.BitcoinConfig{
+		RPCHost: strings.TrimPrefix(node.URL, "http://"),
+		RPCUser: "user",
+		RPCPass: "pass",
+	}, database)
+	if err != nil {
+		t.Fatalf("wallet.NewManager: %v", err)
+	}
+	if err := m.Load(ctx); err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	RegisterRoutes(r, m, Deps{Authenticator: testKeys})
+	get := func(path string, v interface{}) {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("X-API-Key", "admin")
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("GET %s = %d: %s", path, rec.Code, rec.Body)
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), v); err != nil {
+			t.Fatalf("GET %s: %v", path, err)
+		}
+	}
+
+	lis := bufconn.Listen(1 << 20)
+	srv := grpcapi.NewServer(grpcapi.FromManager(m), grpcapi.Deps{Keys: testKeys})
+	go srv.Serve(lis)
+	defer srv.Stop()
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return lis.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("Failed to dial bufconn: %v", err)
+	}
+	defer conn.Close()
+	client := walletv1.NewWalletServiceClient(conn)
+	rpcCtx := metadata.AppendToOutgoingContext(ctx, "x-api-key", "admin")
+
+	var restUTXOs struct {
+		UTXOs []struct {
+			TxID           string  `json:"txid"`
+			Account        *uint32 `json:"account"`
+			DerivationPath string  `json:"derivation_path"`
+		} `json:"utxos"`
+	}
+	get("/v1/wallets/1/utxos", &restUTXOs)
+	rpcUTXOs, err := client.ListUTXOs(rpcCtx, &walletv1.ListUTXOsRequest{})
+	if err != nil {
+		t.Fatalf("ListUTXOs: %v", err)
+	}
+	if len(rpcUTXOs.Utxos) != 3 || len(restUTXOs.UTXOs) != 3 {
+		t.Fatalf("ListUTXOs returned %d outputs, REST %d; want 3", len(rpcUTXOs.Utxos), len(restUTXOs.UTXOs))
+	}
+	for i, u := range rpcUTXOs.Utxos {
+		rest := restUTXOs.UTXOs[i]
+		if u.Txid != rest.TxID || (u.Account == nil) != (rest.Account == nil) ||
+			(u.Account != nil && *u.Account != *rest.Account) || u.DerivationPath != rest.DerivationPath {
+			t.Errorf("UTXO %d: gRPC %v, REST %+v", i, u, rest)
+		}
+	}
+	if u := rpcUTXOs.Utxos[1]; u.Account == nil || *u.Account != 1 || u.DerivationPath != "m/84h/1h/1h/1/0" {
+		t.Errorf("UTXO of account 1 = %v", u)
+	}
+
+	var restBalance struct {
+		Accounts []struct {
+			Account        uint32 `json:"account"`
+			DerivationPath string `json:"derivation_path"`
+			BalanceSats    int64  `json:"balance_sats"`
+		} `json:"accounts"`
+	}
+	get("/v1/wallets/1/balance", &restBalance)
+	rpcBalance, err := client.GetBalance(rpcCtx, &walletv1.GetBalanceRequest{})
+	if err != nil {
+		t.Fatalf("GetBalance: %v", err)
+	}
+	if len(rpcBalance.Accounts) != 2 || len(restBalance.Accounts) != 2 {
+		t.Fatalf("GetBalance returned %d accounts, REST %d; want 2", len(rpcBalance.Accounts), len(restBalance.Accounts))
+	}
+	for i, a := range rpcBalance.Accounts {
+		rest := restBalance.Accounts[i]
+		if a.Account != rest.Account || a.DerivationPath != rest.DerivationPath || a.TrustedSats != rest.BalanceSats {
+			t.Errorf("account %d: gRPC %v, REST %+v", i, a, rest)
+		}
+	}
+	if a := rpcBalance.Accounts[1]; a.TrustedSats != 125000000 || a.DerivationPath != "m/84h/1h/1h" {
+		t.Errorf("balance of account 1 = %v", a)
+	}
+}
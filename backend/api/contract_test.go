@@ -0,0 +1,419 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/sawdustofmind/bitcoin-wallet/backend/auth"
+)
+
+// fakeKeys authenticates a fixed set of secrets.
+type fakeKeys map[string]*auth.Key
+
+func (f fakeKeys) Authenticate(_ context.Context, secret string) (*auth.Key, error) {
+	if k, ok := f[secret]; ok {
+		return k, nil
+	}
+	return nil, auth.ErrInvalidKey
+}
+
+// testKeys holds an admin key and, for each scope, a key lacking it.
+var testKeys = fakeKeys{
+	"admin":                        {ID: 1, Scopes: []string{auth.ScopeAdmin}},
+	"no-" + auth.ScopeReadBalance:  {ID: 2, Scopes: []string{auth.ScopeIssueAddress}},
+	"no-" + auth.ScopeIssueAddress: {ID: 3, Scopes: []string{auth.ScopeReadBalance}},
+	"no-" + auth.ScopeAdmin:        {ID: 4, Scopes: []string{auth.ScopeReadBalance, auth.ScopeIssueAddress}},
+	"no-" + auth.ScopeCreatePSBT:   {ID: 5, Scopes: []string{auth.ScopeReadBalance, auth.ScopeIssueAddress}},
+}
+
+type openAPIDoc struct {
+	OpenAPI    string                                 `json:"openapi"`
+	Paths      map[string]map[string]openAPIOperation `json:"paths"`
+	Components struct {
+		Schemas map[string]map[string]interface{} `json:"schemas"`
+	} `json:"components"`
+}
+
+type openAPIOperation struct {
+	Scope      string                     `json:"x-required-scope"`
+	Parameters []map[string]interface{}   `json:"parameters"`
+	Responses  map[string]json.RawMessage `json:"responses"`
+	// Security is empty, not nil, for operations taking no API key.
+	Security []map[string]interface{} `json:"security"`
+}
+
+// keyless reports whether op is served without an API key.
+func (op openAPIOperation) keyless() bool {
+	return op.Security != nil && len(op.Security) == 0
+}
+
+func loadSpec(t *testing.T) *openAPIDoc {
+	t.Helper()
+	var doc openAPIDoc
+	if err := json.Unmarshal(openAPISpec, &doc); err != nil {
+		t.Fatalf("openapi.json is not valid JSON: %v", err)
+	}
+	if !strings.HasPrefix(doc.OpenAPI, "3.") {
+		t.Fatalf("openapi version = %q, want 3.x", doc.OpenAPI)
+	}
+	return &doc
+}
+
+func testRouter() *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	RegisterRoutes(r, nil, Deps{Authenticator: testKeys})
+	return r
+}
+
+var ginParam = regexp.MustCompile(`:(\w+)`)
+
+// specOperations returns "METHOD /path" for every operation in the spec.
+func specOperations(doc *openAPIDoc) []string {
+	var ops []string
+	for path, methods := range doc.Paths {
+		for method := range methods {
+			ops = append(ops, strings.ToUpper(method)+" "+path)
+		}
+	}
+	sort.Strings(ops)
+	return ops
+}
+
+func TestRoutesMatchSpec(t *testing.T) {
+	doc := loadSpec(t)
+
+	var routes []string
+	for _, r := range testRouter().Routes() {
+		path, ok := strings.CutPrefix(r.Path, "/v1")
+		if !ok {
+			continue
+		}
+		routes = append(routes, r.Method+" "+ginParam.ReplaceAllString(path, "{$1}"))
+	}
+	sort.Strings(routes)
+
+	spec := specOperations(doc)
+	if strings.Join(routes, "\n") != strings.Join(spec, "\n") {
+		t.Errorf("registered /v1 routes:\n%s\n\nspec operations:\n%s",
+			strings.Join(routes, "\n"), strings.Join(spec, "\n"))
+	}
+}
+
+func TestLegacyRoutesBehindFlag(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	for _, legacy := range []bool{false, true} {
+		r := gin.New()
+		RegisterRoutes(r, nil, Deps{Authenticator: testKeys, LegacyRoutes: legacy})
+		found := false
+		for _, route := range r.Routes() {
+			if route.Method == http.MethodGet && route.Path == "/address" {
+				found = true
+			}
+		}
+		if found != legacy {
+			t.Errorf("LegacyRoutes=%v: GET /address registered = %v", legacy, found)
+		}
+	}
+}
+
+func TestScopesMatchSpec(t *testing.T) {
+	doc := loadSpec(t)
+	r := testRouter()
+
+	for path, methods := range doc.Paths {
+		for method, op := range methods {
+			urlPath := "/v1" + strings.ReplaceAll(path, "{id}", "1")
+			if op.Scope == "" {
+				if !op.keyless() {
+					t.Errorf("%s %s has no scope but is not documented as keyless", method, path)
+				}
+				rec := serve(r, strings.ToUpper(method), urlPath, "", nil)
+				// The payjoin receiver has no wallets to serve here
+				if rec.Code == http.StatusUnauthorized || rec.Code == http.StatusForbidden || (method == "get" && rec.Code != http.StatusOK) {
+					t.Errorf("%s %s without key = %d", method, path, rec.Code)
+				}
+				continue
+			}
+			if _, ok := op.Responses["403"]; !ok {
+				t.Errorf("%s %s requires a scope but does not document 403", method, path)
+			}
+			rec := serve(r, strings.ToUpper(method), urlPath, "no-"+op.Scope, nil)
+			if rec.Code != http.StatusForbidden {
+				t.Errorf("%s %s with key lacking %s = %d, want 403", method, path, op.Scope, rec.Code)
+			}
+			checkError(t, doc, rec, "forbidden")
+		}
+	}
+}
+
+func TestMutatingOperationsAcceptIdempotencyKey(t *testing.T) {
+	doc := loadSpec(t)
+	for path, methods := range doc.Paths {
+		for method, op := range methods {
+			// Responses are stored per API key
+			if (method != "post" && method != "delete") || op.keyless() {
+				continue
+			}
+			found := false
+			for _, p := range op.Parameters {
+				if p["$ref"] == "#/components/parameters/IdempotencyKey" {
+					found = true
+				}
+			}
+			if !found {
+				t.Errorf("%s %s does not document Idempotency-Key", method, path)
+			}
+			if _, ok := op.Responses["422"]; !ok {
+				t.Errorf("%s %s does not document 422 for reused idempotency keys", method, path)
+			}
+			if _, ok := op.Responses["413"]; !ok {
+				t.Errorf("%s %s does not document 413 for bodies over the idempotency limit", method, path)
+			}
+		}
+	}
+}
+
+func TestErrorResponsesMatchSpec(t *testing.T) {
+	doc := loadSpec(t)
+	r := testRouter()
+
+	tests := []struct {
+		method, path, key, body string
+		status                  int
+		code                    string
+		specPath                string
+	}{
+		{"GET", "/v1/balance", "", "", 401, "unauthorized", "/balance"},
+		{"GET", "/v1/balance", "wrong", "", 401, "unauthorized", "/balance"},
+		{"GET", "/v1/balance?height=abc", "admin", "", 400, "invalid_request", "/balance"},
+		{"GET", "/v1/balance?height=1&at=2024-01-01T00:00:00Z", "admin", "", 400, "invalid_request", "/balance"},
+		{"GET", "/v1/balance?at=yesterday", "admin", "", 400, "invalid_request", "/balance"},
+		{"GET", "/v1/balance/history?from=01-02-2024", "admin", "", 400, "invalid_request", "/balance/history"},
+		{"GET", "/v1/export/transactions?format=xml", "admin", "", 400, "invalid_request", "/export/transactions"},
+		{"GET", "/v1/export/transactions?to=tomorrow", "admin", "", 400, "invalid_request", "/export/transactions"},
+		{"POST", "/v1/keys", "admin", "{", 400, "invalid_request", "/keys"},
+		{"POST", "/v1/keys", "admin", `{"name":"t","scopes":["read-balance"],"wallet_id":7}`, 400, "invalid_request", "/keys"},
+		{"POST", "/v1/wallets", "admin", `{"name":"t"}`, 400, "invalid_request", "/wallets"},
+		{"GET", "/v1/wallets/7", "admin", "", 404, "not_found", "/wallets/{id}"},
+		{"GET", "/v1/wallets/abc/utxos", "admin", "", 404, "not_found", "/wallets/{id}/utxos"},
+		{"GET", "/v1/wallets/1/balance?height=abc", "admin", "", 400, "invalid_request", "/wallets/{id}/balance"},
+		{"POST", "/v1/wallets/1/psbt", "admin", `{"outputs":[]}`, 400, "invalid_request", "/wallets/{id}/psbt"},
+		{"GET", "/v1/wallets/1/spending-paths?warn_within_blocks=-1", "admin", "", 400, "invalid_request", "/wallets/{id}/spending-paths"},
+		{"GET", "/v1/wallets/1/addresses/bcrt1qxyz/verify?search_limit=-1", "admin", "", 400, "invalid_request", "/wallets/{id}/addresses/{address}/verify"},
+		{"GET", "/v1/wallets/1/addresses/bcrt1qxyz/uri?amount_sats=0", "admin", "", 400, "invalid_request", "/wallets/{id}/addresses/{address}/uri"},
+		{"GET", "/v1/wallets/1/addresses/bcrt1qxyz/qr.png?size=10", "admin", "", 400, "invalid_request", "/wallets/{id}/addresses/{address}/qr.png"},
+		{"GET", "/v1/wallets/1/addresses/bcrt1qxyz/qr.svg?level=X", "admin", "", 400, "invalid_request", "/wallets/{id}/addresses/{address}/qr.svg"},
+		{"DELETE", "/v1/keys/abc", "admin", "", 400, "invalid_request", "/keys/{id}"},
+		{"POST", "/v1/keys/abc/rotate", "admin", "", 400, "invalid_request", "/keys/{id}/rotate"},
+		{"GET", "/v1/nope", "admin", "", 404, "not_found", ""},
+		{"GET", "/v1/addresses", "admin", "", 405, "method_not_allowed", ""},
+		{"GET", "/address", "admin", "", 404, "not_found", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.path, func(t *testing.T) {
+			var body []byte
+			if tt.body != "" {
+				body = []byte(tt.body)
+			}
+			rec := serve(r, tt.method, tt.path, tt.key, body)
+			if rec.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.status, rec.Body)
+			}
+			if tt.specPath != "" {
+				op := doc.Paths[tt.specPath][strings.ToLower(tt.method)]
+				if _, ok := op.Responses[fmt.Sprint(tt.status)]; !ok {
+					t.Errorf("spec does not document %d for %s %s", tt.status, tt.method, tt.specPath)
+				}
+			}
+			checkError(t, doc, rec, tt.code)
+		})
+	}
+}
+
+func TestRequestIDPropagated(t *testing.T) {
+	r := testRouter()
+	req := httptest.NewRequest("GET", "/v1/balance", nil)
+	req.Header.Set("X-Request-ID", "client-supplied-42")
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+
+	if got := rec.Header().Get("X-Request-ID"); got != "client-supplied-42" {
+		t.Errorf("X-Request-ID = %q, want client-supplied-42", got)
+	}
+	var resp struct {
+		Error struct {
+			RequestID string `json:"request_id"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Error.RequestID != "client-supplied-42" {
+		t.Errorf("request_id = %q, want client-supplied-42", resp.Error.RequestID)
+	}
+}
+
+func TestOpenAPIServed(t *testing.T) {
+	rec := serve(testRouter(), "GET", "/v1/openapi.json", "", nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200", rec.Code)
+	}
+	if !bytes.Equal(rec.Body.Bytes(), openAPISpec) {
+		t.Error("served document differs from embedded spec")
+	}
+}
+
+func TestPayjoinErrors(t *testing.T) {
+	doc := loadSpec(t)
+	r := testRouter()
+
+	tests := []struct {
+		query  string
+		status int
+		code   string
+	}{
+		{"?v=2", 400, "version-unsupported"},
+		{"?additionalfeeoutputindex=1", 400, "original-psbt-rejected"},
+		{"?additionalfeeoutputindex=-1&maxadditionalfeecontribution=100", 400, "original-psbt-rejected"},
+		{"?minfeerate=fast", 400, "original-psbt-rejected"},
+		{"?v=1", 404, "unavailable"},
+	}
+	for _, tt := range tests {
+		rec := serve(r, "POST", "/v1/wallets/1/payjoin"+tt.query, "", []byte("cHNidP8B"))
+		if rec.Code != tt.status {
+			t.Errorf("%s: status = %d, want %d: %s", tt.query, rec.Code, tt.status, rec.Body)
+			continue
+		}
+		var body interface{}
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+			t.Fatalf("%s: body is not JSON: %s", tt.query, rec.Body)
+		}
+		if err := validate(doc, map[string]interface{}{"$ref": "#/components/schemas/PayjoinError"}, body, "$"); err != nil {
+			t.Errorf("%s: body does not match spec: %v", tt.query, err)
+		}
+		if code := body.(map[string]interface{})["errorCode"]; code != tt.code {
+			t.Errorf("%s: errorCode = %v, want %s", tt.query, code, tt.code)
+		}
+	}
+}
+
+func serve(r http.Handler, method, path, key string, body []byte) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, bytes.NewReader(body))
+	if key != "" {
+		req.Header.Set("X-API-Key", key)
+	}
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	return rec
+}
+
+// checkError validates an error response against the ErrorResponse schema
+// and checks its code and request ID.
+func checkError(t *testing.T, doc *openAPIDoc, rec *httptest.ResponseRecorder, code string) {
+	t.Helper()
+	var body interface{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("error body is not JSON: %v: %s", err, rec.Body)
+	}
+	if err := validate(doc, map[string]interface{}{"$ref": "#/components/schemas/ErrorResponse"}, body, "$"); err != nil {
+		t.Errorf("error body does not match spec: %v: %s", err, rec.Body)
+		return
+	}
+	e := body.(map[string]interface{})["error"].(map[string]interface{})
+	if e["code"] != code {
+		t.Errorf("code = %v, want %s", e["code"], code)
+	}
+	if id := rec.Header().Get("X-Request-ID"); id == "" || e["request_id"] != id {
+		t.Errorf("request_id = %v, X-Request-ID header = %q", e["request_id"], id)
+	}
+}
+
+// validate checks v against the subset of JSON Schema used by the spec.
+func validate(doc *openAPIDoc, schema map[string]interface{}, v interface{}, at string) error {
+	if ref, ok := schema["$ref"].(string); ok {
+		name := strings.TrimPrefix(ref, "#/components/schemas/")
+		s, ok := doc.Components.Schemas[name]
+		if !ok {
+			return fmt.Errorf("%s: unknown schema %s", at, ref)
+		}
+		return validate(doc, s, v, at)
+	}
+	if v == nil {
+		if schema["nullable"] == true {
+			return nil
+		}
+		return fmt.Errorf("%s: null not allowed", at)
+	}
+	if enum, ok := schema["enum"].([]interface{}); ok {
+		found := false
+		for _, e := range enum {
+			if e == v {
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("%s: %v not in %v", at, v, enum)
+		}
+	}
+
+	switch schema["type"] {
+	case "object":
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%s: want object, got %T", at, v)
+		}
+		required, _ := schema["required"].([]interface{})
+		for _, r := range required {
+			if _, ok := obj[r.(string)]; !ok {
+				return fmt.Errorf("%s: missing %s", at, r)
+			}
+		}
+		props, _ := schema["properties"].(map[string]interface{})
+		for k, val := range obj {
+			if p, ok := props[k].(map[string]interface{}); ok {
+				if err := validate(doc, p, val, at+"."+k); err != nil {
+					return err
+				}
+			}
+		}
+	case "array":
+		arr, ok := v.([]interface{})
+		if !ok {
+			return fmt.Errorf("%s: want array, got %T", at, v)
+		}
+		items, _ := schema["items"].(map[string]interface{})
+		for i, item := range arr {
+			if err := validate(doc, items, item, fmt.Sprintf("%s[%d]", at, i)); err != nil {
+				return err
+			}
+		}
+	case "string":
+		if _, ok := v.(string); !ok {
+			return fmt.Errorf("%s: want string, got %T", at, v)
+		}
+	case "integer":
+		if f, ok := v.(float64); !ok || f != float64(int64(f)) {
+			return fmt.Errorf("%s: want integer, got %v", at, v)
+		}
+	case "number":
+		if _, ok := v.(float64); !ok {
+			return fmt.Errorf("%s: want number, got %T", at, v)
+		}
+	case "boolean":
+		if _, ok := v.(bool); !ok {
+			return fmt.Errorf("%s: want boolean, got %T", at, v)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,222 @@
+package api
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/gin-gonic/gin"
+
+	"github.com/sawdustofmind/bitcoin-wallet/backend/wallet"
+)
+
+// Export formats for /export/transactions.
+const (
+	formatCSV  = "csv"
+	formatOFX  = "ofx"
+	formatJSON = "json"
+)
+
+var exportContentTypes = map[string]string{
+	formatCSV:  "text/csv; charset=utf-8",
+	formatOFX:  "application/x-ofx",
+	formatJSON: "application/json",
+}
+
+type exportRow struct {
+	TxID            string   `json:"txid"`
+	BlockHeight     int64    `json:"block_height"`
+	BlockTime       string   `json:"block_time"`
+	AmountSats      int64    `json:"amount_sats"`
+	FeeSats         *int64   `json:"fee_sats"`
+	BalanceSats     int64    `json:"balance_sats"`
+	Label           string   `json:"label"`
+	Addresses       []string `json:"addresses"`
+	DerivationPaths []string `json:"derivation_paths"`
+}
+
+func toExportRow(e wallet.LedgerEntry) exportRow {
+	return exportRow{
+		TxID:            e.TxID,
+		BlockHeight:     e.BlockHeight,
+		BlockTime:       e.BlockTime.UTC().Format(time.RFC3339),
+		AmountSats:      e.AmountSats,
+		FeeSats:         e.FeeSats,
+		BalanceSats:     e.BalanceSats,
+		Label:           e.Label,
+		Addresses:       e.Addresses,
+		DerivationPaths: e.DerivationPaths,
+	}
+}
+
+func writeJSONExport(out io.Writer, entries []wallet.LedgerEntry) error {
+	rows := make([]exportRow, 0, len(entries))
+	for _, e := range entries {
+		rows = append(rows, toExportRow(e))
+	}
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+	return enc.Encode(gin.H{"transactions": rows})
+}
+
+// csvText neutralizes a text cell a spreadsheet would run as a formula,
+// such as a label starting with =, by prefixing it with a quote.
+func csvText(s string) string {
+	if s != "" && strings.ContainsRune("=+-@\t\r", rune(s[0])) {
+		return "'" + s
+	}
+	return s
+}
+
+// writeCSVExport writes entries as CSV. Numbers are written as is, text
+// through csvText.
+func writeCSVExport(out io.Writer, entries []wallet.LedgerEntry) error {
+	cw := csv.NewWriter(out)
+	header := []string{"txid", "block_height", "block_time", "amount_sats", "fee_sats",
+		"balance_sats", "label", "addresses", "derivation_paths"}
+	if err := cw.Write(header); err != nil {
+		return err
+	}
+	for _, e := range entries {
+		r := toExportRow(e)
+		fee := ""
+		if r.FeeSats != nil {
+			fee = strconv.FormatInt(*r.FeeSats, 10)
+		}
+		record := []string{
+			r.TxID,
+			strconv.FormatInt(r.BlockHeight, 10),
+			r.BlockTime,
+			strconv.FormatInt(r.AmountSats, 10),
+			fee,
+			strconv.FormatInt(r.BalanceSats, 10),
+			csvText(r.Label),
+			csvText(strings.Join(r.Addresses, " ")),
+			csvText(strings.Join(r.DerivationPaths, " ")),
+		}
+		if err := cw.Write(record); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// OFX 2.2 statement structure. Amounts are in BTC using the XBT currency code.
+type ofxDoc struct {
+	XMLName xml.Name `xml:"OFX"`
+	SignOn  struct {
+		SonRs struct {
+			Status   ofxStatus `xml:"STATUS"`
+			DTServer string    `xml:"DTSERVER"`
+			Language string    `xml:"LANGUAGE"`
+		} `xml:"SONRS"`
+	} `xml:"SIGNONMSGSRSV1"`
+	Bank struct {
+		StmtTrnRs struct {
+			TrnUID string    `xml:"TRNUID"`
+			Status ofxStatus `xml:"STATUS"`
+			StmtRs struct {
+				CurDef   string `xml:"CURDEF"`
+				BankAcct struct {
+					BankID   string `xml:"BANKID"`
+					AcctID   string `xml:"ACCTID"`
+					AcctType string `xml:"ACCTTYPE"`
+				} `xml:"BANKACCTFROM"`
+				TranList struct {
+					DTStart string       `xml:"DTSTART"`
+					DTEnd   string       `xml:"DTEND"`
+					Trans   []ofxStmtTrn `xml:"STMTTRN"`
+				} `xml:"BANKTRANLIST"`
+				LedgerBal struct {
+					BalAmt string `xml:"BALAMT"`
+					DTAsOf string `xml:"DTASOF"`
+				} `xml:"LEDGERBAL"`
+			} `xml:"STMTRS"`
+		} `xml:"STMTTRNRS"`
+	} `xml:"BANKMSGSRSV1"`
+}
+
+type ofxStatus struct {
+	Code     int    `xml:"CODE"`
+	Severity string `xml:"SEVERITY"`
+}
+
+type ofxStmtTrn struct {
+	TrnType  string `xml:"TRNTYPE"`
+	DTPosted string `xml:"DTPOSTED"`
+	TrnAmt   string `xml:"TRNAMT"`
+	FITID    string `xml:"FITID"`
+	Name     string `xml:"NAME,omitempty"`
+	Memo     string `xml:"MEMO,omitempty"`
+}
+
+const ofxTimeFormat = "20060102150405"
+
+// writeOFXExport writes entries as an OFX bank statement from from to to,
+// with balance, the ledger balance at to, as its closing balance.
+func writeOFXExport(out io.Writer, entries []wallet.LedgerEntry, from, to time.Time, balance btcutil.Amount) error {
+	now := time.Now().UTC()
+	var doc ofxDoc
+	doc.SignOn.SonRs.Status = ofxStatus{Code: 0, Severity: "INFO"}
+	doc.SignOn.SonRs.DTServer = now.Format(ofxTimeFormat)
+	doc.SignOn.SonRs.Language = "ENG"
+
+	rs := &doc.Bank.StmtTrnRs
+	rs.TrnUID = strconv.FormatInt(now.Unix(), 10)
+	rs.Status = ofxStatus{Code: 0, Severity: "INFO"}
+	rs.StmtRs.CurDef = "XBT"
+	rs.StmtRs.BankAcct.BankID = "BITCOIN"
+	rs.StmtRs.BankAcct.AcctID = "WALLET"
+	rs.StmtRs.BankAcct.AcctType = "CHECKING"
+
+	start, end := from, to
+	if start.IsZero() && len(entries) > 0 {
+		start = entries[0].BlockTime
+	}
+	if end.IsZero() {
+		end = now
+	}
+	rs.StmtRs.TranList.DTStart = start.UTC().Format(ofxTimeFormat)
+	rs.StmtRs.TranList.DTEnd = end.UTC().Format(ofxTimeFormat)
+
+	for _, e := range entries {
+		trnType := "CREDIT"
+		if e.AmountSats < 0 {
+			trnType = "DEBIT"
+		}
+		// OFX limits NAME to 32 characters
+		name := []rune(e.Label)
+		if len(name) > 32 {
+			name = name[:32]
+		}
+		rs.StmtRs.TranList.Trans = append(rs.StmtRs.TranList.Trans, ofxStmtTrn{
+			TrnType:  trnType,
+			DTPosted: e.BlockTime.UTC().Format(ofxTimeFormat),
+			TrnAmt:   formatBTC(btcutil.Amount(e.AmountSats)),
+			FITID:    e.TxID,
+			Name:     string(name),
+			Memo:     strings.Join(e.Addresses, " "),
+		})
+	}
+	rs.StmtRs.LedgerBal.BalAmt = formatBTC(balance)
+	rs.StmtRs.LedgerBal.DTAsOf = end.UTC().Format(ofxTimeFormat)
+
+	header := `<?xml version="1.0" encoding="UTF-8" standalone="no"?>` + "\n" +
+		`<?OFX OFXHEADER="200" VERSION="220" SECURITY="NONE" OLDFILEUID="NONE" NEWFILEUID="NONE"?>` + "\n"
+	if _, err := io.WriteString(out, header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(out)
+	enc.Indent("", "  ")
+	if err := enc.Encode(doc); err != nil {
+		return err
+	}
+	_, err := io.WriteString(out, "\n")
+	return err
+}
@@ -1,42 +1,567 @@
 package api
 
 import (
-	"log"
+	"errors"
+	"fmt"
+	"log/slog"
 	"net/http"
+	"strconv"
+	"time"
 
+	"github.com/btcsuite/btcd/btcutil"
 	"github.com/gin-gonic/gin"
 
+	"github.com/sawdustofmind/bitcoin-wallet/backend/apierr"
+	"github.com/sawdustofmind/bitcoin-wallet/backend/auth"
+	"github.com/sawdustofmind/bitcoin-wallet/backend/health"
+	"github.com/sawdustofmind/bitcoin-wallet/backend/idempotency"
+	"github.com/sawdustofmind/bitcoin-wallet/backend/logging"
+	"github.com/sawdustofmind/bitcoin-wallet/backend/metrics"
+	"github.com/sawdustofmind/bitcoin-wallet/backend/qr"
+	"github.com/sawdustofmind/bitcoin-wallet/backend/ratelimit"
+	"github.com/sawdustofmind/bitcoin-wallet/backend/requestid"
+	"github.com/sawdustofmind/bitcoin-wallet/backend/tracing"
 	"github.com/sawdustofmind/bitcoin-wallet/backend/wallet"
 )
 
-func RegisterRoutes(r *gin.Engine, w *wallet.Wallet) {
-	r.GET("/balance", func(c *gin.Context) {
-		balance, err := w.GetBalance()
+// Deps bundles the services the HTTP API needs besides the wallet.
+type Deps struct {
+	Keys *auth.Store
+	// Authenticator resolves API keys on every request. It defaults to Keys.
+	Authenticator auth.Authenticator
+	// Limiter rate limits requests per client IP and per API key.
+	Limiter *ratelimit.Limiter
+	// Quota caps daily address issuance per API key.
+	Quota *ratelimit.Quota
+	// Idempotency stores responses to mutating requests sent with an
+	// Idempotency-Key header.
+	Idempotency *idempotency.Store
+	// LegacyRoutes also mounts the unversioned pre-v1 routes, including
+	// address issuance via GET /address.
+	LegacyRoutes bool
+	// Readiness backs GET /readyz. The endpoint is not served when nil.
+	Readiness *health.Checker
+	// PayjoinURL is the public base URL payment URIs point payjoin
+	// senders to. Payment URIs carry no pj parameter when it is empty.
+	PayjoinURL string
+}
+
+// scopes holds the per-route authorization and idempotency middleware.
+type scopes struct {
+	readBalance  gin.HandlerFunc
+	issueAddress []gin.HandlerFunc
+	admin        gin.HandlerFunc
+	// idempotent goes on every mutating route.
+	idempotent gin.HandlerFunc
+}
+
+// RegisterRoutes mounts the API. Wallet endpoints are served per wallet
+// under /v1/wallets/{id}; the unscoped /v1 and legacy ones are deprecated
+// aliases for wallet.DefaultWalletID.
+func RegisterRoutes(r *gin.Engine, m *wallet.Manager, deps Deps) {
+	r.Use(requestid.Middleware(), tracing.HTTP(), metrics.HTTP(), logging.HTTP())
+	r.HandleMethodNotAllowed = true
+	r.NoRoute(func(c *gin.Context) {
+		apierr.Abort(c, http.StatusNotFound, apierr.CodeNotFound, "no such endpoint")
+	})
+	r.NoMethod(func(c *gin.Context) {
+		apierr.Abort(c, http.StatusMethodNotAllowed, apierr.CodeMethodNotAllowed, "method not allowed")
+	})
+
+	authenticator := deps.Authenticator
+	if authenticator == nil {
+		authenticator = deps.Keys
+	}
+	middleware := []gin.HandlerFunc{}
+	if deps.Limiter != nil {
+		middleware = append(middleware, ratelimit.ByIP(deps.Limiter))
+	}
+	middleware = append(middleware, auth.Authenticate(authenticator))
+	if deps.Limiter != nil {
+		middleware = append(middleware, ratelimit.ByAPIKey(deps.Limiter))
+	}
+
+	s := scopes{
+		readBalance: auth.Require(auth.ScopeReadBalance),
+		admin:       auth.Require(auth.ScopeAdmin),
+		idempotent:  func(c *gin.Context) { c.Next() },
+	}
+	if deps.Idempotency != nil {
+		s.idempotent = idempotency.Middleware(deps.Idempotency)
+	}
+	// Replays are answered before the quota is charged
+	s.issueAddress = []gin.HandlerFunc{auth.Require(auth.ScopeIssueAddress), s.idempotent}
+	if deps.Quota != nil {
+		s.issueAddress = append(s.issueAddress, ratelimit.IssuanceQuota(deps.Quota))
+	}
+
+	// Probes and Prometheus scrapes live outside the versioned API
+	r.GET("/healthz", health.Live)
+	if deps.Readiness != nil {
+		r.GET("/readyz", health.Ready(deps.Readiness))
+	}
+	r.Group("", middleware...).GET("/metrics", auth.Require(auth.ScopeReadMetrics), gin.WrapH(metrics.Handler()))
+
+	v1 := r.Group("/v1")
+	v1.GET("/openapi.json", serveOpenAPI)
+	// Payjoin senders have no API key, so only the IP limit applies
+	public := v1.Group("")
+	if deps.Limiter != nil {
+		public.Use(ratelimit.ByIP(deps.Limiter))
+	}
+	public.POST("/wallets/:id/payjoin", payjoin(m))
+	authed := v1.Group("", middleware...)
+	registerKeyRoutes(authed.Group("/keys", s.admin), deps.Keys, m, s.idempotent)
+	walletsGroup := authed.Group("/wallets")
+	registerWalletAdminRoutes(walletsGroup, m, s)
+	scoped := walletsGroup.Group("/:id")
+	registerWalletRoutes(scoped, walletByParam(m), s, false, deps.PayjoinURL)
+	scoped.POST("/addresses", append(s.issueAddress, newAddress(walletByParam(m), http.StatusCreated))...)
+	scoped.POST("/psbt", auth.Require(auth.ScopeCreatePSBT), s.idempotent, createPSBT(walletByParam(m)))
+	scoped.GET("/spending-paths", s.readBalance, getSpendingPaths(walletByParam(m)))
+
+	registerWalletRoutes(authed, defaultWallet(m), s, false, deps.PayjoinURL)
+	authed.POST("/addresses", append(s.issueAddress, newAddress(defaultWallet(m), http.StatusCreated))...)
+
+	if deps.LegacyRoutes {
+		legacy := r.Group("/", middleware...)
+		registerWalletRoutes(legacy, defaultWallet(m), s, true, deps.PayjoinURL)
+		registerKeyRoutes(legacy.Group("/keys", s.admin), deps.Keys, m, s.idempotent)
+		legacy.GET("/address", append(s.issueAddress, newAddress(defaultWallet(m), http.StatusOK))...)
+	}
+}
+
+// registerWalletRoutes adds the per-wallet routes shared by
+// /v1/wallets/{id}, their unscoped /v1 aliases and the legacy unversioned
+// API.
+func registerWalletRoutes(g *gin.RouterGroup, wallets walletLookup, s scopes, legacy bool, payjoinURL string) {
+	g.GET("/balance", s.readBalance, getBalance(wallets, legacy))
+	g.GET("/balance/history", s.readBalance, getBalanceHistory(wallets))
+	g.GET("/export/transactions", s.readBalance, exportTransactions(wallets))
+	g.GET("/labels/bip329", s.readBalance, exportLabels(wallets))
+	g.POST("/labels/bip329", s.admin, s.idempotent, importLabels(wallets))
+	g.GET("/utxos", s.readBalance, getUTXOs(wallets))
+	g.GET("/addresses/:address/verify", s.readBalance, verifyAddress(wallets))
+	g.GET("/addresses/:address/uri", s.readBalance, getPaymentURI(wallets, payjoinURL))
+	g.GET("/addresses/:address/qr.png", s.readBalance, getPaymentQR(wallets, payjoinURL, "image/png", qr.PNG))
+	g.GET("/addresses/:address/qr.svg", s.readBalance, getPaymentQR(wallets, payjoinURL, "image/svg+xml", qr.SVG))
+}
+
+// getBalance serves the current balances, or a historical balance when
+// height or at is given. legacy adds the deprecated float balance field.
+func getBalance(wallets walletLookup, legacy bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.Query("height") != "" || c.Query("at") != "" {
+			historicalBalance(c, wallets)
+			return
+		}
+
+		w, ok := wallets(c)
+		if !ok {
+			return
+		}
+		balances, err := w.GetBalances(c.Request.Context())
 		if err != nil {
-			log.Printf("Error getting balance: %v", err)
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			apierr.Internal(c, err, "getting balance")
 			return
 		}
-		c.JSON(http.StatusOK, gin.H{"balance": balance.ToBTC()})
-	})
 
-	r.GET("/address", func(c *gin.Context) {
-		addr, err := w.GetNewAddress()
+		resp := balancesJSON(balances)
+		if legacy {
+			// Deprecated: float BTC, kept for older clients
+			resp["balance"] = balances.Trusted.ToBTC()
+		}
+		if w.DiscoversAccounts() {
+			accounts, err := w.AccountBalances(c.Request.Context())
+			if err != nil {
+				apierr.Internal(c, err, "getting account balances")
+				return
+			}
+			list := make([]gin.H, len(accounts))
+			for i, a := range accounts {
+				list[i] = balancesJSON(&a.Balances)
+				list[i]["account"] = a.Account
+				list[i]["derivation_path"] = a.DerivationPath
+			}
+			resp["accounts"] = list
+		}
+		c.JSON(http.StatusOK, resp)
+	}
+}
+
+// balancesJSON is the balance breakdown served by /balance.
+func balancesJSON(b *wallet.Balances) gin.H {
+	byConfs := gin.H{}
+	for threshold, amt := range b.ByConfirmations {
+		byConfs[strconv.Itoa(threshold)] = amountJSON(amt)
+	}
+	return gin.H{
+		"balance_sats":      int64(b.Trusted),
+		"balance_btc":       formatBTC(b.Trusted),
+		"trusted":           amountJSON(b.Trusted),
+		"untrusted_pending": amountJSON(b.UntrustedPending),
+		"immature":          amountJSON(b.Immature),
+		"confirmations":     byConfs,
+	}
+}
+
+func getBalanceHistory(wallets walletLookup) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		from, err := parseDateQuery(c, "from")
 		if err != nil {
-			log.Printf("Error generating address: %v", err)
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			apierr.Abort(c, http.StatusBadRequest, apierr.CodeInvalidRequest, err.Error())
 			return
 		}
-		c.JSON(http.StatusOK, gin.H{"address": addr})
-	})
+		to, err := parseDateQuery(c, "to")
+		if err != nil {
+			apierr.Abort(c, http.StatusBadRequest, apierr.CodeInvalidRequest, err.Error())
+			return
+		}
+		if to.IsZero() {
+			to = time.Now().UTC()
+		}
+		if from.IsZero() {
+			from = to.AddDate(0, 0, -29)
+		}
 
-	r.GET("/utxos", func(c *gin.Context) {
-		utxos, err := w.GetUTXOs()
+		w, ok := wallets(c)
+		if !ok {
+			return
+		}
+		points, err := w.DailyBalances(c.Request.Context(), from, to)
+		if err != nil {
+			if errors.Is(err, wallet.ErrInvalidRange) {
+				apierr.Abort(c, http.StatusBadRequest, apierr.CodeInvalidRequest, err.Error())
+				return
+			}
+			apierr.Internal(c, err, "getting balance history")
+			return
+		}
+		start, err := w.HistoryStart(c.Request.Context())
+		if err != nil {
+			apierr.Internal(c, err, "getting history start")
+			return
+		}
+
+		series := make([]gin.H, 0, len(points))
+		for _, p := range points {
+			series = append(series, gin.H{
+				"date": p.Date.Format(time.DateOnly),
+				"sats": int64(p.Balance),
+				"btc":  formatBTC(p.Balance),
+			})
+		}
+		c.JSON(http.StatusOK, gin.H{"balances": series, "history_starts_at": historyStartJSON(start)})
+	}
+}
+
+func exportTransactions(wallets walletLookup) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		format := c.DefaultQuery("format", formatCSV)
+		contentType, ok := exportContentTypes[format]
+		if !ok {
+			apierr.Abort(c, http.StatusBadRequest, apierr.CodeInvalidRequest, "format must be one of csv, ofx, json")
+			return
+		}
+
+		from, err := parseDateQuery(c, "from")
+		if err != nil {
+			apierr.Abort(c, http.StatusBadRequest, apierr.CodeInvalidRequest, err.Error())
+			return
+		}
+		to, err := parseDateQuery(c, "to")
 		if err != nil {
-			log.Printf("Error getting UTXOs: %v", err)
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			apierr.Abort(c, http.StatusBadRequest, apierr.CodeInvalidRequest, err.Error())
+			return
+		}
+		// to is inclusive of the whole day
+		if !to.IsZero() {
+			to = to.AddDate(0, 0, 1).Add(-time.Nanosecond)
+		}
+
+		w, ok := wallets(c)
+		if !ok {
+			return
+		}
+		entries, err := w.Ledger(c.Request.Context(), from, to)
+		if err != nil {
+			apierr.Internal(c, err, "exporting transactions")
+			return
+		}
+		var balance btcutil.Amount
+		if format == formatOFX {
+			// The statement's closing balance, even if no transaction is in
+			// the range
+			if balance, err = w.LedgerBalance(c.Request.Context(), to); err != nil {
+				apierr.Internal(c, err, "exporting transactions")
+				return
+			}
+		}
+
+		c.Header("Content-Type", contentType)
+		c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="transactions.%s"`, format))
+		c.Status(http.StatusOK)
+		switch format {
+		case formatCSV:
+			err = writeCSVExport(c.Writer, entries)
+		case formatOFX:
+			err = writeOFXExport(c.Writer, entries, from, to, balance)
+		case formatJSON:
+			err = writeJSONExport(c.Writer, entries)
+		}
+		if err != nil {
+			slog.ErrorContext(c.Request.Context(), "Failed to write export", "format", format, "error", err)
+		}
+	}
+}
+
+func exportLabels(wallets walletLookup) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		w, ok := wallets(c)
+		if !ok {
+			return
+		}
+		c.Header("Content-Type", "application/jsonl")
+		c.Header("Content-Disposition", `attachment; filename="labels.jsonl"`)
+		c.Status(http.StatusOK)
+		if err := w.ExportBIP329(c.Request.Context(), c.Writer); err != nil {
+			slog.ErrorContext(c.Request.Context(), "Failed to export labels", "error", err)
+		}
+	}
+}
+
+// maxLabelImportSize bounds the body of a BIP329 label import.
+const maxLabelImportSize = 16 << 20
+
+func importLabels(wallets walletLookup) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		w, ok := wallets(c)
+		if !ok {
+			return
+		}
+		body := http.MaxBytesReader(c.Writer, c.Request.Body, maxLabelImportSize)
+		n, err := w.ImportBIP329(c.Request.Context(), body)
+		if err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				apierr.Abort(c, http.StatusRequestEntityTooLarge, apierr.CodeRequestTooLarge,
+					fmt.Sprintf("label import exceeds %d bytes", maxLabelImportSize))
+				return
+			}
+			var labelErr *wallet.LabelError
+			if errors.As(err, &labelErr) {
+				apierr.AbortWithDetails(c, http.StatusBadRequest, apierr.CodeInvalidRequest, err.Error(),
+					map[string]interface{}{"line": labelErr.Line})
+				return
+			}
+			apierr.Internal(c, err, "importing labels")
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"imported": n})
+	}
+}
+
+// newAddress issues the next receive address, responding with status on
+// success.
+func newAddress(wallets walletLookup, status int) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		w, ok := wallets(c)
+		if !ok {
+			return
+		}
+		addr, err := w.GetNewAddress(c.Request.Context())
+		if err != nil {
+			var gapErr *wallet.GapLimitError
+			if errors.As(err, &gapErr) {
+				apierr.AbortWithDetails(c, http.StatusConflict, apierr.CodeGapLimitExceeded, err.Error(),
+					map[string]interface{}{"unused": gapErr.Unused, "limit": gapErr.Limit})
+				return
+			}
+			apierr.Internal(c, err, "generating address")
+			return
+		}
+		c.JSON(status, gin.H{"address": addr})
+	}
+}
+
+func getUTXOs(wallets walletLookup) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		w, ok := wallets(c)
+		if !ok {
+			return
+		}
+		if w.DiscoversAccounts() {
+			utxos, err := w.AccountUTXOs(c.Request.Context())
+			if err != nil {
+				apierr.Internal(c, err, "getting UTXOs")
+				return
+			}
+			c.JSON(http.StatusOK, gin.H{"utxos": utxos})
+			return
+		}
+		utxos, err := w.GetUTXOs(c.Request.Context())
+		if err != nil {
+			apierr.Internal(c, err, "getting UTXOs")
 			return
 		}
 		c.JSON(http.StatusOK, gin.H{"utxos": utxos})
-	})
+	}
+}
+
+// verifyAddress tells whether an address belongs to the wallet and
+// decodes it.
+func verifyAddress(wallets walletLookup) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		limit := wallet.DefaultAddressSearch
+		if v := c.Query("search_limit"); v != "" {
+			var err error
+			if limit, err = strconv.Atoi(v); err != nil || limit < 0 || limit > wallet.MaxAddressSearch {
+				apierr.Abort(c, http.StatusBadRequest, apierr.CodeInvalidRequest,
+					fmt.Sprintf("search_limit must be between 0 and %d", wallet.MaxAddressSearch))
+				return
+			}
+		}
+		w, ok := wallets(c)
+		if !ok {
+			return
+		}
+		v, err := w.VerifyAddress(c.Request.Context(), c.Param("address"), limit)
+		if err != nil {
+			var addrErr *wallet.AddressError
+			if errors.As(err, &addrErr) {
+				apierr.Abort(c, http.StatusBadRequest, apierr.CodeInvalidRequest, err.Error())
+				return
+			}
+			apierr.Internal(c, err, "verifying address")
+			return
+		}
+		c.JSON(http.StatusOK, v)
+	}
+}
+
+// getSpendingPaths reports which spending paths can move each coin and
+// warns about timelocked paths opening within warn_within_blocks.
+func getSpendingPaths(wallets walletLookup) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		warn := int64(wallet.DefaultTimelockWarning)
+		if v := c.Query("warn_within_blocks"); v != "" {
+			var err error
+			if warn, err = strconv.ParseInt(v, 10, 64); err != nil || warn < 0 {
+				apierr.Abort(c, http.StatusBadRequest, apierr.CodeInvalidRequest, "invalid warn_within_blocks")
+				return
+			}
+		}
+		w, ok := wallets(c)
+		if !ok {
+			return
+		}
+		report, err := w.SpendingPaths(c.Request.Context(), warn)
+		if err != nil {
+			apierr.Internal(c, err, "getting spending paths")
+			return
+		}
+		c.JSON(http.StatusOK, report)
+	}
+}
+
+// parseDateQuery parses an optional YYYY-MM-DD query parameter. A missing
+// parameter yields the zero time.
+func parseDateQuery(c *gin.Context, key string) (time.Time, error) {
+	v := c.Query(key)
+	if v == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(time.DateOnly, v)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid %s date, expected YYYY-MM-DD", key)
+	}
+	return t, nil
+}
+
+// historicalBalance serves /balance?height= and /balance?at=.
+func historicalBalance(c *gin.Context, wallets walletLookup) {
+	heightStr, atStr := c.Query("height"), c.Query("at")
+	if heightStr != "" && atStr != "" {
+		apierr.Abort(c, http.StatusBadRequest, apierr.CodeInvalidRequest, "specify either height or at, not both")
+		return
+	}
+
+	resp := gin.H{}
+	var balance btcutil.Amount
+	if heightStr != "" {
+		height, err := strconv.ParseInt(heightStr, 10, 64)
+		if err != nil || height < 0 {
+			apierr.Abort(c, http.StatusBadRequest, apierr.CodeInvalidRequest, "invalid height")
+			return
+		}
+		w, ok := wallets(c)
+		if !ok {
+			return
+		}
+		if balance, err = w.BalanceAtHeight(c.Request.Context(), height); err != nil {
+			historyError(c, w, err, fmt.Sprintf("getting balance at height %d", height))
+			return
+		}
+		resp["height"] = height
+	} else {
+		at, err := time.Parse(time.RFC3339, atStr)
+		if err != nil {
+			apierr.Abort(c, http.StatusBadRequest, apierr.CodeInvalidRequest, "invalid at, expected RFC3339 timestamp")
+			return
+		}
+		w, ok := wallets(c)
+		if !ok {
+			return
+		}
+		if balance, err = w.BalanceAtTime(c.Request.Context(), at); err != nil {
+			historyError(c, w, err, fmt.Sprintf("getting balance at %s", at))
+			return
+		}
+		resp["at"] = at.UTC().Format(time.RFC3339)
+	}
+
+	resp["balance_sats"] = int64(balance)
+	resp["balance_btc"] = formatBTC(balance)
+	c.JSON(http.StatusOK, resp)
+}
+
+// historyError answers a failed historical balance query. Points before
+// the wallet's history are a 400 telling where it starts.
+func historyError(c *gin.Context, w *wallet.Wallet, err error, action string) {
+	if !errors.Is(err, wallet.ErrBeforeHistory) {
+		apierr.Internal(c, err, action)
+		return
+	}
+	start, serr := w.HistoryStart(c.Request.Context())
+	if serr != nil {
+		apierr.Internal(c, serr, "getting history start")
+		return
+	}
+	apierr.AbortWithDetails(c, http.StatusBadRequest, apierr.CodeInvalidRequest, err.Error(),
+		map[string]interface{}{"history_starts_at": historyStartJSON(start)})
+}
+
+// historyStartJSON renders the start of a wallet's history, or null.
+func historyStartJSON(start *wallet.HistoryStart) interface{} {
+	if start == nil {
+		return nil
+	}
+	return gin.H{"height": start.Height, "time": start.Time.Format(time.RFC3339)}
+}
+
+// amountJSON renders an amount as integer satoshis and an exact BTC string.
+func amountJSON(a btcutil.Amount) gin.H {
+	return gin.H{"sats": int64(a), "btc": formatBTC(a)}
+}
+
+// formatBTC formats an amount with 8 decimal places without going through
+// a float.
+func formatBTC(a btcutil.Amount) string {
+	sats := int64(a)
+	sign := ""
+	if sats < 0 {
+		sign = "-"
+		sats = -sats
+	}
+	return fmt.Sprintf("%s%d.%08d", sign, sats/btcutil.SatoshiPerBitcoin, sats%btcutil.SatoshiPerBitcoin)
 }
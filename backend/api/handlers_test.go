@@ -0,0 +1,114 @@
+package api
+
+import (
+	"bytes"
+	"encoding/csv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/btcutil"
+
+	"github.com/sawdustofmind/bitcoin-wallet/backend/wallet"
+)
+
+func TestFormatBTC(t *testing.T) {
+	tests := []struct {
+		sats btcutil.Amount
+		want string
+	}{
+		{0, "0.00000000"},
+		{1, "0.00000001"},
+		{150000000, "1.50000000"},
+		{2100000000000000, "21000000.00000000"},
+		{-12345, "-0.00012345"},
+	}
+	for _, tt := range tests {
+		if got := formatBTC(tt.sats); got != tt.want {
+			t.Errorf("formatBTC(%d) = %s, want %s", int64(tt.sats), got, tt.want)
+		}
+	}
+}
+
+func TestWriteCSVExport(t *testing.T) {
+	fee := int64(141)
+	entries := []wallet.LedgerEntry{
+		{
+			TxID:            "aa",
+			BlockHeight:     101,
+			BlockTime:       time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC),
+			AmountSats:      150000000,
+			BalanceSats:     150000000,
+			Label:           "Invoice, #42",
+			Addresses:       []string{"mx1", "mx2"},
+			DerivationPaths: []string{"m/0/0", "m/0/1"},
+		},
+		{
+			TxID:        "bb",
+			BlockHeight: 102,
+			BlockTime:   time.Date(2024, 3, 2, 12, 0, 0, 0, time.UTC),
+			AmountSats:  -50000141,
+			FeeSats:     &fee,
+			BalanceSats: 99999859,
+		},
+	}
+
+	var buf bytes.Buffer
+	if err := writeCSVExport(&buf, entries); err != nil {
+		t.Fatalf("Failed to write CSV: %v", err)
+	}
+
+	want := "txid,block_height,block_time,amount_sats,fee_sats,balance_sats,label,addresses,derivation_paths\n" +
+		"aa,101,2024-03-01T12:00:00Z,150000000,,150000000,\"Invoice, #42\",mx1 mx2,m/0/0 m/0/1\n" +
+		"bb,102,2024-03-02T12:00:00Z,-50000141,141,99999859,,,\n"
+	if buf.String() != want {
+		t.Fatalf("Unexpected CSV:\n%s\nwant:\n%s", buf.String(), want)
+	}
+}
+
+func TestCSVExportFormulas(t *testing.T) {
+	entries := []wallet.LedgerEntry{
+		{TxID: "aa", AmountSats: -1000, BalanceSats: 0, Label: `=HYPERLINK("http://evil","x")`},
+		{TxID: "bb", AmountSats: 1000, BalanceSats: 1000, Label: "+cmd|' /C calc'!A0"},
+		{TxID: "cc", AmountSats: 1000, BalanceSats: 2000, Label: "@SUM(A1)"},
+		{TxID: "dd", AmountSats: 1000, BalanceSats: 3000, Label: "-1+1"},
+		{TxID: "ee", AmountSats: 1000, BalanceSats: 4000, Label: "\tx"},
+		{TxID: "ff", AmountSats: 1000, BalanceSats: 5000, Label: "Coffee = 3"},
+	}
+	var buf bytes.Buffer
+	if err := writeCSVExport(&buf, entries); err != nil {
+		t.Fatalf("Failed to write CSV: %v", err)
+	}
+	records, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatalf("Failed to read CSV: %v", err)
+	}
+	want := []string{`'=HYPERLINK("http://evil","x")`, "'+cmd|' /C calc'!A0", "'@SUM(A1)", "'-1+1", "'\tx", "Coffee = 3"}
+	for i, w := range want {
+		if got := records[i+1][6]; got != w {
+			t.Errorf("label %d = %q, want %q", i, got, w)
+		}
+	}
+	// Negative amounts stay numbers
+	if got := records[1][3]; got != "-1000" {
+		t.Errorf("amount_sats = %q, want -1000", got)
+	}
+}
+
+func TestOFXExportEmptyRange(t *testing.T) {
+	from := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2024, 3, 2, 0, 0, 0, 0, time.UTC).Add(-time.Nanosecond)
+	var buf bytes.Buffer
+	if err := writeOFXExport(&buf, nil, from, to, 150000000); err != nil {
+		t.Fatalf("Failed to write OFX: %v", err)
+	}
+	out := buf.String()
+	for _, want := range []string{"<BALAMT>1.50000000</BALAMT>", "<DTASOF>20240301235959</DTASOF>", "<DTSTART>20240301000000</DTSTART>"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("OFX lacks %s:\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, "<STMTTRN>") {
+		t.Errorf("OFX of an empty range has transactions:\n%s", out)
+	}
+}
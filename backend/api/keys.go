@@ -0,0 +1,99 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/sawdustofmind/bitcoin-wallet/backend/apierr"
+	"github.com/sawdustofmind/bitcoin-wallet/backend/auth"
+	"github.com/sawdustofmind/bitcoin-wallet/backend/idempotency"
+	"github.com/sawdustofmind/bitcoin-wallet/backend/wallet"
+)
+
+// registerKeyRoutes adds API key management endpoints to an admin-only
+// group. Keys restricted to a wallet are checked against m. idempotent runs
+// on the mutating routes.
+func registerKeyRoutes(g *gin.RouterGroup, keys *auth.Store, m *wallet.Manager, idempotent gin.HandlerFunc) {
+	g.GET("", func(c *gin.Context) {
+		list, err := keys.List(c.Request.Context())
+		if err != nil {
+			apierr.Internal(c, err, "listing API keys")
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"keys": list})
+	})
+
+	g.POST("", idempotent, func(c *gin.Context) {
+		var req struct {
+			Name   string   `json:"name" binding:"required"`
+			Scopes []string `json:"scopes" binding:"required"`
+			// WalletID optionally restricts the key to one wallet
+			WalletID *int64 `json:"wallet_id"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil {
+			apierr.Abort(c, http.StatusBadRequest, apierr.CodeInvalidRequest, "request body must be JSON with name and scopes")
+			return
+		}
+		if req.WalletID != nil {
+			if m == nil {
+				apierr.Abort(c, http.StatusBadRequest, apierr.CodeInvalidRequest, "unknown wallet_id")
+				return
+			}
+			if _, err := m.Get(*req.WalletID); err != nil {
+				apierr.Abort(c, http.StatusBadRequest, apierr.CodeInvalidRequest, "unknown wallet_id")
+				return
+			}
+		}
+		secret, key, err := keys.Create(c.Request.Context(), req.Name, req.Scopes, req.WalletID)
+		if err != nil {
+			var scopeErr *auth.ScopeError
+			if errors.As(err, &scopeErr) {
+				apierr.Abort(c, http.StatusBadRequest, apierr.CodeInvalidRequest, err.Error())
+				return
+			}
+			apierr.Internal(c, err, "creating API key")
+			return
+		}
+		idempotency.Sensitive(c)
+		c.JSON(http.StatusCreated, gin.H{"key": key, "secret": secret})
+	})
+
+	g.DELETE("/:id", idempotent, func(c *gin.Context) {
+		id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			apierr.Abort(c, http.StatusBadRequest, apierr.CodeInvalidRequest, "invalid key id")
+			return
+		}
+		if err := keys.Revoke(c.Request.Context(), id); err != nil {
+			keyError(c, err)
+			return
+		}
+		c.Status(http.StatusNoContent)
+	})
+
+	g.POST("/:id/rotate", idempotent, func(c *gin.Context) {
+		id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			apierr.Abort(c, http.StatusBadRequest, apierr.CodeInvalidRequest, "invalid key id")
+			return
+		}
+		secret, key, err := keys.Rotate(c.Request.Context(), id)
+		if err != nil {
+			keyError(c, err)
+			return
+		}
+		idempotency.Sensitive(c)
+		c.JSON(http.StatusCreated, gin.H{"key": key, "secret": secret})
+	})
+}
+
+func keyError(c *gin.Context, err error) {
+	if err == auth.ErrNotFound {
+		apierr.Abort(c, http.StatusNotFound, apierr.CodeNotFound, err.Error())
+		return
+	}
+	apierr.Internal(c, err, "managing API key")
+}
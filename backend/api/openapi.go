@@ -0,0 +1,18 @@
+package api
+
+import (
+	_ "embed"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// openAPISpec describes the /v1 API. Contract tests keep it in sync with
+// the registered routes and error responses.
+//
+//go:embed openapi.json
+var openAPISpec []byte
+
+func serveOpenAPI(c *gin.Context) {
+	c.Data(http.StatusOK, "application/json", openAPISpec)
+}
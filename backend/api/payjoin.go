@@ -0,0 +1,111 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/gin-gonic/gin"
+
+	"github.com/sawdustofmind/bitcoin-wallet/backend/wallet"
+)
+
+// maxOriginalPSBT bounds the body of a payjoin request.
+const maxOriginalPSBT = 100 << 10
+
+// payjoinStatus maps BIP78 error codes to HTTP statuses.
+var payjoinStatus = map[string]int{
+	wallet.PayjoinUnavailable:        http.StatusServiceUnavailable,
+	wallet.PayjoinNotEnoughMoney:     http.StatusBadRequest,
+	wallet.PayjoinVersionUnsupported: http.StatusBadRequest,
+	wallet.PayjoinOriginalRejected:   http.StatusBadRequest,
+}
+
+// payjoinError answers in the BIP78 error format senders understand,
+// rather than the API's.
+func payjoinError(c *gin.Context, status int, code, msg string) {
+	body := gin.H{"errorCode": code, "message": msg}
+	if code == wallet.PayjoinVersionUnsupported {
+		body["supported"] = []int{wallet.PayjoinVersion}
+	}
+	c.AbortWithStatusJSON(status, body)
+}
+
+// payjoin is the BIP78 receiver endpoint, the pj URL of payment URIs. The
+// sender POSTs its signed original PSBT in base64 and gets the proposal
+// back the same way. Senders are customers' wallets, so it takes no API
+// key.
+func payjoin(m *wallet.Manager) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if v := c.Query("v"); v != "" && v != strconv.Itoa(wallet.PayjoinVersion) {
+			payjoinError(c, http.StatusBadRequest, wallet.PayjoinVersionUnsupported, fmt.Sprintf("payjoin version %s is not supported", v))
+			return
+		}
+		params := wallet.PayjoinParams{AdditionalFeeOutputIndex: -1}
+		var err error
+		index, contribution := c.Query("additionalfeeoutputindex"), c.Query("maxadditionalfeecontribution")
+		if (index == "") != (contribution == "") {
+			payjoinError(c, http.StatusBadRequest, wallet.PayjoinOriginalRejected,
+				"additionalfeeoutputindex and maxadditionalfeecontribution go together")
+			return
+		}
+		if index != "" {
+			var sats int64
+			params.AdditionalFeeOutputIndex, err = strconv.Atoi(index)
+			if err == nil {
+				sats, err = strconv.ParseInt(contribution, 10, 64)
+			}
+			if err != nil || params.AdditionalFeeOutputIndex < 0 || sats < 0 {
+				payjoinError(c, http.StatusBadRequest, wallet.PayjoinOriginalRejected, "invalid additional fee parameters")
+				return
+			}
+			params.MaxAdditionalFeeContribution = btcutil.Amount(sats)
+		}
+		if v := c.Query("disableoutputsubstitution"); v != "" {
+			if params.DisableOutputSubstitution, err = strconv.ParseBool(v); err != nil {
+				payjoinError(c, http.StatusBadRequest, wallet.PayjoinOriginalRejected, "invalid disableoutputsubstitution")
+				return
+			}
+		}
+		if v := c.Query("minfeerate"); v != "" {
+			if params.MinFeeRate, err = strconv.ParseFloat(v, 64); err != nil || params.MinFeeRate < 0 {
+				payjoinError(c, http.StatusBadRequest, wallet.PayjoinOriginalRejected, "invalid minfeerate")
+				return
+			}
+		}
+
+		id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		var w *wallet.Wallet
+		if err == nil && m != nil {
+			w, err = m.Get(id)
+		}
+		if w == nil || !w.PayjoinEnabled() {
+			payjoinError(c, http.StatusNotFound, wallet.PayjoinUnavailable, "payjoin is not available for this wallet")
+			return
+		}
+		original, err := io.ReadAll(io.LimitReader(c.Request.Body, maxOriginalPSBT+1))
+		if err != nil || len(original) > maxOriginalPSBT {
+			payjoinError(c, http.StatusBadRequest, wallet.PayjoinOriginalRejected, "original PSBT is too large")
+			return
+		}
+
+		proposal, err := w.Payjoin(c.Request.Context(), string(original), params)
+		if err != nil {
+			var pjErr *wallet.PayjoinError
+			if errors.As(err, &pjErr) {
+				slog.InfoContext(c.Request.Context(), "Payjoin request refused", "wallet_id", id, "code", pjErr.Code, "reason", pjErr.Msg)
+				payjoinError(c, payjoinStatus[pjErr.Code], pjErr.Code, pjErr.Msg)
+				return
+			}
+			// Node, database and signer details stay in the log
+			slog.ErrorContext(c.Request.Context(), "Payjoin request failed", "wallet_id", id, "error", err)
+			payjoinError(c, http.StatusServiceUnavailable, wallet.PayjoinUnavailable, "payjoin is unavailable, broadcast the original transaction")
+			return
+		}
+		c.Data(http.StatusOK, "text/plain; charset=utf-8", []byte(proposal))
+	}
+}
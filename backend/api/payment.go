@@ -0,0 +1,121 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/gin-gonic/gin"
+
+	"github.com/sawdustofmind/bitcoin-wallet/backend/apierr"
+	"github.com/sawdustofmind/bitcoin-wallet/backend/bip21"
+	"github.com/sawdustofmind/bitcoin-wallet/backend/qr"
+	"github.com/sawdustofmind/bitcoin-wallet/backend/wallet"
+)
+
+// paymentURI builds the BIP21 URI of the address in the path from the
+// amount_sats, label and message query parameters, aborting on invalid
+// input. With payjoinURL, the API's public base URL, it carries the
+// wallet's payjoin endpoint if payjoin is enabled and the wallet issued
+// the address.
+func paymentURI(c *gin.Context, wallets walletLookup, payjoinURL string) (bip21.URI, bool) {
+	u := bip21.URI{Address: c.Param("address"), Label: c.Query("label"), Message: c.Query("message")}
+	if v := c.Query("amount_sats"); v != "" {
+		sats, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || sats <= 0 || sats > btcutil.MaxSatoshi {
+			apierr.Abort(c, http.StatusBadRequest, apierr.CodeInvalidRequest, "amount_sats must be a positive amount of satoshis")
+			return u, false
+		}
+		u.Amount = btcutil.Amount(sats)
+	}
+	w, ok := wallets(c)
+	if !ok {
+		return u, false
+	}
+	if err := w.CheckAddress(u.Address); err != nil {
+		var addrErr *wallet.AddressError
+		if errors.As(err, &addrErr) {
+			apierr.Abort(c, http.StatusBadRequest, apierr.CodeInvalidRequest, err.Error())
+			return u, false
+		}
+		apierr.Internal(c, err, "checking address")
+		return u, false
+	}
+	if payjoinURL != "" && w.PayjoinEnabled() {
+		// The receiver only takes originals paying an issued address, so
+		// other addresses get a plain URI
+		issued, err := w.IsIssued(c.Request.Context(), u.Address)
+		if err != nil {
+			apierr.Internal(c, err, "checking address")
+			return u, false
+		}
+		if issued {
+			u.PayjoinURL = fmt.Sprintf("%s/v1/wallets/%d/payjoin", payjoinURL, w.ID())
+		}
+	}
+	return u, true
+}
+
+// getPaymentURI serves the BIP21 payment URI of an address.
+func getPaymentURI(wallets walletLookup, payjoinURL string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		u, ok := paymentURI(c, wallets, payjoinURL)
+		if !ok {
+			return
+		}
+		resp := gin.H{"uri": u.String(), "address": u.Address}
+		if u.Amount > 0 {
+			resp["amount_sats"] = int64(u.Amount)
+			resp["amount"] = bip21.FormatAmount(u.Amount)
+		}
+		if u.Label != "" {
+			resp["label"] = u.Label
+		}
+		if u.Message != "" {
+			resp["message"] = u.Message
+		}
+		if u.PayjoinURL != "" {
+			resp["payjoin_url"] = u.PayjoinURL
+		}
+		c.JSON(http.StatusOK, resp)
+	}
+}
+
+// getPaymentQR renders the BIP21 URI of an address as a QR code with
+// render, in the size and level query parameters.
+func getPaymentQR(wallets walletLookup, payjoinURL, contentType string, render func(string, qr.Level, int) ([]byte, error)) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		size := qr.DefaultSize
+		if v := c.Query("size"); v != "" {
+			var err error
+			if size, err = strconv.Atoi(v); err != nil || size < qr.MinSize || size > qr.MaxSize {
+				apierr.Abort(c, http.StatusBadRequest, apierr.CodeInvalidRequest,
+					fmt.Sprintf("size must be between %d and %d", qr.MinSize, qr.MaxSize))
+				return
+			}
+		}
+		level := qr.DefaultLevel
+		if v := c.Query("level"); v != "" {
+			var err error
+			if level, err = qr.ParseLevel(v); err != nil {
+				apierr.Abort(c, http.StatusBadRequest, apierr.CodeInvalidRequest, err.Error())
+				return
+			}
+		}
+		u, ok := paymentURI(c, wallets, payjoinURL)
+		if !ok {
+			return
+		}
+		img, err := render(u.QRString(), level, size)
+		if err != nil {
+			// The URI is too long for a QR code at this level
+			apierr.Abort(c, http.StatusBadRequest, apierr.CodeInvalidRequest, fmt.Sprintf("cannot encode QR code: %v", err))
+			return
+		}
+		// The image only depends on the URL
+		c.Header("Cache-Control", "private, max-age=3600")
+		c.Data(http.StatusOK, contentType, img)
+	}
+}
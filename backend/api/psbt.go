@@ -0,0 +1,62 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/gin-gonic/gin"
+
+	"github.com/sawdustofmind/bitcoin-wallet/backend/apierr"
+	"github.com/sawdustofmind/bitcoin-wallet/backend/wallet"
+)
+
+// createPSBT builds an unsigned PSBT for the cosigners to sign.
+func createPSBT(wallets walletLookup) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req struct {
+			Outputs []struct {
+				Address    string `json:"address"`
+				AmountSats int64  `json:"amount_sats"`
+			} `json:"outputs" binding:"required"`
+			FeeRate int64 `json:"fee_rate_sat_vb" binding:"required"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil {
+			apierr.Abort(c, http.StatusBadRequest, apierr.CodeInvalidRequest, "request body must be JSON with outputs and fee_rate_sat_vb")
+			return
+		}
+		w, ok := wallets(c)
+		if !ok {
+			return
+		}
+
+		payments := make([]wallet.Payment, len(req.Outputs))
+		for i, o := range req.Outputs {
+			payments[i] = wallet.Payment{Address: o.Address, Amount: btcutil.Amount(o.AmountSats)}
+		}
+		p, err := w.CreatePSBT(c.Request.Context(), payments, req.FeeRate)
+		if err != nil {
+			var reqErr *wallet.PSBTRequestError
+			var fundsErr *wallet.InsufficientFundsError
+			var gapErr *wallet.GapLimitError
+			switch {
+			case errors.As(err, &reqErr):
+				apierr.Abort(c, http.StatusBadRequest, apierr.CodeInvalidRequest, err.Error())
+			case errors.As(err, &fundsErr):
+				apierr.AbortWithDetails(c, http.StatusConflict, apierr.CodeInsufficientFunds, err.Error(),
+					map[string]interface{}{"available_sats": int64(fundsErr.Available), "required_sats": int64(fundsErr.Required)})
+			case errors.As(err, &gapErr):
+				apierr.AbortWithDetails(c, http.StatusConflict, apierr.CodeGapLimitExceeded, err.Error(),
+					map[string]interface{}{"unused": gapErr.Unused, "limit": gapErr.Limit})
+			default:
+				apierr.Internal(c, err, "creating PSBT")
+			}
+			return
+		}
+		resp := gin.H{"psbt": p.Base64, "fee_sats": int64(p.Fee)}
+		if p.ChangeAddress != "" {
+			resp["change_address"] = p.ChangeAddress
+		}
+		c.JSON(http.StatusOK, resp)
+	}
+}
@@ -0,0 +1,202 @@
+package api
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/sawdustofmind/bitcoin-wallet/backend/config"
+	"github.com/sawdustofmind/bitcoin-wallet/backend/db"
+	"github.com/sawdustofmind/bitcoin-wallet/backend/tracing"
+	"github.com/sawdustofmind/bitcoin-wallet/backend/wallet"
+)
+
+const testXPUB = "tpubD6NzVbkrYhZ4XNsDrPgErrqxTmaiY343QwdZmi6RMgU3p4qjY77xXcb15pX6cRa2fX6Vpxz7h16BWmsXyZKUsp1nULcVb2WLAuMQfGKVoQr"
+
+// fakeBitcoind answers the JSON-RPC calls made at startup and when issuing
+// an address.
+func fakeBitcoind(t *testing.T) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			ID     json.RawMessage   `json:"id"`
+			Method string            `json:"method"`
+			Params []json.RawMessage `json:"params"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("bad RPC request: %v", err)
+			return
+		}
+		var result interface{}
+		switch req.Method {
+		case "getblockchaininfo":
+			result = map[string]interface{}{"chain": "regtest", "blocks": 0}
+		case "createwallet":
+			result = map[string]string{"name": "mywallet"}
+		case "importdescriptors":
+			result = []map[string]bool{{"success": true}}
+		default:
+			t.Errorf("unexpected RPC %s", req.Method)
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"result": result, "error": nil, "id": req.ID})
+	}))
+}
+
+// fakeConnector is a database holding the default wallet with derivation
+// index 0.
+type fakeConnector struct{}
+
+func (c fakeConnector) Connect(context.Context) (driver.Conn, error) { return fakeConn{}, nil }
+func (c fakeConnector) Driver() driver.Driver                        { return c }
+func (c fakeConnector) Open(string) (driver.Conn, error)             { return fakeConn{}, nil }
+
+type fakeConn struct{}
+
+func (fakeConn) Prepare(string) (driver.Stmt, error) { return nil, errors.New("not supported") }
+func (fakeConn) Close() error                        { return nil }
+func (fakeConn) Begin() (driver.Tx, error)           { return nil, errors.New("not supported") }
+
+func (fakeConn) QueryContext(_ context.Context, query string, _ []driver.NamedValue) (driver.Rows, error) {
+	switch {
+	case strings.HasPrefix(query, "SELECT id, name, xpub"):
+		return &fakeRows{
+			columns: []string{"id", "name", "xpub", "descriptor", "change_descriptor", "script_type", "node_wallet", "created_at", "change_index",
+				"account_discovery", "account_keys", "accounts"},
+			values: []driver.Value{wallet.DefaultWalletID, "default", testXPUB, nil, nil, wallet.ScriptP2PKH, "mywallet", time.Now(), int64(0),
+				false, nil, int64(0)},
+		}, nil
+	case strings.HasPrefix(query, "SELECT xpub"):
+		return &fakeRows{columns: []string{"xpub", "descriptor", "change_descriptor"}, values: []driver.Value{testXPUB, nil, nil}}, nil
+	default:
+		return &fakeRows{columns: []string{"derivation_index"}, values: []driver.Value{int64(0)}}, nil
+	}
+}
+
+func (fakeConn) ExecContext(context.Context, string, []driver.NamedValue) (driver.Result, error) {
+	return driver.RowsAffected(1), nil
+}
+
+// fakeRows is a single row result.
+type fakeRows struct {
+	columns []string
+	values  []driver.Value
+	done    bool
+}
+
+func (r *fakeRows) Columns() []string { return r.columns }
+func (r *fakeRows) Close() error      { return nil }
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if r.done {
+		return io.EOF
+	}
+	r.done = true
+	copy(dest, r.values)
+	return nil
+}
+
+func TestNewAddressSpanTree(t *testing.T) {
+	node := fakeBitcoind(t)
+	defer node.Close()
+	database := db.Open(fakeConnector{})
+	defer database.Close()
+
+	ctx := context.Background()
+	m, err := wallet.NewManager(ctx, config.BitcoinConfig{
+		RPCHost: strings.TrimPrefix(node.URL, "http://"),
+		RPCUser: "user",
+		RPCPass: "pass",
+	}, database)
+	if err != nil {
+		t.Fatalf("wallet.NewManager: %v", err)
+	}
+	if err := m.RegisterDefault(ctx, wallet.Definition{XPUB: testXPUB}); err != nil {
+		t.Fatalf("RegisterDefault: %v", err)
+	}
+	if err := m.Load(ctx); err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+
+	// Export synchronously so spans are visible as soon as they end
+	exporter := tracetest.NewInMemoryExporter()
+	prev := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)))
+	defer otel.SetTracerProvider(prev)
+	if _, err := tracing.Setup(context.Background(), config.TracingConfig{}); err != nil {
+		t.Fatal(err)
+	}
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	RegisterRoutes(r, m, Deps{Authenticator: testKeys})
+	req := httptest.NewRequest(http.MethodPost, "/v1/wallets/1/addresses", nil)
+	req.Header.Set("X-API-Key", "admin")
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("POST /v1/wallets/1/addresses = %d: %s", rec.Code, rec.Body)
+	}
+
+	spans := exporter.GetSpans()
+	sort.Slice(spans, func(i, j int) bool { return spans[i].StartTime.Before(spans[j].StartTime) })
+
+	var root *tracetest.SpanStub
+	for i := range spans {
+		if spans[i].SpanKind == trace.SpanKindServer {
+			root = &spans[i]
+		}
+	}
+	if root == nil {
+		t.Fatalf("no server span in %d spans", len(spans))
+	}
+	if root.Name != "POST /v1/wallets/:id/addresses" {
+		t.Errorf("root span = %q, want route template", root.Name)
+	}
+	if got := root.Parent.SpanID().String(); got != "00f067aa0ba902b7" {
+		t.Errorf("root parent = %s, want the incoming traceparent", got)
+	}
+
+	var children []string
+	for _, s := range spans {
+		if s.Parent.SpanID() != root.SpanContext.SpanID() {
+			continue
+		}
+		if s.SpanContext.TraceID() != root.SpanContext.TraceID() {
+			t.Errorf("span %s is in another trace", s.Name)
+		}
+		children = append(children, s.Name)
+		attrs := attribute.NewSet(s.Attributes...)
+		switch s.Name {
+		case "importdescriptors":
+			if v, _ := attrs.Value("rpc.method"); v.AsString() != s.Name {
+				t.Errorf("%s rpc.method = %q", s.Name, v.AsString())
+			}
+			if v, _ := attrs.Value("bitcoin.wallet.name"); v.AsString() != "mywallet" {
+				t.Errorf("%s bitcoin.wallet.name = %q, want mywallet", s.Name, v.AsString())
+			}
+		case "SELECT", "UPDATE":
+			if v, _ := attrs.Value("db.query.text"); !strings.Contains(v.AsString(), "wallets") {
+				t.Errorf("%s db.query.text = %q", s.Name, v.AsString())
+			}
+		}
+	}
+	want := "SELECT importdescriptors UPDATE"
+	if got := strings.Join(children, " "); got != want {
+		t.Errorf("children of %s = %q, want %q", root.Name, got, want)
+	}
+}
@@ -0,0 +1,115 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/sawdustofmind/bitcoin-wallet/backend/apierr"
+	"github.com/sawdustofmind/bitcoin-wallet/backend/auth"
+	"github.com/sawdustofmind/bitcoin-wallet/backend/wallet"
+)
+
+// walletLookup resolves the wallet a request targets. It aborts with 404
+// and returns false if the wallet does not exist or the API key is
+// restricted to another one, so keys cannot probe for other tenants.
+type walletLookup func(c *gin.Context) (*wallet.Wallet, bool)
+
+// walletByParam looks up the wallet named by the :id path parameter.
+func walletByParam(m *wallet.Manager) walletLookup {
+	return func(c *gin.Context) (*wallet.Wallet, bool) {
+		id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			apierr.Abort(c, http.StatusNotFound, apierr.CodeNotFound, wallet.ErrWalletNotFound.Error())
+			return nil, false
+		}
+		return lookupWallet(c, m, id)
+	}
+}
+
+// defaultWallet looks up wallet.DefaultWalletID, served by the unscoped
+// routes.
+func defaultWallet(m *wallet.Manager) walletLookup {
+	return func(c *gin.Context) (*wallet.Wallet, bool) {
+		return lookupWallet(c, m, wallet.DefaultWalletID)
+	}
+}
+
+func lookupWallet(c *gin.Context, m *wallet.Manager, id int64) (*wallet.Wallet, bool) {
+	if key := auth.FromContext(c); key == nil || !key.CanAccessWallet(id) || m == nil {
+		apierr.Abort(c, http.StatusNotFound, apierr.CodeNotFound, wallet.ErrWalletNotFound.Error())
+		return nil, false
+	}
+	w, err := m.Get(id)
+	if err != nil {
+		apierr.Abort(c, http.StatusNotFound, apierr.CodeNotFound, err.Error())
+		return nil, false
+	}
+	return w, true
+}
+
+// registerWalletAdminRoutes adds the endpoints that list, register and
+// describe wallets.
+func registerWalletAdminRoutes(g *gin.RouterGroup, m *wallet.Manager, s scopes) {
+	g.GET("", s.admin, func(c *gin.Context) {
+		infos := []wallet.Info{}
+		if m != nil {
+			for _, w := range m.List() {
+				infos = append(infos, w.Info())
+			}
+		}
+		c.JSON(http.StatusOK, gin.H{"wallets": infos})
+	})
+
+	g.POST("", s.admin, s.idempotent, func(c *gin.Context) {
+		var req struct {
+			Name             string   `json:"name" binding:"required"`
+			XPUB             string   `json:"xpub"`
+			ScriptType       string   `json:"script_type"`
+			Descriptor       string   `json:"descriptor"`
+			ChangeDescriptor string   `json:"change_descriptor"`
+			AccountKeys      []string `json:"account_keys"`
+			NodeWallet       string   `json:"node_wallet"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil || (req.XPUB == "" && req.Descriptor == "" && len(req.AccountKeys) == 0) {
+			apierr.Abort(c, http.StatusBadRequest, apierr.CodeInvalidRequest, "request body must be JSON with name and xpub, descriptor or account_keys")
+			return
+		}
+		if m == nil {
+			apierr.Internal(c, errors.New("no wallet manager"), "registering wallet")
+			return
+		}
+		w, err := m.Create(c.Request.Context(), wallet.Definition{
+			Name:             req.Name,
+			XPUB:             req.XPUB,
+			ScriptType:       req.ScriptType,
+			Descriptor:       req.Descriptor,
+			ChangeDescriptor: req.ChangeDescriptor,
+			AccountKeys:      req.AccountKeys,
+			NodeWallet:       req.NodeWallet,
+		})
+		if err != nil {
+			var defErr *wallet.DefinitionError
+			switch {
+			case errors.As(err, &defErr):
+				apierr.Abort(c, http.StatusBadRequest, apierr.CodeInvalidRequest, err.Error())
+			case errors.Is(err, wallet.ErrWalletExists):
+				apierr.Abort(c, http.StatusConflict, apierr.CodeWalletExists, err.Error())
+			default:
+				apierr.Internal(c, err, "registering wallet")
+			}
+			return
+		}
+		c.JSON(http.StatusCreated, gin.H{"wallet": w.Info()})
+	})
+
+	g.GET("/:id", s.readBalance, func(c *gin.Context) {
+		w, ok := walletByParam(m)(c)
+		if !ok {
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"wallet": w.Info()})
+	})
+}
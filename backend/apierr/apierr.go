@@ -0,0 +1,65 @@
+package apierr
+
+import (
+	"log/slog"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/sawdustofmind/bitcoin-wallet/backend/requestid"
+)
+
+// Code identifies an error condition. Codes are part of the API contract;
+// messages are for humans and may change.
+type Code string
+
+const (
+	CodeInvalidRequest    Code = "invalid_request"
+	CodeUnauthorized      Code = "unauthorized"
+	CodeForbidden         Code = "forbidden"
+	CodeNotFound          Code = "not_found"
+	CodeMethodNotAllowed  Code = "method_not_allowed"
+	CodeRateLimited       Code = "rate_limited"
+	CodeQuotaExceeded     Code = "quota_exceeded"
+	CodeGapLimitExceeded  Code = "gap_limit_exceeded"
+	CodeWalletExists      Code = "wallet_exists"
+	CodeInsufficientFunds Code = "insufficient_funds"
+	CodeRequestTooLarge   Code = "request_too_large"
+	CodeInternal          Code = "internal_error"
+
+	CodeIdempotencyKeyReused         Code = "idempotency_key_reused"
+	CodeIdempotencyInProgress        Code = "idempotency_key_in_progress"
+	CodeIdempotencyReplayUnavailable Code = "idempotency_replay_unavailable"
+)
+
+// Error is the body of every error response, wrapped as {"error": Error}.
+type Error struct {
+	Code      Code                   `json:"code"`
+	Message   string                 `json:"message"`
+	RequestID string                 `json:"request_id,omitempty"`
+	Details   map[string]interface{} `json:"details,omitempty"`
+}
+
+// Abort ends the request with an error response.
+func Abort(c *gin.Context, status int, code Code, message string) {
+	AbortWithDetails(c, status, code, message, nil)
+}
+
+// AbortWithDetails ends the request with an error response carrying
+// machine-readable details.
+func AbortWithDetails(c *gin.Context, status int, code Code, message string, details map[string]interface{}) {
+	c.AbortWithStatusJSON(status, gin.H{"error": Error{
+		Code:      code,
+		Message:   message,
+		RequestID: requestid.FromContext(c),
+		Details:   details,
+	}})
+}
+
+// Internal logs err and ends the request with a generic 500 so internal
+// details, e.g. from bitcoind or Postgres, are never exposed to clients.
+// The request ID ties the response to the log line.
+func Internal(c *gin.Context, err error, action string) {
+	slog.ErrorContext(c.Request.Context(), "Request failed", "action", action, "error", err)
+	Abort(c, http.StatusInternalServerError, CodeInternal, "internal error")
+}
@@ -0,0 +1,273 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Scopes that can be granted to an API key. ScopeAdmin implies all others.
+const (
+	ScopeReadBalance  = "read-balance"
+	ScopeIssueAddress = "issue-address"
+	ScopeCreatePSBT   = "create-psbt"
+	ScopeReadMetrics  = "read-metrics"
+	ScopeAdmin        = "admin"
+)
+
+var validScopes = map[string]bool{
+	ScopeReadBalance:  true,
+	ScopeIssueAddress: true,
+	ScopeCreatePSBT:   true,
+	ScopeReadMetrics:  true,
+	ScopeAdmin:        true,
+}
+
+// keyPrefix marks secrets issued by this service.
+const keyPrefix = "bw_"
+
+// bootstrapKeyName is the name of the key registered from ADMIN_API_KEY.
+const bootstrapKeyName = "bootstrap-admin"
+
+var (
+	ErrInvalidKey = errors.New("invalid or revoked API key")
+	ErrNotFound   = errors.New("API key not found")
+)
+
+// Key is a stored API key. The secret itself is never stored.
+type Key struct {
+	ID     int64    `json:"id"`
+	Name   string   `json:"name"`
+	Prefix string   `json:"prefix"`
+	Scopes []string `json:"scopes"`
+	// WalletID restricts the key to one wallet. Keys without it can access
+	// every wallet.
+	WalletID  *int64     `json:"wallet_id,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+}
+
+// HasScope reports whether the key grants scope.
+func (k *Key) HasScope(scope string) bool {
+	for _, s := range k.Scopes {
+		if s == scope || s == ScopeAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+// CanAccessWallet reports whether the key may use wallet id.
+func (k *Key) CanAccessWallet(id int64) bool {
+	return k.WalletID == nil || *k.WalletID == id
+}
+
+type Store struct {
+	db *sql.DB
+}
+
+func NewStore(db *sql.DB) *Store {
+	return &Store{db: db}
+}
+
+// Create generates a new key and returns its secret, which is only
+// available at this point. A non-nil walletID restricts the key to that
+// wallet.
+func (s *Store) Create(ctx context.Context, name string, scopes []string, walletID *int64) (string, *Key, error) {
+	if err := validateScopes(scopes); err != nil {
+		return "", nil, err
+	}
+	if walletID != nil {
+		for _, scope := range scopes {
+			if scope == ScopeAdmin {
+				return "", nil, &ScopeError{Msg: "admin keys cannot be restricted to a wallet"}
+			}
+		}
+	}
+	secret, err := generateSecret()
+	if err != nil {
+		return "", nil, err
+	}
+	key, err := s.insert(ctx, s.db, name, secret, scopes, walletID)
+	if err != nil {
+		return "", nil, err
+	}
+	return secret, key, nil
+}
+
+// Revoke disables a key.
+func (s *Store) Revoke(ctx context.Context, id int64) error {
+	res, err := s.db.ExecContext(ctx, "UPDATE api_keys SET revoked_at = now() WHERE id = $1 AND revoked_at IS NULL", id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// Rotate revokes a key and issues a replacement with the same name, scopes
+// and wallet.
+func (s *Store) Rotate(ctx context.Context, id int64) (string, *Key, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return "", nil, err
+	}
+	defer tx.Rollback()
+
+	var name string
+	var scopes []string
+	var walletID *int64
+	err = tx.QueryRowContext(ctx, "UPDATE api_keys SET revoked_at = now() WHERE id = $1 AND revoked_at IS NULL RETURNING name, scopes, wallet_id", id).
+		Scan(&name, pq.Array(&scopes), &walletID)
+	if err == sql.ErrNoRows {
+		return "", nil, ErrNotFound
+	}
+	if err != nil {
+		return "", nil, err
+	}
+
+	secret, err := generateSecret()
+	if err != nil {
+		return "", nil, err
+	}
+	key, err := s.insert(ctx, tx, name, secret, scopes, walletID)
+	if err != nil {
+		return "", nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return "", nil, err
+	}
+	return secret, key, nil
+}
+
+// List returns all keys, including revoked ones.
+func (s *Store) List(ctx context.Context) ([]Key, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT id, name, prefix, scopes, wallet_id, created_at, revoked_at FROM api_keys ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []Key{}
+	for rows.Next() {
+		var k Key
+		if err := rows.Scan(&k.ID, &k.Name, &k.Prefix, pq.Array(&k.Scopes), &k.WalletID, &k.CreatedAt, &k.RevokedAt); err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	return keys, rows.Err()
+}
+
+// Authenticate looks up an active key by its secret.
+func (s *Store) Authenticate(ctx context.Context, secret string) (*Key, error) {
+	if secret == "" {
+		return nil, ErrInvalidKey
+	}
+	var k Key
+	err := s.db.QueryRowContext(ctx, `SELECT id, name, prefix, scopes, wallet_id, created_at FROM api_keys
+		WHERE key_hash = $1 AND revoked_at IS NULL`, hashSecret(secret)).
+		Scan(&k.ID, &k.Name, &k.Prefix, pq.Array(&k.Scopes), &k.WalletID, &k.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrInvalidKey
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &k, nil
+}
+
+// Bootstrap registers secret as an admin key unless it already exists, and
+// revokes earlier bootstrap keys so a changed ADMIN_API_KEY retires the old
+// one.
+func (s *Store) Bootstrap(ctx context.Context, secret string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	hash := hashSecret(secret)
+	_, err = tx.ExecContext(ctx, `INSERT INTO api_keys (name, prefix, key_hash, scopes)
+		VALUES ($1, 'config', $2, $3)
+		ON CONFLICT (key_hash) DO NOTHING`,
+		bootstrapKeyName, hash, pq.Array([]string{ScopeAdmin}))
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `UPDATE api_keys SET revoked_at = now()
+		WHERE name = $1 AND prefix = 'config' AND key_hash <> $2 AND revoked_at IS NULL`,
+		bootstrapKeyName, hash)
+	if err != nil {
+		return fmt.Errorf("failed to revoke earlier bootstrap keys: %v", err)
+	}
+	return tx.Commit()
+}
+
+type queryRower interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+func (s *Store) insert(ctx context.Context, q queryRower, name, secret string, scopes []string, walletID *int64) (*Key, error) {
+	k := &Key{Name: name, Prefix: displayPrefix(secret), Scopes: scopes, WalletID: walletID}
+	err := q.QueryRowContext(ctx, `INSERT INTO api_keys (name, prefix, key_hash, scopes, wallet_id)
+		VALUES ($1, $2, $3, $4, $5) RETURNING id, created_at`,
+		name, k.Prefix, hashSecret(secret), pq.Array(scopes), walletID).Scan(&k.ID, &k.CreatedAt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to store API key: %v", err)
+	}
+	return k, nil
+}
+
+// ScopeError reports an invalid scope list passed to Create.
+type ScopeError struct {
+	Msg string
+}
+
+func (e *ScopeError) Error() string {
+	return e.Msg
+}
+
+func validateScopes(scopes []string) error {
+	if len(scopes) == 0 {
+		return &ScopeError{Msg: "at least one scope is required"}
+	}
+	for _, s := range scopes {
+		if !validScopes[s] {
+			return &ScopeError{Msg: fmt.Sprintf("unknown scope %q", s)}
+		}
+	}
+	return nil
+}
+
+func generateSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return keyPrefix + hex.EncodeToString(b), nil
+}
+
+// hashSecret returns the stored form of a key. Keys are random 256-bit
+// values, so a fast hash is sufficient.
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// displayPrefix is the part of a key shown in listings to identify it.
+func displayPrefix(secret string) string {
+	if len(secret) > 11 {
+		return secret[:11]
+	}
+	return secret
+}
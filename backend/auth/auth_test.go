@@ -0,0 +1,79 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestHasScope(t *testing.T) {
+	reader := &Key{Scopes: []string{ScopeReadBalance}}
+	if !reader.HasScope(ScopeReadBalance) {
+		t.Error("Expected read-balance key to have read-balance scope")
+	}
+	if reader.HasScope(ScopeIssueAddress) || reader.HasScope(ScopeAdmin) {
+		t.Error("Expected read-balance key to lack other scopes")
+	}
+
+	admin := &Key{Scopes: []string{ScopeAdmin}}
+	for _, s := range []string{ScopeReadBalance, ScopeIssueAddress, ScopeAdmin} {
+		if !admin.HasScope(s) {
+			t.Errorf("Expected admin key to have %s scope", s)
+		}
+	}
+}
+
+func TestCanAccessWallet(t *testing.T) {
+	unrestricted := &Key{Scopes: []string{ScopeReadBalance}}
+	if !unrestricted.CanAccessWallet(1) || !unrestricted.CanAccessWallet(2) {
+		t.Error("Expected an unrestricted key to access every wallet")
+	}
+
+	walletID := int64(2)
+	restricted := &Key{Scopes: []string{ScopeReadBalance}, WalletID: &walletID}
+	if restricted.CanAccessWallet(1) || !restricted.CanAccessWallet(2) {
+		t.Error("Expected a restricted key to access only its wallet")
+	}
+}
+
+func TestCreateRejectsWalletAdmin(t *testing.T) {
+	walletID := int64(2)
+	_, _, err := (&Store{}).Create(context.Background(), "tenant", []string{ScopeAdmin}, &walletID)
+	var scopeErr *ScopeError
+	if !errors.As(err, &scopeErr) {
+		t.Fatalf("Expected a ScopeError, got %v", err)
+	}
+}
+
+func TestGenerateSecret(t *testing.T) {
+	a, err := generateSecret()
+	if err != nil {
+		t.Fatalf("Failed to generate secret: %v", err)
+	}
+	b, _ := generateSecret()
+	if a == b {
+		t.Fatal("Secrets should be unique")
+	}
+	if !strings.HasPrefix(a, keyPrefix) || len(a) != len(keyPrefix)+64 {
+		t.Fatalf("Unexpected secret format: %s", a)
+	}
+	if hashSecret(a) == a || len(hashSecret(a)) != 64 {
+		t.Fatal("Expected a hex SHA-256 hash")
+	}
+}
+
+func TestSecretFromRequest(t *testing.T) {
+	r, _ := http.NewRequest("GET", "/", nil)
+	r.Header.Set("Authorization", "Bearer bw_abc")
+	if got := secretFromRequest(r); got != "bw_abc" {
+		t.Errorf("Expected bearer token, got %q", got)
+	}
+
+	r, _ = http.NewRequest("GET", "/", nil)
+	r.Header.Set("X-API-Key", "bw_def")
+	if got := secretFromRequest(r); got != "bw_def" {
+		t.Errorf("Expected X-API-Key, got %q", got)
+	}
+}
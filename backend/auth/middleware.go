@@ -0,0 +1,70 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/sawdustofmind/bitcoin-wallet/backend/apierr"
+)
+
+// contextKey is where Authenticate stores the caller's *Key.
+const contextKey = "auth.key"
+
+// Authenticator looks up API keys by secret. *Store implements it.
+type Authenticator interface {
+	Authenticate(ctx context.Context, secret string) (*Key, error)
+}
+
+// Authenticate resolves the API key from the Authorization bearer token or
+// the X-API-Key header and rejects the request if it is missing or invalid.
+func Authenticate(keys Authenticator) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key, err := keys.Authenticate(c.Request.Context(), secretFromRequest(c.Request))
+		if err != nil {
+			if err != ErrInvalidKey {
+				apierr.Internal(c, err, "authenticating API key")
+				return
+			}
+			c.Header("WWW-Authenticate", "Bearer")
+			apierr.Abort(c, http.StatusUnauthorized, apierr.CodeUnauthorized, err.Error())
+			return
+		}
+		c.Set(contextKey, key)
+		c.Next()
+	}
+}
+
+// Require rejects requests whose key lacks scope. It must run after
+// Authenticate.
+func Require(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := FromContext(c)
+		if key == nil || !key.HasScope(scope) {
+			apierr.Abort(c, http.StatusForbidden, apierr.CodeForbidden, "API key lacks scope "+scope)
+			return
+		}
+		c.Next()
+	}
+}
+
+// FromContext returns the authenticated key, or nil.
+func FromContext(c *gin.Context) *Key {
+	v, ok := c.Get(contextKey)
+	if !ok {
+		return nil
+	}
+	key, _ := v.(*Key)
+	return key
+}
+
+func secretFromRequest(r *http.Request) string {
+	if h := r.Header.Get("Authorization"); h != "" {
+		if token, ok := strings.CutPrefix(h, "Bearer "); ok {
+			return strings.TrimSpace(token)
+		}
+	}
+	return r.Header.Get("X-API-Key")
+}
@@ -0,0 +1,140 @@
+// Package bip21 builds and parses BIP21 bitcoin: payment URIs.
+package bip21
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/btcsuite/btcd/btcutil"
+)
+
+// Scheme is the URI scheme of BIP21 URIs.
+const Scheme = "bitcoin"
+
+// URI is a payment request. Only Address is required.
+type URI struct {
+	Address string
+	// Amount is in satoshis, 0 for none.
+	Amount  btcutil.Amount
+	Label   string
+	Message string
+	// PayjoinURL is the BIP78 endpoint senders may propose a payjoin at.
+	PayjoinURL string
+}
+
+// String encodes u, e.g. bitcoin:bc1q...?amount=0.001&label=Shop.
+func (u URI) String() string {
+	var params []string
+	if u.Amount > 0 {
+		params = append(params, "amount="+FormatAmount(u.Amount))
+	}
+	if u.Label != "" {
+		params = append(params, "label="+escape(u.Label))
+	}
+	if u.Message != "" {
+		params = append(params, "message="+escape(u.Message))
+	}
+	if u.PayjoinURL != "" {
+		params = append(params, "pj="+escape(u.PayjoinURL))
+	}
+	s := Scheme + ":" + u.Address
+	if len(params) > 0 {
+		s += "?" + strings.Join(params, "&")
+	}
+	return s
+}
+
+// QRString is String for QR codes. Without parameters, a bech32 address is
+// uppercased so the whole URI fits the denser alphanumeric mode (BIP173).
+func (u URI) QRString() string {
+	s := u.String()
+	if s == Scheme+":"+u.Address && isBech32(u.Address) {
+		return strings.ToUpper(s)
+	}
+	return s
+}
+
+// isBech32 reports whether address looks like a segwit address, whose
+// human-readable part ends in 1.
+func isBech32(address string) bool {
+	lower := strings.ToLower(address)
+	for _, hrp := range []string{"bc1", "tb1", "bcrt1"} {
+		if strings.HasPrefix(lower, hrp) {
+			return true
+		}
+	}
+	return false
+}
+
+// escape percent-encodes a parameter value. Spaces become %20, as some
+// wallets do not read + as a space.
+func escape(s string) string {
+	return strings.ReplaceAll(url.QueryEscape(s), "+", "%20")
+}
+
+// FormatAmount formats an amount in BTC as BIP21 requires: a decimal
+// without exponent or trailing zeros.
+func FormatAmount(a btcutil.Amount) string {
+	s := fmt.Sprintf("%d.%08d", int64(a)/btcutil.SatoshiPerBitcoin, int64(a)%btcutil.SatoshiPerBitcoin)
+	return strings.TrimSuffix(strings.TrimRight(s, "0"), ".")
+}
+
+// Parse decodes a BIP21 URI. Unknown parameters are ignored unless they
+// start with req-, which BIP21 requires rejecting.
+func Parse(s string) (*URI, error) {
+	scheme, rest, ok := strings.Cut(s, ":")
+	if !ok || !strings.EqualFold(scheme, Scheme) {
+		return nil, fmt.Errorf("not a %s: URI", Scheme)
+	}
+	address, query, _ := strings.Cut(rest, "?")
+	if address == "" {
+		return nil, errors.New("URI has no address")
+	}
+	u := &URI{Address: address}
+	values, err := url.ParseQuery(query)
+	if err != nil {
+		return nil, fmt.Errorf("invalid URI parameters: %v", err)
+	}
+	for key, v := range values {
+		switch key {
+		case "amount":
+			if u.Amount, err = parseAmount(v[0]); err != nil {
+				return nil, err
+			}
+		case "label":
+			u.Label = v[0]
+		case "message":
+			u.Message = v[0]
+		case "pj":
+			u.PayjoinURL = v[0]
+		default:
+			if strings.HasPrefix(key, "req-") {
+				return nil, fmt.Errorf("unsupported required parameter %q", key)
+			}
+		}
+	}
+	return u, nil
+}
+
+func parseAmount(s string) (btcutil.Amount, error) {
+	whole, frac, _ := strings.Cut(s, ".")
+	if whole == "" && frac == "" || len(frac) > 8 {
+		return 0, fmt.Errorf("invalid amount %q", s)
+	}
+	btc, err := strconv.ParseUint("0"+whole, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid amount %q", s)
+	}
+	sats, err := strconv.ParseUint("0"+frac+strings.Repeat("0", 8-len(frac)), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid amount %q", s)
+	}
+	a := btcutil.Amount(btc*btcutil.SatoshiPerBitcoin + sats)
+	if a > btcutil.MaxSatoshi {
+		return 0, fmt.Errorf("amount %q exceeds the supply", s)
+	}
+	return a, nil
+}
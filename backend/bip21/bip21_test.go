@@ -0,0 +1,87 @@
+package bip21
+
+import (
+	"testing"
+
+	"github.com/btcsuite/btcd/btcutil"
+)
+
+func TestString(t *testing.T) {
+	tests := []struct {
+		uri  URI
+		want string
+		qr   string
+	}{
+		{
+			uri:  URI{Address: "bcrt1qw508d6qejxtdg4y5r3zarvary0c5xw7kygt080"},
+			want: "bitcoin:bcrt1qw508d6qejxtdg4y5r3zarvary0c5xw7kygt080",
+			qr:   "BITCOIN:BCRT1QW508D6QEJXTDG4Y5R3ZARVARY0C5XW7KYGT080",
+		},
+		{
+			uri:  URI{Address: "mipcBbFg9gMiCh81Kj8tqqdgoZub1ZJRfn", Amount: 100000},
+			want: "bitcoin:mipcBbFg9gMiCh81Kj8tqqdgoZub1ZJRfn?amount=0.001",
+		},
+		{
+			uri: URI{
+				Address: "bcrt1qw508d6qejxtdg4y5r3zarvary0c5xw7kygt080",
+				Amount:  250000001,
+				Label:   "Coffee & Co",
+				Message: "Order #12 = 2 cups",
+			},
+			want: "bitcoin:bcrt1qw508d6qejxtdg4y5r3zarvary0c5xw7kygt080?amount=2.50000001&label=Coffee%20%26%20Co&message=Order%20%2312%20%3D%202%20cups",
+		},
+		{
+			uri:  URI{Address: "bcrt1qw508d6qejxtdg4y5r3zarvary0c5xw7kygt080", PayjoinURL: "https://pay.example.com/v1/wallets/2/payjoin"},
+			want: "bitcoin:bcrt1qw508d6qejxtdg4y5r3zarvary0c5xw7kygt080?pj=https%3A%2F%2Fpay.example.com%2Fv1%2Fwallets%2F2%2Fpayjoin",
+		},
+	}
+	for _, tt := range tests {
+		if got := tt.uri.String(); got != tt.want {
+			t.Errorf("String() = %q, want %q", got, tt.want)
+		}
+		qr := tt.qr
+		if qr == "" {
+			qr = tt.want
+		}
+		if got := tt.uri.QRString(); got != qr {
+			t.Errorf("QRString() = %q, want %q", got, qr)
+		}
+		parsed, err := Parse(tt.want)
+		if err != nil {
+			t.Errorf("Parse(%q): %v", tt.want, err)
+		} else if *parsed != tt.uri {
+			t.Errorf("Parse(%q) = %+v, want %+v", tt.want, *parsed, tt.uri)
+		}
+	}
+}
+
+func TestFormatAmount(t *testing.T) {
+	for sats, want := range map[btcutil.Amount]string{
+		1:                "0.00000001",
+		100000000:        "1",
+		2100000000000000: "21000000",
+		123456789:        "1.23456789",
+		50000:            "0.0005",
+	} {
+		if got := FormatAmount(sats); got != want {
+			t.Errorf("FormatAmount(%d) = %q, want %q", sats, got, want)
+		}
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	for _, s := range []string{
+		"bc1qxyz",
+		"litecoin:abc",
+		"bitcoin:",
+		"bitcoin:abc?amount=1.123456789",
+		"bitcoin:abc?amount=-1",
+		"bitcoin:abc?amount=1e3",
+		"bitcoin:abc?amount=21000001",
+		"bitcoin:abc?req-somethingyoudontunderstand=50",
+	} {
+		if _, err := Parse(s); err == nil {
+			t.Errorf("Parse(%q) succeeded", s)
+		}
+	}
+}
@@ -2,13 +2,130 @@ package config
 
 import (
 	"fmt"
+	"log/slog"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 )
 
 type Config struct {
-	XPUB    string
-	DB      DBConfig
-	Bitcoin BitcoinConfig
+	// XPUB, if set, is registered as the default wallet served by the
+	// unscoped routes. More wallets are registered through the API.
+	XPUB string
+	// Descriptor defines the default wallet by an output descriptor
+	// instead of XPUB, for policies an xpub cannot describe. A multipath
+	// <0;1> step or ChangeDescriptor gives the change chain.
+	Descriptor       string
+	ChangeDescriptor string
+	DB               DBConfig
+	Bitcoin          BitcoinConfig
+	Auth             AuthConfig
+	HTTP             HTTPConfig
+	Limits           LimitsConfig
+	Tracing          TracingConfig
+	Log              LogConfig
+	Payjoin          PayjoinConfig
+}
+
+// PayjoinConfig enables the BIP78 payjoin receiver when SignerURL is set.
+type PayjoinConfig struct {
+	// SignerURL is the external signer hook. Proposals are POSTed to it as
+	// {"wallet_id": 1, "psbt": "<base64>"} and it answers {"psbt":
+	// "<base64>"} with the wallet's input signed.
+	SignerURL string
+	// SignerTimeout bounds each call to the signer hook.
+	SignerTimeout time.Duration
+	// FallbackTimeout is how long after a payjoin request the original
+	// transaction is broadcast, unless the sender has broadcast it or the
+	// proposal by then.
+	FallbackTimeout time.Duration
+	// PublicURL is the base URL senders reach the API at, e.g.
+	// https://pay.example.com. If set, payment URIs carry a pj parameter.
+	PublicURL string
+}
+
+func (c PayjoinConfig) Enabled() bool {
+	return c.SignerURL != ""
+}
+
+// Log formats.
+const (
+	LogFormatJSON = "json"
+	LogFormatText = "text"
+)
+
+type LogConfig struct {
+	// Level is the minimum level logged.
+	Level slog.Level
+	// Format is LogFormatJSON or LogFormatText.
+	Format string
+}
+
+// TracingConfig exports OpenTelemetry traces over OTLP/gRPC when Endpoint
+// is set.
+type TracingConfig struct {
+	// Endpoint is the collector URL, e.g. http://otel-collector:4317. An
+	// http scheme disables TLS.
+	Endpoint string
+	// SampleRatio is the fraction of new traces recorded. Requests that
+	// arrive with a sampled parent are always recorded.
+	SampleRatio float64
+}
+
+type LimitsConfig struct {
+	// RequestsPerSecond and Burst configure the token bucket applied per
+	// client IP and per API key. Zero disables rate limiting.
+	RequestsPerSecond float64
+	Burst             int
+	// DailyAddressQuota caps addresses issued per API key per UTC day.
+	// Zero disables the quota.
+	DailyAddressQuota int
+	// GapLimit is the maximum number of consecutive unused issued
+	// addresses. Zero disables the guard.
+	GapLimit int
+}
+
+type HTTPConfig struct {
+	Port string
+	// GRPCPort serves the gRPC API. TLS settings are shared with HTTP.
+	GRPCPort string
+	CORS     CORSConfig
+	TLS      TLSConfig
+	// LegacyRoutes also serves the unversioned pre-v1 routes, including
+	// address issuance via GET /address.
+	LegacyRoutes bool
+	// IdempotencyTTL is how long responses to requests with an
+	// Idempotency-Key are kept for replay.
+	IdempotencyTTL time.Duration
+	// ShutdownTimeout bounds how long in-flight requests are drained on
+	// SIGINT or SIGTERM before connections are closed.
+	ShutdownTimeout time.Duration
+}
+
+type CORSConfig struct {
+	// AllowedOrigins may contain "*" to allow any origin, in which case
+	// credentials are never allowed.
+	AllowedOrigins   []string
+	AllowedMethods   []string
+	AllowedHeaders   []string
+	AllowCredentials bool
+	MaxAge           time.Duration
+}
+
+// TLSConfig enables HTTPS when CertFile and KeyFile are set. Certificates
+// are reloaded on SIGHUP.
+type TLSConfig struct {
+	CertFile string
+	KeyFile  string
+	// ClientCAFile enables mTLS: client certificates signed by this CA are
+	// verified when presented, and required if RequireClientCert is set.
+	ClientCAFile      string
+	RequireClientCert bool
+}
+
+func (c TLSConfig) Enabled() bool {
+	return c.CertFile != "" && c.KeyFile != ""
 }
 
 type DBConfig struct {
@@ -23,16 +140,110 @@ type BitcoinConfig struct {
 	RPCHost string
 	RPCUser string
 	RPCPass string
+
+	// PollInterval is how often the wallet checks the node for new blocks.
+	PollInterval time.Duration
+	// ReorgDepth is the number of recent block hashes kept to detect reorgs.
+	ReorgDepth int
+	// SyncMode selects how wallet state is obtained, see SyncModeWallet and
+	// SyncModeFilters.
+	SyncMode string
+	// MaxTipAge is the age of the node's best block after which the service
+	// reports not ready. Zero disables the check.
+	MaxTipAge time.Duration
+	// RPCTimeout bounds each bitcoind RPC. Zero leaves calls bounded only
+	// by their caller's context.
+	RPCTimeout time.Duration
 }
 
+// exampleAdminAPIKey is the placeholder earlier example configs shipped as
+// ADMIN_API_KEY. It is refused since anyone could guess it.
+const exampleAdminAPIKey = "change-me-admin-key"
+
+type AuthConfig struct {
+	// AdminAPIKey is a bootstrap key with the admin scope, registered at
+	// startup so the first real keys can be created.
+	AdminAPIKey string
+}
+
+const (
+	// SyncModeWallet uses a watch-only wallet in bitcoind.
+	SyncModeWallet = "wallet"
+	// SyncModeFilters uses BIP158 compact block filters and works with
+	// pruned nodes and without the node's wallet.
+	SyncModeFilters = "filters"
+)
+
 func Load() (*Config, error) {
+	pollInterval, err := getEnvDuration("BITCOIN_POLL_INTERVAL", 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	reorgDepth, err := getEnvInt("BITCOIN_REORG_DEPTH", 100)
+	if err != nil {
+		return nil, err
+	}
+
+	maxTipAge, err := getEnvDuration("BITCOIN_MAX_TIP_AGE", 2*time.Hour)
+	if err != nil {
+		return nil, err
+	}
+	rpcTimeout, err := getEnvDuration("BITCOIN_RPC_TIMEOUT", 30*time.Second)
+	if err != nil {
+		return nil, err
+	}
+
+	syncMode := os.Getenv("BITCOIN_SYNC_MODE")
+	if syncMode == "" {
+		syncMode = SyncModeWallet
+	}
+	if syncMode != SyncModeWallet && syncMode != SyncModeFilters {
+		return nil, fmt.Errorf("invalid BITCOIN_SYNC_MODE %q", syncMode)
+	}
+
+	httpCfg, err := loadHTTP()
+	if err != nil {
+		return nil, err
+	}
+
+	limits, err := loadLimits()
+	if err != nil {
+		return nil, err
+	}
+
+	tracing, err := loadTracing()
+	if err != nil {
+		return nil, err
+	}
+
+	logCfg, err := loadLog()
+	if err != nil {
+		return nil, err
+	}
+
+	payjoin, err := loadPayjoin()
+	if err != nil {
+		return nil, err
+	}
+
 	xpub := os.Getenv("XPUB")
-	if xpub == "" {
-		return nil, fmt.Errorf("XPUB environment variable is required")
+	desc := os.Getenv("DESCRIPTOR")
+	changeDesc := os.Getenv("CHANGE_DESCRIPTOR")
+	if xpub != "" && desc != "" {
+		return nil, fmt.Errorf("XPUB and DESCRIPTOR are mutually exclusive")
+	}
+	if changeDesc != "" && desc == "" {
+		return nil, fmt.Errorf("CHANGE_DESCRIPTOR requires DESCRIPTOR")
+	}
+	adminKey := os.Getenv("ADMIN_API_KEY")
+	if adminKey == exampleAdminAPIKey {
+		return nil, fmt.Errorf("ADMIN_API_KEY is the example value %q; set a random key, e.g. from openssl rand -hex 32", exampleAdminAPIKey)
 	}
 
 	return &Config{
-		XPUB: xpub,
+		XPUB:             xpub,
+		Descriptor:       desc,
+		ChangeDescriptor: changeDesc,
 		DB: DBConfig{
 			Host:     os.Getenv("DB_HOST"),
 			Port:     os.Getenv("DB_PORT"),
@@ -44,6 +255,213 @@ func Load() (*Config, error) {
 			RPCHost: os.Getenv("BITCOIN_RPC_HOST"),
 			RPCUser: os.Getenv("BITCOIN_RPC_USER"),
 			RPCPass: os.Getenv("BITCOIN_RPC_PASS"),
+
+			PollInterval: pollInterval,
+			ReorgDepth:   reorgDepth,
+			SyncMode:     syncMode,
+			MaxTipAge:    maxTipAge,
+			RPCTimeout:   rpcTimeout,
+		},
+		Auth: AuthConfig{
+			AdminAPIKey: adminKey,
 		},
+		HTTP:    httpCfg,
+		Limits:  limits,
+		Tracing: tracing,
+		Log:     logCfg,
+		Payjoin: payjoin,
 	}, nil
 }
+
+func loadLog() (LogConfig, error) {
+	cfg := LogConfig{Level: slog.LevelInfo, Format: os.Getenv("LOG_FORMAT")}
+	if v := os.Getenv("LOG_LEVEL"); v != "" {
+		if err := cfg.Level.UnmarshalText([]byte(v)); err != nil {
+			return cfg, fmt.Errorf("invalid LOG_LEVEL: %v", err)
+		}
+	}
+	if cfg.Format == "" {
+		cfg.Format = LogFormatJSON
+	}
+	if cfg.Format != LogFormatJSON && cfg.Format != LogFormatText {
+		return cfg, fmt.Errorf("invalid LOG_FORMAT %q", cfg.Format)
+	}
+	return cfg, nil
+}
+
+func loadPayjoin() (PayjoinConfig, error) {
+	cfg := PayjoinConfig{
+		SignerURL: os.Getenv("PAYJOIN_SIGNER_URL"),
+		PublicURL: strings.TrimSuffix(os.Getenv("PAYJOIN_PUBLIC_URL"), "/"),
+	}
+	var err error
+	if cfg.SignerTimeout, err = getEnvDuration("PAYJOIN_SIGNER_TIMEOUT", 10*time.Second); err != nil {
+		return cfg, err
+	}
+	if cfg.FallbackTimeout, err = getEnvDuration("PAYJOIN_FALLBACK_TIMEOUT", 2*time.Minute); err != nil {
+		return cfg, err
+	}
+	if cfg.FallbackTimeout <= 0 {
+		return cfg, fmt.Errorf("PAYJOIN_FALLBACK_TIMEOUT must be positive")
+	}
+	if cfg.PublicURL != "" && !cfg.Enabled() {
+		return cfg, fmt.Errorf("PAYJOIN_PUBLIC_URL requires PAYJOIN_SIGNER_URL")
+	}
+	return cfg, nil
+}
+
+func loadTracing() (TracingConfig, error) {
+	cfg := TracingConfig{Endpoint: os.Getenv("TRACING_ENDPOINT"), SampleRatio: 1}
+	if v := os.Getenv("TRACING_SAMPLE_RATIO"); v != "" {
+		ratio, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid TRACING_SAMPLE_RATIO: %v", err)
+		}
+		if ratio < 0 || ratio > 1 {
+			return cfg, fmt.Errorf("TRACING_SAMPLE_RATIO must be between 0 and 1")
+		}
+		cfg.SampleRatio = ratio
+	}
+	return cfg, nil
+}
+
+func loadLimits() (LimitsConfig, error) {
+	var cfg LimitsConfig
+	var err error
+	if v := os.Getenv("RATE_LIMIT_RPS"); v != "" {
+		if cfg.RequestsPerSecond, err = strconv.ParseFloat(v, 64); err != nil {
+			return cfg, fmt.Errorf("invalid RATE_LIMIT_RPS: %v", err)
+		}
+	} else {
+		cfg.RequestsPerSecond = 10
+	}
+	if cfg.Burst, err = getEnvInt("RATE_LIMIT_BURST", 20); err != nil {
+		return cfg, err
+	}
+	if cfg.DailyAddressQuota, err = getEnvInt("DAILY_ADDRESS_QUOTA", 1000); err != nil {
+		return cfg, err
+	}
+	if cfg.GapLimit, err = getEnvInt("GAP_LIMIT", 20); err != nil {
+		return cfg, err
+	}
+	return cfg, nil
+}
+
+func loadHTTP() (HTTPConfig, error) {
+	port := os.Getenv("PORT")
+	if port == "" {
+		port = "8080"
+	}
+	grpcPort := os.Getenv("GRPC_PORT")
+	if grpcPort == "" {
+		grpcPort = "9090"
+	}
+
+	allowCredentials, err := getEnvBool("CORS_ALLOW_CREDENTIALS", false)
+	if err != nil {
+		return HTTPConfig{}, err
+	}
+	maxAge, err := getEnvDuration("CORS_MAX_AGE", 10*time.Minute)
+	if err != nil {
+		return HTTPConfig{}, err
+	}
+	requireClientCert, err := getEnvBool("TLS_REQUIRE_CLIENT_CERT", false)
+	if err != nil {
+		return HTTPConfig{}, err
+	}
+	legacyRoutes, err := getEnvBool("API_LEGACY_ROUTES", false)
+	if err != nil {
+		return HTTPConfig{}, err
+	}
+	idempotencyTTL, err := getEnvDuration("IDEMPOTENCY_TTL", 24*time.Hour)
+	if err != nil {
+		return HTTPConfig{}, err
+	}
+	shutdownTimeout, err := getEnvDuration("SHUTDOWN_TIMEOUT", 30*time.Second)
+	if err != nil {
+		return HTTPConfig{}, err
+	}
+
+	cfg := HTTPConfig{
+		Port:     port,
+		GRPCPort: grpcPort,
+		CORS: CORSConfig{
+			AllowedOrigins:   getEnvList("CORS_ALLOWED_ORIGINS", "http://localhost:3000"),
+			AllowedMethods:   getEnvList("CORS_ALLOWED_METHODS", "GET, POST, PUT, DELETE, OPTIONS"),
+			AllowedHeaders:   getEnvList("CORS_ALLOWED_HEADERS", "Content-Type, Authorization, X-API-Key, Idempotency-Key"),
+			AllowCredentials: allowCredentials,
+			MaxAge:           maxAge,
+		},
+		TLS: TLSConfig{
+			CertFile:          os.Getenv("TLS_CERT_FILE"),
+			KeyFile:           os.Getenv("TLS_KEY_FILE"),
+			ClientCAFile:      os.Getenv("TLS_CLIENT_CA_FILE"),
+			RequireClientCert: requireClientCert,
+		},
+		LegacyRoutes:    legacyRoutes,
+		IdempotencyTTL:  idempotencyTTL,
+		ShutdownTimeout: shutdownTimeout,
+	}
+
+	if (cfg.TLS.CertFile == "") != (cfg.TLS.KeyFile == "") {
+		return HTTPConfig{}, fmt.Errorf("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	}
+	if cfg.TLS.ClientCAFile != "" && !cfg.TLS.Enabled() {
+		return HTTPConfig{}, fmt.Errorf("TLS_CLIENT_CA_FILE requires TLS_CERT_FILE and TLS_KEY_FILE")
+	}
+	if cfg.TLS.RequireClientCert && cfg.TLS.ClientCAFile == "" {
+		return HTTPConfig{}, fmt.Errorf("TLS_REQUIRE_CLIENT_CERT requires TLS_CLIENT_CA_FILE")
+	}
+	return cfg, nil
+}
+
+func getEnvInt(key string, def int) (int, error) {
+	v := os.Getenv(key)
+	if v == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %v", key, err)
+	}
+	return n, nil
+}
+
+func getEnvDuration(key string, def time.Duration) (time.Duration, error) {
+	v := os.Getenv(key)
+	if v == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %v", key, err)
+	}
+	return d, nil
+}
+
+func getEnvBool(key string, def bool) (bool, error) {
+	v := os.Getenv(key)
+	if v == "" {
+		return def, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s: %v", key, err)
+	}
+	return b, nil
+}
+
+// getEnvList splits a comma-separated variable, falling back to def.
+func getEnvList(key, def string) []string {
+	v := os.Getenv(key)
+	if v == "" {
+		v = def
+	}
+	var list []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
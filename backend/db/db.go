@@ -1,33 +1,35 @@
 package db
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
-	"log"
+	"log/slog"
 	"time"
 
-	"github.com/sawdustofmind/bitcoin-wallet/backend/config"
+	"github.com/lib/pq"
 
-	_ "github.com/lib/pq"
+	"github.com/sawdustofmind/bitcoin-wallet/backend/config"
+	"github.com/sawdustofmind/bitcoin-wallet/backend/health"
 )
 
 func Connect(cfg config.DBConfig) (*sql.DB, error) {
 	connStr := fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=disable",
 		cfg.Host, cfg.Port, cfg.User, cfg.Password, cfg.Name)
 
-	var db *sql.DB
-	var err error
+	connector, err := pq.NewConnector(connStr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid database configuration: %v", err)
+	}
+	db := Open(connector)
 
 	// Retry connection loop
 	for i := 0; i < 30; i++ {
-		db, err = sql.Open("postgres", connStr)
+		err = db.Ping()
 		if err == nil {
-			err = db.Ping()
-			if err == nil {
-				break
-			}
+			break
 		}
-		log.Printf("Failed to connect to database: %v. Retrying in 2s...", err)
+		slog.Warn("Failed to connect to database, retrying", "attempt", i+1, "retry_in", 2*time.Second, "error", err)
 		time.Sleep(2 * time.Second)
 	}
 
@@ -35,26 +37,213 @@ func Connect(cfg config.DBConfig) (*sql.DB, error) {
 		return nil, fmt.Errorf("could not connect to database after retries: %v", err)
 	}
 
-	if err := runMigrations(db); err != nil {
+	if err := Migrate(db); err != nil {
 		return nil, err
 	}
 
 	return db, nil
 }
 
-func runMigrations(db *sql.DB) error {
-	query := `
-	CREATE TABLE IF NOT EXISTS wallet_state (
+// migrations are applied in order on every start, so each statement must be
+// idempotent.
+var migrations = []string{
+	`CREATE TABLE IF NOT EXISTS wallet_state (
 		id SERIAL PRIMARY KEY,
 		derivation_index INT NOT NULL DEFAULT 0
 	);
 	INSERT INTO wallet_state (id, derivation_index)
 	SELECT 1, 0
-	WHERE NOT EXISTS (SELECT 1 FROM wallet_state WHERE id = 1);
-	`
-	_, err := db.Exec(query)
-	if err != nil {
-		return fmt.Errorf("migration failed: %v", err)
+	WHERE NOT EXISTS (SELECT 1 FROM wallet_state WHERE id = 1);`,
+
+	// Last N processed block hashes, used to detect chain reorganizations
+	`CREATE TABLE IF NOT EXISTS block_hashes (
+		height BIGINT PRIMARY KEY,
+		hash TEXT NOT NULL
+	);`,
+
+	// Wallet outputs and transactions seen in processed blocks
+	`CREATE TABLE IF NOT EXISTS wallet_utxos (
+		txid TEXT NOT NULL,
+		vout INT NOT NULL,
+		address TEXT NOT NULL,
+		derivation_index INT NOT NULL,
+		amount_sats BIGINT NOT NULL,
+		block_height BIGINT NOT NULL,
+		block_hash TEXT NOT NULL,
+		block_time TIMESTAMPTZ NOT NULL,
+		spent_txid TEXT,
+		spent_height BIGINT,
+		spent_time TIMESTAMPTZ,
+		PRIMARY KEY (txid, vout)
+	);
+	CREATE INDEX IF NOT EXISTS wallet_utxos_block_height_idx ON wallet_utxos (block_height);
+	CREATE INDEX IF NOT EXISTS wallet_utxos_spent_height_idx ON wallet_utxos (spent_height);`,
+
+	`CREATE TABLE IF NOT EXISTS wallet_transactions (
+		txid TEXT PRIMARY KEY,
+		block_height BIGINT NOT NULL,
+		block_hash TEXT NOT NULL,
+		block_time TIMESTAMPTZ NOT NULL,
+		fee_sats BIGINT
+	);
+	CREATE INDEX IF NOT EXISTS wallet_transactions_block_height_idx ON wallet_transactions (block_height);`,
+
+	`ALTER TABLE wallet_utxos ADD COLUMN IF NOT EXISTS coinbase BOOLEAN NOT NULL DEFAULT FALSE;`,
+
+	// BIP329 wallet labels
+	`CREATE TABLE IF NOT EXISTS labels (
+		type TEXT NOT NULL,
+		ref TEXT NOT NULL,
+		label TEXT NOT NULL DEFAULT '',
+		origin TEXT,
+		spendable BOOLEAN,
+		PRIMARY KEY (type, ref)
+	);`,
+
+	// API keys; only a SHA-256 hash of each key is stored
+	`CREATE TABLE IF NOT EXISTS api_keys (
+		id SERIAL PRIMARY KEY,
+		name TEXT NOT NULL,
+		prefix TEXT NOT NULL,
+		key_hash TEXT NOT NULL UNIQUE,
+		scopes TEXT[] NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		revoked_at TIMESTAMPTZ
+	);`,
+
+	// Addresses issued per client per UTC day, for issuance quotas
+	`CREATE TABLE IF NOT EXISTS address_issuance (
+		client TEXT NOT NULL,
+		day DATE NOT NULL,
+		count INT NOT NULL DEFAULT 0,
+		PRIMARY KEY (client, day)
+	);`,
+
+	// Responses to requests sent with an Idempotency-Key. status_code is
+	// NULL while the first request is still running.
+	`CREATE TABLE IF NOT EXISTS idempotency_keys (
+		client TEXT NOT NULL,
+		key TEXT NOT NULL,
+		fingerprint TEXT NOT NULL,
+		status_code INT,
+		content_type TEXT,
+		body BYTEA,
+		expires_at TIMESTAMPTZ NOT NULL,
+		PRIMARY KEY (client, key)
+	);`,
+	`CREATE INDEX IF NOT EXISTS idx_idempotency_keys_expires ON idempotency_keys(expires_at);`,
+
+	// Registered wallets. ID 1 is reserved for the one configured with XPUB,
+	// whose derivation index starts from wallet_state when it is registered.
+	`CREATE TABLE IF NOT EXISTS wallets (
+		id SERIAL PRIMARY KEY,
+		name TEXT NOT NULL UNIQUE,
+		xpub TEXT NOT NULL,
+		script_type TEXT NOT NULL,
+		node_wallet TEXT NOT NULL UNIQUE,
+		derivation_index INT NOT NULL DEFAULT 0,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		UNIQUE (xpub, script_type)
+	);
+	SELECT setval(pg_get_serial_sequence('wallets', 'id'), (SELECT GREATEST(MAX(id), 1) FROM wallets));`,
+
+	// Scope block-derived state and labels to a wallet. Existing rows
+	// belong to wallet 1.
+	`ALTER TABLE block_hashes ADD COLUMN IF NOT EXISTS wallet_id INT NOT NULL DEFAULT 1;
+	ALTER TABLE block_hashes ALTER COLUMN wallet_id DROP DEFAULT;
+	ALTER TABLE wallet_utxos ADD COLUMN IF NOT EXISTS wallet_id INT NOT NULL DEFAULT 1;
+	ALTER TABLE wallet_utxos ALTER COLUMN wallet_id DROP DEFAULT;
+	ALTER TABLE wallet_transactions ADD COLUMN IF NOT EXISTS wallet_id INT NOT NULL DEFAULT 1;
+	ALTER TABLE wallet_transactions ALTER COLUMN wallet_id DROP DEFAULT;
+	ALTER TABLE labels ADD COLUMN IF NOT EXISTS wallet_id INT NOT NULL DEFAULT 1;
+	ALTER TABLE labels ALTER COLUMN wallet_id DROP DEFAULT;`,
+	`DO $$
+	BEGIN
+		IF NOT EXISTS (SELECT 1 FROM pg_constraint WHERE conname = 'block_hashes_wallet_pkey') THEN
+			ALTER TABLE block_hashes DROP CONSTRAINT block_hashes_pkey;
+			ALTER TABLE block_hashes ADD CONSTRAINT block_hashes_wallet_pkey PRIMARY KEY (wallet_id, height);
+			ALTER TABLE wallet_utxos DROP CONSTRAINT wallet_utxos_pkey;
+			ALTER TABLE wallet_utxos ADD CONSTRAINT wallet_utxos_wallet_pkey PRIMARY KEY (wallet_id, txid, vout);
+			ALTER TABLE wallet_transactions DROP CONSTRAINT wallet_transactions_pkey;
+			ALTER TABLE wallet_transactions ADD CONSTRAINT wallet_transactions_wallet_pkey PRIMARY KEY (wallet_id, txid);
+			ALTER TABLE labels DROP CONSTRAINT labels_pkey;
+			ALTER TABLE labels ADD CONSTRAINT labels_wallet_pkey PRIMARY KEY (wallet_id, type, ref);
+		END IF;
+	END $$;`,
+
+	// API keys may be limited to a single wallet
+	`ALTER TABLE api_keys ADD COLUMN IF NOT EXISTS wallet_id INT REFERENCES wallets (id);`,
+
+	// Wallets may be defined by output descriptors instead of an xpub.
+	// Descriptors are stored normalized with their checksum.
+	`ALTER TABLE wallets ADD COLUMN IF NOT EXISTS descriptor TEXT UNIQUE;
+	ALTER TABLE wallets ADD COLUMN IF NOT EXISTS change_descriptor TEXT;
+	ALTER TABLE wallets ALTER COLUMN xpub DROP NOT NULL;`,
+
+	// Next change index handed out for PSBTs
+	`ALTER TABLE wallets ADD COLUMN IF NOT EXISTS change_index INT NOT NULL DEFAULT 0;`,
+
+	// Wallets discovering BIP44 accounts from their account-level xpubs,
+	// and how many accounts have been imported
+	`ALTER TABLE wallets ADD COLUMN IF NOT EXISTS account_discovery BOOLEAN NOT NULL DEFAULT FALSE;
+	ALTER TABLE wallets ADD COLUMN IF NOT EXISTS account_keys TEXT[];
+	ALTER TABLE wallets ADD COLUMN IF NOT EXISTS accounts INT NOT NULL DEFAULT 0;`,
+
+	// BIP78 payjoin requests, whose original transaction is broadcast
+	// after a timeout unless the sender broadcast it or the proposal, and
+	// every input they spend so an input is never offered twice
+	`CREATE TABLE IF NOT EXISTS payjoins (
+		id BIGSERIAL PRIMARY KEY,
+		wallet_id INT NOT NULL REFERENCES wallets (id),
+		original_txid TEXT NOT NULL,
+		original_tx TEXT NOT NULL,
+		proposal_txid TEXT,
+		status TEXT NOT NULL DEFAULT 'pending',
+		created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		fallback_at TIMESTAMPTZ NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS payjoins_pending_idx ON payjoins (wallet_id, fallback_at) WHERE status = 'pending';
+	CREATE TABLE IF NOT EXISTS payjoin_inputs (
+		outpoint TEXT PRIMARY KEY,
+		payjoin_id BIGINT NOT NULL REFERENCES payjoins (id),
+		ours BOOLEAN NOT NULL
+	);`,
+
+	// First block each wallet processed, before which its history is not
+	// known. Existing wallets start at their oldest tracked block.
+	`ALTER TABLE wallets ADD COLUMN IF NOT EXISTS history_start_height BIGINT;
+	ALTER TABLE wallets ADD COLUMN IF NOT EXISTS history_start_time TIMESTAMPTZ;
+	UPDATE wallets SET history_start_height = (SELECT MIN(height) FROM block_hashes WHERE block_hashes.wallet_id = wallets.id)
+		WHERE history_start_height IS NULL;`,
+
+	// Outputs to the change chain, whose derivation_index is a change index
+	`ALTER TABLE wallet_utxos ADD COLUMN IF NOT EXISTS internal BOOLEAN NOT NULL DEFAULT FALSE;`,
+
+	// Outputs kept out of coin selection: inputs of created PSBTs and coins
+	// offered in payjoin proposals
+	`CREATE TABLE IF NOT EXISTS coin_reservations (
+		outpoint TEXT PRIMARY KEY,
+		wallet_id INT NOT NULL REFERENCES wallets (id),
+		expires_at TIMESTAMPTZ NOT NULL
+	);`,
+}
+
+// Migrate brings the schema up to date.
+func Migrate(db *sql.DB) error {
+	for i, query := range migrations {
+		if _, err := db.Exec(query); err != nil {
+			return fmt.Errorf("migration %d failed: %v", i, err)
+		}
 	}
 	return nil
 }
+
+// ReadinessCheck pings the database.
+func ReadinessCheck(db *sql.DB) health.Check {
+	return health.Check{Name: "postgres", Run: func(ctx context.Context) error {
+		if err := db.PingContext(ctx); err != nil {
+			return health.Fail("ping failed", err)
+		}
+		return nil
+	}}
+}
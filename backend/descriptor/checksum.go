@@ -0,0 +1,62 @@
+package descriptor
+
+import (
+	"fmt"
+	"strings"
+)
+
+// inputCharset orders the characters a descriptor may contain. A
+// character's position determines the symbols it contributes to the
+// checksum.
+const inputCharset = "0123456789()[],'/*abcdefgh@:$%{}" +
+	"IJKLMNOPQRSTUVWXYZ&+-.;<=>?!^_|~" +
+	"ijklmnopqrstuvwxyzABCDEFGH`#\"\\ "
+
+// checksumCharset encodes the checksum, as in bech32.
+const checksumCharset = "qpzry9x8gf2tvdw0s3jn54khce6mua7l"
+
+var generator = [5]uint64{0xf5dee51989, 0xa9fdca3312, 0x1bab10e32d, 0x3706b1677a, 0x644d626ffd}
+
+func polymod(c uint64, val int) uint64 {
+	top := c >> 35
+	c = (c&0x7ffffffff)<<5 ^ uint64(val)
+	for i, g := range generator {
+		if (top>>i)&1 != 0 {
+			c ^= g
+		}
+	}
+	return c
+}
+
+// Checksum returns the BIP380 checksum of a descriptor given without one.
+func Checksum(desc string) (string, error) {
+	c := uint64(1)
+	// Every three characters also contribute their groups in inputCharset
+	group, groups := 0, 0
+	for i, ch := range desc {
+		pos := strings.IndexRune(inputCharset, ch)
+		if pos < 0 {
+			return "", fmt.Errorf("invalid character %q at position %d", ch, i)
+		}
+		c = polymod(c, pos&31)
+		group = group*3 + pos>>5
+		groups++
+		if groups == 3 {
+			c = polymod(c, group)
+			group, groups = 0, 0
+		}
+	}
+	if groups > 0 {
+		c = polymod(c, group)
+	}
+	for i := 0; i < 8; i++ {
+		c = polymod(c, 0)
+	}
+	c ^= 1
+
+	sum := make([]byte, 8)
+	for i := range sum {
+		sum[i] = checksumCharset[(c>>(5*(7-i)))&31]
+	}
+	return string(sum), nil
+}
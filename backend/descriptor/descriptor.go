@@ -0,0 +1,686 @@
+// Package descriptor parses output script descriptors (BIP380) and derives
+// the addresses they describe.
+//
+// Only watch-only descriptors are supported:
+//
+//	pkh(KEY)  wpkh(KEY)  sh(wpkh(KEY))  tr(KEY)  tr(KEY,TREE)
+//	wsh(MULTI)  sh(wsh(MULTI))  sh(MULTI)  wsh(MS)  sh(wsh(MS))
+//
+// where MULTI is multi(k,KEY,...) or sortedmulti(k,KEY,...), MS is a
+// miniscript expression, TREE is a miniscript leaf or {TREE,TREE}, and KEY
+// is a compressed public key in hex (x-only in taproot) or an extended
+// public key with optional origin info and unhardened derivation steps, one
+// of which may be a BIP389 multipath step, e.g.
+// [d34db33f/84h/1h/0h]tpub.../<0;1>/*.
+package descriptor
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/btcsuite/btcd/btcec/v2/schnorr"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/btcutil/hdkeychain"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/txscript"
+)
+
+// Descriptor is a parsed output descriptor.
+type Descriptor struct {
+	root   node
+	keys   []*Key
+	params *chaincfg.Params
+}
+
+// node is a script expression.
+type node interface {
+	// script returns the script of the expression at child index i: the
+	// output script of a top-level expression, or the script sh() wraps.
+	script(i uint32, params *chaincfg.Params) ([]byte, error)
+	// name is the expression without its keys, e.g. "sh(wpkh)".
+	name() string
+	// format writes the expression, see Key.format.
+	format(b *strings.Builder, branch int)
+}
+
+// scope is where an expression appears, which limits what it may be.
+type scope int
+
+const (
+	scopeTop scope = iota
+	scopeSH
+	scopeWSH
+)
+
+// Most keys multi() takes: standard P2WSH scripts allow 20, while P2SH
+// scripts must fit in 520 bytes.
+const (
+	maxMultisigKeys     = 20
+	maxP2SHMultisigKeys = 15
+)
+
+// Parse parses a descriptor for the network. The checksum is required.
+func Parse(desc string, params *chaincfg.Params) (*Descriptor, error) {
+	body, sum, ok := strings.Cut(desc, "#")
+	if !ok {
+		return nil, errors.New("missing checksum")
+	}
+	want, err := Checksum(body)
+	if err != nil {
+		return nil, err
+	}
+	if sum != want {
+		return nil, fmt.Errorf("checksum %q does not match the computed %q", sum, want)
+	}
+
+	d := &Descriptor{params: params}
+	if d.root, err = d.parse(body, scopeTop); err != nil {
+		return nil, err
+	}
+
+	// BIP389: all multipath steps must have the same number of paths
+	paths := 0
+	for _, k := range d.keys {
+		if k.multi == nil {
+			continue
+		}
+		if paths != 0 && len(k.multi) != paths {
+			return nil, errors.New("multipath steps must have the same number of paths")
+		}
+		paths = len(k.multi)
+	}
+	return d, nil
+}
+
+func (d *Descriptor) parse(s string, sc scope) (node, error) {
+	fn, args, err := splitCall(s)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case fn == "pkh" && sc == scopeTop:
+		key, err := d.parseKeyArg(fn, args)
+		if err != nil {
+			return nil, err
+		}
+		return &pkhNode{key: key}, nil
+	case fn == "wpkh" && (sc == scopeTop || sc == scopeSH):
+		key, err := d.parseKeyArg(fn, args)
+		if err != nil {
+			return nil, err
+		}
+		return &wpkhNode{key: key}, nil
+	case fn == "sh" && sc == scopeTop:
+		inner, err := d.parse(args, scopeSH)
+		if err != nil {
+			return nil, err
+		}
+		return &shNode{inner: inner}, nil
+	case fn == "wsh" && (sc == scopeTop || sc == scopeSH):
+		inner, err := d.parse(args, scopeWSH)
+		if err != nil {
+			return nil, err
+		}
+		return &wshNode{inner: inner}, nil
+	case (fn == "multi" || fn == "sortedmulti") && (sc == scopeSH || sc == scopeWSH):
+		return d.parseMulti(fn, args, sc)
+	case sc == scopeWSH && !descriptorOnly[fn]:
+		return d.parseMiniscript(s, ctxWSH)
+	case fn == "tr" && sc == scopeTop:
+		parts := splitArgs(args)
+		if len(parts) > 2 {
+			return nil, errors.New("tr() takes a key and an optional script tree")
+		}
+		key, err := d.addKey(parts[0], true)
+		if err != nil {
+			return nil, fmt.Errorf("tr(): %v", err)
+		}
+		n := &trNode{key: key}
+		if len(parts) == 2 {
+			if n.tree, err = d.parseTapTree(parts[1], 0); err != nil {
+				return nil, err
+			}
+		}
+		return n, nil
+	case sc == scopeSH:
+		return nil, fmt.Errorf("%s() is not supported inside sh()", fn)
+	case sc == scopeWSH:
+		return nil, fmt.Errorf("%s() is not supported inside wsh()", fn)
+	default:
+		return nil, fmt.Errorf("%s() is not supported", fn)
+	}
+}
+
+// descriptorOnly are the expressions that are not miniscript, so are
+// rejected rather than parsed as miniscript inside wsh().
+var descriptorOnly = map[string]bool{
+	"wpkh": true, "sh": true, "wsh": true, "tr": true, "combo": true, "addr": true, "raw": true, "rawtr": true,
+}
+
+func (d *Descriptor) parseKeyArg(fn, args string) (*Key, error) {
+	if len(splitArgs(args)) != 1 {
+		return nil, fmt.Errorf("%s() takes one key", fn)
+	}
+	key, err := d.addKey(args, false)
+	if err != nil {
+		return nil, fmt.Errorf("%s(): %v", fn, err)
+	}
+	return key, nil
+}
+
+// addKey parses a key and adds it to the descriptor's keys. x-only keys
+// are only valid in taproot.
+func (d *Descriptor) addKey(s string, taproot bool) (*Key, error) {
+	key, err := parseKey(s, d.params)
+	if err != nil {
+		return nil, err
+	}
+	if key.xonly && !taproot {
+		return nil, errors.New("x-only keys are only allowed in tr()")
+	}
+	d.keys = append(d.keys, key)
+	return key, nil
+}
+
+func (d *Descriptor) parseMulti(fn, args string, sc scope) (node, error) {
+	parts := splitArgs(args)
+	threshold, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("%s(): invalid threshold %q", fn, parts[0])
+	}
+	keys := parts[1:]
+	limit := maxMultisigKeys
+	if sc == scopeSH {
+		limit = maxP2SHMultisigKeys
+	}
+	if len(keys) == 0 || len(keys) > limit {
+		return nil, fmt.Errorf("%s() takes 1 to %d keys here", fn, limit)
+	}
+	if threshold < 1 || threshold > len(keys) {
+		return nil, fmt.Errorf("%s(): threshold must be between 1 and %d", fn, len(keys))
+	}
+	n := &multiNode{threshold: threshold, sorted: fn == "sortedmulti"}
+	for _, arg := range keys {
+		key, err := d.addKey(arg, false)
+		if err != nil {
+			return nil, fmt.Errorf("%s(): %v", fn, err)
+		}
+		n.keys = append(n.keys, key)
+	}
+	return n, nil
+}
+
+// splitCall splits "fn(args)" into fn and args.
+func splitCall(s string) (string, string, error) {
+	open := strings.IndexByte(s, '(')
+	if open <= 0 || !strings.HasSuffix(s, ")") {
+		return "", "", fmt.Errorf("expected a script expression, got %q", s)
+	}
+	return s[:open], s[open+1 : len(s)-1], nil
+}
+
+// splitArgs splits args at commas outside brackets.
+func splitArgs(args string) []string {
+	var parts []string
+	depth, start := 0, 0
+	for i, ch := range args {
+		switch ch {
+		case '(', '[', '{':
+			depth++
+		case ')', ']', '}':
+			depth--
+		case ',':
+			if depth == 0 {
+				parts = append(parts, args[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(parts, args[start:])
+}
+
+// String returns the descriptor with its checksum.
+func (d *Descriptor) String() string {
+	return d.text(-1)
+}
+
+func (d *Descriptor) text(branch int) string {
+	var b strings.Builder
+	d.root.format(&b, branch)
+	// Parse has checked every character
+	sum, _ := Checksum(b.String())
+	return b.String() + "#" + sum
+}
+
+// Type is the script expression without its keys, e.g. "sh(wpkh)".
+func (d *Descriptor) Type() string {
+	return d.root.name()
+}
+
+// Keys returns the descriptor's keys in the order they appear.
+func (d *Descriptor) Keys() []*Key {
+	return d.keys
+}
+
+// IsRange reports whether the descriptor derives a script per child
+// index, i.e. a key ends in /*.
+func (d *Descriptor) IsRange() bool {
+	for _, k := range d.keys {
+		if k.wildcard {
+			return true
+		}
+	}
+	return false
+}
+
+// Branches splits a multipath descriptor into one descriptor per path,
+// e.g. the receive and change descriptors of .../<0;1>/*. Other
+// descriptors are returned as is.
+func (d *Descriptor) Branches() ([]*Descriptor, error) {
+	paths := 0
+	for _, k := range d.keys {
+		paths = max(paths, len(k.multi))
+	}
+	if paths == 0 {
+		return []*Descriptor{d}, nil
+	}
+	branches := make([]*Descriptor, paths)
+	for i := range branches {
+		b, err := Parse(d.text(i), d.params)
+		if err != nil {
+			return nil, err
+		}
+		branches[i] = b
+	}
+	return branches, nil
+}
+
+// Script returns the output script at child index i.
+func (d *Descriptor) Script(i uint32) ([]byte, error) {
+	if i >= hdkeychain.HardenedKeyStart {
+		return nil, fmt.Errorf("child index %d is out of range", i)
+	}
+	return d.root.script(i, d.params)
+}
+
+// Scripts are what spending an output needs besides signatures.
+type Scripts struct {
+	// Output is the output script.
+	Output []byte
+	// Redeem is the script a P2SH output commits to, or nil.
+	Redeem []byte
+	// Witness is the script a P2WSH output commits to, or nil.
+	Witness []byte
+	// TapMerkleRoot and TapLeaves describe a taproot script tree, if
+	// any.
+	TapMerkleRoot []byte
+	TapLeaves     []TapLeaf
+}
+
+// Scripts returns the scripts at child index i.
+func (d *Descriptor) Scripts(i uint32) (*Scripts, error) {
+	out, err := d.Script(i)
+	if err != nil {
+		return nil, err
+	}
+	scripts := &Scripts{Output: out}
+	n := d.root
+	if sh, ok := n.(*shNode); ok {
+		n = sh.inner
+		if scripts.Redeem, err = n.script(i, d.params); err != nil {
+			return nil, err
+		}
+	}
+	if wsh, ok := n.(*wshNode); ok {
+		if scripts.Witness, err = wsh.inner.script(i, d.params); err != nil {
+			return nil, err
+		}
+	}
+	if tr, ok := n.(*trNode); ok && tr.tree != nil {
+		if _, scripts.TapMerkleRoot, scripts.TapLeaves, err = tr.outputKey(i); err != nil {
+			return nil, err
+		}
+	}
+	return scripts, nil
+}
+
+// InputVSize is the largest virtual size of an input spending an output
+// of the descriptor, with 72-byte signatures.
+func (d *Descriptor) InputVSize() int {
+	// Outpoint, script length and sequence
+	const base = 36 + 1 + 4
+	switch n := d.root.(type) {
+	case *pkhNode:
+		// <sig> <pubkey>
+		return base + 1 + 72 + 1 + 33
+	case *wpkhNode:
+		return base + witnessVSize(2+72+33)
+	case *trNode:
+		// One 64-byte Schnorr signature
+		size := 1 + 64
+		if n.tree != nil {
+			leaves, depths := n.tree.leaves(0)
+			for j, leaf := range leaves {
+				sat, _ := leaf.satSizes()
+				scriptLen := leaf.scriptSize()
+				controlLen := 33 + 32*depths[j]
+				size = max(size, sat+varIntSize(scriptLen)+scriptLen+varIntSize(controlLen)+controlLen)
+			}
+		}
+		return base + witnessVSize(size)
+	case *wshNode:
+		return base + witnessVSize(wshWitnessSize(n.inner))
+	case *shNode:
+		switch inner := n.inner.(type) {
+		case *wpkhNode:
+			// Push of the 22-byte witness program
+			return base + 23 + witnessVSize(2+72+33)
+		case *wshNode:
+			// Push of the 34-byte witness program
+			return base + 35 + witnessVSize(wshWitnessSize(inner.inner))
+		case *multiNode:
+			size := inner.witnessSize()
+			return base + size + 2
+		}
+	}
+	return 0
+}
+
+// wshWitnessSize is the size of the largest witness satisfying a wsh()
+// script, excluding the item count.
+func wshWitnessSize(n node) int {
+	if ms, ok := n.(*msNode); ok {
+		sat, _ := ms.satSizes()
+		scriptLen := ms.scriptSize()
+		return max(sat, 0) + varIntSize(scriptLen) + scriptLen
+	}
+	return n.(*multiNode).witnessSize()
+}
+
+// witnessVSize converts a witness of size bytes, excluding its item
+// count, to virtual bytes.
+func witnessVSize(size int) int {
+	return (1 + size + 3) / 4
+}
+
+// SpendingPath is one way to spend an output: signatures from enough keys
+// of each Signers group, with the timelocks and hash preimages it needs.
+type SpendingPath struct {
+	// Leaf is the index of the taproot script tree leaf, from the left,
+	// or -1 for the key path and other descriptors.
+	Leaf    int
+	Signers []Signers
+	// Older is the relative timelock as a BIP68 sequence value, or 0.
+	Older uint32
+	// After is the absolute timelock as a lock time, or 0.
+	After uint32
+	// Hashes are the hash locks, e.g. sha256(<hex>).
+	Hashes []string
+}
+
+// Signers requires signatures from Threshold of Keys.
+type Signers struct {
+	Threshold int
+	Keys      []*Key
+}
+
+// SpendingPaths returns the ways outputs of the descriptor can be spent.
+func (d *Descriptor) SpendingPaths() ([]SpendingPath, error) {
+	n := d.root
+	if sh, ok := n.(*shNode); ok {
+		n = sh.inner
+	}
+	if wsh, ok := n.(*wshNode); ok {
+		n = wsh.inner
+	}
+	switch n := n.(type) {
+	case *pkhNode:
+		return []SpendingPath{{Leaf: -1, Signers: []Signers{{Threshold: 1, Keys: []*Key{n.key}}}}}, nil
+	case *wpkhNode:
+		return []SpendingPath{{Leaf: -1, Signers: []Signers{{Threshold: 1, Keys: []*Key{n.key}}}}}, nil
+	case *multiNode:
+		return []SpendingPath{{Leaf: -1, Signers: []Signers{{Threshold: n.threshold, Keys: n.keys}}}}, nil
+	case *msNode:
+		return n.paths()
+	case *trNode:
+		var paths []SpendingPath
+		if n.keyPathSpendable() {
+			paths = append(paths, SpendingPath{Leaf: -1, Signers: []Signers{{Threshold: 1, Keys: []*Key{n.key}}}})
+		}
+		if n.tree == nil {
+			return paths, nil
+		}
+		leaves, _ := n.tree.leaves(0)
+		for j, leaf := range leaves {
+			leafPaths, err := leaf.paths()
+			if err != nil {
+				return nil, err
+			}
+			for _, p := range leafPaths {
+				p.Leaf = j
+				paths = append(paths, p)
+			}
+		}
+		return paths, nil
+	}
+	return nil, fmt.Errorf("%s has no spending paths", d.Type())
+}
+
+// Address returns the address at child index i.
+func (d *Descriptor) Address(i uint32) (btcutil.Address, error) {
+	script, err := d.Script(i)
+	if err != nil {
+		return nil, err
+	}
+	_, addrs, _, err := txscript.ExtractPkScriptAddrs(script, d.params)
+	if err != nil {
+		return nil, err
+	}
+	if len(addrs) != 1 {
+		return nil, errors.New("output script has no address")
+	}
+	return addrs[0], nil
+}
+
+type pkhNode struct {
+	key *Key
+}
+
+func (n *pkhNode) script(i uint32, params *chaincfg.Params) ([]byte, error) {
+	pub, err := n.key.PubKey(i)
+	if err != nil {
+		return nil, err
+	}
+	addr, err := btcutil.NewAddressPubKeyHash(btcutil.Hash160(pub.SerializeCompressed()), params)
+	if err != nil {
+		return nil, err
+	}
+	return txscript.PayToAddrScript(addr)
+}
+
+func (n *pkhNode) name() string {
+	return "pkh"
+}
+
+func (n *pkhNode) format(b *strings.Builder, branch int) {
+	b.WriteString("pkh(")
+	n.key.format(b, branch)
+	b.WriteByte(')')
+}
+
+type wpkhNode struct {
+	key *Key
+}
+
+func (n *wpkhNode) script(i uint32, params *chaincfg.Params) ([]byte, error) {
+	pub, err := n.key.PubKey(i)
+	if err != nil {
+		return nil, err
+	}
+	addr, err := btcutil.NewAddressWitnessPubKeyHash(btcutil.Hash160(pub.SerializeCompressed()), params)
+	if err != nil {
+		return nil, err
+	}
+	return txscript.PayToAddrScript(addr)
+}
+
+func (n *wpkhNode) name() string {
+	return "wpkh"
+}
+
+func (n *wpkhNode) format(b *strings.Builder, branch int) {
+	b.WriteString("wpkh(")
+	n.key.format(b, branch)
+	b.WriteByte(')')
+}
+
+type shNode struct {
+	inner node
+}
+
+func (n *shNode) script(i uint32, params *chaincfg.Params) ([]byte, error) {
+	redeem, err := n.inner.script(i, params)
+	if err != nil {
+		return nil, err
+	}
+	addr, err := btcutil.NewAddressScriptHash(redeem, params)
+	if err != nil {
+		return nil, err
+	}
+	return txscript.PayToAddrScript(addr)
+}
+
+func (n *shNode) name() string {
+	return "sh(" + n.inner.name() + ")"
+}
+
+func (n *shNode) format(b *strings.Builder, branch int) {
+	b.WriteString("sh(")
+	n.inner.format(b, branch)
+	b.WriteByte(')')
+}
+
+type wshNode struct {
+	inner node
+}
+
+func (n *wshNode) script(i uint32, params *chaincfg.Params) ([]byte, error) {
+	witness, err := n.inner.script(i, params)
+	if err != nil {
+		return nil, err
+	}
+	hash := sha256.Sum256(witness)
+	addr, err := btcutil.NewAddressWitnessScriptHash(hash[:], params)
+	if err != nil {
+		return nil, err
+	}
+	return txscript.PayToAddrScript(addr)
+}
+
+func (n *wshNode) name() string {
+	return "wsh(" + n.inner.name() + ")"
+}
+
+func (n *wshNode) format(b *strings.Builder, branch int) {
+	b.WriteString("wsh(")
+	n.inner.format(b, branch)
+	b.WriteByte(')')
+}
+
+// multiNode is a bare OP_CHECKMULTISIG script. sortedmulti orders the
+// keys as in BIP67.
+type multiNode struct {
+	threshold int
+	keys      []*Key
+	sorted    bool
+}
+
+func (n *multiNode) script(i uint32, _ *chaincfg.Params) ([]byte, error) {
+	pubs := make([][]byte, len(n.keys))
+	for j, key := range n.keys {
+		pub, err := key.PubKey(i)
+		if err != nil {
+			return nil, err
+		}
+		pubs[j] = pub.SerializeCompressed()
+	}
+	if n.sorted {
+		sort.Slice(pubs, func(a, b int) bool { return bytes.Compare(pubs[a], pubs[b]) < 0 })
+	}
+	b := txscript.NewScriptBuilder().AddInt64(int64(n.threshold))
+	for _, pub := range pubs {
+		b.AddData(pub)
+	}
+	return b.AddInt64(int64(len(pubs))).AddOp(txscript.OP_CHECKMULTISIG).Script()
+}
+
+// witnessSize is the size of the items satisfying the script: the dummy
+// element, threshold signatures and the script itself.
+func (n *multiNode) witnessSize() int {
+	scriptLen := 3 + 34*len(n.keys)
+	return 1 + n.threshold*(1+72) + varIntSize(scriptLen) + scriptLen
+}
+
+func varIntSize(n int) int {
+	if n < 0xfd {
+		return 1
+	}
+	return 3
+}
+
+func (n *multiNode) name() string {
+	if n.sorted {
+		return "sortedmulti"
+	}
+	return "multi"
+}
+
+func (n *multiNode) format(b *strings.Builder, branch int) {
+	b.WriteString(n.name() + "(" + strconv.Itoa(n.threshold))
+	for _, key := range n.keys {
+		b.WriteByte(',')
+		key.format(b, branch)
+	}
+	b.WriteByte(')')
+}
+
+// trNode is a taproot output. Without a script tree the key is tweaked
+// as in BIP86.
+type trNode struct {
+	key  *Key
+	tree *tapTree
+}
+
+func (n *trNode) script(i uint32, params *chaincfg.Params) ([]byte, error) {
+	outputKey, _, _, err := n.outputKey(i)
+	if err != nil {
+		return nil, err
+	}
+	addr, err := btcutil.NewAddressTaproot(schnorr.SerializePubKey(outputKey), params)
+	if err != nil {
+		return nil, err
+	}
+	return txscript.PayToAddrScript(addr)
+}
+
+func (n *trNode) name() string {
+	if n.tree != nil {
+		return "tr(miniscript)"
+	}
+	return "tr"
+}
+
+func (n *trNode) format(b *strings.Builder, branch int) {
+	b.WriteString("tr(")
+	n.key.format(b, branch)
+	if n.tree != nil {
+		b.WriteByte(',')
+		n.tree.format(b, branch)
+	}
+	b.WriteByte(')')
+}
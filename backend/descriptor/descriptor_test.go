@@ -0,0 +1,339 @@
+package descriptor
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/btcsuite/btcd/btcec/v2/schnorr"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/btcutil/hdkeychain"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/txscript"
+)
+
+// BIP84 account key of the "abandon ... about" mnemonic, and its master
+// key fingerprint
+const (
+	bip84ZPUB   = "zpub6rFR7y4Q2AijBEqTUquhVz398htDFrtymD9xYYfG1m4wAcvPhXNfE3EfH1r1ADqtfSdVCToUG868RvUUkgDKf31mGDtKsAYz2oz2AGutZYs"
+	bip84Master = "73c5da0a"
+)
+
+func withChecksum(t *testing.T, desc string) string {
+	t.Helper()
+	sum, err := Checksum(desc)
+	if err != nil {
+		t.Fatalf("Checksum(%q) failed: %v", desc, err)
+	}
+	return desc + "#" + sum
+}
+
+// bip84XPUB re-encodes the BIP84 zpub with the mainnet xpub version, as
+// descriptors use.
+func bip84XPUB(t *testing.T) *hdkeychain.ExtendedKey {
+	t.Helper()
+	key, err := hdkeychain.NewKeyFromString(bip84ZPUB)
+	if err != nil {
+		t.Fatalf("Failed to parse zpub: %v", err)
+	}
+	key, err = key.CloneWithVersion(chaincfg.MainNetParams.HDPublicKeyID[:])
+	if err != nil {
+		t.Fatalf("Failed to re-encode zpub: %v", err)
+	}
+	return key
+}
+
+func TestChecksum(t *testing.T) {
+	// Vectors from BIP380
+	tests := map[string]string{
+		"raw(deadbeef)": "89f8spxm",
+		"pkh([d34db33f/44'/0'/0']xpub6ERApfZwUNrhLCkDtcHTcxd75RbzS1ed54G1LkBUHQVHQKqhMkhgbmJbZRkrgZw4koxb5JaHWkY4ALHY2grBGRjaDMzQLcgJvLJuZZvRcEL/1/*)": "ml40v0wf",
+	}
+	for desc, want := range tests {
+		got, err := Checksum(desc)
+		if err != nil || got != want {
+			t.Errorf("Checksum(%q) = %s, %v, want %s", desc, got, err, want)
+		}
+	}
+	if _, err := Checksum("pkh(é)"); err == nil {
+		t.Error("Expected an error for a character outside the descriptor charset")
+	}
+}
+
+func TestParseBIP84(t *testing.T) {
+	xpub := bip84XPUB(t)
+	d, err := Parse(withChecksum(t, "wpkh(["+bip84Master+"/84h/0h/0h]"+xpub.String()+"/<0;1>/*)"), &chaincfg.MainNetParams)
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	if d.Type() != "wpkh" || !d.IsRange() {
+		t.Errorf("Type() = %s, IsRange() = %v", d.Type(), d.IsRange())
+	}
+	if _, err := d.Address(0); err == nil {
+		t.Error("Expected deriving from a multipath descriptor to fail")
+	}
+
+	branches, err := d.Branches()
+	if err != nil || len(branches) != 2 {
+		t.Fatalf("Branches() = %d, %v, want 2", len(branches), err)
+	}
+	want := []map[uint32]string{
+		{0: "bc1qcr8te4kr609gcawutmrza0j4xv80jy8z306fyu", 1: "bc1qnjg0jd8228aq7egyzacy8cys3knf9xvrerkf9g"},
+		{0: "bc1q8c6fshw2dlwun7ekn9qwf37cu2rn755upcp6el"},
+	}
+	for b, addrs := range want {
+		for i, wantAddr := range addrs {
+			addr, err := branches[b].Address(i)
+			if err != nil || addr.EncodeAddress() != wantAddr {
+				t.Errorf("branch %d address %d = %v, %v, want %s", b, i, addr, err, wantAddr)
+			}
+		}
+	}
+
+	fingerprint, path, err := branches[1].Keys()[0].Origin(5)
+	if err != nil {
+		t.Fatalf("Origin failed: %v", err)
+	}
+	wantPath := []uint32{84 + hdkeychain.HardenedKeyStart, hdkeychain.HardenedKeyStart, hdkeychain.HardenedKeyStart, 1, 5}
+	if string(fingerprint[:]) != "\x73\xc5\xda\x0a" || len(path) != len(wantPath) {
+		t.Fatalf("Origin(5) = %x, %v", fingerprint, path)
+	}
+	for i := range path {
+		if path[i] != wantPath[i] {
+			t.Fatalf("Origin(5) path = %v, want %v", path, wantPath)
+		}
+	}
+
+	// String normalizes and keeps a valid checksum
+	if !strings.Contains(branches[0].String(), "/0/*)#") {
+		t.Errorf("receive branch = %s", branches[0])
+	}
+	if again, err := Parse(d.String(), &chaincfg.MainNetParams); err != nil || again.String() != d.String() {
+		t.Errorf("round trip = %v, %v", again, err)
+	}
+}
+
+func TestParseScriptTypes(t *testing.T) {
+	xpub := bip84XPUB(t)
+	child, err := xpub.Derive(0)
+	if err == nil {
+		child, err = child.Derive(0)
+	}
+	if err != nil {
+		t.Fatalf("Failed to derive key: %v", err)
+	}
+	pubKey, err := child.ECPubKey()
+	if err != nil {
+		t.Fatalf("Failed to get public key: %v", err)
+	}
+
+	derive := func(desc string) string {
+		t.Helper()
+		d, err := Parse(withChecksum(t, desc), &chaincfg.MainNetParams)
+		if err != nil {
+			t.Fatalf("Parse(%s) failed: %v", desc, err)
+		}
+		addr, err := d.Address(0)
+		if err != nil {
+			t.Fatalf("Address failed: %v", err)
+		}
+		return addr.EncodeAddress()
+	}
+
+	if got := derive("pkh(" + xpub.String() + "/0/*)"); !strings.HasPrefix(got, "1") {
+		t.Errorf("pkh address = %s", got)
+	}
+	if got := derive("sh(wpkh(" + xpub.String() + "/0/*))"); !strings.HasPrefix(got, "3") {
+		t.Errorf("sh(wpkh) address = %s", got)
+	}
+
+	d, err := Parse(withChecksum(t, "tr("+xpub.String()+"/0/*)"), &chaincfg.MainNetParams)
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	addr, err := d.Address(0)
+	if err != nil {
+		t.Fatalf("Address failed: %v", err)
+	}
+	outputKey := schnorr.SerializePubKey(txscript.ComputeTaprootKeyNoScript(pubKey))
+	if !bytes.Equal(addr.ScriptAddress(), outputKey) {
+		t.Errorf("tr address %s does not commit to the tweaked key", addr)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	seed := bytes.Repeat([]byte{1}, hdkeychain.RecommendedSeedLen)
+	master, err := hdkeychain.NewMaster(seed, &chaincfg.RegressionNetParams)
+	if err != nil {
+		t.Fatalf("Failed to create master key: %v", err)
+	}
+	tpub, err := master.Neuter()
+	if err != nil {
+		t.Fatalf("Failed to neuter key: %v", err)
+	}
+	xpub := bip84XPUB(t).String()
+
+	tests := []struct {
+		name string
+		desc string
+		want string
+	}{
+		{"private key", "wpkh(" + master.String() + "/0/*)", "private keys are not accepted"},
+		{"wrong network", "wpkh(" + xpub + "/0/*)", "not for regtest"},
+		{"hardened step", "wpkh(" + tpub.String() + "/0h/*)", "needs the private key"},
+		{"hardened wildcard", "wpkh(" + tpub.String() + "/0/*h)", "hardened wildcards"},
+		{"wildcard not last", "wpkh(" + tpub.String() + "/*/0)", "must be the last"},
+		{"bad fingerprint", "wpkh([d34d/84h]" + tpub.String() + "/0/*)", "fingerprint"},
+		{"two multipath steps", "wpkh(" + tpub.String() + "/<0;1>/<2;3>/*)", "only one multipath"},
+		{"one-child branch", "tr(" + tpub.String() + "/0/*,{pk(" + tpub.String() + "/1/*)})", "two children"},
+		{"pkh in sh", "sh(pkh(" + tpub.String() + "/0/*))", "not supported inside sh()"},
+		{"wpkh in wsh", "wsh(wpkh(" + tpub.String() + "/0/*))", "not supported inside wsh()"},
+		{"bare multi", "sortedmulti(1," + tpub.String() + "/0/*)", "sortedmulti() is not supported"},
+		{"threshold above keys", "wsh(sortedmulti(3," + tpub.String() + "/0/*," + tpub.String() + "/1/*))", "threshold must be between 1 and 2"},
+		{"zero threshold", "wsh(multi(0," + tpub.String() + "/0/*))", "threshold must be"},
+		{"uncompressed key", "wsh(multi(1,04" + strings.Repeat("ab", 64) + "))", "must be compressed"},
+		{"unknown", "combo(" + tpub.String() + "/0/*)", "combo() is not supported"},
+		{"two keys", "wpkh(" + tpub.String() + "/0/*," + tpub.String() + "/1/*)", "takes one key"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Parse(withChecksum(t, tt.desc), &chaincfg.RegressionNetParams)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("Parse error = %v, want it to contain %q", err, tt.want)
+			}
+		})
+	}
+
+	valid := "wpkh(" + tpub.String() + "/0/*)"
+	if _, err := Parse(valid, &chaincfg.RegressionNetParams); err == nil || !strings.Contains(err.Error(), "missing checksum") {
+		t.Errorf("Parse without checksum = %v", err)
+	}
+	if _, err := Parse(valid+"#qqqqqqqq", &chaincfg.RegressionNetParams); err == nil || !strings.Contains(err.Error(), "does not match") {
+		t.Errorf("Parse with a wrong checksum = %v", err)
+	}
+}
+
+func TestSortedMultiBIP67(t *testing.T) {
+	// Vector 1 of BIP67: the keys are given out of order
+	const (
+		pub1   = "02ff12471208c14bd580709cb2358d98975247d8765f92bc25eab3b2763ed605f8"
+		pub2   = "02fe6f0a5a297eb38c391581c4413e084773ea23954d93f7753db7dc0adc188b2f"
+		redeem = "522102fe6f0a5a297eb38c391581c4413e084773ea23954d93f7753db7dc0adc188b2f2102ff12471208c14bd580709cb2358d98975247d8765f92bc25eab3b2763ed605f852ae"
+		want   = "39bgKC7RFbpoCRbtD5KEdkYKtNyhpsNa3Z"
+	)
+	for _, desc := range []string{"sh(sortedmulti(2," + pub1 + "," + pub2 + "))", "sh(sortedmulti(2," + pub2 + "," + pub1 + "))"} {
+		d, err := Parse(withChecksum(t, desc), &chaincfg.MainNetParams)
+		if err != nil {
+			t.Fatalf("Parse failed: %v", err)
+		}
+		scripts, err := d.Scripts(0)
+		if err != nil {
+			t.Fatalf("Scripts failed: %v", err)
+		}
+		if got := hex.EncodeToString(scripts.Redeem); got != redeem {
+			t.Errorf("redeem script = %s, want %s", got, redeem)
+		}
+		if addr, err := d.Address(0); err != nil || addr.EncodeAddress() != want {
+			t.Errorf("address = %v, %v, want %s", addr, err, want)
+		}
+	}
+
+	// multi keeps the given order
+	d, err := Parse(withChecksum(t, "sh(multi(2,"+pub1+","+pub2+"))"), &chaincfg.MainNetParams)
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	if addr, err := d.Address(0); err != nil || addr.EncodeAddress() == want {
+		t.Errorf("multi address = %v, %v, want it to differ from sortedmulti", addr, err)
+	}
+}
+
+// TestMultisigVectors derives the addresses in testdata/multisig.json. The
+// integration test checks the same vectors against bitcoind's
+// deriveaddresses.
+func TestMultisigVectors(t *testing.T) {
+	raw, err := os.ReadFile("testdata/multisig.json")
+	if err != nil {
+		t.Fatalf("Failed to read vectors: %v", err)
+	}
+	var vectors []struct {
+		Descriptor string `json:"descriptor"`
+		Index      uint32 `json:"index"`
+		Address    string `json:"address"`
+	}
+	if err := json.Unmarshal(raw, &vectors); err != nil {
+		t.Fatalf("Failed to parse vectors: %v", err)
+	}
+	for _, v := range vectors {
+		d, err := Parse(v.Descriptor, &chaincfg.RegressionNetParams)
+		if err != nil {
+			t.Fatalf("Parse(%s) failed: %v", v.Descriptor, err)
+		}
+		if d.String() != v.Descriptor {
+			t.Errorf("String() = %s, want %s", d, v.Descriptor)
+		}
+		if addr, err := d.Address(v.Index); err != nil || addr.EncodeAddress() != v.Address {
+			t.Errorf("%s at %d = %v, %v, want %s", v.Descriptor, v.Index, addr, err, v.Address)
+		}
+	}
+}
+
+func TestMultisigScripts(t *testing.T) {
+	raw, err := os.ReadFile("testdata/multisig.json")
+	if err != nil {
+		t.Fatalf("Failed to read vectors: %v", err)
+	}
+	var vectors []struct {
+		Descriptor string `json:"descriptor"`
+	}
+	if err := json.Unmarshal(raw, &vectors); err != nil {
+		t.Fatalf("Failed to parse vectors: %v", err)
+	}
+	var nested *Descriptor
+	for _, v := range vectors {
+		if strings.HasPrefix(v.Descriptor, "sh(wsh(") {
+			if nested, err = Parse(v.Descriptor, &chaincfg.RegressionNetParams); err != nil {
+				t.Fatalf("Parse failed: %v", err)
+			}
+			break
+		}
+	}
+	if nested == nil {
+		t.Fatal("No sh(wsh()) vector")
+	}
+	if nested.Type() != "sh(wsh(sortedmulti))" || len(nested.Keys()) != 3 {
+		t.Errorf("Type() = %s with %d keys", nested.Type(), len(nested.Keys()))
+	}
+
+	scripts, err := nested.Scripts(4)
+	if err != nil {
+		t.Fatalf("Scripts failed: %v", err)
+	}
+	// 2 <33-byte key>x3 3 CHECKMULTISIG
+	if len(scripts.Witness) != 105 || scripts.Witness[len(scripts.Witness)-1] != txscript.OP_CHECKMULTISIG {
+		t.Errorf("witness script = %x", scripts.Witness)
+	}
+	witnessHash := sha256.Sum256(scripts.Witness)
+	if !bytes.Equal(scripts.Redeem, append([]byte{txscript.OP_0, 32}, witnessHash[:]...)) {
+		t.Errorf("redeem script = %x, want the P2WSH program", scripts.Redeem)
+	}
+	if !bytes.Contains(scripts.Output, btcutil.Hash160(scripts.Redeem)) {
+		t.Errorf("output script = %x does not commit to the redeem script", scripts.Output)
+	}
+
+	// Each cosigner's path ends in the child index
+	for _, key := range nested.Keys() {
+		_, path, err := key.Origin(4)
+		if err != nil || len(path) != 6 || path[5] != 4 {
+			t.Errorf("Origin(4) = %v, %v", path, err)
+		}
+	}
+
+	if native, err := Parse(vectors[0].Descriptor, &chaincfg.RegressionNetParams); err != nil || native.InputVSize() >= nested.InputVSize() {
+		t.Errorf("wsh input vsize %d should be below sh(wsh) %d", native.InputVSize(), nested.InputVSize())
+	}
+}
@@ -0,0 +1,269 @@
+package descriptor
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcec/v2/schnorr"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/btcutil/hdkeychain"
+	"github.com/btcsuite/btcd/chaincfg"
+)
+
+var errMultipath = errors.New("multipath descriptors must be split with Branches before deriving")
+
+// Key is a public key in a descriptor: an extended key with the
+// derivation steps below it, e.g. [d34db33f/84h/1h/0h]tpub.../0/*, or a
+// hex-encoded compressed or, in taproot, x-only key.
+type Key struct {
+	// fingerprint and originPath are the key origin, if hasOrigin.
+	hasOrigin   bool
+	fingerprint [4]byte
+	originPath  []uint32
+
+	// Exactly one of xpub and pub is set.
+	xpub *hdkeychain.ExtendedKey
+	pub  *btcec.PublicKey
+	// xonly is set for a 32-byte hex key, which has an even Y coordinate.
+	xonly bool
+	// text is the key as written, so String does not re-encode it.
+	text string
+	path []uint32
+	// multi holds the alternatives of the <a;b> step at path[multiAt], or
+	// nil.
+	multi    []uint32
+	multiAt  int
+	wildcard bool
+}
+
+func parseKey(s string, params *chaincfg.Params) (*Key, error) {
+	k := &Key{}
+	if strings.HasPrefix(s, "[") {
+		end := strings.IndexByte(s, ']')
+		if end < 0 {
+			return nil, errors.New("key origin is missing ']'")
+		}
+		fingerprint, path, err := ParseOrigin(s[1:end])
+		if err != nil {
+			return nil, err
+		}
+		k.hasOrigin = true
+		k.fingerprint, k.originPath = fingerprint, path
+		s = s[end+1:]
+	}
+
+	if raw, err := hex.DecodeString(s); err == nil {
+		switch len(raw) {
+		case btcec.PubKeyBytesLenCompressed:
+			k.pub, err = btcec.ParsePubKey(raw)
+		case schnorr.PubKeyBytesLen:
+			k.xonly = true
+			k.pub, err = schnorr.ParsePubKey(raw)
+		default:
+			return nil, errors.New("hex public keys must be compressed or x-only")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid public key: %v", err)
+		}
+		k.text = s
+		return k, nil
+	}
+
+	steps := strings.Split(s, "/")
+	xpub, err := hdkeychain.NewKeyFromString(steps[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid extended public key: %v", err)
+	}
+	if xpub.IsPrivate() {
+		return nil, errors.New("private keys are not accepted")
+	}
+	if !xpub.IsForNet(params) {
+		return nil, fmt.Errorf("extended public key is not for %s", params.Name)
+	}
+	k.xpub = xpub
+	k.text = steps[0]
+
+	for i, step := range steps[1:] {
+		last := i == len(steps)-2
+		switch {
+		case step == "*":
+			if !last {
+				return nil, errors.New("wildcard must be the last derivation step")
+			}
+			k.wildcard = true
+		case step == "*'" || step == "*h":
+			return nil, errors.New("hardened wildcards need private keys")
+		case strings.HasPrefix(step, "<") && strings.HasSuffix(step, ">"):
+			if k.multi != nil {
+				return nil, errors.New("a key may have only one multipath step")
+			}
+			alts := strings.Split(step[1:len(step)-1], ";")
+			if len(alts) < 2 {
+				return nil, errors.New("a multipath step needs at least two paths")
+			}
+			seen := make(map[uint32]bool)
+			for _, alt := range alts {
+				n, err := parseUnhardened(alt)
+				if err != nil {
+					return nil, err
+				}
+				if seen[n] {
+					return nil, fmt.Errorf("duplicate path %d in multipath step", n)
+				}
+				seen[n] = true
+				k.multi = append(k.multi, n)
+			}
+			k.multiAt = len(k.path)
+			k.path = append(k.path, k.multi[0])
+		default:
+			n, err := parseUnhardened(step)
+			if err != nil {
+				return nil, err
+			}
+			k.path = append(k.path, n)
+		}
+	}
+	return k, nil
+}
+
+// ParseOrigin parses a key origin without its brackets, e.g.
+// d34db33f/84h/1h/0h, into the master key fingerprint and path.
+func ParseOrigin(s string) ([4]byte, []uint32, error) {
+	steps := strings.Split(s, "/")
+	var fingerprint [4]byte
+	fp, err := hex.DecodeString(steps[0])
+	if err != nil || len(fp) != 4 {
+		return fingerprint, nil, errors.New("key origin fingerprint must be 8 hex characters")
+	}
+	copy(fingerprint[:], fp)
+	var path []uint32
+	for _, step := range steps[1:] {
+		n, err := parseStep(step)
+		if err != nil {
+			return fingerprint, nil, err
+		}
+		path = append(path, n)
+	}
+	return fingerprint, path, nil
+}
+
+// parseStep parses a derivation step, where a trailing ' or h marks it
+// hardened.
+func parseStep(s string) (uint32, error) {
+	var offset uint32
+	if strings.HasSuffix(s, "'") || strings.HasSuffix(s, "h") {
+		s = s[:len(s)-1]
+		offset = hdkeychain.HardenedKeyStart
+	}
+	n, err := strconv.ParseUint(s, 10, 31)
+	if err != nil {
+		return 0, fmt.Errorf("invalid derivation step %q", s)
+	}
+	return uint32(n) + offset, nil
+}
+
+func parseUnhardened(s string) (uint32, error) {
+	n, err := parseStep(s)
+	if err != nil {
+		return 0, err
+	}
+	if n >= hdkeychain.HardenedKeyStart {
+		return 0, errors.New("hardened derivation below an extended public key needs the private key")
+	}
+	return n, nil
+}
+
+// PubKey derives the key at child index i, which is ignored unless the
+// key has a wildcard.
+func (k *Key) PubKey(i uint32) (*btcec.PublicKey, error) {
+	if k.pub != nil {
+		return k.pub, nil
+	}
+	if k.multi != nil {
+		return nil, errMultipath
+	}
+	ext := k.xpub
+	var err error
+	for _, step := range k.path {
+		if ext, err = ext.Derive(step); err != nil {
+			return nil, err
+		}
+	}
+	if k.wildcard {
+		if ext, err = ext.Derive(i); err != nil {
+			return nil, err
+		}
+	}
+	return ext.ECPubKey()
+}
+
+// Origin returns the master key fingerprint and full derivation path of
+// the key at child index i. Without origin info the key itself is taken
+// as the master.
+func (k *Key) Origin(i uint32) ([4]byte, []uint32, error) {
+	if k.multi != nil {
+		return [4]byte{}, nil, errMultipath
+	}
+	fingerprint := k.fingerprint
+	if !k.hasOrigin {
+		pub := k.pub
+		if pub == nil {
+			var err error
+			if pub, err = k.xpub.ECPubKey(); err != nil {
+				return [4]byte{}, nil, err
+			}
+		}
+		copy(fingerprint[:], btcutil.Hash160(pub.SerializeCompressed()))
+	}
+	path := append(append([]uint32{}, k.originPath...), k.path...)
+	if k.wildcard {
+		path = append(path, i)
+	}
+	return fingerprint, path, nil
+}
+
+// format writes the key with its multipath step resolved to branch, or
+// kept if branch is -1.
+func (k *Key) format(b *strings.Builder, branch int) {
+	if k.hasOrigin {
+		b.WriteByte('[')
+		b.WriteString(hex.EncodeToString(k.fingerprint[:]))
+		for _, step := range k.originPath {
+			b.WriteByte('/')
+			b.WriteString(FormatStep(step))
+		}
+		b.WriteByte(']')
+	}
+	b.WriteString(k.text)
+	for j, step := range k.path {
+		b.WriteByte('/')
+		if k.multi != nil && j == k.multiAt {
+			if branch >= 0 {
+				b.WriteString(FormatStep(k.multi[branch]))
+				continue
+			}
+			alts := make([]string, len(k.multi))
+			for a, n := range k.multi {
+				alts[a] = FormatStep(n)
+			}
+			b.WriteString("<" + strings.Join(alts, ";") + ">")
+			continue
+		}
+		b.WriteString(FormatStep(step))
+	}
+	if k.wildcard {
+		b.WriteString("/*")
+	}
+}
+
+// FormatStep formats a derivation step, marking hardened steps with h.
+func FormatStep(n uint32) string {
+	if n >= hdkeychain.HardenedKeyStart {
+		return strconv.FormatUint(uint64(n-hdkeychain.HardenedKeyStart), 10) + "h"
+	}
+	return strconv.FormatUint(uint64(n), 10)
+}
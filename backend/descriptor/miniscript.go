@@ -0,0 +1,892 @@
+package descriptor
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/btcsuite/btcd/btcec/v2/schnorr"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/txscript"
+)
+
+// Miniscript (https://bitcoin.sipa.be/miniscript/) is parsed inside wsh()
+// and in the leaves of tr() script trees. Expressions are type checked for
+// correctness as in the spec; malleability is not analyzed, so a policy
+// that is only satisfiable malleably is accepted.
+
+// msContext is the script version a miniscript is encoded for.
+type msContext int
+
+const (
+	ctxWSH msContext = iota
+	ctxTapscript
+)
+
+// Limits from the miniscript spec and standardness.
+const (
+	maxWSHScriptSize = 3600
+	maxMultiAKeys    = 999
+	maxSpendingPaths = 1000
+	maxTapTreeDepth  = 128
+)
+
+// seqTypeFlag marks a relative timelock in units of 512 seconds (BIP68),
+// and lockTimeThreshold separates absolute heights from times.
+const (
+	seqTypeFlag       = 1 << 22
+	lockTimeThreshold = 500000000
+)
+
+// msType is the correctness type of an expression: its basic type B, V, K
+// or W and the z, o, n, d and u properties.
+type msType struct {
+	base          byte
+	z, o, n, d, u bool
+}
+
+// msNode is a miniscript expression. Sugar such as pk(K) and t:X is
+// expanded, with alias kept so the expression is written back as given.
+type msNode struct {
+	frag  string
+	alias string
+	subs  []*msNode
+	keys  []*Key
+	// k is the threshold of thresh, multi and multi_a.
+	k int
+	// num is the argument of older and after.
+	num  uint32
+	hash []byte
+	ctx  msContext
+	typ  msType
+}
+
+// parseMiniscript parses a top-level miniscript, which must be of type B.
+func (d *Descriptor) parseMiniscript(s string, ctx msContext) (*msNode, error) {
+	n, err := d.parseMS(s, ctx)
+	if err != nil {
+		return nil, err
+	}
+	if n.typ.base != 'B' {
+		return nil, fmt.Errorf("miniscript %q is of type %c, not B", s, n.typ.base)
+	}
+	if _, err := n.paths(); err != nil {
+		return nil, err
+	}
+	// Signatures for a repeated key could be reused across its checks
+	seen := make(map[string]bool)
+	for _, k := range n.allKeys() {
+		var b strings.Builder
+		k.format(&b, -1)
+		if seen[b.String()] {
+			return nil, fmt.Errorf("miniscript repeats key %s", b.String())
+		}
+		seen[b.String()] = true
+	}
+	return n, nil
+}
+
+// allKeys returns the keys of n and its subexpressions.
+func (n *msNode) allKeys() []*Key {
+	keys := append([]*Key{}, n.keys...)
+	for _, s := range n.subs {
+		keys = append(keys, s.allKeys()...)
+	}
+	return keys
+}
+
+func (d *Descriptor) parseMS(s string, ctx msContext) (*msNode, error) {
+	// Wrappers are the letters before a colon, e.g. sv:older(1)
+	if colon := strings.IndexByte(s, ':'); colon > 0 {
+		if open := strings.IndexByte(s, '('); open < 0 || colon < open {
+			n, err := d.parseMS(s[colon+1:], ctx)
+			if err != nil {
+				return nil, err
+			}
+			for j := colon - 1; j >= 0; j-- {
+				if n, err = wrap(s[j], n, ctx); err != nil {
+					return nil, err
+				}
+			}
+			return n, nil
+		}
+	}
+
+	if s == "0" || s == "1" {
+		return newMS(&msNode{frag: s, ctx: ctx})
+	}
+	fn, args, err := splitCall(s)
+	if err != nil {
+		return nil, err
+	}
+	parts := splitArgs(args)
+	n := &msNode{frag: fn, ctx: ctx}
+	switch fn {
+	case "pk_k", "pk_h", "pk", "pkh":
+		if len(parts) != 1 {
+			return nil, fmt.Errorf("%s() takes one key", fn)
+		}
+		key, err := d.addKey(parts[0], ctx == ctxTapscript)
+		if err != nil {
+			return nil, fmt.Errorf("%s(): %v", fn, err)
+		}
+		if fn == "pk" || fn == "pkh" {
+			// pk(K) is c:pk_k(K) and pkh(K) is c:pk_h(K)
+			inner, _ := newMS(&msNode{frag: map[string]string{"pk": "pk_k", "pkh": "pk_h"}[fn], keys: []*Key{key}, ctx: ctx})
+			return newMS(&msNode{frag: "c", alias: fn, subs: []*msNode{inner}, ctx: ctx})
+		}
+		n.keys = []*Key{key}
+	case "older", "after":
+		if len(parts) != 1 {
+			return nil, fmt.Errorf("%s() takes one number", fn)
+		}
+		v, err := strconv.ParseUint(parts[0], 10, 32)
+		if err != nil || v < 1 || v >= 1<<31 {
+			return nil, fmt.Errorf("%s(): %q must be between 1 and 2^31-1", fn, parts[0])
+		}
+		n.num = uint32(v)
+	case "sha256", "hash256", "ripemd160", "hash160":
+		size := 32
+		if fn == "ripemd160" || fn == "hash160" {
+			size = 20
+		}
+		if len(parts) != 1 {
+			return nil, fmt.Errorf("%s() takes one hash", fn)
+		}
+		h, err := hex.DecodeString(parts[0])
+		if err != nil || len(h) != size {
+			return nil, fmt.Errorf("%s() takes a %d-byte hex hash", fn, size)
+		}
+		n.hash = h
+	case "andor", "and_v", "and_b", "and_n", "or_b", "or_c", "or_d", "or_i":
+		want := 2
+		if fn == "andor" {
+			want = 3
+		}
+		if len(parts) != want {
+			return nil, fmt.Errorf("%s() takes %d arguments", fn, want)
+		}
+		for _, p := range parts {
+			sub, err := d.parseMS(p, ctx)
+			if err != nil {
+				return nil, err
+			}
+			n.subs = append(n.subs, sub)
+		}
+		if fn == "and_n" {
+			// and_n(X,Y) is andor(X,Y,0)
+			zero, _ := newMS(&msNode{frag: "0", ctx: ctx})
+			n.frag, n.alias = "andor", fn
+			n.subs = append(n.subs, zero)
+		}
+	case "thresh", "multi", "multi_a":
+		if fn == "multi" && ctx == ctxTapscript {
+			return nil, errors.New("multi() is not allowed in tapscript, use multi_a()")
+		}
+		if fn == "multi_a" && ctx != ctxTapscript {
+			return nil, errors.New("multi_a() is only allowed in tapscript")
+		}
+		if len(parts) < 2 {
+			return nil, fmt.Errorf("%s() takes a threshold and at least one argument", fn)
+		}
+		k, err := strconv.Atoi(parts[0])
+		if err != nil || k < 1 || k > len(parts)-1 {
+			return nil, fmt.Errorf("%s(): threshold must be between 1 and %d", fn, len(parts)-1)
+		}
+		n.k = k
+		if fn == "thresh" {
+			for _, p := range parts[1:] {
+				sub, err := d.parseMS(p, ctx)
+				if err != nil {
+					return nil, err
+				}
+				n.subs = append(n.subs, sub)
+			}
+			break
+		}
+		limit := maxMultisigKeys
+		if fn == "multi_a" {
+			limit = maxMultiAKeys
+		}
+		if len(parts)-1 > limit {
+			return nil, fmt.Errorf("%s() takes at most %d keys", fn, limit)
+		}
+		for _, p := range parts[1:] {
+			key, err := d.addKey(p, ctx == ctxTapscript)
+			if err != nil {
+				return nil, fmt.Errorf("%s(): %v", fn, err)
+			}
+			n.keys = append(n.keys, key)
+		}
+	default:
+		return nil, fmt.Errorf("unknown miniscript fragment %s()", fn)
+	}
+	return newMS(n)
+}
+
+// wrap applies wrapper w to x.
+func wrap(w byte, x *msNode, ctx msContext) (*msNode, error) {
+	switch w {
+	case 'a', 's', 'c', 'd', 'v', 'j', 'n':
+		return newMS(&msNode{frag: string(w), subs: []*msNode{x}, ctx: ctx})
+	case 't':
+		one, _ := newMS(&msNode{frag: "1", ctx: ctx})
+		return newMS(&msNode{frag: "and_v", alias: "t", subs: []*msNode{x, one}, ctx: ctx})
+	case 'l', 'u':
+		zero, _ := newMS(&msNode{frag: "0", ctx: ctx})
+		subs := []*msNode{zero, x}
+		if w == 'u' {
+			subs = []*msNode{x, zero}
+		}
+		return newMS(&msNode{frag: "or_i", alias: string(w), subs: subs, ctx: ctx})
+	}
+	return nil, fmt.Errorf("unknown miniscript wrapper %q", w)
+}
+
+// newMS type checks n.
+func newMS(n *msNode) (*msNode, error) {
+	t, err := n.checkType()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", n.text(), err)
+	}
+	n.typ = t
+	return n, nil
+}
+
+// checkType derives the type of n from its subexpressions' types, following
+// the correctness table of the miniscript spec.
+func (n *msNode) checkType() (msType, error) {
+	var x, y, z msType
+	if len(n.subs) > 0 {
+		x = n.subs[0].typ
+	}
+	if len(n.subs) > 1 {
+		y = n.subs[1].typ
+	}
+	if len(n.subs) > 2 {
+		z = n.subs[2].typ
+	}
+	need := func(t msType, base byte, props string) error {
+		if t.base != base {
+			return fmt.Errorf("%s() needs a %c argument, got %c", n.frag, base, t.base)
+		}
+		for _, p := range props {
+			ok := map[rune]bool{'z': t.z, 'o': t.o, 'n': t.n, 'd': t.d, 'u': t.u}[p]
+			if !ok {
+				return fmt.Errorf("%s() needs an argument with property %c", n.frag, p)
+			}
+		}
+		return nil
+	}
+
+	switch n.frag {
+	case "0":
+		return msType{base: 'B', z: true, u: true, d: true}, nil
+	case "1":
+		return msType{base: 'B', z: true, u: true}, nil
+	case "pk_k":
+		return msType{base: 'K', o: true, n: true, d: true, u: true}, nil
+	case "pk_h":
+		return msType{base: 'K', n: true, d: true, u: true}, nil
+	case "older", "after":
+		return msType{base: 'B', z: true}, nil
+	case "sha256", "hash256", "ripemd160", "hash160":
+		return msType{base: 'B', o: true, n: true, d: true, u: true}, nil
+	case "multi":
+		return msType{base: 'B', n: true, d: true, u: true}, nil
+	case "multi_a":
+		return msType{base: 'B', d: true, u: true}, nil
+	case "andor":
+		if err := need(x, 'B', "du"); err != nil {
+			return msType{}, err
+		}
+		if y.base != z.base || y.base == 'W' {
+			return msType{}, errors.New("andor() needs its second and third arguments both B, K or V")
+		}
+		return msType{
+			base: y.base,
+			z:    x.z && y.z && z.z,
+			o:    (x.z && y.o && z.o) || (x.o && y.z && z.z),
+			u:    y.u && z.u,
+			d:    z.d,
+		}, nil
+	case "and_v":
+		if err := need(x, 'V', ""); err != nil {
+			return msType{}, err
+		}
+		if y.base == 'W' {
+			return msType{}, errors.New("and_v() needs a B, K or V second argument")
+		}
+		return msType{
+			base: y.base,
+			z:    x.z && y.z,
+			o:    (x.z && y.o) || (x.o && y.z),
+			n:    x.n || (x.z && y.n),
+			u:    y.u,
+		}, nil
+	case "and_b":
+		if err := need(x, 'B', ""); err != nil {
+			return msType{}, err
+		}
+		if err := need(y, 'W', ""); err != nil {
+			return msType{}, err
+		}
+		return msType{
+			base: 'B',
+			z:    x.z && y.z,
+			o:    (x.z && y.o) || (x.o && y.z),
+			n:    x.n || (x.z && y.n),
+			d:    x.d && y.d,
+			u:    true,
+		}, nil
+	case "or_b":
+		if err := need(x, 'B', "d"); err != nil {
+			return msType{}, err
+		}
+		if err := need(y, 'W', "d"); err != nil {
+			return msType{}, err
+		}
+		return msType{
+			base: 'B',
+			z:    x.z && y.z,
+			o:    (x.z && y.o) || (x.o && y.z),
+			d:    true,
+			u:    true,
+		}, nil
+	case "or_c":
+		if err := need(x, 'B', "du"); err != nil {
+			return msType{}, err
+		}
+		if err := need(y, 'V', ""); err != nil {
+			return msType{}, err
+		}
+		return msType{base: 'V', z: x.z && y.z, o: x.o && y.z}, nil
+	case "or_d":
+		if err := need(x, 'B', "du"); err != nil {
+			return msType{}, err
+		}
+		if err := need(y, 'B', ""); err != nil {
+			return msType{}, err
+		}
+		return msType{base: 'B', z: x.z && y.z, o: x.o && y.z, d: y.d, u: y.u}, nil
+	case "or_i":
+		if x.base != y.base || x.base == 'W' {
+			return msType{}, errors.New("or_i() needs two B, K or V arguments")
+		}
+		return msType{base: x.base, o: x.z && y.z, u: x.u && y.u, d: x.d || y.d}, nil
+	case "thresh":
+		t := msType{base: 'B', z: true, d: true, u: true}
+		ones := 0
+		for i, sub := range n.subs {
+			base := byte('W')
+			if i == 0 {
+				base = 'B'
+			}
+			if err := need(sub.typ, base, "du"); err != nil {
+				return msType{}, err
+			}
+			if !sub.typ.z {
+				t.z = false
+				if sub.typ.o {
+					ones++
+				} else {
+					ones = 2
+				}
+			}
+		}
+		t.o = ones == 1
+		return t, nil
+	case "a":
+		if err := need(x, 'B', ""); err != nil {
+			return msType{}, err
+		}
+		return msType{base: 'W', d: x.d, u: x.u}, nil
+	case "s":
+		if err := need(x, 'B', "o"); err != nil {
+			return msType{}, err
+		}
+		return msType{base: 'W', d: x.d, u: x.u}, nil
+	case "c":
+		if err := need(x, 'K', ""); err != nil {
+			return msType{}, err
+		}
+		return msType{base: 'B', o: x.o, n: x.n, d: x.d, u: true}, nil
+	case "d":
+		if err := need(x, 'V', "z"); err != nil {
+			return msType{}, err
+		}
+		// Segwit v0 does not require minimal IF arguments
+		return msType{base: 'B', o: true, n: true, d: true, u: n.ctx == ctxTapscript}, nil
+	case "v":
+		if err := need(x, 'B', ""); err != nil {
+			return msType{}, err
+		}
+		return msType{base: 'V', z: x.z, o: x.o, n: x.n}, nil
+	case "j":
+		if err := need(x, 'B', "n"); err != nil {
+			return msType{}, err
+		}
+		return msType{base: 'B', o: x.o, n: true, d: true, u: x.u}, nil
+	case "n":
+		if err := need(x, 'B', ""); err != nil {
+			return msType{}, err
+		}
+		return msType{base: 'B', z: x.z, o: x.o, n: x.n, d: x.d, u: true}, nil
+	}
+	return msType{}, fmt.Errorf("unknown fragment %s", n.frag)
+}
+
+// msOp is an element of a compiled script: an opcode, or a push of data
+// or of a number.
+type msOp struct {
+	code byte
+	data []byte
+	num  int64
+	kind int
+}
+
+const (
+	opCode = iota
+	opData
+	opNum
+)
+
+func code(c byte) msOp   { return msOp{code: c} }
+func data(b []byte) msOp { return msOp{data: b, kind: opData} }
+func num(n int64) msOp   { return msOp{num: n, kind: opNum} }
+
+// script encodes the miniscript with keys derived at child index i.
+func (n *msNode) script(i uint32, _ *chaincfg.Params) ([]byte, error) {
+	script, err := n.encode(func(k *Key) ([]byte, error) {
+		pub, err := k.PubKey(i)
+		if err != nil {
+			return nil, err
+		}
+		if n.ctx == ctxTapscript {
+			return schnorr.SerializePubKey(pub), nil
+		}
+		return pub.SerializeCompressed(), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if n.ctx == ctxWSH && len(script) > maxWSHScriptSize {
+		return nil, fmt.Errorf("witness script of %d bytes exceeds %d", len(script), maxWSHScriptSize)
+	}
+	return script, nil
+}
+
+// scriptSize is the length of the script, which does not depend on the
+// keys.
+func (n *msNode) scriptSize() int {
+	size := 33
+	if n.ctx == ctxTapscript {
+		size = 32
+	}
+	script, _ := n.encode(func(*Key) ([]byte, error) { return make([]byte, size), nil })
+	return len(script)
+}
+
+// encode compiles the miniscript with keys serialized by key.
+func (n *msNode) encode(key func(*Key) ([]byte, error)) ([]byte, error) {
+	ops, err := n.compile(key)
+	if err != nil {
+		return nil, err
+	}
+	b := txscript.NewScriptBuilder()
+	for _, op := range ops {
+		switch op.kind {
+		case opData:
+			b.AddData(op.data)
+		case opNum:
+			b.AddInt64(op.num)
+		default:
+			b.AddOp(op.code)
+		}
+	}
+	return b.Script()
+}
+
+func (n *msNode) compile(keyBytes func(*Key) ([]byte, error)) ([]msOp, error) {
+	var subs [][]msOp
+	for _, s := range n.subs {
+		ops, err := s.compile(keyBytes)
+		if err != nil {
+			return nil, err
+		}
+		subs = append(subs, ops)
+	}
+	cat := func(parts ...[]msOp) []msOp {
+		var out []msOp
+		for _, p := range parts {
+			out = append(out, p...)
+		}
+		return out
+	}
+	ops := func(o ...msOp) []msOp { return o }
+
+	switch n.frag {
+	case "0":
+		return ops(code(txscript.OP_0)), nil
+	case "1":
+		return ops(code(txscript.OP_1)), nil
+	case "pk_k":
+		key, err := keyBytes(n.keys[0])
+		if err != nil {
+			return nil, err
+		}
+		return ops(data(key)), nil
+	case "pk_h":
+		key, err := keyBytes(n.keys[0])
+		if err != nil {
+			return nil, err
+		}
+		return ops(code(txscript.OP_DUP), code(txscript.OP_HASH160), data(btcutil.Hash160(key)), code(txscript.OP_EQUALVERIFY)), nil
+	case "older":
+		return ops(num(int64(n.num)), code(txscript.OP_CHECKSEQUENCEVERIFY)), nil
+	case "after":
+		return ops(num(int64(n.num)), code(txscript.OP_CHECKLOCKTIMEVERIFY)), nil
+	case "sha256", "hash256", "ripemd160", "hash160":
+		hashOp := map[string]byte{
+			"sha256":    txscript.OP_SHA256,
+			"hash256":   txscript.OP_HASH256,
+			"ripemd160": txscript.OP_RIPEMD160,
+			"hash160":   txscript.OP_HASH160,
+		}[n.frag]
+		return ops(code(txscript.OP_SIZE), num(32), code(txscript.OP_EQUALVERIFY), code(hashOp), data(n.hash), code(txscript.OP_EQUAL)), nil
+	case "andor":
+		return cat(subs[0], ops(code(txscript.OP_NOTIF)), subs[2], ops(code(txscript.OP_ELSE)), subs[1], ops(code(txscript.OP_ENDIF))), nil
+	case "and_v":
+		return cat(subs[0], subs[1]), nil
+	case "and_b":
+		return cat(subs[0], subs[1], ops(code(txscript.OP_BOOLAND))), nil
+	case "or_b":
+		return cat(subs[0], subs[1], ops(code(txscript.OP_BOOLOR))), nil
+	case "or_c":
+		return cat(subs[0], ops(code(txscript.OP_NOTIF)), subs[1], ops(code(txscript.OP_ENDIF))), nil
+	case "or_d":
+		return cat(subs[0], ops(code(txscript.OP_IFDUP), code(txscript.OP_NOTIF)), subs[1], ops(code(txscript.OP_ENDIF))), nil
+	case "or_i":
+		return cat(ops(code(txscript.OP_IF)), subs[0], ops(code(txscript.OP_ELSE)), subs[1], ops(code(txscript.OP_ENDIF))), nil
+	case "thresh":
+		out := subs[0]
+		for _, s := range subs[1:] {
+			out = cat(out, s, ops(code(txscript.OP_ADD)))
+		}
+		return cat(out, ops(num(int64(n.k)), code(txscript.OP_EQUAL))), nil
+	case "multi":
+		out := ops(num(int64(n.k)))
+		for _, k := range n.keys {
+			key, err := keyBytes(k)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, data(key))
+		}
+		return append(out, num(int64(len(n.keys))), code(txscript.OP_CHECKMULTISIG)), nil
+	case "multi_a":
+		var out []msOp
+		for j, k := range n.keys {
+			key, err := keyBytes(k)
+			if err != nil {
+				return nil, err
+			}
+			op := code(txscript.OP_CHECKSIGADD)
+			if j == 0 {
+				op = code(txscript.OP_CHECKSIG)
+			}
+			out = append(out, data(key), op)
+		}
+		return append(out, num(int64(n.k)), code(txscript.OP_NUMEQUAL)), nil
+	case "a":
+		return cat(ops(code(txscript.OP_TOALTSTACK)), subs[0], ops(code(txscript.OP_FROMALTSTACK))), nil
+	case "s":
+		return cat(ops(code(txscript.OP_SWAP)), subs[0]), nil
+	case "c":
+		return cat(subs[0], ops(code(txscript.OP_CHECKSIG))), nil
+	case "d":
+		return cat(ops(code(txscript.OP_DUP), code(txscript.OP_IF)), subs[0], ops(code(txscript.OP_ENDIF))), nil
+	case "v":
+		out := append([]msOp{}, subs[0]...)
+		// Fold into the VERIFY form of a final EQUAL, CHECKSIG,
+		// CHECKMULTISIG or NUMEQUAL
+		last := &out[len(out)-1]
+		if last.kind == opCode {
+			switch last.code {
+			case txscript.OP_EQUAL, txscript.OP_CHECKSIG, txscript.OP_CHECKMULTISIG, txscript.OP_NUMEQUAL:
+				last.code++
+				return out, nil
+			}
+		}
+		return append(out, code(txscript.OP_VERIFY)), nil
+	case "j":
+		return cat(ops(code(txscript.OP_SIZE), code(txscript.OP_0NOTEQUAL), code(txscript.OP_IF)), subs[0], ops(code(txscript.OP_ENDIF))), nil
+	case "n":
+		return cat(subs[0], ops(code(txscript.OP_0NOTEQUAL))), nil
+	}
+	return nil, fmt.Errorf("unknown fragment %s", n.frag)
+}
+
+func (n *msNode) name() string {
+	return "miniscript"
+}
+
+// wrapper returns the wrapper letter n was written as and the expression
+// it wraps, or "" if n is not written as a wrapper.
+func (n *msNode) wrapper() (string, *msNode) {
+	switch {
+	case n.alias == "t" || n.alias == "u":
+		return n.alias, n.subs[0]
+	case n.alias == "l":
+		return n.alias, n.subs[1]
+	case n.alias == "" && len(n.frag) == 1 && strings.Contains("ascdvjn", n.frag):
+		return n.frag, n.subs[0]
+	}
+	return "", nil
+}
+
+func (n *msNode) format(b *strings.Builder, branch int) {
+	if w, inner := n.wrapper(); w != "" {
+		b.WriteString(w)
+		if iw, _ := inner.wrapper(); iw == "" {
+			b.WriteByte(':')
+		}
+		inner.format(b, branch)
+		return
+	}
+
+	switch {
+	case n.alias == "pk" || n.alias == "pkh":
+		b.WriteString(n.alias + "(")
+		n.subs[0].keys[0].format(b, branch)
+		b.WriteByte(')')
+		return
+	case n.alias == "and_n":
+		b.WriteString("and_n(")
+		n.subs[0].format(b, branch)
+		b.WriteByte(',')
+		n.subs[1].format(b, branch)
+		b.WriteByte(')')
+		return
+	}
+
+	switch n.frag {
+	case "0", "1":
+		b.WriteString(n.frag)
+		return
+	case "older", "after":
+		b.WriteString(n.frag + "(" + strconv.FormatUint(uint64(n.num), 10) + ")")
+		return
+	case "sha256", "hash256", "ripemd160", "hash160":
+		b.WriteString(n.frag + "(" + hex.EncodeToString(n.hash) + ")")
+		return
+	}
+	b.WriteString(n.frag + "(")
+	sep := ""
+	if n.k > 0 {
+		b.WriteString(strconv.Itoa(n.k))
+		sep = ","
+	}
+	for _, k := range n.keys {
+		b.WriteString(sep)
+		k.format(b, branch)
+		sep = ","
+	}
+	for _, s := range n.subs {
+		b.WriteString(sep)
+		s.format(b, branch)
+		sep = ","
+	}
+	b.WriteByte(')')
+}
+
+// text is the expression as written, for error messages.
+func (n *msNode) text() string {
+	var b strings.Builder
+	n.format(&b, -1)
+	return b.String()
+}
+
+// impossible marks a satisfaction or dissatisfaction that does not exist.
+const impossible = -1
+
+// satSizes returns upper bounds on the serialized size of the witness
+// items satisfying and dissatisfying n, length prefixes included.
+func (n *msNode) satSizes() (sat, dissat int) {
+	sig, pub := 1+72, 1+33
+	if n.ctx == ctxTapscript {
+		sig, pub = 1+64, 1+32
+	}
+	add := func(a ...int) int {
+		total := 0
+		for _, v := range a {
+			if v == impossible {
+				return impossible
+			}
+			total += v
+		}
+		return total
+	}
+	var sats, dissats []int
+	for _, s := range n.subs {
+		a, b := s.satSizes()
+		sats, dissats = append(sats, a), append(dissats, b)
+	}
+
+	switch n.frag {
+	case "0":
+		return impossible, 0
+	case "1":
+		return 0, impossible
+	case "pk_k":
+		return sig, 1
+	case "pk_h":
+		return sig + pub, 1 + pub
+	case "older", "after":
+		return 0, impossible
+	case "sha256", "hash256", "ripemd160", "hash160":
+		return 1 + 32, 1 + 32
+	case "andor":
+		return max(add(sats[0], sats[1]), add(dissats[0], sats[2])), add(dissats[0], dissats[2])
+	case "and_v":
+		return add(sats[0], sats[1]), impossible
+	case "and_b":
+		return add(sats[0], sats[1]), add(dissats[0], dissats[1])
+	case "or_b":
+		return max(add(sats[0], dissats[1]), add(dissats[0], sats[1])), add(dissats[0], dissats[1])
+	case "or_c":
+		return max(sats[0], add(dissats[0], sats[1])), impossible
+	case "or_d":
+		return max(sats[0], add(dissats[0], sats[1])), add(dissats[0], dissats[1])
+	case "or_i":
+		// A 1 or empty item selects the branch
+		return max(add(sats[0], 2), add(sats[1], 1)), max(add(dissats[0], 2), add(dissats[1], 1))
+	case "thresh":
+		sat, dissat := 0, 0
+		for j := range n.subs {
+			sat = add(sat, max(sats[j], dissats[j]))
+			dissat = add(dissat, dissats[j])
+		}
+		return sat, dissat
+	case "multi":
+		// Plus the dummy element
+		return 1 + n.k*sig, 1 + n.k
+	case "multi_a":
+		return n.k*sig + len(n.keys) - n.k, len(n.keys)
+	case "a", "s", "c", "n":
+		return sats[0], dissats[0]
+	case "d":
+		return add(sats[0], 2), 1
+	case "v":
+		return sats[0], impossible
+	case "j":
+		return sats[0], 1
+	}
+	return impossible, impossible
+}
+
+// paths returns the ways to satisfy n. Dissatisfying a subexpression
+// never needs signatures, preimages or timelocks, so only satisfactions
+// contribute.
+func (n *msNode) paths() ([]SpendingPath, error) {
+	var subs [][]SpendingPath
+	for _, s := range n.subs {
+		p, err := s.paths()
+		if err != nil {
+			return nil, err
+		}
+		subs = append(subs, p)
+	}
+
+	switch n.frag {
+	case "0":
+		return nil, nil
+	case "1":
+		return []SpendingPath{{Leaf: -1}}, nil
+	case "pk_k", "pk_h":
+		return []SpendingPath{{Leaf: -1, Signers: []Signers{{Threshold: 1, Keys: n.keys}}}}, nil
+	case "multi", "multi_a":
+		return []SpendingPath{{Leaf: -1, Signers: []Signers{{Threshold: n.k, Keys: n.keys}}}}, nil
+	case "older":
+		return []SpendingPath{{Leaf: -1, Older: n.num}}, nil
+	case "after":
+		return []SpendingPath{{Leaf: -1, After: n.num}}, nil
+	case "sha256", "hash256", "ripemd160", "hash160":
+		return []SpendingPath{{Leaf: -1, Hashes: []string{n.frag + "(" + hex.EncodeToString(n.hash) + ")"}}}, nil
+	case "andor":
+		both, err := andPaths(subs[0], subs[1])
+		if err != nil {
+			return nil, err
+		}
+		return orPaths(both, subs[2])
+	case "and_v", "and_b":
+		return andPaths(subs[0], subs[1])
+	case "or_b", "or_c", "or_d", "or_i":
+		return orPaths(subs[0], subs[1])
+	case "thresh":
+		return threshPaths(n.k, subs)
+	default:
+		// Wrappers
+		return subs[0], nil
+	}
+}
+
+func orPaths(a, b []SpendingPath) ([]SpendingPath, error) {
+	if len(a)+len(b) > maxSpendingPaths {
+		return nil, fmt.Errorf("miniscript has more than %d spending paths", maxSpendingPaths)
+	}
+	return append(append([]SpendingPath{}, a...), b...), nil
+}
+
+// andPaths combines every path of a with every path of b.
+func andPaths(a, b []SpendingPath) ([]SpendingPath, error) {
+	if len(a)*len(b) > maxSpendingPaths {
+		return nil, fmt.Errorf("miniscript has more than %d spending paths", maxSpendingPaths)
+	}
+	var out []SpendingPath
+	for _, p := range a {
+		for _, q := range b {
+			if p.Older != 0 && q.Older != 0 && p.Older&seqTypeFlag != q.Older&seqTypeFlag {
+				return nil, errors.New("a spending path mixes height and time based relative timelocks")
+			}
+			if p.After != 0 && q.After != 0 && (p.After < lockTimeThreshold) != (q.After < lockTimeThreshold) {
+				return nil, errors.New("a spending path mixes height and time based absolute timelocks")
+			}
+			out = append(out, SpendingPath{
+				Leaf:    -1,
+				Signers: append(append([]Signers{}, p.Signers...), q.Signers...),
+				Older:   max(p.Older, q.Older),
+				After:   max(p.After, q.After),
+				Hashes:  append(append([]string{}, p.Hashes...), q.Hashes...),
+			})
+		}
+	}
+	return out, nil
+}
+
+// threshPaths returns the paths satisfying k of the subexpressions.
+func threshPaths(k int, subs [][]SpendingPath) ([]SpendingPath, error) {
+	if k == 0 {
+		return []SpendingPath{{Leaf: -1}}, nil
+	}
+	if len(subs) < k {
+		return nil, nil
+	}
+	// Either the first is satisfied, or k of the rest are
+	rest, err := threshPaths(k-1, subs[1:])
+	if err != nil {
+		return nil, err
+	}
+	with, err := andPaths(subs[0], rest)
+	if err != nil {
+		return nil, err
+	}
+	without, err := threshPaths(k, subs[1:])
+	if err != nil {
+		return nil, err
+	}
+	return orPaths(with, without)
+}
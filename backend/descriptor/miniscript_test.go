@@ -0,0 +1,240 @@
+package descriptor
+
+import (
+	"bytes"
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcec/v2/schnorr"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// testKeys returns n deterministic private keys and their compressed
+// public keys in hex.
+func testKeys(n int) ([]*btcec.PrivateKey, []string) {
+	privs := make([]*btcec.PrivateKey, n)
+	pubs := make([]string, n)
+	for i := range privs {
+		privs[i], _ = btcec.PrivKeyFromBytes(bytes.Repeat([]byte{byte(i + 1)}, 32))
+		pubs[i] = hex.EncodeToString(privs[i].PubKey().SerializeCompressed())
+	}
+	return privs, pubs
+}
+
+func TestMiniscriptScripts(t *testing.T) {
+	privs, keys := testKeys(3)
+	a, b, c := privs[0].PubKey().SerializeCompressed(), privs[1].PubKey().SerializeCompressed(), privs[2].PubKey().SerializeCompressed()
+	hash := bytes.Repeat([]byte{0xab}, 32)
+
+	tests := []struct {
+		ms   string
+		want *txscript.ScriptBuilder
+	}{
+		{"pk(" + keys[0] + ")", txscript.NewScriptBuilder().AddData(a).AddOp(txscript.OP_CHECKSIG)},
+		{"pkh(" + keys[0] + ")", txscript.NewScriptBuilder().AddOp(txscript.OP_DUP).AddOp(txscript.OP_HASH160).
+			AddData(btcutil.Hash160(a)).AddOp(txscript.OP_EQUALVERIFY).AddOp(txscript.OP_CHECKSIG)},
+		{"and_v(v:pk(" + keys[0] + "),older(144))", txscript.NewScriptBuilder().AddData(a).AddOp(txscript.OP_CHECKSIGVERIFY).
+			AddInt64(144).AddOp(txscript.OP_CHECKSEQUENCEVERIFY)},
+		{"or_d(pk(" + keys[0] + "),and_v(v:pkh(" + keys[1] + "),after(800000)))", txscript.NewScriptBuilder().
+			AddData(a).AddOp(txscript.OP_CHECKSIG).AddOp(txscript.OP_IFDUP).AddOp(txscript.OP_NOTIF).
+			AddOp(txscript.OP_DUP).AddOp(txscript.OP_HASH160).AddData(btcutil.Hash160(b)).AddOp(txscript.OP_EQUALVERIFY).
+			AddOp(txscript.OP_CHECKSIGVERIFY).AddInt64(800000).AddOp(txscript.OP_CHECKLOCKTIMEVERIFY).AddOp(txscript.OP_ENDIF)},
+		{"thresh(2,pk(" + keys[0] + "),s:pk(" + keys[1] + "),sln:older(10))", txscript.NewScriptBuilder().
+			AddData(a).AddOp(txscript.OP_CHECKSIG).
+			AddOp(txscript.OP_SWAP).AddData(b).AddOp(txscript.OP_CHECKSIG).AddOp(txscript.OP_ADD).
+			AddOp(txscript.OP_SWAP).AddOp(txscript.OP_IF).AddOp(txscript.OP_0).AddOp(txscript.OP_ELSE).
+			AddInt64(10).AddOp(txscript.OP_CHECKSEQUENCEVERIFY).AddOp(txscript.OP_0NOTEQUAL).AddOp(txscript.OP_ENDIF).
+			AddOp(txscript.OP_ADD).AddInt64(2).AddOp(txscript.OP_EQUAL)},
+		{"andor(pk(" + keys[0] + "),sha256(" + hex.EncodeToString(hash) + "),and_n(pk(" + keys[1] + "),pk(" + keys[2] + ")))", txscript.NewScriptBuilder().
+			AddData(a).AddOp(txscript.OP_CHECKSIG).AddOp(txscript.OP_NOTIF).
+			AddData(b).AddOp(txscript.OP_CHECKSIG).AddOp(txscript.OP_NOTIF).AddOp(txscript.OP_0).AddOp(txscript.OP_ELSE).
+			AddData(c).AddOp(txscript.OP_CHECKSIG).AddOp(txscript.OP_ENDIF).
+			AddOp(txscript.OP_ELSE).
+			AddOp(txscript.OP_SIZE).AddInt64(32).AddOp(txscript.OP_EQUALVERIFY).AddOp(txscript.OP_SHA256).AddData(hash).AddOp(txscript.OP_EQUAL).
+			AddOp(txscript.OP_ENDIF)},
+		{"multi(2," + strings.Join(keys, ",") + ")", txscript.NewScriptBuilder().AddInt64(2).AddData(a).AddData(b).AddData(c).
+			AddInt64(3).AddOp(txscript.OP_CHECKMULTISIG)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.ms, func(t *testing.T) {
+			desc, err := Parse(withChecksum(t, "wsh("+tt.ms+")"), &chaincfg.RegressionNetParams)
+			if err != nil {
+				t.Fatalf("Parse failed: %v", err)
+			}
+			scripts, err := desc.Scripts(0)
+			if err != nil {
+				t.Fatalf("Scripts failed: %v", err)
+			}
+			want, _ := tt.want.Script()
+			if !bytes.Equal(scripts.Witness, want) {
+				t.Errorf("witness script = %x, want %x", scripts.Witness, want)
+			}
+			if got := desc.String(); got != withChecksum(t, "wsh("+tt.ms+")") {
+				t.Errorf("String() = %s", got)
+			}
+		})
+	}
+}
+
+func TestMiniscriptErrors(t *testing.T) {
+	_, keys := testKeys(2)
+	a, b := keys[0], keys[1]
+	xonly := a[2:]
+
+	tests := []struct {
+		name string
+		desc string
+		want string
+	}{
+		{"not B", "wsh(pk_k(" + a + "))", "not B"},
+		{"and_v without V", "wsh(and_v(pk(" + a + "),pk(" + b + ")))", "needs a V argument"},
+		{"or_b without W", "wsh(or_b(pk(" + a + "),pk(" + b + ")))", "needs a W argument"},
+		{"s: without o", "wsh(and_b(pk(" + a + "),s:older(1)))", "property o"},
+		{"mixed relative timelocks", "wsh(and_v(v:older(10),older(4194305)))", "mixes height and time"},
+		{"mixed absolute timelocks", "wsh(and_v(v:after(10),after(500000001)))", "mixes height and time"},
+		{"zero older", "wsh(older(0))", "between 1 and"},
+		{"unknown wrapper", "wsh(x:pk(" + a + "))", "unknown miniscript wrapper"},
+		{"unknown fragment", "wsh(foo(" + a + "))", "unknown miniscript fragment"},
+		{"repeated key", "wsh(or_d(pk(" + a + "),pkh(" + a + ")))", "repeats key"},
+		{"multi_a in wsh", "wsh(multi_a(1," + a + "))", "only allowed in tapscript"},
+		{"multi in tapscript", "tr(" + xonly + ",multi(1," + a + "))", "not allowed in tapscript"},
+		{"x-only in wsh", "wsh(pk(" + xonly + "))", "only allowed in tr()"},
+		{"short hash", "wsh(sha256(abcd))", "32-byte hex hash"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Parse(withChecksum(t, tt.desc), &chaincfg.RegressionNetParams)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("Parse error = %v, want it to contain %q", err, tt.want)
+			}
+		})
+	}
+}
+
+// spend checks that witness spends the output script in a version 2
+// transaction with the given sequence and lock time.
+func spend(t *testing.T, pkScript []byte, sequence, lockTime uint32, witness func(tx *wire.MsgTx, hashes *txscript.TxSigHashes) wire.TxWitness) {
+	t.Helper()
+	const amount = 100000
+	tx := wire.NewMsgTx(2)
+	tx.LockTime = lockTime
+	tx.AddTxIn(&wire.TxIn{PreviousOutPoint: wire.OutPoint{Hash: chainhash.Hash{1}}, Sequence: sequence})
+	tx.AddTxOut(wire.NewTxOut(amount-1000, []byte{txscript.OP_TRUE}))
+	fetcher := txscript.NewCannedPrevOutputFetcher(pkScript, amount)
+	hashes := txscript.NewTxSigHashes(tx, fetcher)
+	tx.TxIn[0].Witness = witness(tx, hashes)
+
+	engine, err := txscript.NewEngine(pkScript, tx, 0, txscript.StandardVerifyFlags, nil, hashes, amount, fetcher)
+	if err != nil {
+		t.Fatalf("NewEngine failed: %v", err)
+	}
+	if err := engine.Execute(); err != nil {
+		t.Errorf("witness does not satisfy the script: %v", err)
+	}
+}
+
+func TestMiniscriptRecoveryPath(t *testing.T) {
+	privs, keys := testKeys(4)
+	// 2-of-3 now, or the recovery key after 52560 blocks
+	ms := "or_d(multi(2," + strings.Join(keys[:3], ",") + "),and_v(v:pk(" + keys[3] + "),older(52560)))"
+	desc, err := Parse(withChecksum(t, "wsh("+ms+")"), &chaincfg.RegressionNetParams)
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	scripts, err := desc.Scripts(0)
+	if err != nil {
+		t.Fatalf("Scripts failed: %v", err)
+	}
+
+	sign := func(tx *wire.MsgTx, hashes *txscript.TxSigHashes, key *btcec.PrivateKey) []byte {
+		sig, err := txscript.RawTxInWitnessSignature(tx, hashes, 0, 100000, scripts.Witness, txscript.SigHashAll, key)
+		if err != nil {
+			t.Fatalf("Signing failed: %v", err)
+		}
+		return sig
+	}
+	// Recovery: the multisig is dissatisfied with empty signatures
+	var recovery wire.TxWitness
+	spend(t, scripts.Output, 52560, 0, func(tx *wire.MsgTx, hashes *txscript.TxSigHashes) wire.TxWitness {
+		recovery = wire.TxWitness{sign(tx, hashes, privs[3]), nil, nil, nil, scripts.Witness}
+		return recovery
+	})
+	spend(t, scripts.Output, 0, 0, func(tx *wire.MsgTx, hashes *txscript.TxSigHashes) wire.TxWitness {
+		return wire.TxWitness{nil, sign(tx, hashes, privs[0]), sign(tx, hashes, privs[2]), scripts.Witness}
+	})
+
+	if got, max := recovery.SerializeSize(), 4*(desc.InputVSize()-41); got > max {
+		t.Errorf("recovery witness is %d bytes, above the estimate of %d", got, max)
+	}
+
+	paths, err := desc.SpendingPaths()
+	if err != nil {
+		t.Fatalf("SpendingPaths failed: %v", err)
+	}
+	if len(paths) != 2 {
+		t.Fatalf("got %d spending paths, want 2", len(paths))
+	}
+	if p := paths[0]; p.Older != 0 || len(p.Signers) != 1 || p.Signers[0].Threshold != 2 || len(p.Signers[0].Keys) != 3 {
+		t.Errorf("multisig path = %+v", p)
+	}
+	if p := paths[1]; p.Older != 52560 || len(p.Signers) != 1 || p.Signers[0].Keys[0] != desc.Keys()[3] {
+		t.Errorf("recovery path = %+v", p)
+	}
+}
+
+func TestTaprootScriptTree(t *testing.T) {
+	privs, keys := testKeys(3)
+	// Script-path only: the internal key is the unspendable point H
+	internal := hex.EncodeToString(unspendableKey)
+	body := "tr(" + internal + ",{multi_a(2," + keys[0] + "," + keys[1] + "),and_v(v:pk(" + keys[2] + "),after(100))})"
+	desc, err := Parse(withChecksum(t, body), &chaincfg.RegressionNetParams)
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	if desc.Type() != "tr(miniscript)" || desc.String() != withChecksum(t, body) {
+		t.Errorf("Type() = %s, String() = %s", desc.Type(), desc)
+	}
+	scripts, err := desc.Scripts(0)
+	if err != nil {
+		t.Fatalf("Scripts failed: %v", err)
+	}
+	if len(scripts.TapLeaves) != 2 || len(scripts.TapMerkleRoot) != 32 {
+		t.Fatalf("got %d leaves, merkle root %x", len(scripts.TapLeaves), scripts.TapMerkleRoot)
+	}
+
+	leafSpend := func(leaf TapLeaf, lockTime uint32, signers ...*btcec.PrivateKey) {
+		spend(t, scripts.Output, 0, lockTime, func(tx *wire.MsgTx, hashes *txscript.TxSigHashes) wire.TxWitness {
+			var witness wire.TxWitness
+			// multi_a checks keys in order, so signatures go in reverse
+			for j := len(signers) - 1; j >= 0; j-- {
+				sig, err := txscript.RawTxInTapscriptSignature(tx, hashes, 0, 100000, scripts.Output,
+					txscript.NewBaseTapLeaf(leaf.Script), txscript.SigHashDefault, signers[j])
+				if err != nil {
+					t.Fatalf("Signing failed: %v", err)
+				}
+				witness = append(witness, sig)
+			}
+			return append(witness, leaf.Script, leaf.ControlBlock)
+		})
+	}
+	leafSpend(scripts.TapLeaves[0], 0, privs[0], privs[1])
+	leafSpend(scripts.TapLeaves[1], 100, privs[2])
+
+	paths, err := desc.SpendingPaths()
+	if err != nil {
+		t.Fatalf("SpendingPaths failed: %v", err)
+	}
+	// No key path
+	if len(paths) != 2 || paths[0].Leaf != 0 || paths[1].Leaf != 1 || paths[1].After != 100 {
+		t.Errorf("spending paths = %+v", paths)
+	}
+	if !bytes.Equal(schnorr.SerializePubKey(desc.Keys()[0].pub), unspendableKey) {
+		t.Errorf("internal key = %x", schnorr.SerializePubKey(desc.Keys()[0].pub))
+	}
+}
@@ -0,0 +1,167 @@
+package descriptor
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+)
+
+// unspendableKey is the BIP341 point H with no known discrete logarithm,
+// used as the internal key of outputs that must be spent by script.
+var unspendableKey = []byte{
+	0x50, 0x92, 0x9b, 0x74, 0xc1, 0xa0, 0x49, 0x54, 0xb7, 0x8b, 0x4b, 0x60, 0x35, 0xe9, 0x7a, 0x5e,
+	0x07, 0x8a, 0x5a, 0x0f, 0x28, 0xec, 0x96, 0xd5, 0x47, 0xbf, 0xee, 0x9a, 0xce, 0x80, 0x3a, 0xc0,
+}
+
+// tapTree is a taproot script tree: a miniscript leaf or a branch.
+type tapTree struct {
+	leaf        *msNode
+	left, right *tapTree
+}
+
+func (d *Descriptor) parseTapTree(s string, depth int) (*tapTree, error) {
+	if depth > maxTapTreeDepth {
+		return nil, fmt.Errorf("script tree is deeper than %d", maxTapTreeDepth)
+	}
+	if !strings.HasPrefix(s, "{") {
+		leaf, err := d.parseMiniscript(s, ctxTapscript)
+		if err != nil {
+			return nil, err
+		}
+		return &tapTree{leaf: leaf}, nil
+	}
+	if !strings.HasSuffix(s, "}") {
+		return nil, errors.New("script tree branch is missing '}'")
+	}
+	parts := splitArgs(s[1 : len(s)-1])
+	if len(parts) != 2 {
+		return nil, errors.New("a script tree branch {A,B} has two children")
+	}
+	left, err := d.parseTapTree(parts[0], depth+1)
+	if err != nil {
+		return nil, err
+	}
+	right, err := d.parseTapTree(parts[1], depth+1)
+	if err != nil {
+		return nil, err
+	}
+	return &tapTree{left: left, right: right}, nil
+}
+
+func (t *tapTree) format(b *strings.Builder, branch int) {
+	if t.leaf != nil {
+		t.leaf.format(b, branch)
+		return
+	}
+	b.WriteByte('{')
+	t.left.format(b, branch)
+	b.WriteByte(',')
+	t.right.format(b, branch)
+	b.WriteByte('}')
+}
+
+// leaves returns the leaves from left to right with their depths.
+func (t *tapTree) leaves(depth int) ([]*msNode, []int) {
+	if t.leaf != nil {
+		return []*msNode{t.leaf}, []int{depth}
+	}
+	l, ld := t.left.leaves(depth + 1)
+	r, rd := t.right.leaves(depth + 1)
+	return append(l, r...), append(ld, rd...)
+}
+
+// TapLeaf is a leaf of a taproot script tree with what spending it needs.
+type TapLeaf struct {
+	Script       []byte
+	ControlBlock []byte
+	// Keys are the keys the script checks signatures against.
+	Keys []*Key
+}
+
+// leafProof is a leaf script with the hashes proving its inclusion, from
+// its sibling up.
+type leafProof struct {
+	leaf   *msNode
+	script []byte
+	proof  []byte
+}
+
+// hash returns the merkle root of the tree at child index i and the
+// inclusion proofs of its leaves.
+func (t *tapTree) hash(i uint32) (chainhash.Hash, []leafProof, error) {
+	if t.leaf != nil {
+		script, err := t.leaf.script(i, nil)
+		if err != nil {
+			return chainhash.Hash{}, nil, err
+		}
+		h := txscript.NewBaseTapLeaf(script).TapHash()
+		return h, []leafProof{{leaf: t.leaf, script: script}}, nil
+	}
+	l, lp, err := t.left.hash(i)
+	if err != nil {
+		return chainhash.Hash{}, nil, err
+	}
+	r, rp, err := t.right.hash(i)
+	if err != nil {
+		return chainhash.Hash{}, nil, err
+	}
+	for j := range lp {
+		lp[j].proof = append(lp[j].proof, r[:]...)
+	}
+	for j := range rp {
+		rp[j].proof = append(rp[j].proof, l[:]...)
+	}
+	// Children are hashed in lexicographic order
+	a, b := l, r
+	if bytes.Compare(a[:], b[:]) > 0 {
+		a, b = b, a
+	}
+	return *chainhash.TaggedHash(chainhash.TagTapBranch, a[:], b[:]), append(lp, rp...), nil
+}
+
+// outputKey returns the tweaked output key at child index i and, for a
+// script tree, its merkle root and leaves.
+func (n *trNode) outputKey(i uint32) (*btcec.PublicKey, []byte, []TapLeaf, error) {
+	pub, err := n.key.PubKey(i)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if n.tree == nil {
+		return txscript.ComputeTaprootKeyNoScript(pub), nil, nil, nil
+	}
+	root, proofs, err := n.tree.hash(i)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	outputKey := txscript.ComputeTaprootOutputKey(pub, root[:])
+	leaves := make([]TapLeaf, len(proofs))
+	for j, p := range proofs {
+		cb := txscript.ControlBlock{
+			InternalKey:     pub,
+			OutputKeyYIsOdd: outputKey.SerializeCompressed()[0] == 0x03,
+			LeafVersion:     txscript.BaseLeafVersion,
+			InclusionProof:  p.proof,
+		}
+		if leaves[j].ControlBlock, err = cb.ToBytes(); err != nil {
+			return nil, nil, nil, err
+		}
+		leaves[j].Script = p.script
+		leaves[j].Keys = p.leaf.allKeys()
+	}
+	return outputKey, root[:], leaves, nil
+}
+
+// keyPathSpendable reports whether the internal key may sign, i.e. it is
+// not the unspendable point H.
+func (n *trNode) keyPathSpendable() bool {
+	if n.key.pub == nil {
+		return true
+	}
+	x := n.key.pub.SerializeCompressed()[1:]
+	return !bytes.Equal(x, unspendableKey)
+}
@@ -0,0 +1,136 @@
+package grpcapi
+
+import (
+	"context"
+	"math"
+	"strconv"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/sawdustofmind/bitcoin-wallet/backend/auth"
+	"github.com/sawdustofmind/bitcoin-wallet/backend/proto/walletv1"
+	"github.com/sawdustofmind/bitcoin-wallet/backend/ratelimit"
+	"github.com/sawdustofmind/bitcoin-wallet/backend/requestid"
+)
+
+// requestIDKey is the metadata key carrying request IDs, as X-Request-ID
+// does over REST.
+const requestIDKey = "x-request-id"
+
+// walletIDKey is the metadata key selecting the wallet a call targets.
+const walletIDKey = "x-wallet-id"
+
+// methodScopes is the scope each method requires. Methods missing here are
+// rejected.
+var methodScopes = map[string]string{
+	walletv1.WalletService_GetBalance_FullMethodName:       auth.ScopeReadBalance,
+	walletv1.WalletService_NewAddress_FullMethodName:       auth.ScopeIssueAddress,
+	walletv1.WalletService_ListUTXOs_FullMethodName:        auth.ScopeReadBalance,
+	walletv1.WalletService_ListTransactions_FullMethodName: auth.ScopeReadBalance,
+	walletv1.WalletService_WatchEvents_FullMethodName:      auth.ScopeReadBalance,
+}
+
+type keyContextKey struct{}
+
+type interceptors struct {
+	keys    auth.Authenticator
+	limiter *ratelimit.Limiter
+}
+
+func (i *interceptors) unary(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	ctx, id := withRequestID(ctx)
+	grpc.SetHeader(ctx, metadata.Pairs(requestIDKey, id))
+	ctx, err := i.authorize(ctx, info.FullMethod)
+	if err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+func (i *interceptors) stream(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, id := withRequestID(ss.Context())
+	ss.SetHeader(metadata.Pairs(requestIDKey, id))
+	ctx, err := i.authorize(ctx, info.FullMethod)
+	if err != nil {
+		return err
+	}
+	return handler(srv, &authedStream{ServerStream: ss, ctx: ctx})
+}
+
+// authorize authenticates the caller's API key, checks the method's scope
+// and applies the per-key rate limit.
+func (i *interceptors) authorize(ctx context.Context, method string) (context.Context, error) {
+	scope, ok := methodScopes[method]
+	if !ok {
+		return nil, status.Errorf(codes.PermissionDenied, "method %s is not allowed", method)
+	}
+
+	key, err := i.keys.Authenticate(ctx, secretFromMetadata(ctx))
+	if err != nil {
+		if err != auth.ErrInvalidKey {
+			return nil, internal(ctx, err, "authenticating API key")
+		}
+		return nil, status.Error(codes.Unauthenticated, err.Error())
+	}
+	if !key.HasScope(scope) {
+		return nil, status.Error(codes.PermissionDenied, "API key lacks scope "+scope)
+	}
+
+	if i.limiter != nil {
+		if ok, retryAfter := i.limiter.Allow(clientID(key)); !ok {
+			return nil, status.Errorf(codes.ResourceExhausted, "rate limit exceeded, retry after %ds",
+				int(math.Ceil(retryAfter.Seconds())))
+		}
+	}
+	return context.WithValue(ctx, keyContextKey{}, key), nil
+}
+
+// withRequestID adds the caller's request ID, or a new one, to ctx.
+func withRequestID(ctx context.Context) (context.Context, string) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	var id string
+	if v := md.Get(requestIDKey); len(v) > 0 {
+		id = v[0]
+	}
+	id = requestid.Resolve(id)
+	return requestid.NewContext(ctx, id), id
+}
+
+// keyFromContext returns the authenticated key, or nil.
+func keyFromContext(ctx context.Context) *auth.Key {
+	key, _ := ctx.Value(keyContextKey{}).(*auth.Key)
+	return key
+}
+
+// clientID matches the client names used by the REST API's limiters, so a
+// key shares its budget across both APIs.
+func clientID(key *auth.Key) string {
+	return "key:" + strconv.FormatInt(key.ID, 10)
+}
+
+func secretFromMetadata(ctx context.Context) string {
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, v := range md.Get("authorization") {
+		if token, ok := strings.CutPrefix(v, "Bearer "); ok {
+			return strings.TrimSpace(token)
+		}
+	}
+	if v := md.Get("x-api-key"); len(v) > 0 {
+		return v[0]
+	}
+	return ""
+}
+
+// authedStream carries the authenticated context into stream handlers.
+type authedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *authedStream) Context() context.Context {
+	return s.ctx
+}
@@ -0,0 +1,282 @@
+package grpcapi
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"strconv"
+
+	"github.com/btcsuite/btcd/btcjson"
+	"github.com/btcsuite/btcd/btcutil"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/sawdustofmind/bitcoin-wallet/backend/auth"
+	"github.com/sawdustofmind/bitcoin-wallet/backend/proto/walletv1"
+	"github.com/sawdustofmind/bitcoin-wallet/backend/ratelimit"
+	"github.com/sawdustofmind/bitcoin-wallet/backend/wallet"
+)
+
+// Wallet is the subset of *wallet.Wallet served over gRPC.
+type Wallet interface {
+	GetBalances(ctx context.Context) (*wallet.Balances, error)
+	GetNewAddress(ctx context.Context) (string, error)
+	GetUTXOs(ctx context.Context) ([]btcjson.ListUnspentResult, error)
+	ListTransactions(ctx context.Context) ([]wallet.Transaction, error)
+	Subscribe() (<-chan wallet.Event, func())
+
+	DiscoversAccounts() bool
+	AccountUTXOs(ctx context.Context) ([]wallet.AccountUTXO, error)
+	AccountBalances(ctx context.Context) ([]wallet.AccountBalance, error)
+}
+
+// Wallets looks up a wallet by ID, returning wallet.ErrWalletNotFound for
+// unknown IDs.
+type Wallets func(id int64) (Wallet, error)
+
+// FromManager serves the wallets registered with m.
+func FromManager(m *wallet.Manager) Wallets {
+	return func(id int64) (Wallet, error) {
+		w, err := m.Get(id)
+		if err != nil {
+			return nil, err
+		}
+		return w, nil
+	}
+}
+
+// Deps bundles the services the gRPC API needs besides the wallets. They are
+// shared with the REST API so limits apply across both.
+type Deps struct {
+	Keys auth.Authenticator
+	// Limiter rate limits calls per API key.
+	Limiter *ratelimit.Limiter
+	// Quota caps daily address issuance per API key.
+	Quota *ratelimit.Quota
+}
+
+// NewServer returns a gRPC server with WalletService registered. Calls
+// select a wallet with the x-wallet-id metadata key, defaulting to
+// wallet.DefaultWalletID.
+func NewServer(wallets Wallets, deps Deps, opts ...grpc.ServerOption) *grpc.Server {
+	i := &interceptors{keys: deps.Keys, limiter: deps.Limiter}
+	opts = append(opts,
+		grpc.ChainUnaryInterceptor(i.unary),
+		grpc.ChainStreamInterceptor(i.stream),
+	)
+	srv := grpc.NewServer(opts...)
+	walletv1.RegisterWalletServiceServer(srv, &service{wallets: wallets, quota: deps.Quota})
+	return srv
+}
+
+type service struct {
+	walletv1.UnimplementedWalletServiceServer
+
+	wallets Wallets
+	quota   *ratelimit.Quota
+}
+
+// wallet returns the wallet selected by the call's metadata. Wallets the
+// API key may not use are reported as not found.
+func (s *service) wallet(ctx context.Context) (Wallet, error) {
+	id := wallet.DefaultWalletID
+	md, _ := metadata.FromIncomingContext(ctx)
+	if v := md.Get(walletIDKey); len(v) > 0 {
+		var err error
+		if id, err = strconv.ParseInt(v[0], 10, 64); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid %s", walletIDKey)
+		}
+	}
+	if key := keyFromContext(ctx); key == nil || !key.CanAccessWallet(id) {
+		return nil, status.Error(codes.NotFound, wallet.ErrWalletNotFound.Error())
+	}
+	w, err := s.wallets(id)
+	if errors.Is(err, wallet.ErrWalletNotFound) {
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
+	if err != nil {
+		return nil, internal(ctx, err, "looking up wallet")
+	}
+	return w, nil
+}
+
+func (s *service) GetBalance(ctx context.Context, _ *walletv1.GetBalanceRequest) (*walletv1.GetBalanceResponse, error) {
+	w, err := s.wallet(ctx)
+	if err != nil {
+		return nil, err
+	}
+	balances, err := w.GetBalances(ctx)
+	if err != nil {
+		return nil, internal(ctx, err, "getting balance")
+	}
+	resp := &walletv1.GetBalanceResponse{
+		TrustedSats:          int64(balances.Trusted),
+		UntrustedPendingSats: int64(balances.UntrustedPending),
+		ImmatureSats:         int64(balances.Immature),
+		ConfirmationsSats:    confirmationsSats(balances),
+	}
+	if w.DiscoversAccounts() {
+		accounts, err := w.AccountBalances(ctx)
+		if err != nil {
+			return nil, internal(ctx, err, "getting account balances")
+		}
+		for _, a := range accounts {
+			resp.Accounts = append(resp.Accounts, &walletv1.AccountBalance{
+				Account:              a.Account,
+				DerivationPath:       a.DerivationPath,
+				TrustedSats:          int64(a.Trusted),
+				UntrustedPendingSats: int64(a.UntrustedPending),
+				ImmatureSats:         int64(a.Immature),
+				ConfirmationsSats:    confirmationsSats(&a.Balances),
+			})
+		}
+	}
+	return resp, nil
+}
+
+// confirmationsSats converts the balance buckets of b.
+func confirmationsSats(b *wallet.Balances) map[int32]int64 {
+	m := make(map[int32]int64, len(b.ByConfirmations))
+	for threshold, amt := range b.ByConfirmations {
+		m[int32(threshold)] = int64(amt)
+	}
+	return m
+}
+
+func (s *service) NewAddress(ctx context.Context, _ *walletv1.NewAddressRequest) (*walletv1.NewAddressResponse, error) {
+	w, err := s.wallet(ctx)
+	if err != nil {
+		return nil, err
+	}
+	client := ""
+	if key := keyFromContext(ctx); key != nil && s.quota != nil {
+		client = clientID(key)
+		if err := s.quota.Consume(ctx, client); err != nil {
+			if err == ratelimit.ErrQuotaExceeded {
+				return nil, status.Error(codes.ResourceExhausted, err.Error())
+			}
+			return nil, internal(ctx, err, "checking issuance quota")
+		}
+	}
+
+	addr, err := w.GetNewAddress(ctx)
+	if err != nil {
+		if client != "" {
+			if err := s.quota.Refund(context.WithoutCancel(ctx), client); err != nil {
+				slog.ErrorContext(ctx, "Failed to refund issuance quota", "client", client, "error", err)
+			}
+		}
+		var gapErr *wallet.GapLimitError
+		if errors.As(err, &gapErr) {
+			return nil, status.Error(codes.FailedPrecondition, err.Error())
+		}
+		return nil, internal(ctx, err, "generating address")
+	}
+	return &walletv1.NewAddressResponse{Address: addr}, nil
+}
+
+func (s *service) ListUTXOs(ctx context.Context, _ *walletv1.ListUTXOsRequest) (*walletv1.ListUTXOsResponse, error) {
+	w, err := s.wallet(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var utxos []wallet.AccountUTXO
+	if w.DiscoversAccounts() {
+		if utxos, err = w.AccountUTXOs(ctx); err != nil {
+			return nil, internal(ctx, err, "getting UTXOs")
+		}
+	} else {
+		plain, err := w.GetUTXOs(ctx)
+		if err != nil {
+			return nil, internal(ctx, err, "getting UTXOs")
+		}
+		for _, u := range plain {
+			utxos = append(utxos, wallet.AccountUTXO{ListUnspentResult: u})
+		}
+	}
+	resp := &walletv1.ListUTXOsResponse{Utxos: make([]*walletv1.UTXO, 0, len(utxos))}
+	for _, u := range utxos {
+		amt, err := btcutil.NewAmount(u.Amount)
+		if err != nil {
+			return nil, internal(ctx, err, "converting UTXO amount")
+		}
+		resp.Utxos = append(resp.Utxos, &walletv1.UTXO{
+			Txid:           u.TxID,
+			Vout:           u.Vout,
+			Address:        u.Address,
+			ScriptPubKey:   u.ScriptPubKey,
+			AmountSats:     int64(amt),
+			Confirmations:  u.Confirmations,
+			Spendable:      u.Spendable,
+			Account:        u.Account,
+			DerivationPath: u.DerivationPath,
+		})
+	}
+	return resp, nil
+}
+
+func (s *service) ListTransactions(ctx context.Context, _ *walletv1.ListTransactionsRequest) (*walletv1.ListTransactionsResponse, error) {
+	w, err := s.wallet(ctx)
+	if err != nil {
+		return nil, err
+	}
+	txs, err := w.ListTransactions(ctx)
+	if err != nil {
+		return nil, internal(ctx, err, "listing transactions")
+	}
+	resp := &walletv1.ListTransactionsResponse{Transactions: make([]*walletv1.Transaction, 0, len(txs))}
+	for _, t := range txs {
+		resp.Transactions = append(resp.Transactions, &walletv1.Transaction{
+			Txid:        t.TxID,
+			BlockHeight: t.BlockHeight,
+			BlockHash:   t.BlockHash,
+			BlockTime:   timestamppb.New(t.BlockTime),
+			FeeSats:     t.FeeSats,
+		})
+	}
+	return resp, nil
+}
+
+func (s *service) WatchEvents(_ *walletv1.WatchEventsRequest, stream walletv1.WalletService_WatchEventsServer) error {
+	w, err := s.wallet(stream.Context())
+	if err != nil {
+		return err
+	}
+	events, cancel := w.Subscribe()
+	defer cancel()
+
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case e, ok := <-events:
+			if !ok {
+				return nil
+			}
+			data, err := structpb.NewStruct(e.Data)
+			if err != nil {
+				slog.ErrorContext(stream.Context(), "Failed to convert event", "type", e.Type, "error", err)
+				continue
+			}
+			err = stream.Send(&walletv1.Event{
+				Type: e.Type,
+				Time: timestamppb.New(e.Time),
+				Data: data,
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// internal logs err and returns a generic status so node and database
+// details are not exposed to clients.
+func internal(ctx context.Context, err error, action string) error {
+	slog.ErrorContext(ctx, "gRPC request failed", "action", action, "error", err)
+	return status.Error(codes.Internal, "internal error")
+}
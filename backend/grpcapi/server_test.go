@@ -0,0 +1,255 @@
+package grpcapi
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/btcjson"
+	"github.com/btcsuite/btcd/btcutil"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	"github.com/sawdustofmind/bitcoin-wallet/backend/auth"
+	"github.com/sawdustofmind/bitcoin-wallet/backend/proto/walletv1"
+	"github.com/sawdustofmind/bitcoin-wallet/backend/wallet"
+)
+
+type fakeWallet struct {
+	events chan wallet.Event
+	gapErr bool
+}
+
+func (f *fakeWallet) GetBalances(context.Context) (*wallet.Balances, error) {
+	return &wallet.Balances{
+		Trusted:          150000000,
+		UntrustedPending: 2500,
+		ByConfirmations:  map[int]btcutil.Amount{0: 150002500, 1: 150000000, 6: 0},
+	}, nil
+}
+
+func (f *fakeWallet) GetNewAddress(context.Context) (string, error) {
+	if f.gapErr {
+		return "", &wallet.GapLimitError{Unused: 20, Limit: 20}
+	}
+	return "mkHS9ne12qx9pS9VojpwU5xtRd4T7X7ZUt", nil
+}
+
+func (f *fakeWallet) GetUTXOs(context.Context) ([]btcjson.ListUnspentResult, error) {
+	return []btcjson.ListUnspentResult{
+		{TxID: "aa", Vout: 1, Address: "mkHS9ne12qx9pS9VojpwU5xtRd4T7X7ZUt", Amount: 1.5, Confirmations: 3},
+	}, nil
+}
+
+func (f *fakeWallet) ListTransactions(context.Context) ([]wallet.Transaction, error) {
+	fee := int64(141)
+	return []wallet.Transaction{
+		{TxID: "bb", BlockHeight: 102, BlockHash: "00ff", BlockTime: time.Unix(1700000000, 0), FeeSats: &fee},
+		{TxID: "aa", BlockHeight: 101, BlockHash: "00fe", BlockTime: time.Unix(1699999000, 0)},
+	}, nil
+}
+
+func (f *fakeWallet) Subscribe() (<-chan wallet.Event, func()) {
+	return f.events, func() {}
+}
+
+func (f *fakeWallet) DiscoversAccounts() bool { return false }
+
+func (f *fakeWallet) AccountUTXOs(context.Context) ([]wallet.AccountUTXO, error) {
+	return nil, errors.New("wallet does not discover accounts")
+}
+
+func (f *fakeWallet) AccountBalances(context.Context) ([]wallet.AccountBalance, error) {
+	return nil, errors.New("wallet does not discover accounts")
+}
+
+type fakeKeys map[string]*auth.Key
+
+func (f fakeKeys) Authenticate(_ context.Context, secret string) (*auth.Key, error) {
+	if k, ok := f[secret]; ok {
+		return k, nil
+	}
+	return nil, auth.ErrInvalidKey
+}
+
+var tenantWallet = int64(2)
+
+var testKeys = fakeKeys{
+	"admin":  {ID: 1, Scopes: []string{auth.ScopeAdmin}},
+	"reader": {ID: 2, Scopes: []string{auth.ScopeReadBalance}},
+	"tenant": {ID: 3, Scopes: []string{auth.ScopeReadBalance}, WalletID: &tenantWallet},
+}
+
+// dial serves w as wallets 1 and 2 on an in-process listener and returns a
+// client.
+func dial(t *testing.T, w Wallet) walletv1.WalletServiceClient {
+	t.Helper()
+	lis := bufconn.Listen(1 << 20)
+	wallets := func(id int64) (Wallet, error) {
+		if id != wallet.DefaultWalletID && id != tenantWallet {
+			return nil, wallet.ErrWalletNotFound
+		}
+		return w, nil
+	}
+	srv := NewServer(wallets, Deps{Keys: testKeys})
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return lis.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("Failed to dial bufconn: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return walletv1.NewWalletServiceClient(conn)
+}
+
+func withKey(key string) context.Context {
+	return metadata.AppendToOutgoingContext(context.Background(), "x-api-key", key)
+}
+
+func TestUnary(t *testing.T) {
+	client := dial(t, &fakeWallet{})
+	ctx := withKey("admin")
+
+	bal, err := client.GetBalance(ctx, &walletv1.GetBalanceRequest{})
+	if err != nil {
+		t.Fatalf("GetBalance: %v", err)
+	}
+	if bal.TrustedSats != 150000000 || bal.UntrustedPendingSats != 2500 || bal.ConfirmationsSats[0] != 150002500 {
+		t.Errorf("GetBalance = %v", bal)
+	}
+
+	addr, err := client.NewAddress(ctx, &walletv1.NewAddressRequest{})
+	if err != nil {
+		t.Fatalf("NewAddress: %v", err)
+	}
+	if addr.Address != "mkHS9ne12qx9pS9VojpwU5xtRd4T7X7ZUt" {
+		t.Errorf("NewAddress = %s", addr.Address)
+	}
+
+	utxos, err := client.ListUTXOs(ctx, &walletv1.ListUTXOsRequest{})
+	if err != nil {
+		t.Fatalf("ListUTXOs: %v", err)
+	}
+	if len(utxos.Utxos) != 1 || utxos.Utxos[0].AmountSats != 150000000 || utxos.Utxos[0].Vout != 1 {
+		t.Errorf("ListUTXOs = %v", utxos.Utxos)
+	}
+
+	txs, err := client.ListTransactions(ctx, &walletv1.ListTransactionsRequest{})
+	if err != nil {
+		t.Fatalf("ListTransactions: %v", err)
+	}
+	if len(txs.Transactions) != 2 {
+		t.Fatalf("ListTransactions returned %d transactions, want 2", len(txs.Transactions))
+	}
+	if tx := txs.Transactions[0]; tx.GetFeeSats() != 141 || tx.BlockTime.AsTime().Unix() != 1700000000 {
+		t.Errorf("first transaction = %v", tx)
+	}
+	if txs.Transactions[1].FeeSats != nil {
+		t.Errorf("expected unknown fee, got %d", txs.Transactions[1].GetFeeSats())
+	}
+}
+
+func TestAuthorization(t *testing.T) {
+	client := dial(t, &fakeWallet{})
+
+	tests := []struct {
+		name string
+		ctx  context.Context
+		call func(context.Context) error
+		want codes.Code
+	}{
+		{"no key", context.Background(), func(ctx context.Context) error {
+			_, err := client.GetBalance(ctx, &walletv1.GetBalanceRequest{})
+			return err
+		}, codes.Unauthenticated},
+		{"bearer token", metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer reader"), func(ctx context.Context) error {
+			_, err := client.GetBalance(ctx, &walletv1.GetBalanceRequest{})
+			return err
+		}, codes.OK},
+		{"missing scope", withKey("reader"), func(ctx context.Context) error {
+			_, err := client.NewAddress(ctx, &walletv1.NewAddressRequest{})
+			return err
+		}, codes.PermissionDenied},
+		{"tenant key on its wallet", metadata.AppendToOutgoingContext(withKey("tenant"), "x-wallet-id", "2"), func(ctx context.Context) error {
+			_, err := client.GetBalance(ctx, &walletv1.GetBalanceRequest{})
+			return err
+		}, codes.OK},
+		{"tenant key on another wallet", withKey("tenant"), func(ctx context.Context) error {
+			_, err := client.GetBalance(ctx, &walletv1.GetBalanceRequest{})
+			return err
+		}, codes.NotFound},
+		{"unknown wallet", metadata.AppendToOutgoingContext(withKey("admin"), "x-wallet-id", "7"), func(ctx context.Context) error {
+			_, err := client.ListUTXOs(ctx, &walletv1.ListUTXOsRequest{})
+			return err
+		}, codes.NotFound},
+		{"invalid wallet id", metadata.AppendToOutgoingContext(withKey("admin"), "x-wallet-id", "abc"), func(ctx context.Context) error {
+			_, err := client.ListUTXOs(ctx, &walletv1.ListUTXOsRequest{})
+			return err
+		}, codes.InvalidArgument},
+		{"stream without key", context.Background(), func(ctx context.Context) error {
+			stream, err := client.WatchEvents(ctx, &walletv1.WatchEventsRequest{})
+			if err != nil {
+				return err
+			}
+			_, err = stream.Recv()
+			return err
+		}, codes.Unauthenticated},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := status.Code(tt.call(tt.ctx)); got != tt.want {
+				t.Errorf("code = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGapLimit(t *testing.T) {
+	client := dial(t, &fakeWallet{gapErr: true})
+	_, err := client.NewAddress(withKey("admin"), &walletv1.NewAddressRequest{})
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("code = %s, want FailedPrecondition", status.Code(err))
+	}
+}
+
+func TestWatchEvents(t *testing.T) {
+	events := make(chan wallet.Event, 1)
+	client := dial(t, &fakeWallet{events: events})
+
+	ctx, cancel := context.WithCancel(withKey("reader"))
+	defer cancel()
+	stream, err := client.WatchEvents(ctx, &walletv1.WatchEventsRequest{})
+	if err != nil {
+		t.Fatalf("WatchEvents: %v", err)
+	}
+
+	events <- wallet.Event{
+		Type: wallet.EventReorg,
+		Time: time.Unix(1700000000, 0),
+		Data: map[string]interface{}{"fork_height": int64(100), "depth": int64(2), "old_tip": "00ff"},
+	}
+	e, err := stream.Recv()
+	if err != nil {
+		t.Fatalf("Recv: %v", err)
+	}
+	if e.Type != wallet.EventReorg || e.Time.AsTime().Unix() != 1700000000 {
+		t.Errorf("event = %v", e)
+	}
+	if got := e.Data.Fields["fork_height"].GetNumberValue(); got != 100 {
+		t.Errorf("fork_height = %v, want 100", got)
+	}
+	if got := e.Data.Fields["old_tip"].GetStringValue(); got != "00ff" {
+		t.Errorf("old_tip = %q, want 00ff", got)
+	}
+}
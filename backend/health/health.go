@@ -0,0 +1,149 @@
+// Package health serves liveness and readiness endpoints.
+package health
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Check statuses.
+const (
+	StatusOK      = "ok"
+	StatusFailing = "failing"
+)
+
+// Check is a named readiness condition. Run returns nil when the condition
+// holds.
+type Check struct {
+	Name string
+	Run  func(ctx context.Context) error
+}
+
+// Failure is a failed check whose Reason is safe to show to anyone who can
+// reach the endpoint. Err carries the details, which are only logged.
+type Failure struct {
+	Reason string
+	Err    error
+}
+
+func (f *Failure) Error() string {
+	if f.Err == nil {
+		return f.Reason
+	}
+	return f.Reason + ": " + f.Err.Error()
+}
+
+func (f *Failure) Unwrap() error {
+	return f.Err
+}
+
+// Fail returns a Failure for reason, caused by err.
+func Fail(reason string, err error) error {
+	return &Failure{Reason: reason, Err: err}
+}
+
+// Result is the outcome of one check.
+type Result struct {
+	Status     string `json:"status"`
+	Error      string `json:"error,omitempty"`
+	DurationMS int64  `json:"duration_ms"`
+}
+
+// Report is the readiness response body.
+type Report struct {
+	Status string            `json:"status"`
+	Checks map[string]Result `json:"checks"`
+}
+
+// Checker runs readiness checks concurrently, each bounded by a timeout.
+type Checker struct {
+	checks  []Check
+	timeout time.Duration
+}
+
+// NewChecker returns a Checker that fails checks taking longer than
+// timeout.
+func NewChecker(timeout time.Duration, checks ...Check) *Checker {
+	return &Checker{checks: checks, timeout: timeout}
+}
+
+// Add registers more checks.
+func (c *Checker) Add(checks ...Check) {
+	c.checks = append(c.checks, checks...)
+}
+
+// Run executes every check and reports the service ready only if all pass.
+func (c *Checker) Run(ctx context.Context) Report {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	report := Report{Status: "ready", Checks: make(map[string]Result, len(c.checks))}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, check := range c.checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res := c.run(ctx, check)
+			mu.Lock()
+			defer mu.Unlock()
+			report.Checks[check.Name] = res
+			if res.Status == StatusFailing {
+				report.Status = "unavailable"
+			}
+		}()
+	}
+	wg.Wait()
+	return report
+}
+
+// run waits for check until the deadline. A check that ignores its context
+// is left running and reported as timed out.
+func (c *Checker) run(ctx context.Context, check Check) Result {
+	start := time.Now()
+	done := make(chan error, 1)
+	go func() { done <- check.Run(ctx) }()
+
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		err = Fail("timed out", ctx.Err())
+	}
+	res := Result{Status: StatusOK, DurationMS: time.Since(start).Milliseconds()}
+	switch {
+	case err == nil:
+	default:
+		res.Status = StatusFailing
+		res.Error = err.Error()
+		var f *Failure
+		if errors.As(err, &f) {
+			res.Error = f.Reason
+		}
+		slog.WarnContext(ctx, "Readiness check failed", "check", check.Name, "error", err)
+	}
+	return res
+}
+
+// Live reports that the process is up and serving requests.
+func Live(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"status": StatusOK})
+}
+
+// Ready runs the checks, answering 503 when any fails.
+func Ready(checker *Checker) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		report := checker.Run(c.Request.Context())
+		status := http.StatusOK
+		if report.Status != "ready" {
+			status = http.StatusServiceUnavailable
+		}
+		c.JSON(status, report)
+	}
+}
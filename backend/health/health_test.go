@@ -0,0 +1,87 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestChecker(t *testing.T) {
+	checker := NewChecker(50*time.Millisecond,
+		Check{Name: "ok", Run: func(context.Context) error { return nil }},
+		Check{Name: "plain", Run: func(context.Context) error { return errors.New("node is in initial block download") }},
+		Check{Name: "wrapped", Run: func(context.Context) error {
+			return Fail("ping failed", errors.New("dial tcp 10.0.0.5:5432: connection refused"))
+		}},
+		Check{Name: "hung", Run: func(context.Context) error {
+			time.Sleep(time.Second)
+			return nil
+		}},
+	)
+
+	start := time.Now()
+	report := checker.Run(context.Background())
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("Run took %s, want it bounded by the timeout", elapsed)
+	}
+
+	if report.Status != "unavailable" {
+		t.Errorf("status = %q, want unavailable", report.Status)
+	}
+	want := map[string]Result{
+		"ok":      {Status: StatusOK},
+		"plain":   {Status: StatusFailing, Error: "node is in initial block download"},
+		"wrapped": {Status: StatusFailing, Error: "ping failed"},
+		"hung":    {Status: StatusFailing, Error: "timed out"},
+	}
+	for name, w := range want {
+		got := report.Checks[name]
+		if got.Status != w.Status || got.Error != w.Error {
+			t.Errorf("%s = %+v, want status %q error %q", name, got, w.Status, w.Error)
+		}
+	}
+}
+
+func TestReady(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	healthy := true
+	checker := NewChecker(time.Second, Check{Name: "postgres", Run: func(context.Context) error {
+		if !healthy {
+			return Fail("ping failed", errors.New("connection refused"))
+		}
+		return nil
+	}})
+	r := gin.New()
+	r.GET("/healthz", Live)
+	r.GET("/readyz", Ready(checker))
+
+	get := func(path string) (int, Report) {
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		var report Report
+		json.Unmarshal(rec.Body.Bytes(), &report)
+		return rec.Code, report
+	}
+
+	if code, _ := get("/healthz"); code != http.StatusOK {
+		t.Errorf("/healthz = %d, want 200", code)
+	}
+	if code, report := get("/readyz"); code != http.StatusOK || report.Status != "ready" {
+		t.Errorf("/readyz = %d %+v, want 200 ready", code, report)
+	}
+
+	healthy = false
+	code, report := get("/readyz")
+	if code != http.StatusServiceUnavailable || report.Checks["postgres"].Error != "ping failed" {
+		t.Errorf("/readyz = %d %+v, want 503 with the postgres failure", code, report)
+	}
+	if code, _ := get("/healthz"); code != http.StatusOK {
+		t.Errorf("/healthz = %d while not ready, want 200", code)
+	}
+}
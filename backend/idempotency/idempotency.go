@@ -0,0 +1,261 @@
+package idempotency
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/sawdustofmind/bitcoin-wallet/backend/apierr"
+	"github.com/sawdustofmind/bitcoin-wallet/backend/auth"
+)
+
+// Header is the request header carrying the client's idempotency key.
+const Header = "Idempotency-Key"
+
+// maxKeyLength bounds client supplied keys.
+const maxKeyLength = 255
+
+// MaxBodySize bounds the body of a request sent with an Idempotency-Key,
+// which is read into memory to fingerprint it. It matches the largest body
+// any endpoint accepts, a BIP329 label import.
+const MaxBodySize = 16 << 20
+
+// pruneInterval is how often expired records are deleted.
+const pruneInterval = time.Minute
+
+// sensitiveKey marks a response that must not be stored, see Sensitive.
+const sensitiveKey = "idempotency.sensitive"
+
+// Store keeps responses to idempotent requests in Postgres for ttl.
+type Store struct {
+	db  *sql.DB
+	ttl time.Duration
+
+	mu        sync.Mutex
+	lastPrune time.Time
+}
+
+func NewStore(db *sql.DB, ttl time.Duration) *Store {
+	return &Store{db: db, ttl: ttl}
+}
+
+// record is a stored request. StatusCode is nil while it is in progress.
+type record struct {
+	Fingerprint string
+	StatusCode  *int
+	ContentType sql.NullString
+	Body        []byte
+}
+
+// claim reserves key for client. It returns nil if the caller should run
+// the request, or the existing record otherwise. Expired records are
+// replaced.
+func (s *Store) claim(client, key, fingerprint string) (*record, error) {
+	s.prune()
+
+	res, err := s.db.Exec(`INSERT INTO idempotency_keys (client, key, fingerprint, expires_at)
+		VALUES ($1, $2, $3, now() + $4::float8 * interval '1 second')
+		ON CONFLICT (client, key) DO UPDATE
+		SET fingerprint = EXCLUDED.fingerprint, status_code = NULL, content_type = NULL,
+			body = NULL, expires_at = EXCLUDED.expires_at
+		WHERE idempotency_keys.expires_at <= now()`,
+		client, key, fingerprint, s.ttl.Seconds())
+	if err != nil {
+		return nil, err
+	}
+	if n, _ := res.RowsAffected(); n == 1 {
+		return nil, nil
+	}
+
+	var r record
+	err = s.db.QueryRow(`SELECT fingerprint, status_code, content_type, body FROM idempotency_keys
+		WHERE client = $1 AND key = $2`, client, key).
+		Scan(&r.Fingerprint, &r.StatusCode, &r.ContentType, &r.Body)
+	if err == sql.ErrNoRows {
+		// Pruned in between; try again
+		return s.claim(client, key, fingerprint)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// complete stores the response to a claimed request.
+func (s *Store) complete(client, key string, status int, contentType string, body []byte) error {
+	_, err := s.db.Exec(`UPDATE idempotency_keys SET status_code = $3, content_type = $4, body = $5
+		WHERE client = $1 AND key = $2`, client, key, status, contentType, body)
+	return err
+}
+
+// release drops a claim so the request can be retried.
+func (s *Store) release(client, key string) error {
+	_, err := s.db.Exec("DELETE FROM idempotency_keys WHERE client = $1 AND key = $2", client, key)
+	return err
+}
+
+// prune deletes expired records at most once per pruneInterval.
+func (s *Store) prune() {
+	s.mu.Lock()
+	if time.Since(s.lastPrune) < pruneInterval {
+		s.mu.Unlock()
+		return
+	}
+	s.lastPrune = time.Now()
+	s.mu.Unlock()
+
+	if _, err := s.db.Exec("DELETE FROM idempotency_keys WHERE expires_at <= now()"); err != nil {
+		slog.Error("Failed to prune idempotency keys", "error", err)
+	}
+}
+
+// Sensitive marks the current response as containing a secret. Its body is
+// not stored, so a replay reports the original status without the body.
+func Sensitive(c *gin.Context) {
+	c.Set(sensitiveKey, true)
+}
+
+// Middleware honors the Idempotency-Key header: the first request with a
+// key runs normally and its response is stored; later requests with the
+// same key and parameters get that response back, and requests reusing
+// the key with different parameters are rejected. Keys are scoped to the
+// authenticated API key, so it must run after auth.Authenticate.
+func Middleware(s *Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := c.GetHeader(Header)
+		if key == "" {
+			c.Next()
+			return
+		}
+		if len(key) > maxKeyLength {
+			apierr.Abort(c, http.StatusBadRequest, apierr.CodeInvalidRequest,
+				"Idempotency-Key must be at most "+strconv.Itoa(maxKeyLength)+" characters")
+			return
+		}
+		apiKey := auth.FromContext(c)
+		if apiKey == nil {
+			c.Next()
+			return
+		}
+		client := "key:" + strconv.FormatInt(apiKey.ID, 10)
+
+		body, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, MaxBodySize))
+		if err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				apierr.Abort(c, http.StatusRequestEntityTooLarge, apierr.CodeRequestTooLarge,
+					"request body exceeds "+strconv.Itoa(MaxBodySize)+" bytes")
+				return
+			}
+			apierr.Abort(c, http.StatusBadRequest, apierr.CodeInvalidRequest, "failed to read request body")
+			return
+		}
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+		fp := fingerprint(c.Request, body)
+
+		existing, err := s.claim(client, key, fp)
+		if err != nil {
+			apierr.Internal(c, err, "claiming idempotency key")
+			return
+		}
+		if existing != nil {
+			replay(c, existing, fp)
+			return
+		}
+
+		release := func() {
+			if err := s.release(client, key); err != nil {
+				slog.ErrorContext(c.Request.Context(), "Failed to release idempotency key", "error", err)
+			}
+		}
+		// A panicking handler would otherwise leave the key in progress
+		// until it expires
+		defer func() {
+			if p := recover(); p != nil {
+				release()
+				panic(p)
+			}
+		}()
+
+		rec := &recorder{ResponseWriter: c.Writer}
+		c.Writer = rec
+		c.Next()
+
+		status := rec.Status()
+		// Transient failures are not remembered so the client can retry
+		if status >= http.StatusInternalServerError || status == http.StatusTooManyRequests {
+			release()
+			return
+		}
+		stored := rec.body.Bytes()
+		if c.GetBool(sensitiveKey) {
+			stored = nil
+		}
+		if err := s.complete(client, key, status, rec.Header().Get("Content-Type"), stored); err != nil {
+			slog.ErrorContext(c.Request.Context(), "Failed to store idempotent response", "error", err)
+		}
+	}
+}
+
+func replay(c *gin.Context, r *record, fp string) {
+	if r.Fingerprint != fp {
+		apierr.Abort(c, http.StatusUnprocessableEntity, apierr.CodeIdempotencyKeyReused,
+			"Idempotency-Key was already used with different request parameters")
+		return
+	}
+	if r.StatusCode == nil {
+		apierr.Abort(c, http.StatusConflict, apierr.CodeIdempotencyInProgress,
+			"a request with this Idempotency-Key is still in progress")
+		return
+	}
+	if r.Body == nil && *r.StatusCode != http.StatusNoContent {
+		apierr.AbortWithDetails(c, http.StatusConflict, apierr.CodeIdempotencyReplayUnavailable,
+			"the original response contained a secret and was not stored",
+			map[string]interface{}{"original_status": *r.StatusCode})
+		return
+	}
+
+	c.Header("Idempotent-Replayed", "true")
+	if r.ContentType.Valid && r.ContentType.String != "" {
+		c.Header("Content-Type", r.ContentType.String)
+	}
+	c.Status(*r.StatusCode)
+	if len(r.Body) > 0 {
+		c.Writer.Write(r.Body)
+	}
+	c.Abort()
+}
+
+// fingerprint identifies the parameters of a request.
+func fingerprint(r *http.Request, body []byte) string {
+	h := sha256.New()
+	io.WriteString(h, r.Method+" "+r.URL.Path+"?"+r.URL.RawQuery+"\n")
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// recorder copies the response body while it is written.
+type recorder struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (r *recorder) Write(b []byte) (int, error) {
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
+
+func (r *recorder) WriteString(s string) (int, error) {
+	r.body.WriteString(s)
+	return r.ResponseWriter.WriteString(s)
+}
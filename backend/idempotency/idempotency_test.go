@@ -0,0 +1,186 @@
+package idempotency
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/sawdustofmind/bitcoin-wallet/backend/auth"
+)
+
+func TestFingerprint(t *testing.T) {
+	req := func(method, target string) *http.Request {
+		return httptest.NewRequest(method, target, nil)
+	}
+	base := fingerprint(req("POST", "/v1/keys"), []byte(`{"name":"a"}`))
+
+	if fingerprint(req("POST", "/v1/keys"), []byte(`{"name":"a"}`)) != base {
+		t.Error("identical requests have different fingerprints")
+	}
+	for name, fp := range map[string]string{
+		"body":   fingerprint(req("POST", "/v1/keys"), []byte(`{"name":"b"}`)),
+		"path":   fingerprint(req("POST", "/v1/addresses"), []byte(`{"name":"a"}`)),
+		"query":  fingerprint(req("POST", "/v1/keys?x=1"), []byte(`{"name":"a"}`)),
+		"method": fingerprint(req("DELETE", "/v1/keys"), []byte(`{"name":"a"}`)),
+	} {
+		if fp == base {
+			t.Errorf("changing the %s does not change the fingerprint", name)
+		}
+	}
+}
+
+func TestReplay(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	created := http.StatusCreated
+	noContent := http.StatusNoContent
+
+	tests := []struct {
+		name       string
+		record     record
+		fp         string
+		wantStatus int
+		wantBody   string
+		replayed   bool
+	}{
+		{
+			name:       "stored response",
+			record:     record{Fingerprint: "f", StatusCode: &created, ContentType: sql.NullString{String: "application/json", Valid: true}, Body: []byte(`{"address":"mx"}`)},
+			fp:         "f",
+			wantStatus: http.StatusCreated,
+			wantBody:   `{"address":"mx"}`,
+			replayed:   true,
+		},
+		{
+			name:       "no content",
+			record:     record{Fingerprint: "f", StatusCode: &noContent},
+			fp:         "f",
+			wantStatus: http.StatusNoContent,
+			replayed:   true,
+		},
+		{
+			name:       "different parameters",
+			record:     record{Fingerprint: "f", StatusCode: &created, Body: []byte(`{}`)},
+			fp:         "g",
+			wantStatus: http.StatusUnprocessableEntity,
+		},
+		{
+			name:       "in progress",
+			record:     record{Fingerprint: "f"},
+			fp:         "f",
+			wantStatus: http.StatusConflict,
+		},
+		{
+			name:       "secret not stored",
+			record:     record{Fingerprint: "f", StatusCode: &created},
+			fp:         "f",
+			wantStatus: http.StatusConflict,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(rec)
+			replay(c, &tt.record, tt.fp)
+			c.Writer.WriteHeaderNow()
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if tt.wantBody != "" && rec.Body.String() != tt.wantBody {
+				t.Errorf("body = %s, want %s", rec.Body, tt.wantBody)
+			}
+			if got := rec.Header().Get("Idempotent-Replayed") == "true"; got != tt.replayed {
+				t.Errorf("Idempotent-Replayed = %v, want %v", got, tt.replayed)
+			}
+			if !c.IsAborted() {
+				t.Error("handler chain was not aborted")
+			}
+		})
+	}
+}
+
+type testAuthenticator struct{}
+
+func (testAuthenticator) Authenticate(context.Context, string) (*auth.Key, error) {
+	return &auth.Key{ID: 1}, nil
+}
+
+func TestMiddlewareBodyLimit(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	// The store is never reached for a rejected body
+	r.POST("/v1/labels/bip329", auth.Authenticate(testAuthenticator{}), Middleware(NewStore(nil, 0)), func(c *gin.Context) {
+		t.Error("handler ran for an oversized body")
+	})
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/labels/bip329", strings.NewReader(strings.Repeat("x", MaxBodySize+1)))
+	req.Header.Set(Header, "k")
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("status = %d, want 413", rec.Code)
+	}
+	if !strings.Contains(rec.Body.String(), `"request_too_large"`) {
+		t.Errorf("body = %s, want code request_too_large", rec.Body)
+	}
+}
+
+// execLog is a database that accepts every statement and records them.
+type execLog struct {
+	mu    sync.Mutex
+	execs []string
+}
+
+func (l *execLog) Connect(context.Context) (driver.Conn, error) { return l, nil }
+func (l *execLog) Driver() driver.Driver                        { return l }
+func (l *execLog) Open(string) (driver.Conn, error)             { return l, nil }
+
+func (l *execLog) Prepare(string) (driver.Stmt, error) { return nil, errors.New("not supported") }
+func (l *execLog) Close() error                        { return nil }
+func (l *execLog) Begin() (driver.Tx, error)           { return nil, errors.New("not supported") }
+
+func (l *execLog) ExecContext(_ context.Context, query string, _ []driver.NamedValue) (driver.Result, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.execs = append(l.execs, query)
+	return driver.RowsAffected(1), nil
+}
+
+func TestMiddlewarePanicReleasesKey(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	log := &execLog{}
+	database := sql.OpenDB(log)
+	defer database.Close()
+
+	r := gin.New()
+	r.Use(gin.CustomRecovery(func(c *gin.Context, _ interface{}) {
+		c.AbortWithStatus(http.StatusInternalServerError)
+	}))
+	r.POST("/v1/psbt", auth.Authenticate(testAuthenticator{}), Middleware(NewStore(database, time.Hour)), func(c *gin.Context) {
+		panic("boom")
+	})
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/psbt", strings.NewReader(`{}`))
+	req.Header.Set(Header, "k")
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	if rec.Code != http.StatusInternalServerError {
+		t.Fatalf("status = %d, want 500 from the recovered panic", rec.Code)
+	}
+
+	log.mu.Lock()
+	defer log.mu.Unlock()
+	last := log.execs[len(log.execs)-1]
+	if !strings.HasPrefix(last, "DELETE FROM idempotency_keys WHERE client = $1 AND key = $2") {
+		t.Errorf("last statement = %q, want the claim released", last)
+	}
+}
@@ -1,24 +1,39 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/btcutil/hdkeychain"
+	"github.com/btcsuite/btcd/btcutil/psbt"
+	"github.com/btcsuite/btcd/chaincfg"
 	"github.com/btcsuite/btcd/rpcclient"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
 	"github.com/gin-gonic/gin"
 	_ "github.com/lib/pq"
 	"github.com/testcontainers/testcontainers-go"
 	"github.com/testcontainers/testcontainers-go/wait"
 
 	"github.com/sawdustofmind/bitcoin-wallet/backend/api"
+	"github.com/sawdustofmind/bitcoin-wallet/backend/auth"
 	"github.com/sawdustofmind/bitcoin-wallet/backend/config"
+	"github.com/sawdustofmind/bitcoin-wallet/backend/db"
+	"github.com/sawdustofmind/bitcoin-wallet/backend/descriptor"
+	"github.com/sawdustofmind/bitcoin-wallet/backend/idempotency"
 	"github.com/sawdustofmind/bitcoin-wallet/backend/wallet"
 )
 
@@ -63,20 +78,41 @@ func TestIntegration(t *testing.T) {
 		RPCPass: "testpass",
 	}
 
-	w, err := wallet.New(btcCfg, xpubStr, db)
+	wallets, err := wallet.NewManager(ctx, btcCfg, db)
 	if err != nil {
-		t.Fatalf("Failed to create wallet: %v", err)
+		t.Fatalf("Failed to connect to bitcoind: %v", err)
+	}
+	if err := wallets.RegisterDefault(ctx, wallet.Definition{XPUB: xpubStr}); err != nil {
+		t.Fatalf("Failed to register default wallet: %v", err)
+	}
+	if err := wallets.Load(ctx); err != nil {
+		t.Fatalf("Failed to load wallets: %v", err)
+	}
+	w, err := wallets.Get(wallet.DefaultWalletID)
+	if err != nil {
+		t.Fatalf("Failed to get default wallet: %v", err)
 	}
 
 	// Set up Gin router
 	gin.SetMode(gin.TestMode)
 	router := gin.New()
-	api.RegisterRoutes(router, w)
+	keys := auth.NewStore(db)
+	if err := keys.Bootstrap(ctx, testAdminKey); err != nil {
+		t.Fatalf("Failed to bootstrap admin key: %v", err)
+	}
+	api.RegisterRoutes(router, wallets, api.Deps{
+		Keys:        keys,
+		Idempotency: idempotency.NewStore(db, time.Hour),
+	})
 
-	// Create test server
-	ts := httptest.NewServer(router)
+	// Create test server; requests are authenticated with the admin key
+	ts := httptest.NewServer(withAPIKey(router, testAdminKey))
 	defer ts.Close()
 
+	t.Run("Unauthorized", func(t *testing.T) {
+		testUnauthorized(t, router, keys)
+	})
+
 	// Run subtests
 	t.Run("GetAddress", func(t *testing.T) {
 		testGetAddress(t, ts.URL)
@@ -93,6 +129,90 @@ func TestIntegration(t *testing.T) {
 	t.Run("FullFlowWithFunds", func(t *testing.T) {
 		testFullFlowWithFunds(t, ts.URL, btcCfg)
 	})
+
+	t.Run("ReorgRollback", func(t *testing.T) {
+		testReorgRollback(t, w, btcCfg)
+	})
+
+	t.Run("Idempotency", func(t *testing.T) {
+		testIdempotency(t, ts.URL)
+	})
+
+	t.Run("GapLimit", func(t *testing.T) {
+		testGapLimit(t, w)
+	})
+
+	t.Run("ConcurrentIssuance", func(t *testing.T) {
+		testConcurrentIssuance(t, w)
+	})
+
+	t.Run("WalletIsolation", func(t *testing.T) {
+		testWalletIsolation(t, router, ts.URL, keys)
+	})
+
+	t.Run("DescriptorWallet", func(t *testing.T) {
+		testDescriptorWallet(t, ts.URL, btcCfg)
+	})
+
+	t.Run("MultisigWallet", func(t *testing.T) {
+		testMultisigWallet(t, ts.URL, btcCfg)
+	})
+
+	t.Run("ChangeOutputs", func(t *testing.T) {
+		testChangeOutputs(t, wallets, ts.URL, btcCfg)
+	})
+
+	t.Run("PayjoinFallback", func(t *testing.T) {
+		testPayjoinFallback(t, wallets, btcCfg)
+	})
+
+	t.Run("PayjoinSignerFailure", func(t *testing.T) {
+		testPayjoinSignerFailure(t, wallets, btcCfg)
+	})
+}
+
+const testAdminKey = "bw_integration_test_admin_key"
+
+// withAPIKey authenticates every request to h with key.
+func withAPIKey(h http.Handler, key string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Header.Set("Authorization", "Bearer "+key)
+		h.ServeHTTP(w, r)
+	})
+}
+
+func testUnauthorized(t *testing.T, router http.Handler, keys *auth.Store) {
+	// No key
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest("GET", "/v1/balance", nil))
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected 401 without key, got %d", rec.Code)
+	}
+
+	// Key without the issue-address scope
+	secret, key, err := keys.Create(context.Background(), "reader", []string{auth.ScopeReadBalance}, nil)
+	if err != nil {
+		t.Fatalf("Failed to create key: %v", err)
+	}
+	req := httptest.NewRequest("POST", "/v1/addresses", nil)
+	req.Header.Set("X-API-Key", secret)
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("Expected 403 for read-only key, got %d", rec.Code)
+	}
+
+	// Revoked key
+	if err := keys.Revoke(context.Background(), key.ID); err != nil {
+		t.Fatalf("Failed to revoke key: %v", err)
+	}
+	req = httptest.NewRequest("GET", "/v1/balance", nil)
+	req.Header.Set("X-API-Key", secret)
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected 401 for revoked key, got %d", rec.Code)
+	}
 }
 
 func startPostgres(t *testing.T, ctx context.Context) (testcontainers.Container, string) {
@@ -167,30 +287,20 @@ func startBitcoind(t *testing.T, ctx context.Context) (testcontainers.Container,
 	return container, rpcHost
 }
 
-func runTestMigrations(db *sql.DB) error {
-	query := `
-	CREATE TABLE IF NOT EXISTS wallet_state (
-		id SERIAL PRIMARY KEY,
-		derivation_index INT NOT NULL DEFAULT 0
-	);
-	INSERT INTO wallet_state (id, derivation_index)
-	SELECT 1, 0
-	WHERE NOT EXISTS (SELECT 1 FROM wallet_state WHERE id = 1);
-	`
-	_, err := db.Exec(query)
-	return err
+func runTestMigrations(conn *sql.DB) error {
+	return db.Migrate(conn)
 }
 
 func testGetAddress(t *testing.T, baseURL string) {
-	resp, err := http.Get(baseURL + "/address")
+	resp, err := http.Post(baseURL+"/v1/addresses", "application/json", nil)
 	if err != nil {
 		t.Fatalf("Failed to get address: %v", err)
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
+	if resp.StatusCode != http.StatusCreated {
 		body, _ := io.ReadAll(resp.Body)
-		t.Fatalf("Expected status 200, got %d: %s", resp.StatusCode, string(body))
+		t.Fatalf("Expected status 201, got %d: %s", resp.StatusCode, string(body))
 	}
 
 	var result map[string]interface{}
@@ -212,7 +322,7 @@ func testGetAddress(t *testing.T, baseURL string) {
 }
 
 func testGetBalanceInitial(t *testing.T, baseURL string) {
-	resp, err := http.Get(baseURL + "/balance")
+	resp, err := http.Get(baseURL + "/v1/balance")
 	if err != nil {
 		t.Fatalf("Failed to get balance: %v", err)
 	}
@@ -228,20 +338,20 @@ func testGetBalanceInitial(t *testing.T, baseURL string) {
 		t.Fatalf("Failed to decode response: %v", err)
 	}
 
-	balance, ok := result["balance"].(float64)
+	balance, ok := result["balance_sats"].(float64)
 	if !ok {
-		t.Fatal("Expected balance field in response")
+		t.Fatal("Expected balance_sats field in response")
 	}
 
-	t.Logf("Initial balance: %f BTC", balance)
+	t.Logf("Initial balance: %.0f sats", balance)
 
 	if balance != 0 {
-		t.Fatalf("Expected initial balance to be 0, got %f", balance)
+		t.Fatalf("Expected initial balance to be 0, got %.0f", balance)
 	}
 }
 
 func testGetUTXOsInitial(t *testing.T, baseURL string) {
-	resp, err := http.Get(baseURL + "/utxos")
+	resp, err := http.Get(baseURL + "/v1/utxos")
 	if err != nil {
 		t.Fatalf("Failed to get UTXOs: %v", err)
 	}
@@ -278,7 +388,7 @@ func testFullFlowWithFunds(t *testing.T, baseURL string, btcCfg config.BitcoinCo
 	// 5. Verify balance and UTXOs are non-zero
 
 	// Step 1: Get address from our wallet
-	resp, err := http.Get(baseURL + "/address")
+	resp, err := http.Post(baseURL+"/v1/addresses", "application/json", nil)
 	if err != nil {
 		t.Fatalf("Failed to get address: %v", err)
 	}
@@ -329,7 +439,7 @@ func testFullFlowWithFunds(t *testing.T, baseURL string, btcCfg config.BitcoinCo
 	t.Log("Step 4: Mined 1 block to confirm transaction")
 
 	// Step 5: Verify balance is non-zero
-	balanceResp, err := http.Get(baseURL + "/balance")
+	balanceResp, err := http.Get(baseURL + "/v1/balance")
 	if err != nil {
 		t.Fatalf("Failed to get balance: %v", err)
 	}
@@ -340,21 +450,17 @@ func testFullFlowWithFunds(t *testing.T, baseURL string, btcCfg config.BitcoinCo
 		t.Fatalf("Failed to decode balance response: %v", err)
 	}
 
-	balance, ok := balanceResult["balance"].(float64)
-	if !ok {
-		t.Fatal("Expected balance field in response")
-	}
-	t.Logf("Step 5: Balance after funding: %.8f BTC", balance)
-
-	if balance <= 0 {
-		t.Fatalf("Expected positive balance after funding, got %.8f", balance)
+	balanceSats, ok := balanceResult["balance_sats"].(float64)
+	t.Logf("Step 5: Balance after funding: %v BTC", balanceResult["balance_btc"])
+	if !ok || int64(balanceSats) != 150000000 {
+		t.Fatalf("Expected balance_sats 150000000, got %v", balanceResult["balance_sats"])
 	}
-	if balance < amountToSend-0.001 || balance > amountToSend+0.001 {
-		t.Logf("Warning: Balance %.8f differs from sent amount %.2f (fees may apply)", balance, amountToSend)
+	if balanceResult["balance_btc"] != "1.50000000" {
+		t.Fatalf("Expected balance_btc 1.50000000, got %v", balanceResult["balance_btc"])
 	}
 
 	// Step 6: Verify UTXOs are non-zero
-	utxosResp, err := http.Get(baseURL + "/utxos")
+	utxosResp, err := http.Get(baseURL + "/v1/utxos")
 	if err != nil {
 		t.Fatalf("Failed to get UTXOs: %v", err)
 	}
@@ -446,3 +552,905 @@ func sendToAddress(client *rpcclient.Client, address string, amount float64) (st
 
 	return txid, nil
 }
+
+func testReorgRollback(t *testing.T, w *wallet.Wallet, btcCfg config.BitcoinConfig) {
+	ctx := context.Background()
+	// This test verifies reorg handling:
+	// 1. Fund a wallet address and confirm it in block B
+	// 2. Invalidate B so the transaction returns to the mempool
+	// 3. Mine a longer branch which re-confirms the transaction
+	// 4. Verify the wallet emits a reorg event and moves the transaction
+
+	events, unsubscribe := w.Subscribe()
+	defer unsubscribe()
+
+	if err := w.SyncChain(ctx); err != nil {
+		t.Fatalf("Initial sync failed: %v", err)
+	}
+	start, err := w.HistoryStart(ctx)
+	if err != nil || start == nil {
+		t.Fatalf("Expected a history start after the first sync, got %+v, %v", start, err)
+	}
+	if _, err := w.BalanceAtHeight(ctx, start.Height-1); !errors.Is(err, wallet.ErrBeforeHistory) {
+		t.Fatalf("Expected ErrBeforeHistory before height %d, got %v", start.Height, err)
+	}
+
+	minerClient := createMinerWallet(t, btcCfg)
+	defer minerClient.Shutdown()
+
+	minerAddress, err := minerClient.GetNewAddress("mining", "bech32")
+	if err != nil {
+		t.Fatalf("Failed to get miner address: %v", err)
+	}
+
+	walletAddress, err := w.GetNewAddress(ctx)
+	if err != nil {
+		t.Fatalf("Failed to get wallet address: %v", err)
+	}
+
+	txid, err := sendToAddress(minerClient, walletAddress, 0.25)
+	if err != nil {
+		t.Fatalf("Failed to send funds: %v", err)
+	}
+
+	hashes, err := minerClient.GenerateToAddress(1, minerAddress, nil)
+	if err != nil {
+		t.Fatalf("Failed to mine block: %v", err)
+	}
+	orphaned := hashes[0].String()
+
+	if err := w.SyncChain(ctx); err != nil {
+		t.Fatalf("Sync failed: %v", err)
+	}
+	if tx := findTransaction(t, w, txid); tx == nil || tx.BlockHash != orphaned {
+		t.Fatalf("Expected %s to be recorded in block %s, got %+v", txid, orphaned, tx)
+	}
+
+	// Step 2: Invalidate the block containing our transaction
+	params := []json.RawMessage{json.RawMessage(fmt.Sprintf(`"%s"`, orphaned))}
+	if _, err := minerClient.RawRequest("invalidateblock", params); err != nil {
+		t.Fatalf("invalidateblock failed: %v", err)
+	}
+
+	// Step 3: Mine a longer branch; the transaction is mined again from the mempool
+	if _, err := minerClient.GenerateToAddress(2, minerAddress, nil); err != nil {
+		t.Fatalf("Failed to mine new branch: %v", err)
+	}
+
+	if err := w.SyncChain(ctx); err != nil {
+		t.Fatalf("Sync after reorg failed: %v", err)
+	}
+
+	// Step 4: Verify reorg event and updated transaction
+	select {
+	case e := <-events:
+		if e.Type != wallet.EventReorg {
+			t.Fatalf("Expected reorg event, got %s", e.Type)
+		}
+		if depth, _ := e.Data["depth"].(int64); depth != 1 {
+			t.Fatalf("Expected reorg depth 1, got %v", e.Data["depth"])
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for reorg event")
+	}
+
+	tx := findTransaction(t, w, txid)
+	if tx == nil {
+		t.Fatalf("Expected %s to be re-applied from the new branch", txid)
+	}
+	if tx.BlockHash == orphaned {
+		t.Fatalf("Transaction still recorded in orphaned block %s", orphaned)
+	}
+	t.Logf("Reorg test PASSED - %s moved from %s to %s", txid, orphaned, tx.BlockHash)
+}
+
+func findTransaction(t *testing.T, w *wallet.Wallet, txid string) *wallet.Transaction {
+	txs, err := w.ListTransactions(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to list transactions: %v", err)
+	}
+	for i := range txs {
+		if txs[i].TxID == txid {
+			return &txs[i]
+		}
+	}
+	return nil
+}
+
+func testIdempotency(t *testing.T, baseURL string) {
+	issue := func(path string) (*http.Response, string) {
+		req, err := http.NewRequest("POST", baseURL+path, nil)
+		if err != nil {
+			t.Fatalf("Failed to build request: %v", err)
+		}
+		req.Header.Set("Idempotency-Key", "order-42")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Failed to issue address: %v", err)
+		}
+		defer resp.Body.Close()
+		var result map[string]interface{}
+		json.NewDecoder(resp.Body).Decode(&result)
+		addr, _ := result["address"].(string)
+		return resp, addr
+	}
+
+	first, addr := issue("/v1/addresses")
+	if first.StatusCode != http.StatusCreated || addr == "" {
+		t.Fatalf("Expected 201 with an address, got %d", first.StatusCode)
+	}
+
+	retry, retryAddr := issue("/v1/addresses")
+	if retry.StatusCode != http.StatusCreated || retryAddr != addr {
+		t.Fatalf("Expected replay of %s, got %d %s", addr, retry.StatusCode, retryAddr)
+	}
+	if retry.Header.Get("Idempotent-Replayed") != "true" {
+		t.Fatal("Expected Idempotent-Replayed header on replay")
+	}
+
+	reused, _ := issue("/v1/addresses?label=other")
+	if reused.StatusCode != http.StatusUnprocessableEntity {
+		t.Fatalf("Expected 422 for reused key, got %d", reused.StatusCode)
+	}
+}
+
+func testGapLimit(t *testing.T, w *wallet.Wallet) {
+	ctx := context.Background()
+	gap, err := w.UnusedGap(ctx)
+	if err != nil {
+		t.Fatalf("Failed to get unused gap: %v", err)
+	}
+
+	// Allow exactly one more unused address
+	w.SetGapLimit(gap + 1)
+	defer w.SetGapLimit(0)
+
+	if _, err := w.GetNewAddress(ctx); err != nil {
+		t.Fatalf("Expected address within gap limit, got %v", err)
+	}
+
+	_, err = w.GetNewAddress(ctx)
+	var gapErr *wallet.GapLimitError
+	if !errors.As(err, &gapErr) {
+		t.Fatalf("Expected GapLimitError, got %v", err)
+	}
+	if gapErr.Unused != gap+1 {
+		t.Fatalf("Expected %d unused addresses, got %d", gap+1, gapErr.Unused)
+	}
+}
+
+// testConcurrentIssuance issues addresses in parallel and checks that none
+// is handed out twice and the stored index, seen through the unused gap,
+// covers all of them.
+func testConcurrentIssuance(t *testing.T, w *wallet.Wallet) {
+	ctx := context.Background()
+	const n = 8
+	before, err := w.UnusedGap(ctx)
+	if err != nil {
+		t.Fatalf("Failed to get unused gap: %v", err)
+	}
+
+	addrs := make(chan string, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			addr, err := w.GetNewAddress(ctx)
+			if err != nil {
+				t.Errorf("Failed to issue address: %v", err)
+				return
+			}
+			addrs <- addr
+		}()
+	}
+	wg.Wait()
+	close(addrs)
+
+	seen := make(map[string]bool)
+	for addr := range addrs {
+		if seen[addr] {
+			t.Errorf("Address %s issued twice", addr)
+		}
+		seen[addr] = true
+	}
+	after, err := w.UnusedGap(ctx)
+	if err != nil {
+		t.Fatalf("Failed to get unused gap: %v", err)
+	}
+	if after != before+n {
+		t.Errorf("Unused gap = %d after issuing %d addresses from %d", after, n, before)
+	}
+}
+
+// tenantXPUB is the key at m/1 below the default wallet's xpub, so no
+// address overlaps.
+const tenantXPUB = "tpubD8L452csQadSdxhC1HqPTxRJ5ybwcDYuucfq5D2ArM8t9mSPTUD7wfEYwQWuPim7GMuT1ZSFGKsiw28vZ5mLCVQPNmK5DQk43ScUXv7S8ik"
+
+// testWalletIsolation registers a second wallet and checks that it has its
+// own addresses and that a key restricted to it cannot see the default
+// wallet.
+func testWalletIsolation(t *testing.T, router http.Handler, baseURL string, keys *auth.Store) {
+	resp, err := http.Post(baseURL+"/v1/wallets", "application/json",
+		strings.NewReader(`{"name":"tenant","xpub":"`+tenantXPUB+`","script_type":"p2wpkh"}`))
+	if err != nil {
+		t.Fatalf("Failed to register wallet: %v", err)
+	}
+	var created struct {
+		Wallet wallet.Info `json:"wallet"`
+	}
+	json.NewDecoder(resp.Body).Decode(&created)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("Expected 201 registering a wallet, got %d", resp.StatusCode)
+	}
+	id := created.Wallet.ID
+
+	issue := func(path string) string {
+		resp, err := http.Post(baseURL+path, "application/json", nil)
+		if err != nil {
+			t.Fatalf("POST %s failed: %v", path, err)
+		}
+		defer resp.Body.Close()
+		var body struct {
+			Address string `json:"address"`
+		}
+		json.NewDecoder(resp.Body).Decode(&body)
+		if resp.StatusCode != http.StatusCreated {
+			t.Fatalf("POST %s = %d", path, resp.StatusCode)
+		}
+		return body.Address
+	}
+	addr := issue(fmt.Sprintf("/v1/wallets/%d/addresses", id))
+	if !strings.HasPrefix(addr, "bcrt1q") {
+		t.Errorf("Expected a native segwit address, got %s", addr)
+	}
+	if other := issue("/v1/wallets/1/addresses"); other == addr {
+		t.Errorf("Wallets issued the same address %s", addr)
+	}
+
+	// Registering the same xpub and script type again conflicts
+	resp, err = http.Post(baseURL+"/v1/wallets", "application/json",
+		strings.NewReader(`{"name":"tenant-2","xpub":"`+tenantXPUB+`","script_type":"p2wpkh"}`))
+	if err != nil {
+		t.Fatalf("Failed to register wallet: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusConflict {
+		t.Errorf("Expected 409 for a duplicate wallet, got %d", resp.StatusCode)
+	}
+
+	secret, _, err := keys.Create(context.Background(), "tenant", []string{auth.ScopeReadBalance}, &id)
+	if err != nil {
+		t.Fatalf("Failed to create key: %v", err)
+	}
+	for path, want := range map[string]int{
+		fmt.Sprintf("/v1/wallets/%d/utxos", id): http.StatusOK,
+		"/v1/wallets/1/utxos":                   http.StatusNotFound,
+		"/v1/utxos":                             http.StatusNotFound,
+	} {
+		req := httptest.NewRequest("GET", path, nil)
+		req.Header.Set("X-API-Key", secret)
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		if rec.Code != want {
+			t.Errorf("GET %s with tenant key = %d, want %d", path, rec.Code, want)
+		}
+	}
+}
+
+// testDescriptorWallet registers a wallet from a multipath taproot
+// descriptor and checks its addresses against bitcoind's, and that the
+// change chain is imported.
+func testDescriptorWallet(t *testing.T, baseURL string, btcCfg config.BitcoinConfig) {
+	body := "tr([d34db33f/86h/1h/0h]" + tenantXPUB + "/<0;1>/*)"
+	sum, err := descriptor.Checksum(body)
+	if err != nil {
+		t.Fatalf("Checksum failed: %v", err)
+	}
+	reqBody, _ := json.Marshal(map[string]string{"name": "taproot", "descriptor": body + "#" + sum})
+	resp, err := http.Post(baseURL+"/v1/wallets", "application/json", strings.NewReader(string(reqBody)))
+	if err != nil {
+		t.Fatalf("Failed to register wallet: %v", err)
+	}
+	var created struct {
+		Wallet wallet.Info `json:"wallet"`
+	}
+	json.NewDecoder(resp.Body).Decode(&created)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("Expected 201 registering a descriptor wallet, got %d", resp.StatusCode)
+	}
+	if created.Wallet.ScriptType != wallet.ScriptP2TR {
+		t.Errorf("script_type = %s, want p2tr", created.Wallet.ScriptType)
+	}
+
+	resp, err = http.Post(fmt.Sprintf("%s/v1/wallets/%d/addresses", baseURL, created.Wallet.ID), "application/json", nil)
+	if err != nil {
+		t.Fatalf("Failed to issue address: %v", err)
+	}
+	var issued struct {
+		Address string `json:"address"`
+	}
+	json.NewDecoder(resp.Body).Decode(&issued)
+	resp.Body.Close()
+
+	client, err := rpcclient.New(&rpcclient.ConnConfig{
+		Host:         fmt.Sprintf("%s/wallet/%s", btcCfg.RPCHost, created.Wallet.NodeWallet),
+		User:         btcCfg.RPCUser,
+		Pass:         btcCfg.RPCPass,
+		HTTPPostMode: true,
+		DisableTLS:   true,
+	}, nil)
+	if err != nil {
+		t.Fatalf("Failed to connect to bitcoind: %v", err)
+	}
+	defer client.Shutdown()
+
+	derive := func(branch string) string {
+		desc := "tr([d34db33f/86h/1h/0h]" + tenantXPUB + "/" + branch + "/*)"
+		sum, err := descriptor.Checksum(desc)
+		if err != nil {
+			t.Fatalf("Checksum failed: %v", err)
+		}
+		descJSON, _ := json.Marshal(desc + "#" + sum)
+		raw, err := client.RawRequest("deriveaddresses", []json.RawMessage{descJSON, json.RawMessage("[0,0]")})
+		if err != nil {
+			t.Fatalf("deriveaddresses failed: %v", err)
+		}
+		var addrs []string
+		if err := json.Unmarshal(raw, &addrs); err != nil || len(addrs) != 1 {
+			t.Fatalf("deriveaddresses returned %s", raw)
+		}
+		return addrs[0]
+	}
+	if want := derive("0"); issued.Address != want {
+		t.Errorf("Issued %s, bitcoind derives %s", issued.Address, want)
+	}
+
+	// The first change address is watched and marked as change
+	raw, err := client.RawRequest("getaddressinfo", []json.RawMessage{mustJSON(t, derive("1"))})
+	if err != nil {
+		t.Fatalf("getaddressinfo failed: %v", err)
+	}
+	var info struct {
+		IsWatchOnly bool `json:"iswatchonly"`
+		IsChange    bool `json:"ischange"`
+	}
+	json.Unmarshal(raw, &info)
+	if !info.IsWatchOnly || !info.IsChange {
+		t.Errorf("change address info = %s", raw)
+	}
+
+	// The issued address is found in the records, the change address by
+	// searching the chain
+	verify := func(address string) wallet.AddressVerification {
+		resp, err := http.Get(fmt.Sprintf("%s/v1/wallets/%d/addresses/%s/verify", baseURL, created.Wallet.ID, address))
+		if err != nil {
+			t.Fatalf("Failed to verify address: %v", err)
+		}
+		defer resp.Body.Close()
+		var v wallet.AddressVerification
+		json.NewDecoder(resp.Body).Decode(&v)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("Expected 200 verifying %s, got %d", address, resp.StatusCode)
+		}
+		return v
+	}
+	if v := verify(issued.Address); !v.Ours || !v.Issued || v.DerivationPath != "m/86h/1h/0h/0/0" || v.Decoded.Type != "p2tr" {
+		t.Errorf("verify issued address = %+v", v)
+	}
+	if v := verify(derive("1")); !v.Ours || v.Issued || v.Chain != wallet.ChainChange || v.DerivationPath != "m/86h/1h/0h/1/0" {
+		t.Errorf("verify change address = %+v", v)
+	}
+}
+
+// testMultisigWallet checks the descriptor package's multisig vectors
+// against bitcoind, then funds a 2-of-3 wallet and checks that its PSBT
+// carries every cosigner's derivation.
+func testMultisigWallet(t *testing.T, baseURL string, btcCfg config.BitcoinConfig) {
+	minerClient := createMinerWallet(t, btcCfg)
+	defer minerClient.Shutdown()
+
+	data, err := os.ReadFile("descriptor/testdata/multisig.json")
+	if err != nil {
+		t.Fatalf("Failed to read vectors: %v", err)
+	}
+	var vectors []struct {
+		Descriptor string `json:"descriptor"`
+		Index      int    `json:"index"`
+		Address    string `json:"address"`
+	}
+	if err := json.Unmarshal(data, &vectors); err != nil {
+		t.Fatalf("Failed to parse vectors: %v", err)
+	}
+	for _, v := range vectors {
+		rng := mustJSON(t, []int{v.Index, v.Index})
+		raw, err := minerClient.RawRequest("deriveaddresses", []json.RawMessage{mustJSON(t, v.Descriptor), rng})
+		if err != nil {
+			t.Fatalf("deriveaddresses failed: %v", err)
+		}
+		var addrs []string
+		if err := json.Unmarshal(raw, &addrs); err != nil || len(addrs) != 1 || addrs[0] != v.Address {
+			t.Errorf("%s at %d: bitcoind derives %s, want %s", v.Descriptor, v.Index, raw, v.Address)
+		}
+	}
+
+	keys := []string{
+		"[4ba43603/48h/1h/0h/2h]tpubDDwf2gdFxFahr9RUtDQCuZmsx34CfdZ7RALAirwC2FGeLBzW1TDiEpqFeRdxLdZD7rfsbZHYwSaT6CLM3TAcYRw6xfRv4U6KCQt4Zuhvjkz/<0;1>/*",
+		"[8dfc9b34/48h/1h/0h/2h]tpubDEXiq2SVhhqALktxfVFgj3C9M3T2G7xL11iezYg2LJAf245YkNyqp2K9TrvHABDCp2232k34UegU4aKEtUZNigit8EEqoLNe2JKMzMiLwYq/<0;1>/*",
+		"[56c4fac3/48h/1h/0h/2h]tpubDEg3kqr2jo5ergkJbFqRHvCpiob7wR7Hi44J7y987G1JZfbzBND77XKTyPZzGvh3uyDf8kexMJnFD9W8FuraJ4wLMsx6YuZVXRSRRcx6QdD/<0;1>/*",
+	}
+	body := "wsh(sortedmulti(2," + strings.Join(keys, ",") + "))"
+	sum, err := descriptor.Checksum(body)
+	if err != nil {
+		t.Fatalf("Checksum failed: %v", err)
+	}
+	reqBody := mustJSON(t, map[string]string{"name": "multisig", "descriptor": body + "#" + sum})
+	resp, err := http.Post(baseURL+"/v1/wallets", "application/json", strings.NewReader(string(reqBody)))
+	if err != nil {
+		t.Fatalf("Failed to register wallet: %v", err)
+	}
+	var created struct {
+		Wallet wallet.Info `json:"wallet"`
+	}
+	json.NewDecoder(resp.Body).Decode(&created)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated || created.Wallet.ScriptType != wallet.ScriptP2WSH {
+		t.Fatalf("Registering a multisig wallet = %d, script_type %s", resp.StatusCode, created.Wallet.ScriptType)
+	}
+	walletURL := fmt.Sprintf("%s/v1/wallets/%d", baseURL, created.Wallet.ID)
+
+	resp, err = http.Post(walletURL+"/addresses", "application/json", nil)
+	if err != nil {
+		t.Fatalf("Failed to issue address: %v", err)
+	}
+	var issued struct {
+		Address string `json:"address"`
+	}
+	json.NewDecoder(resp.Body).Decode(&issued)
+	resp.Body.Close()
+	if issued.Address != vectors[0].Address {
+		t.Errorf("Issued %s, want %s", issued.Address, vectors[0].Address)
+	}
+
+	minerAddress, err := minerClient.GetNewAddress("mining", "bech32")
+	if err != nil {
+		t.Fatalf("Failed to get miner address: %v", err)
+	}
+	if _, err := sendToAddress(minerClient, issued.Address, 0.5); err != nil {
+		t.Fatalf("Failed to send funds: %v", err)
+	}
+	if _, err := minerClient.GenerateToAddress(1, minerAddress, nil); err != nil {
+		t.Fatalf("Failed to mine confirmation block: %v", err)
+	}
+
+	reqBody = mustJSON(t, map[string]interface{}{
+		"outputs":         []map[string]interface{}{{"address": minerAddress.EncodeAddress(), "amount_sats": 10_000_000}},
+		"fee_rate_sat_vb": 2,
+	})
+	resp, err = http.Post(walletURL+"/psbt", "application/json", strings.NewReader(string(reqBody)))
+	if err != nil {
+		t.Fatalf("Failed to create PSBT: %v", err)
+	}
+	var psbtResp struct {
+		PSBT          string `json:"psbt"`
+		FeeSats       int64  `json:"fee_sats"`
+		ChangeAddress string `json:"change_address"`
+	}
+	json.NewDecoder(resp.Body).Decode(&psbtResp)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || psbtResp.ChangeAddress == "" {
+		t.Fatalf("POST psbt = %d, change address %q", resp.StatusCode, psbtResp.ChangeAddress)
+	}
+
+	raw, err := minerClient.RawRequest("decodepsbt", []json.RawMessage{mustJSON(t, psbtResp.PSBT)})
+	if err != nil {
+		t.Fatalf("decodepsbt failed: %v", err)
+	}
+	var decoded struct {
+		Inputs []struct {
+			WitnessScript *struct{} `json:"witness_script"`
+			Derivations   []struct {
+				Fingerprint string `json:"master_fingerprint"`
+				Path        string `json:"path"`
+			} `json:"bip32_derivs"`
+		} `json:"inputs"`
+		Outputs []struct {
+			Derivations []struct {
+				Path string `json:"path"`
+			} `json:"bip32_derivs"`
+		} `json:"outputs"`
+		Fee float64 `json:"fee"`
+	}
+	if err := json.Unmarshal(raw, &decoded); err != nil {
+		t.Fatalf("Failed to parse decodepsbt: %v", err)
+	}
+	if len(decoded.Inputs) != 1 || decoded.Inputs[0].WitnessScript == nil || len(decoded.Inputs[0].Derivations) != 3 {
+		t.Fatalf("decoded inputs = %s", raw)
+	}
+	for _, d := range decoded.Inputs[0].Derivations {
+		if !strings.HasPrefix(d.Path, "m/48h/1h/0h/2h/0/0") && !strings.HasPrefix(d.Path, "m/48'/1'/0'/2'/0/0") {
+			t.Errorf("input derivation %s: %s", d.Fingerprint, d.Path)
+		}
+	}
+	if len(decoded.Outputs) != 2 || len(decoded.Outputs[1].Derivations) != 3 {
+		t.Errorf("decoded outputs = %s", raw)
+	}
+	if fee, _ := btcutil.NewAmount(decoded.Fee); int64(fee) != psbtResp.FeeSats {
+		t.Errorf("fee_sats = %d, bitcoind computes %d", psbtResp.FeeSats, fee)
+	}
+}
+
+// testMaster returns a regtest master key from a seed of b bytes and its
+// xpub.
+func testMaster(t *testing.T, b byte) (*hdkeychain.ExtendedKey, string) {
+	t.Helper()
+	master, err := hdkeychain.NewMaster(bytes.Repeat([]byte{b}, hdkeychain.RecommendedSeedLen), &chaincfg.RegressionNetParams)
+	if err != nil {
+		t.Fatalf("NewMaster failed: %v", err)
+	}
+	xpub, err := master.Neuter()
+	if err != nil {
+		t.Fatalf("Neuter failed: %v", err)
+	}
+	return master, xpub.String()
+}
+
+// testChangeOutputs spends a coin of a wallet with a change chain through
+// CreatePSBT, which reserves it against a second PSBT, and checks that
+// block processing keeps the change: the
+// ledger shows the net amount and the balance the change, also in an OFX
+// statement of a later day without transactions.
+func testChangeOutputs(t *testing.T, wallets *wallet.Manager, baseURL string, btcCfg config.BitcoinConfig) {
+	ctx := context.Background()
+	minerClient := createMinerWallet(t, btcCfg)
+	defer minerClient.Shutdown()
+	minerAddress, err := minerClient.GetNewAddress("mining", "bech32")
+	if err != nil {
+		t.Fatalf("Failed to get miner address: %v", err)
+	}
+
+	master, xpub := testMaster(t, 0x6b)
+	body := "wpkh(" + xpub + "/<0;1>/*)"
+	sum, err := descriptor.Checksum(body)
+	if err != nil {
+		t.Fatalf("Checksum failed: %v", err)
+	}
+	w, err := wallets.Create(ctx, wallet.Definition{Name: "change", Descriptor: body + "#" + sum})
+	if err != nil {
+		t.Fatalf("Failed to register wallet: %v", err)
+	}
+	// The first sync starts the wallet's history at the tip
+	if err := w.SyncChain(ctx); err != nil {
+		t.Fatalf("SyncChain failed: %v", err)
+	}
+
+	funded, err := w.GetNewAddress(ctx)
+	if err != nil {
+		t.Fatalf("Failed to issue address: %v", err)
+	}
+	if _, err := sendToAddress(minerClient, funded, 0.5); err != nil {
+		t.Fatalf("Failed to send funds: %v", err)
+	}
+	if _, err := minerClient.GenerateToAddress(1, minerAddress, nil); err != nil {
+		t.Fatalf("Failed to mine confirmation block: %v", err)
+	}
+	if err := w.SyncChain(ctx); err != nil {
+		t.Fatalf("SyncChain failed: %v", err)
+	}
+
+	const payment = 10_000_000
+	created, err := w.CreatePSBT(ctx, []wallet.Payment{{Address: minerAddress.EncodeAddress(), Amount: payment}}, 2)
+	if err != nil {
+		t.Fatalf("CreatePSBT failed: %v", err)
+	}
+	if created.ChangeAddress == "" {
+		t.Fatal("CreatePSBT made no change output")
+	}
+	// The only coin is reserved for the first PSBT
+	_, err = w.CreatePSBT(ctx, []wallet.Payment{{Address: minerAddress.EncodeAddress(), Amount: payment}}, 2)
+	var insufficient *wallet.InsufficientFundsError
+	if !errors.As(err, &insufficient) || insufficient.Available != 0 {
+		t.Fatalf("Second CreatePSBT = %v, want insufficient funds with the coin reserved", err)
+	}
+	packet, err := psbt.NewFromRawBytes(strings.NewReader(created.Base64), true)
+	if err != nil {
+		t.Fatalf("Failed to parse PSBT: %v", err)
+	}
+	if packet, err = (keySigner{master: master}).SignPSBT(ctx, w.ID(), packet); err != nil {
+		t.Fatalf("Failed to sign PSBT: %v", err)
+	}
+	if err := psbt.MaybeFinalizeAll(packet); err != nil {
+		t.Fatalf("Failed to finalize PSBT: %v", err)
+	}
+	tx, err := psbt.Extract(packet)
+	if err != nil {
+		t.Fatalf("Failed to extract transaction: %v", err)
+	}
+	if _, err := minerClient.SendRawTransaction(tx, false); err != nil {
+		t.Fatalf("Failed to broadcast spend: %v", err)
+	}
+	if _, err := minerClient.GenerateToAddress(1, minerAddress, nil); err != nil {
+		t.Fatalf("Failed to mine confirmation block: %v", err)
+	}
+	if err := w.SyncChain(ctx); err != nil {
+		t.Fatalf("SyncChain failed: %v", err)
+	}
+
+	want := int64(50_000_000 - payment - created.Fee)
+	entries, err := w.Ledger(ctx, time.Time{}, time.Time{})
+	if err != nil {
+		t.Fatalf("Ledger failed: %v", err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("Ledger has %d entries, want 2", len(entries))
+	}
+	spend := entries[1]
+	if spend.TxID != tx.TxHash().String() || spend.AmountSats != -int64(payment+created.Fee) || spend.BalanceSats != want {
+		t.Errorf("Spend entry = %s %d, balance %d; want %s %d, balance %d",
+			spend.TxID, spend.AmountSats, spend.BalanceSats, tx.TxHash(), -int64(payment+created.Fee), want)
+	}
+	if spend.FeeSats == nil || *spend.FeeSats != int64(created.Fee) {
+		t.Errorf("Spend fee = %v, want %d", spend.FeeSats, created.Fee)
+	}
+	tip, err := minerClient.GetBlockCount()
+	if err != nil {
+		t.Fatalf("GetBlockCount failed: %v", err)
+	}
+	if balance, err := w.BalanceAtHeight(ctx, tip); err != nil || int64(balance) != want {
+		t.Errorf("BalanceAtHeight(%d) = %d, %v; want %d", tip, balance, err, want)
+	}
+
+	day := time.Now().UTC().AddDate(0, 0, 1).Format(time.DateOnly)
+	resp, err := http.Get(fmt.Sprintf("%s/v1/wallets/%d/export/transactions?format=ofx&from=%s&to=%s", baseURL, w.ID(), day, day))
+	if err != nil {
+		t.Fatalf("Failed to export OFX: %v", err)
+	}
+	ofx, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("OFX export = %d, %v", resp.StatusCode, err)
+	}
+	balAmt := fmt.Sprintf("<BALAMT>%d.%08d</BALAMT>", want/btcutil.SatoshiPerBitcoin, want%btcutil.SatoshiPerBitcoin)
+	if !strings.Contains(string(ofx), balAmt) || strings.Contains(string(ofx), "<STMTTRN>") {
+		t.Errorf("OFX export of an empty range, want %s:\n%s", balAmt, ofx)
+	}
+}
+
+// testPayjoinFallback makes a payjoin request whose original the fallback
+// broadcasts, then a second one, which must get a proposal with another
+// coin, as a coin offered once is never offered again.
+func testPayjoinFallback(t *testing.T, wallets *wallet.Manager, btcCfg config.BitcoinConfig) {
+	ctx := context.Background()
+	minerClient := createMinerWallet(t, btcCfg)
+	defer minerClient.Shutdown()
+	minerAddress, err := minerClient.GetNewAddress("mining", "bech32")
+	if err != nil {
+		t.Fatalf("Failed to get miner address: %v", err)
+	}
+
+	master, xpub := testMaster(t, 0x5a)
+	w, err := wallets.Create(ctx, wallet.Definition{Name: "payjoin", XPUB: xpub})
+	if err != nil {
+		t.Fatalf("Failed to register wallet: %v", err)
+	}
+	// Originals are due for the fallback right away
+	w.SetPayjoin(keySigner{master: master}, 0)
+	w.Start(ctx)
+	defer w.Stop()
+
+	// The wallet's only coin
+	funded, err := w.GetNewAddress(ctx)
+	if err != nil {
+		t.Fatalf("Failed to issue address: %v", err)
+	}
+	if _, err := sendToAddress(minerClient, funded, 0.5); err != nil {
+		t.Fatalf("Failed to send funds: %v", err)
+	}
+	if _, err := minerClient.GenerateToAddress(1, minerAddress, nil); err != nil {
+		t.Fatalf("Failed to mine confirmation block: %v", err)
+	}
+
+	firstTxid, firstCoin := payjoinRequest(t, w, payjoinOriginal(t, w, minerClient))
+	deadline := time.Now().Add(30 * time.Second)
+	for {
+		if _, err := minerClient.RawRequest("getmempoolentry", []json.RawMessage{mustJSON(t, firstTxid)}); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Fallback did not broadcast original %s", firstTxid)
+		}
+		time.Sleep(time.Second)
+	}
+	// The offered coin stays unspent, and the payment is a second coin
+	if _, err := minerClient.GenerateToAddress(1, minerAddress, nil); err != nil {
+		t.Fatalf("Failed to mine confirmation block: %v", err)
+	}
+
+	_, secondCoin := payjoinRequest(t, w, payjoinOriginal(t, w, minerClient))
+	if secondCoin == firstCoin {
+		t.Errorf("Coin %s was offered twice", firstCoin)
+	}
+}
+
+// testPayjoinSignerFailure checks that a proposal the signer fails to
+// sign claims nothing, so the wallet's only coin is offered again.
+func testPayjoinSignerFailure(t *testing.T, wallets *wallet.Manager, btcCfg config.BitcoinConfig) {
+	ctx := context.Background()
+	minerClient := createMinerWallet(t, btcCfg)
+	defer minerClient.Shutdown()
+	minerAddress, err := minerClient.GetNewAddress("mining", "bech32")
+	if err != nil {
+		t.Fatalf("Failed to get miner address: %v", err)
+	}
+
+	master, xpub := testMaster(t, 0x7c)
+	w, err := wallets.Create(ctx, wallet.Definition{Name: "payjoin-signer", XPUB: xpub})
+	if err != nil {
+		t.Fatalf("Failed to register wallet: %v", err)
+	}
+	signer := &failingSigner{Signer: keySigner{master: master}, failures: 1}
+	w.SetPayjoin(signer, time.Hour)
+
+	funded, err := w.GetNewAddress(ctx)
+	if err != nil {
+		t.Fatalf("Failed to issue address: %v", err)
+	}
+	fundTxid, err := sendToAddress(minerClient, funded, 0.5)
+	if err != nil {
+		t.Fatalf("Failed to send funds: %v", err)
+	}
+	if _, err := minerClient.GenerateToAddress(1, minerAddress, nil); err != nil {
+		t.Fatalf("Failed to mine confirmation block: %v", err)
+	}
+
+	original := payjoinOriginal(t, w, minerClient)
+	if _, err := w.Payjoin(ctx, original, wallet.PayjoinParams{AdditionalFeeOutputIndex: -1}); err == nil {
+		t.Fatal("Payjoin succeeded with a failing signer")
+	}
+	// Nothing was recorded, so even the same original is accepted again
+	_, coin := payjoinRequest(t, w, original)
+	if coin.Hash.String() != fundTxid {
+		t.Errorf("Proposal adds %s, want the funded coin of %s", coin, fundTxid)
+	}
+}
+
+// failingSigner fails its first failures calls, then signs with Signer.
+type failingSigner struct {
+	wallet.Signer
+	failures int
+}
+
+func (s *failingSigner) SignPSBT(ctx context.Context, walletID int64, p *psbt.Packet) (*psbt.Packet, error) {
+	if s.failures > 0 {
+		s.failures--
+		return nil, errors.New("signer unavailable")
+	}
+	return s.Signer.SignPSBT(ctx, walletID, p)
+}
+
+// payjoinOriginal has the miner sign an original PSBT paying 0.1 BTC to a
+// new address of w.
+func payjoinOriginal(t *testing.T, w *wallet.Wallet, minerClient *rpcclient.Client) string {
+	t.Helper()
+	addr, err := w.GetNewAddress(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to issue address: %v", err)
+	}
+	raw, err := minerClient.RawRequest("walletcreatefundedpsbt", []json.RawMessage{
+		mustJSON(t, []interface{}{}),
+		mustJSON(t, []map[string]float64{{addr: 0.1}}),
+		mustJSON(t, 0),
+		mustJSON(t, map[string]interface{}{"fee_rate": 10}),
+	})
+	if err != nil {
+		t.Fatalf("walletcreatefundedpsbt failed: %v", err)
+	}
+	var created struct {
+		PSBT string `json:"psbt"`
+	}
+	if err := json.Unmarshal(raw, &created); err != nil {
+		t.Fatalf("Failed to parse walletcreatefundedpsbt: %v", err)
+	}
+	raw, err = minerClient.RawRequest("walletprocesspsbt", []json.RawMessage{mustJSON(t, created.PSBT)})
+	if err != nil {
+		t.Fatalf("walletprocesspsbt failed: %v", err)
+	}
+	var signed struct {
+		PSBT     string `json:"psbt"`
+		Complete bool   `json:"complete"`
+	}
+	if err := json.Unmarshal(raw, &signed); err != nil || !signed.Complete {
+		t.Fatalf("walletprocesspsbt = %s, %v", raw, err)
+	}
+	return signed.PSBT
+}
+
+// payjoinRequest sends the original PSBT b64 to w. It returns the
+// original's txid and the coin the proposal adds.
+func payjoinRequest(t *testing.T, w *wallet.Wallet, b64 string) (string, wire.OutPoint) {
+	t.Helper()
+	proposal, err := w.Payjoin(context.Background(), b64, wallet.PayjoinParams{AdditionalFeeOutputIndex: -1})
+	if err != nil {
+		t.Fatalf("Payjoin failed: %v", err)
+	}
+	original, err := psbt.NewFromRawBytes(strings.NewReader(b64), true)
+	if err != nil {
+		t.Fatalf("Failed to parse original: %v", err)
+	}
+	packet, err := psbt.NewFromRawBytes(strings.NewReader(proposal), true)
+	if err != nil {
+		t.Fatalf("Failed to parse proposal: %v", err)
+	}
+	sender := make(map[wire.OutPoint]bool)
+	for _, in := range original.UnsignedTx.TxIn {
+		sender[in.PreviousOutPoint] = true
+	}
+	for _, in := range packet.UnsignedTx.TxIn {
+		if !sender[in.PreviousOutPoint] {
+			return original.UnsignedTx.TxHash().String(), in.PreviousOutPoint
+		}
+	}
+	t.Fatal("Proposal adds no input")
+	return "", wire.OutPoint{}
+}
+
+// keySigner is the payjoin signer hook of a p2wpkh wallet on the xpub of
+// master, signing with its private keys.
+type keySigner struct {
+	master *hdkeychain.ExtendedKey
+}
+
+func (s keySigner) SignPSBT(_ context.Context, _ int64, p *psbt.Packet) (*psbt.Packet, error) {
+	prevOuts := txscript.NewMultiPrevOutFetcher(nil)
+	for i, in := range p.Inputs {
+		if in.WitnessUtxo != nil {
+			prevOuts.AddPrevOut(p.UnsignedTx.TxIn[i].PreviousOutPoint, in.WitnessUtxo)
+		}
+	}
+	hashes := txscript.NewTxSigHashes(p.UnsignedTx, prevOuts)
+	updater, err := psbt.NewUpdater(p)
+	if err != nil {
+		return nil, err
+	}
+	for i, in := range p.Inputs {
+		for _, d := range in.Bip32Derivation {
+			key := s.master
+			for _, step := range d.Bip32Path {
+				if key, err = key.Derive(step); err != nil {
+					return nil, err
+				}
+			}
+			priv, err := key.ECPrivKey()
+			if err != nil {
+				return nil, err
+			}
+			addr, err := btcutil.NewAddressPubKeyHash(btcutil.Hash160(d.PubKey), &chaincfg.RegressionNetParams)
+			if err != nil {
+				return nil, err
+			}
+			script, err := txscript.PayToAddrScript(addr)
+			if err != nil {
+				return nil, err
+			}
+			sig, err := txscript.RawTxInWitnessSignature(p.UnsignedTx, hashes, i, in.WitnessUtxo.Value, script, txscript.SigHashAll, priv)
+			if err != nil {
+				return nil, err
+			}
+			if _, err := updater.Sign(i, sig, d.PubKey, nil, nil); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return p, nil
+}
+
+func mustJSON(t *testing.T, v interface{}) json.RawMessage {
+	t.Helper()
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatalf("Failed to marshal: %v", err)
+	}
+	return b
+}
@@ -0,0 +1,128 @@
+// Package logging configures structured logging. Records logged with a
+// request's context carry its request and trace IDs, and secrets are
+// redacted from every record.
+package logging
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"regexp"
+	"strings"
+
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/sawdustofmind/bitcoin-wallet/backend/config"
+	"github.com/sawdustofmind/bitcoin-wallet/backend/requestid"
+)
+
+const redacted = "[REDACTED]"
+
+// sensitiveKeys are attribute keys whose values are never logged.
+var sensitiveKeys = map[string]bool{
+	"password":      true,
+	"pass":          true,
+	"secret":        true,
+	"api_key":       true,
+	"authorization": true,
+	"xpub":          true,
+	"descriptor":    true,
+}
+
+var (
+	// extendedKey matches BIP32 extended public and private keys on any
+	// network (xpub, tpub, zpub, ...).
+	extendedKey = regexp.MustCompile(`\b[a-zA-Z]{1,2}(?:pub|prv)[1-9A-HJ-NP-Za-km-z]{100,}`)
+	// urlCredentials matches the user:password part of a URL.
+	urlCredentials = regexp.MustCompile(`(\w+://)[^/\s:@]+:[^/\s@]+@`)
+	// apiKeySecret matches secrets issued by the auth package.
+	apiKeySecret = regexp.MustCompile(`\bbw_[A-Za-z0-9_-]{16,}`)
+)
+
+// New returns a logger writing cfg.Format records at cfg.Level or above to
+// w. Occurrences of secrets, e.g. configured RPC and database passwords,
+// are redacted along with extended keys, URL credentials and API keys.
+func New(w io.Writer, cfg config.LogConfig, secrets ...string) *slog.Logger {
+	r := newRedactor(secrets)
+	opts := &slog.HandlerOptions{Level: cfg.Level, ReplaceAttr: r.replaceAttr}
+	var h slog.Handler
+	if cfg.Format == config.LogFormatText {
+		h = slog.NewTextHandler(w, opts)
+	} else {
+		h = slog.NewJSONHandler(w, opts)
+	}
+	return slog.New(contextHandler{h, r})
+}
+
+// Setup makes New's logger the default, which the standard log package
+// also writes through.
+func Setup(w io.Writer, cfg config.LogConfig, secrets ...string) {
+	slog.SetDefault(New(w, cfg, secrets...))
+}
+
+// contextHandler adds request and trace IDs from the record's context.
+type contextHandler struct {
+	slog.Handler
+	r *redactor
+}
+
+func (h contextHandler) Handle(ctx context.Context, rec slog.Record) error {
+	rec.Message = h.r.redact(rec.Message)
+	if id := requestid.ID(ctx); id != "" {
+		rec.AddAttrs(slog.String("request_id", id))
+	}
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		rec.AddAttrs(slog.String("trace_id", sc.TraceID().String()))
+	}
+	return h.Handler.Handle(ctx, rec)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs), h.r}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name), h.r}
+}
+
+type redactor struct {
+	secrets *strings.Replacer
+}
+
+func newRedactor(secrets []string) *redactor {
+	var pairs []string
+	for _, s := range secrets {
+		if s != "" {
+			pairs = append(pairs, s, redacted)
+		}
+	}
+	r := &redactor{}
+	if len(pairs) > 0 {
+		r.secrets = strings.NewReplacer(pairs...)
+	}
+	return r
+}
+
+func (r *redactor) redact(s string) string {
+	if r.secrets != nil {
+		s = r.secrets.Replace(s)
+	}
+	s = extendedKey.ReplaceAllString(s, redacted)
+	s = urlCredentials.ReplaceAllString(s, "${1}"+redacted+"@")
+	return apiKeySecret.ReplaceAllString(s, "bw_"+redacted)
+}
+
+func (r *redactor) replaceAttr(_ []string, a slog.Attr) slog.Attr {
+	if sensitiveKeys[strings.ToLower(a.Key)] {
+		return slog.String(a.Key, redacted)
+	}
+	switch a.Value.Kind() {
+	case slog.KindString:
+		return slog.String(a.Key, r.redact(a.Value.String()))
+	case slog.KindAny:
+		if err, ok := a.Value.Any().(error); ok {
+			return slog.String(a.Key, r.redact(err.Error()))
+		}
+	}
+	return a
+}
@@ -1,62 +1,213 @@
 package main
 
 import (
-	"log"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
 	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/sawdustofmind/bitcoin-wallet/backend/api"
+	"github.com/sawdustofmind/bitcoin-wallet/backend/auth"
 	"github.com/sawdustofmind/bitcoin-wallet/backend/config"
 	"github.com/sawdustofmind/bitcoin-wallet/backend/db"
+	"github.com/sawdustofmind/bitcoin-wallet/backend/grpcapi"
+	"github.com/sawdustofmind/bitcoin-wallet/backend/health"
+	"github.com/sawdustofmind/bitcoin-wallet/backend/idempotency"
+	"github.com/sawdustofmind/bitcoin-wallet/backend/logging"
+	"github.com/sawdustofmind/bitcoin-wallet/backend/ratelimit"
+	"github.com/sawdustofmind/bitcoin-wallet/backend/server"
+	"github.com/sawdustofmind/bitcoin-wallet/backend/tracing"
 	"github.com/sawdustofmind/bitcoin-wallet/backend/wallet"
 
 	"github.com/gin-gonic/gin"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 )
 
 func main() {
+	// SIGINT and SIGTERM start a graceful shutdown; a second signal kills
+	// the process
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
 	cfg, err := config.Load()
 	if err != nil {
-		log.Fatalf("Failed to load config: %v", err)
+		fatal("Failed to load config", err)
 	}
+	logging.Setup(os.Stdout, cfg.Log, cfg.Bitcoin.RPCPass, cfg.DB.Password, cfg.Auth.AdminAPIKey, cfg.XPUB)
+
+	shutdownTracing, err := tracing.Setup(context.Background(), cfg.Tracing)
+	if err != nil {
+		fatal("Failed to set up tracing", err)
+	}
+	defer shutdownTracing(context.Background())
 
 	database, err := db.Connect(cfg.DB)
 	if err != nil {
-		log.Fatalf("Failed to connect to database: %v", err)
+		fatal("Failed to connect to database", err)
 	}
-	defer database.Close()
+	// Closed last, after the servers and wallet have drained
+	defer func() {
+		if err := database.Close(); err != nil {
+			slog.Error("Failed to close database", "error", err)
+		}
+	}()
 
-	w, err := wallet.New(cfg.Bitcoin, cfg.XPUB, database)
+	wallets, err := wallet.NewManager(ctx, cfg.Bitcoin, database)
 	if err != nil {
-		log.Fatalf("Failed to initialize wallet: %v", err)
+		fatal("Failed to connect to bitcoind", err)
+	}
+	wallets.SetGapLimit(cfg.Limits.GapLimit)
+	if cfg.Payjoin.Enabled() {
+		wallets.SetPayjoin(wallet.NewHTTPSigner(cfg.Payjoin.SignerURL, cfg.Payjoin.SignerTimeout), cfg.Payjoin.FallbackTimeout)
+	}
+	if cfg.XPUB != "" || cfg.Descriptor != "" {
+		def := wallet.Definition{XPUB: cfg.XPUB, Descriptor: cfg.Descriptor, ChangeDescriptor: cfg.ChangeDescriptor}
+		if err := wallets.RegisterDefault(ctx, def); err != nil {
+			fatal("Failed to register default wallet", err)
+		}
+	}
+	if err := wallets.Load(ctx); err != nil {
+		fatal("Failed to initialize wallets", err)
+	}
+
+	keys := auth.NewStore(database)
+	if cfg.Auth.AdminAPIKey != "" {
+		if err := keys.Bootstrap(ctx, cfg.Auth.AdminAPIKey); err != nil {
+			fatal("Failed to register bootstrap admin key", err)
+		}
+	} else {
+		slog.Warn("ADMIN_API_KEY not set; only existing API keys can access the API")
 	}
 
 	// Start wallet background tasks (e.g. scanning)
-	go w.Start()
+	wallets.Start(ctx)
 
-	r := gin.Default()
+	r := gin.New()
+	r.Use(logging.Recovery())
 
-	// Manual CORS middleware
-	r.Use(func(c *gin.Context) {
-		c.Writer.Header().Set("Access-Control-Allow-Origin", "*")
-		c.Writer.Header().Set("Access-Control-Allow-Credentials", "true")
-		c.Writer.Header().Set("Access-Control-Allow-Headers", "Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, accept, origin, Cache-Control, X-Requested-With")
-		c.Writer.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS, GET, PUT")
+	r.Use(server.CORS(cfg.HTTP.CORS))
 
-		if c.Request.Method == "OPTIONS" {
-			c.AbortWithStatus(204)
-			return
-		}
+	readiness := health.NewChecker(5*time.Second, db.ReadinessCheck(database))
+	readiness.Add(wallets.ReadinessChecks(cfg.Bitcoin.MaxTipAge)...)
+
+	// Limits are shared so a key has one budget across REST and gRPC
+	limiter := ratelimit.New(cfg.Limits.RequestsPerSecond, cfg.Limits.Burst)
+	quota := ratelimit.NewQuota(database, cfg.Limits.DailyAddressQuota)
 
-		c.Next()
+	api.RegisterRoutes(r, wallets, api.Deps{
+		Keys:    keys,
+		Limiter: limiter,
+		Quota:   quota,
+
+		Idempotency:  idempotency.NewStore(database, cfg.HTTP.IdempotencyTTL),
+		LegacyRoutes: cfg.HTTP.LegacyRoutes,
+		Readiness:    readiness,
+		PayjoinURL:   cfg.Payjoin.PublicURL,
 	})
 
-	api.RegisterRoutes(r, w)
+	var certs *server.CertReloader
+	if cfg.HTTP.TLS.Enabled() {
+		certs, err = server.NewCertReloader(cfg.HTTP.TLS)
+		if err != nil {
+			fatal("Failed to load TLS configuration", err)
+		}
+		certs.WatchSIGHUP()
+	}
 
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8080"
+	var grpcOpts []grpc.ServerOption
+	if certs != nil {
+		grpcOpts = append(grpcOpts, grpc.Creds(credentials.NewTLS(certs.TLSConfig("h2"))))
+	}
+	grpcSrv := grpcapi.NewServer(grpcapi.FromManager(wallets), grpcapi.Deps{Keys: keys, Limiter: limiter, Quota: quota}, grpcOpts...)
+	lis, err := net.Listen("tcp", ":"+cfg.HTTP.GRPCPort)
+	if err != nil {
+		fatal("Failed to listen for gRPC", err)
 	}
 
-	if err := r.Run(":" + port); err != nil {
-		log.Fatalf("Failed to run server: %v", err)
+	srv := &http.Server{
+		Addr:    ":" + cfg.HTTP.Port,
+		Handler: r,
+	}
+	if certs != nil {
+		srv.TLSConfig = certs.TLSConfig()
 	}
+
+	serveErr := make(chan error, 2)
+	go func() {
+		slog.Info("Serving gRPC", "addr", lis.Addr().String())
+		if err := grpcSrv.Serve(lis); err != nil {
+			serveErr <- fmt.Errorf("gRPC server: %v", err)
+		}
+	}()
+	go func() {
+		var err error
+		if certs != nil {
+			slog.Info("Serving HTTPS", "addr", srv.Addr)
+			err = srv.ListenAndServeTLS("", "")
+		} else {
+			slog.Info("Serving HTTP", "addr", srv.Addr)
+			err = srv.ListenAndServe()
+		}
+		if !errors.Is(err, http.ErrServerClosed) {
+			serveErr <- fmt.Errorf("HTTP server: %v", err)
+		}
+	}()
+
+	select {
+	case <-ctx.Done():
+		slog.Info("Shutting down", "timeout", cfg.HTTP.ShutdownTimeout)
+	case err := <-serveErr:
+		slog.Error("Server failed, shutting down", "error", err)
+	}
+	stop()
+
+	shutdown(cfg.HTTP.ShutdownTimeout, srv, grpcSrv, wallets)
+}
+
+// shutdown stops accepting requests, drains in-flight ones for up to
+// timeout and then stops the wallets, in that order so nothing issues
+// addresses against a stopped wallet or closed database.
+func shutdown(timeout time.Duration, srv *http.Server, grpcSrv *grpc.Server, wallets *wallet.Manager) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		if err := srv.Shutdown(ctx); err != nil {
+			slog.Warn("HTTP requests did not drain in time", "error", err)
+			srv.Close()
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		drained := make(chan struct{})
+		go func() {
+			grpcSrv.GracefulStop()
+			close(drained)
+		}()
+		select {
+		case <-drained:
+		case <-ctx.Done():
+			slog.Warn("gRPC requests did not drain in time")
+			grpcSrv.Stop()
+		}
+	}()
+	wg.Wait()
+
+	wallets.Stop()
+}
+
+func fatal(msg string, err error) {
+	slog.Error(msg, "error", err)
+	os.Exit(1)
 }
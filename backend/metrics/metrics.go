@@ -0,0 +1,129 @@
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	httpDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "http_request_duration_seconds",
+		Help:    "HTTP request latency by route, method and status code.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "route", "status"})
+
+	rpcDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "bitcoind_rpc_duration_seconds",
+		Help:    "bitcoind RPC latency by method. The count is the number of calls.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method"})
+	rpcErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "bitcoind_rpc_errors_total",
+		Help: "Failed bitcoind RPCs by method.",
+	}, []string{"method"})
+
+	queryDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "db_query_duration_seconds",
+		Help:    "Postgres statement latency by operation (select, insert, ...).",
+		Buckets: []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1},
+	}, []string{"operation"})
+	queryErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "db_query_errors_total",
+		Help: "Failed Postgres statements by operation.",
+	}, []string{"operation"})
+
+	// DerivationIndex is the next external derivation index to be issued.
+	DerivationIndex = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "wallet_derivation_index",
+		Help: "Next external address derivation index by wallet ID.",
+	}, []string{"wallet"})
+	// UnusedGap is the number of issued addresses after the last one that
+	// received funds.
+	UnusedGap = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "wallet_unused_address_gap",
+		Help: "Consecutive issued addresses that never received funds, by wallet ID.",
+	}, []string{"wallet"})
+	// BalanceSats is the trusted wallet balance.
+	BalanceSats = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "wallet_balance_sats",
+		Help: "Confirmed, spendable wallet balance in satoshis by wallet ID.",
+	}, []string{"wallet"})
+	// ChainTipHeight is the node's best block height.
+	ChainTipHeight = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "chain_tip_height",
+		Help: "Height of the node's best block.",
+	})
+
+	// lastBlockTime is the tip's header timestamp in Unix seconds.
+	lastBlockTime atomic.Int64
+	_             = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "chain_seconds_since_last_block",
+		Help: "Seconds since the timestamp of the node's best block.",
+	}, func() float64 {
+		t := lastBlockTime.Load()
+		if t == 0 {
+			return 0
+		}
+		return time.Since(time.Unix(t, 0)).Seconds()
+	})
+)
+
+// Handler serves the metrics in the Prometheus text format.
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// HTTP records the latency and status of every request by route template,
+// so path parameters do not create new series.
+func HTTP() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		httpDuration.WithLabelValues(c.Request.Method, route, strconv.Itoa(c.Writer.Status())).
+			Observe(time.Since(start).Seconds())
+	}
+}
+
+// ObserveRPC records a bitcoind RPC.
+func ObserveRPC(method string, d time.Duration, err error) {
+	rpcDuration.WithLabelValues(method).Observe(d.Seconds())
+	if err != nil {
+		rpcErrors.WithLabelValues(method).Inc()
+	}
+}
+
+// ObserveQuery records a Postgres statement.
+func ObserveQuery(query string, d time.Duration, err error) {
+	op := Operation(query)
+	queryDuration.WithLabelValues(op).Observe(d.Seconds())
+	if err != nil {
+		queryErrors.WithLabelValues(op).Inc()
+	}
+}
+
+// SetLastBlockTime records the timestamp of the chain tip.
+func SetLastBlockTime(t time.Time) {
+	lastBlockTime.Store(t.Unix())
+}
+
+// Operation is the lowercased leading keyword of a SQL statement.
+func Operation(query string) string {
+	fields := strings.Fields(query)
+	if len(fields) == 0 {
+		return "unknown"
+	}
+	return strings.ToLower(fields[0])
+}
@@ -0,0 +1,59 @@
+package metrics
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/common/expfmt"
+)
+
+func TestOperation(t *testing.T) {
+	tests := map[string]string{
+		"SELECT derivation_index FROM wallet_state":  "select",
+		"\n\t\tinsert INTO block_hashes VALUES ($1)": "insert",
+		"COMMIT": "commit",
+		"   ":    "unknown",
+	}
+	for query, want := range tests {
+		if got := Operation(query); got != want {
+			t.Errorf("Operation(%q) = %q, want %q", query, got, want)
+		}
+	}
+}
+
+func TestHTTP(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(HTTP())
+	r.GET("/v1/keys/:id", func(c *gin.Context) { c.Status(http.StatusNoContent) })
+
+	for _, path := range []string{"/v1/keys/1", "/v1/keys/2", "/missing"} {
+		r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+
+	if n := testutil.CollectAndCount(httpDuration); n != 2 {
+		t.Errorf("got %d series, want one for the route template and one for unmatched", n)
+	}
+}
+
+func TestObserveRPC(t *testing.T) {
+	ObserveRPC("getblockcount", time.Millisecond, nil)
+	ObserveRPC("getblockcount", time.Millisecond, errors.New("refused"))
+
+	if got := testutil.ToFloat64(rpcErrors.WithLabelValues("getblockcount")); got != 1 {
+		t.Errorf("errors = %v, want 1", got)
+	}
+	out, err := testutil.CollectAndFormat(rpcDuration, expfmt.TypeTextPlain, "bitcoind_rpc_duration_seconds")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(out), `bitcoind_rpc_duration_seconds_count{method="getblockcount"} 2`) {
+		t.Errorf("missing call count in:\n%s", out)
+	}
+}
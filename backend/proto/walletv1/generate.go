@@ -0,0 +1,5 @@
+// Package walletv1 contains the generated protobuf and gRPC code for the
+// wallet.v1 API.
+package walletv1
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative wallet.proto
@@ -0,0 +1,100 @@
+// Package qr renders QR codes as PNG and SVG images.
+package qr
+
+import (
+	"fmt"
+	"strings"
+
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+const (
+	// DefaultSize is the default image width and height in pixels.
+	DefaultSize = 256
+	// MinSize and MaxSize bound the image size.
+	MinSize = 64
+	MaxSize = 2048
+)
+
+// Level is an error correction level: L, M, Q or H, recovering about 7%,
+// 15%, 25% and 30% of the code.
+type Level string
+
+// Error correction levels
+const (
+	LevelL Level = "L"
+	LevelM Level = "M"
+	LevelQ Level = "Q"
+	LevelH Level = "H"
+)
+
+// DefaultLevel suits screens and printed receipts.
+const DefaultLevel = LevelM
+
+var levels = map[Level]qrcode.RecoveryLevel{
+	LevelL: qrcode.Low,
+	LevelM: qrcode.Medium,
+	LevelQ: qrcode.High,
+	LevelH: qrcode.Highest,
+}
+
+// ParseLevel parses a level, case-insensitively.
+func ParseLevel(s string) (Level, error) {
+	l := Level(strings.ToUpper(s))
+	if _, ok := levels[l]; !ok {
+		return "", fmt.Errorf("invalid error correction level %q, want L, M, Q or H", s)
+	}
+	return l, nil
+}
+
+func encode(content string, level Level, size int) (*qrcode.QRCode, error) {
+	recovery, ok := levels[level]
+	if !ok {
+		return nil, fmt.Errorf("invalid error correction level %q", level)
+	}
+	if size < MinSize || size > MaxSize {
+		return nil, fmt.Errorf("size must be between %d and %d", MinSize, MaxSize)
+	}
+	return qrcode.New(content, recovery)
+}
+
+// PNG renders content as a size by size PNG image.
+func PNG(content string, level Level, size int) ([]byte, error) {
+	q, err := encode(content, level, size)
+	if err != nil {
+		return nil, err
+	}
+	return q.PNG(size)
+}
+
+// SVG renders content as a size by size SVG image. The code is drawn in
+// module units, so it stays sharp when scaled.
+func SVG(content string, level Level, size int) ([]byte, error) {
+	q, err := encode(content, level, size)
+	if err != nil {
+		return nil, err
+	}
+	// The bitmap includes the quiet zone
+	bitmap := q.Bitmap()
+	n := len(bitmap)
+
+	var path strings.Builder
+	for y, row := range bitmap {
+		for x := 0; x < n; x++ {
+			if !row[x] {
+				continue
+			}
+			// One rectangle per run of dark modules
+			start := x
+			for x < n && row[x] {
+				x++
+			}
+			fmt.Fprintf(&path, "M%d %dh%dv1h-%dz", start, y, x-start, x-start)
+		}
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" shape-rendering="crispEdges">`, size, size, n, n)
+	fmt.Fprintf(&b, `<rect width="%d" height="%d" fill="#fff"/>`, n, n)
+	fmt.Fprintf(&b, `<path fill="#000" d="%s"/></svg>`, path.String())
+	return []byte(b.String()), nil
+}
@@ -0,0 +1,56 @@
+package qr
+
+import (
+	"bytes"
+	"image/png"
+	"strings"
+	"testing"
+)
+
+const content = "BITCOIN:BCRT1QW508D6QEJXTDG4Y5R3ZARVARY0C5XW7KYGT080"
+
+func TestPNG(t *testing.T) {
+	b, err := PNG(content, LevelH, 300)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := png.Decode(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size := img.Bounds().Size(); size.X != 300 || size.Y != 300 {
+		t.Errorf("image is %v, want 300x300", size)
+	}
+}
+
+func TestSVG(t *testing.T) {
+	low, err := SVG(content, LevelL, DefaultSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	high, err := SVG(content, LevelH, DefaultSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(low), `<svg xmlns="http://www.w3.org/2000/svg" width="256" height="256"`) {
+		t.Errorf("SVG = %.80s", low)
+	}
+	// More error correction needs a larger version
+	if len(high) <= len(low) {
+		t.Errorf("level H SVG is %d bytes, level L %d", len(high), len(low))
+	}
+}
+
+func TestInvalid(t *testing.T) {
+	if _, err := ParseLevel("X"); err == nil {
+		t.Error("ParseLevel(X) succeeded")
+	}
+	if l, err := ParseLevel("q"); err != nil || l != LevelQ {
+		t.Errorf("ParseLevel(q) = %q, %v", l, err)
+	}
+	for _, size := range []int{MinSize - 1, MaxSize + 1} {
+		if _, err := PNG(content, DefaultLevel, size); err == nil {
+			t.Errorf("PNG with size %d succeeded", size)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package ratelimit
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/sawdustofmind/bitcoin-wallet/backend/apierr"
+	"github.com/sawdustofmind/bitcoin-wallet/backend/auth"
+)
+
+var ErrQuotaExceeded = errors.New("daily address quota exceeded")
+
+// Quota enforces a daily number of issued addresses per client, stored in
+// Postgres so it holds across restarts and replicas.
+type Quota struct {
+	db    *sql.DB
+	limit int
+}
+
+// NewQuota returns a quota of limit per client per UTC day. A
+// non-positive limit disables it.
+func NewQuota(db *sql.DB, limit int) *Quota {
+	return &Quota{db: db, limit: limit}
+}
+
+// Consume counts one issuance against client's quota for today.
+func (q *Quota) Consume(ctx context.Context, client string) error {
+	if q.limit <= 0 {
+		return nil
+	}
+	var count int
+	err := q.db.QueryRowContext(ctx, `INSERT INTO address_issuance (client, day, count)
+		VALUES ($1, (now() AT TIME ZONE 'UTC')::date, 1)
+		ON CONFLICT (client, day) DO UPDATE SET count = address_issuance.count + 1
+		WHERE address_issuance.count < $2
+		RETURNING count`, client, q.limit).Scan(&count)
+	if err == sql.ErrNoRows {
+		return ErrQuotaExceeded
+	}
+	return err
+}
+
+// Refund returns an issuance that did not complete.
+func (q *Quota) Refund(ctx context.Context, client string) error {
+	if q.limit <= 0 {
+		return nil
+	}
+	_, err := q.db.ExecContext(ctx, `UPDATE address_issuance SET count = count - 1
+		WHERE client = $1 AND day = (now() AT TIME ZONE 'UTC')::date AND count > 0`, client)
+	return err
+}
+
+// IssuanceQuota consumes quota for the authenticated API key before the
+// handler runs and refunds it if the handler fails.
+func IssuanceQuota(q *Quota) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := auth.FromContext(c)
+		if key == nil {
+			c.Next()
+			return
+		}
+		client := "key:" + strconv.FormatInt(key.ID, 10)
+
+		if err := q.Consume(c.Request.Context(), client); err != nil {
+			if err == ErrQuotaExceeded {
+				now := time.Now().UTC()
+				midnight := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC)
+				seconds := int(midnight.Sub(now).Seconds()) + 1
+				c.Header("Retry-After", strconv.Itoa(seconds))
+				apierr.AbortWithDetails(c, http.StatusTooManyRequests, apierr.CodeQuotaExceeded, err.Error(),
+					map[string]interface{}{"limit": q.limit, "retry_after_seconds": seconds})
+				return
+			}
+			apierr.Internal(c, err, "checking issuance quota")
+			return
+		}
+
+		c.Next()
+
+		if c.Writer.Status() >= http.StatusBadRequest {
+			// The refund is due even if the client went away
+			if err := q.Refund(context.WithoutCancel(c.Request.Context()), client); err != nil {
+				slog.ErrorContext(c.Request.Context(), "Failed to refund issuance quota", "client", client, "error", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package ratelimit
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/time/rate"
+
+	"github.com/sawdustofmind/bitcoin-wallet/backend/apierr"
+	"github.com/sawdustofmind/bitcoin-wallet/backend/auth"
+)
+
+// idleTimeout is how long an unused client bucket is kept.
+const idleTimeout = 10 * time.Minute
+
+// Limiter keeps a token bucket per client.
+type Limiter struct {
+	limit rate.Limit
+	burst int
+
+	mu          sync.Mutex
+	clients     map[string]*bucket
+	lastCleanup time.Time
+}
+
+type bucket struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// New returns a limiter allowing rps requests per second with bursts of
+// up to burst. A non-positive rps disables limiting.
+func New(rps float64, burst int) *Limiter {
+	return &Limiter{
+		limit:   rate.Limit(rps),
+		burst:   burst,
+		clients: make(map[string]*bucket),
+	}
+}
+
+// Allow takes a token from client's bucket. If none is available it
+// returns false and how long until one is.
+func (l *Limiter) Allow(client string) (bool, time.Duration) {
+	if l.limit <= 0 {
+		return true, 0
+	}
+
+	now := time.Now()
+	l.mu.Lock()
+	if now.Sub(l.lastCleanup) > idleTimeout {
+		for k, b := range l.clients {
+			if now.Sub(b.lastSeen) > idleTimeout {
+				delete(l.clients, k)
+			}
+		}
+		l.lastCleanup = now
+	}
+	b, ok := l.clients[client]
+	if !ok {
+		b = &bucket{limiter: rate.NewLimiter(l.limit, l.burst)}
+		l.clients[client] = b
+	}
+	b.lastSeen = now
+	l.mu.Unlock()
+
+	r := b.limiter.ReserveN(now, 1)
+	if !r.OK() {
+		return false, time.Second
+	}
+	if delay := r.DelayFrom(now); delay > 0 {
+		r.CancelAt(now)
+		return false, delay
+	}
+	return true, 0
+}
+
+// ByIP limits requests per client IP.
+func ByIP(l *Limiter) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		limit(c, l, "ip:"+c.ClientIP())
+	}
+}
+
+// ByAPIKey limits requests per authenticated API key. It must run after
+// auth.Authenticate.
+func ByAPIKey(l *Limiter) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := auth.FromContext(c)
+		if key == nil {
+			c.Next()
+			return
+		}
+		limit(c, l, "key:"+strconv.FormatInt(key.ID, 10))
+	}
+}
+
+func limit(c *gin.Context, l *Limiter, client string) {
+	ok, retryAfter := l.Allow(client)
+	if !ok {
+		seconds := int(math.Ceil(retryAfter.Seconds()))
+		c.Header("Retry-After", strconv.Itoa(seconds))
+		apierr.AbortWithDetails(c, http.StatusTooManyRequests, apierr.CodeRateLimited, "rate limit exceeded",
+			map[string]interface{}{"retry_after_seconds": seconds})
+		return
+	}
+	c.Next()
+}
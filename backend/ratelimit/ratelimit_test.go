@@ -0,0 +1,36 @@
+package ratelimit
+
+import (
+	"testing"
+)
+
+func TestLimiter(t *testing.T) {
+	l := New(1, 3)
+
+	for i := 0; i < 3; i++ {
+		if ok, _ := l.Allow("a"); !ok {
+			t.Fatalf("Request %d within burst should be allowed", i+1)
+		}
+	}
+	ok, retryAfter := l.Allow("a")
+	if ok {
+		t.Fatal("Request beyond burst should be limited")
+	}
+	if retryAfter <= 0 {
+		t.Fatalf("Expected positive retry-after, got %v", retryAfter)
+	}
+
+	// Buckets are per client
+	if ok, _ := l.Allow("b"); !ok {
+		t.Fatal("Other clients should not be affected")
+	}
+}
+
+func TestLimiterDisabled(t *testing.T) {
+	l := New(0, 0)
+	for i := 0; i < 100; i++ {
+		if ok, _ := l.Allow("a"); !ok {
+			t.Fatal("Disabled limiter should allow everything")
+		}
+	}
+}
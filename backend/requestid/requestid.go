@@ -0,0 +1,81 @@
+package requestid
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Header carries the request ID in both directions.
+const Header = "X-Request-ID"
+
+// contextKey is where Middleware stores the request ID.
+const contextKey = "request_id"
+
+// ctxKey carries the request ID in a context.Context, so it reaches code
+// that only sees the request's context.
+type ctxKey struct{}
+
+// maxLength bounds client supplied IDs.
+const maxLength = 128
+
+// Middleware assigns every request an ID, reusing the client's X-Request-ID
+// when it is well formed, and echoes it in the response.
+func Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := Resolve(c.GetHeader(Header))
+		c.Set(contextKey, id)
+		c.Request = c.Request.WithContext(NewContext(c.Request.Context(), id))
+		c.Header(Header, id)
+		c.Next()
+	}
+}
+
+// Resolve returns id if it is acceptable as a request ID and a new random
+// ID otherwise.
+func Resolve(id string) string {
+	if valid(id) {
+		return id
+	}
+	return generate()
+}
+
+// FromContext returns the request ID, or "" if Middleware did not run.
+func FromContext(c *gin.Context) string {
+	return c.GetString(contextKey)
+}
+
+// NewContext returns a copy of ctx carrying the request ID.
+func NewContext(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, ctxKey{}, id)
+}
+
+// ID returns the request ID carried by ctx, or "".
+func ID(ctx context.Context) string {
+	id, _ := ctx.Value(ctxKey{}).(string)
+	return id
+}
+
+// valid accepts IDs of printable ASCII without spaces, so they are safe to
+// log and echo.
+func valid(id string) bool {
+	if id == "" || len(id) > maxLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+func generate() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "unknown"
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,333 @@
+package wallet
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+
+	"github.com/btcsuite/btcd/btcjson"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/btcutil/hdkeychain"
+	"github.com/btcsuite/btcd/chaincfg"
+
+	"github.com/sawdustofmind/bitcoin-wallet/backend/config"
+	"github.com/sawdustofmind/bitcoin-wallet/backend/descriptor"
+)
+
+// accountGap is how many consecutive unused receive addresses make an
+// account unused in BIP44 account discovery.
+const accountGap = 20
+
+// accountPurposes maps script types to the purpose of their derivation
+// scheme: BIP44, BIP49, BIP84 and BIP86.
+var accountPurposes = map[string]uint32{
+	ScriptP2PKH:      44,
+	ScriptP2SHP2WPKH: 49,
+	ScriptP2WPKH:     84,
+	ScriptP2TR:       86,
+}
+
+// accountKeyScriptType checks that keys are the account-level xpubs of
+// accounts 0, 1, ... of one master key, each with its origin
+// [fingerprint/purpose'/coin_type'/account'] as BIP44 derives them, and
+// returns the script type of their purpose. scriptType, if set, must match
+// it.
+func accountKeyScriptType(keys []string, scriptType string, params *chaincfg.Params) (string, error) {
+	if len(keys) == 0 {
+		return "", errors.New("account discovery needs the key of account 0")
+	}
+	var fingerprint [4]byte
+	var purpose uint32
+	for i, key := range keys {
+		example := fmt.Sprintf("[d34db33f/84h/%dh/%dh]", params.HDCoinType, i)
+		end := strings.IndexByte(key, ']')
+		if !strings.HasPrefix(key, "[") || end < 0 {
+			return "", fmt.Errorf("account key %d must start with its key origin, e.g. %s", i, example)
+		}
+		fp, path, err := descriptor.ParseOrigin(key[1:end])
+		if err != nil {
+			return "", fmt.Errorf("account key %d has an invalid key origin: %v", i, err)
+		}
+		if len(path) != 3 || path[0] < hdkeychain.HardenedKeyStart ||
+			path[1] != hdkeychain.HardenedKeyStart+params.HDCoinType || path[2] != hdkeychain.HardenedKeyStart+uint32(i) {
+			return "", fmt.Errorf("account key %d must be derived at purpose'/%d'/%d', e.g. %s", i, params.HDCoinType, i, example)
+		}
+		xpub, err := parseXPUB(key[end+1:], params)
+		if err != nil {
+			return "", fmt.Errorf("account key %d: %v", i, err)
+		}
+		if xpub.Depth() != 3 {
+			return "", fmt.Errorf("account key %d is at depth %d, not at its account", i, xpub.Depth())
+		}
+		if i == 0 {
+			fingerprint, purpose = fp, path[0]-hdkeychain.HardenedKeyStart
+		} else if fp != fingerprint || path[0]-hdkeychain.HardenedKeyStart != purpose {
+			return "", errors.New("account keys must share their master fingerprint and purpose")
+		}
+	}
+	for typ, p := range accountPurposes {
+		if p != purpose {
+			continue
+		}
+		if scriptType != "" && scriptType != typ {
+			return "", fmt.Errorf("purpose %d is for script type %q, not %q", purpose, typ, scriptType)
+		}
+		return typ, nil
+	}
+	return "", fmt.Errorf("account discovery does not support purpose %d", purpose)
+}
+
+// accountDescriptors returns the receive and change descriptors of account
+// n, <0;1>/* below its key. The keys were checked by accountKeyScriptType.
+func accountDescriptors(def Definition, n uint32, params *chaincfg.Params) (external, internal *descriptor.Descriptor, err error) {
+	if int(n) >= len(def.AccountKeys) {
+		return nil, nil, fmt.Errorf("no key for account %d", n)
+	}
+	desc, err := keyDescriptor(def.AccountKeys[n]+"/<0;1>/*", def.ScriptType, params)
+	if err != nil {
+		return nil, nil, err
+	}
+	branches, err := desc.Branches()
+	if err != nil {
+		return nil, nil, err
+	}
+	return branches[0], branches[1], nil
+}
+
+// accountSet tracks the accounts discovery has imported into the node
+// wallet.
+type accountSet struct {
+	def Definition
+	// client has no per-call timeout, as imports that rescan the chain
+	// outlast it.
+	client *nodeClient
+
+	// mu guards n and warned, which the sync loop updates while the API
+	// reads n
+	mu sync.Mutex
+	// n accounts are imported. The last one is unused unless discovery
+	// has yet to see it used.
+	n int
+	// warned is set once discovery has logged that every account with a
+	// key is used.
+	warned bool
+}
+
+func newAccountSet(def Definition, cfg config.BitcoinConfig, nodeWallet string, n int) *accountSet {
+	a := &accountSet{def: def, client: newNodeClient(cfg, nodeWallet), n: n}
+	a.client.timeout = 0
+	return a
+}
+
+func (a *accountSet) count() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.n
+}
+
+// locate returns the account and full derivation path of the key in a
+// descriptor bitcoind infers for an output, e.g.
+// wpkh([d34db33f/84h/1h/0h/0/5]02...).
+func (a *accountSet) locate(desc string) (uint32, string, bool) {
+	start, end := strings.IndexByte(desc, '['), strings.IndexByte(desc, ']')
+	if start < 0 || end < start {
+		return 0, "", false
+	}
+	_, path, err := descriptor.ParseOrigin(desc[start+1 : end])
+	if err != nil || len(path) != 5 || path[2] < hdkeychain.HardenedKeyStart {
+		return 0, "", false
+	}
+	return path[2] - hdkeychain.HardenedKeyStart, formatPath(path), true
+}
+
+// DiscoversAccounts reports whether the wallet watches multiple accounts.
+func (w *Wallet) DiscoversAccounts() bool {
+	return w.accounts != nil
+}
+
+// discoverAccounts follows BIP44 account discovery: it imports accounts,
+// rescanning the chain for their history, until the last one has no
+// transactions on its first accountGap receive addresses or there is no
+// key for the next one. It resumes after the accounts imported before, and
+// picks up an account that has been used since. Only the sync loop runs
+// it.
+func (w *Wallet) discoverAccounts(ctx context.Context) error {
+	a := w.accounts
+	if a == nil {
+		return nil
+	}
+	for {
+		n := a.count()
+		if n > 0 {
+			used, err := w.accountUsed(ctx, uint32(n-1))
+			if err != nil || !used {
+				return err
+			}
+		}
+		if n >= len(a.def.AccountKeys) {
+			a.mu.Lock()
+			if !a.warned {
+				slog.WarnContext(ctx, "Every account with a key is used, later accounts are not watched",
+					"wallet_id", w.id, "accounts", n)
+				a.warned = true
+			}
+			a.mu.Unlock()
+			return nil
+		}
+		if err := w.importAccount(ctx, uint32(n)); err != nil {
+			return fmt.Errorf("failed to import account %d: %v", n, err)
+		}
+		if _, err := w.db.ExecContext(ctx, "UPDATE wallets SET accounts = $2 WHERE id = $1", w.id, n+1); err != nil {
+			return err
+		}
+		a.mu.Lock()
+		a.n = n + 1
+		a.mu.Unlock()
+		slog.InfoContext(ctx, "Account imported", "wallet_id", w.id, "account", n)
+	}
+}
+
+// importAccount imports both chains of account n, rescanning from the
+// genesis block.
+func (w *Wallet) importAccount(ctx context.Context, n uint32) error {
+	external, internal, err := accountDescriptors(w.accounts.def, n, w.params)
+	if err != nil {
+		return err
+	}
+	externalEnd, internalEnd := accountGap-1, changeLookahead
+	if n == 0 {
+		// Account 0 issues addresses, and bitcoind refuses to shrink the
+		// ranges imported for it
+		var idx, changeIdx int
+		err := w.db.QueryRowContext(ctx, "SELECT derivation_index, change_index FROM wallets WHERE id = $1", w.id).Scan(&idx, &changeIdx)
+		if err != nil {
+			return err
+		}
+		externalEnd = max(externalEnd, idx-1)
+		internalEnd += changeIdx
+	}
+	return importDescriptors(ctx, w.accounts.client,
+		descriptorImport(external, externalEnd, false, 0),
+		descriptorImport(internal, internalEnd, true, 0))
+}
+
+// accountUsed reports whether any of the first accountGap receive
+// addresses of account n has received funds.
+func (w *Wallet) accountUsed(ctx context.Context, n uint32) (bool, error) {
+	external, _, err := accountDescriptors(w.accounts.def, n, w.params)
+	if err != nil {
+		return false, err
+	}
+	// listreceivedbyaddress 0 false true
+	var received []struct {
+		Address string `json:"address"`
+	}
+	if err := w.client.call(ctx, "listreceivedbyaddress", &received, 0, false, true); err != nil {
+		return false, fmt.Errorf("listreceivedbyaddress failed: %v", err)
+	}
+	seen := make(map[string]bool, len(received))
+	for _, r := range received {
+		seen[r.Address] = true
+	}
+	for i := uint32(0); i < accountGap; i++ {
+		addr, err := external.Address(i)
+		if err != nil {
+			return false, err
+		}
+		if seen[addr.EncodeAddress()] {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// AccountUTXO is an unspent output with the account and derivation path of
+// its key.
+type AccountUTXO struct {
+	btcjson.ListUnspentResult
+	// Account is unset for outputs bitcoind cannot place.
+	Account        *uint32 `json:"account,omitempty"`
+	DerivationPath string  `json:"derivation_path,omitempty"`
+}
+
+// AccountUTXOs is GetUTXOs for a wallet discovering accounts.
+func (w *Wallet) AccountUTXOs(ctx context.Context) ([]AccountUTXO, error) {
+	return w.accountUTXOs(ctx)
+}
+
+// accountUTXOs runs listunspent with params and places each output in its
+// account by the descriptor bitcoind reports for it.
+func (w *Wallet) accountUTXOs(ctx context.Context, params ...interface{}) ([]AccountUTXO, error) {
+	if w.accounts == nil {
+		return nil, errors.New("wallet does not discover accounts")
+	}
+	var utxos []struct {
+		btcjson.ListUnspentResult
+		Desc string `json:"desc"`
+	}
+	if err := w.client.call(ctx, "listunspent", &utxos, params...); err != nil {
+		return nil, err
+	}
+	result := make([]AccountUTXO, len(utxos))
+	for i, u := range utxos {
+		result[i].ListUnspentResult = u.ListUnspentResult
+		if account, path, ok := w.accounts.locate(u.Desc); ok {
+			result[i].Account = &account
+			result[i].DerivationPath = path
+		}
+	}
+	return result, nil
+}
+
+// AccountBalance is the balance of one account.
+type AccountBalance struct {
+	Account uint32
+	// DerivationPath is the account's path, e.g. m/84h/1h/0h.
+	DerivationPath string
+	Balances
+}
+
+// AccountBalances breaks the balance down by imported account. It is
+// built on listunspent alone, so unconfirmed outputs count as untrusted
+// pending and immature coinbase outputs as trusted.
+func (w *Wallet) AccountBalances(ctx context.Context) ([]AccountBalance, error) {
+	// listunspent 0 9999999 to include unconfirmed outputs
+	utxos, err := w.accountUTXOs(ctx, 0, 9999999)
+	if err != nil {
+		return nil, err
+	}
+	balances := make([]AccountBalance, max(w.accounts.count(), 1))
+	for i := range balances {
+		balances[i] = AccountBalance{Account: uint32(i), Balances: *newBalances()}
+		external, _, err := accountDescriptors(w.accounts.def, uint32(i), w.params)
+		if err != nil {
+			return nil, err
+		}
+		_, path, err := external.Keys()[0].Origin(0)
+		if err != nil {
+			return nil, err
+		}
+		// Without the chain and index steps
+		balances[i].DerivationPath = formatPath(path[:len(path)-2])
+	}
+	for _, u := range utxos {
+		if u.Account == nil || int(*u.Account) >= len(balances) {
+			continue
+		}
+		amt, err := btcutil.NewAmount(u.Amount)
+		if err != nil {
+			return nil, err
+		}
+		b := &balances[*u.Account].Balances
+		if u.Confirmations == 0 {
+			b.UntrustedPending += amt
+		} else {
+			b.Trusted += amt
+		}
+		b.addToBuckets(amt, u.Confirmations)
+	}
+	return balances, nil
+}
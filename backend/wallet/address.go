@@ -0,0 +1,194 @@
+package wallet
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/btcsuite/btcd/chaincfg"
+
+	"github.com/sawdustofmind/bitcoin-wallet/backend/descriptor"
+)
+
+// Script types a wallet derives addresses for.
+const (
+	// ScriptP2PKH is legacy pay-to-pubkey-hash, used by the default wallet.
+	ScriptP2PKH = "p2pkh"
+	// ScriptP2SHP2WPKH is P2WPKH nested in P2SH.
+	ScriptP2SHP2WPKH = "p2sh-p2wpkh"
+	// ScriptP2WPKH is native segwit v0.
+	ScriptP2WPKH = "p2wpkh"
+	// ScriptP2TR is a BIP86 key-path-only taproot output, or a taproot
+	// output with a miniscript script tree given by a descriptor.
+	ScriptP2TR = "p2tr"
+	// ScriptP2WSH is a native segwit multisig or miniscript script. It
+	// needs a descriptor.
+	ScriptP2WSH = "p2wsh"
+	// ScriptP2SHP2WSH is P2WSH nested in P2SH. It needs a descriptor.
+	ScriptP2SHP2WSH = "p2sh-p2wsh"
+)
+
+var validScriptTypes = map[string]bool{
+	ScriptP2PKH:      true,
+	ScriptP2SHP2WPKH: true,
+	ScriptP2WPKH:     true,
+	ScriptP2TR:       true,
+	ScriptP2WSH:      true,
+	ScriptP2SHP2WSH:  true,
+}
+
+// descriptorScriptTypes maps descriptor types to script types.
+var descriptorScriptTypes = map[string]string{
+	"pkh":                  ScriptP2PKH,
+	"sh(wpkh)":             ScriptP2SHP2WPKH,
+	"wpkh":                 ScriptP2WPKH,
+	"tr":                   ScriptP2TR,
+	"wsh(multi)":           ScriptP2WSH,
+	"wsh(sortedmulti)":     ScriptP2WSH,
+	"sh(wsh(multi))":       ScriptP2SHP2WSH,
+	"sh(wsh(sortedmulti))": ScriptP2SHP2WSH,
+	"wsh(miniscript)":      ScriptP2WSH,
+	"sh(wsh(miniscript))":  ScriptP2SHP2WSH,
+	"tr(miniscript)":       ScriptP2TR,
+}
+
+// xpubDescriptor returns the descriptor of the external chain m/0/* of
+// xpub for scriptType.
+func xpubDescriptor(xpub, scriptType string, params *chaincfg.Params) (*descriptor.Descriptor, error) {
+	return keyDescriptor(xpub+"/0/*", scriptType, params)
+}
+
+// keyDescriptor returns the single-key descriptor of key for scriptType.
+func keyDescriptor(key, scriptType string, params *chaincfg.Params) (*descriptor.Descriptor, error) {
+	var desc string
+	switch scriptType {
+	case ScriptP2PKH:
+		desc = fmt.Sprintf("pkh(%s)", key)
+	case ScriptP2WPKH:
+		desc = fmt.Sprintf("wpkh(%s)", key)
+	case ScriptP2SHP2WPKH:
+		desc = fmt.Sprintf("sh(wpkh(%s))", key)
+	case ScriptP2TR:
+		desc = fmt.Sprintf("tr(%s)", key)
+	case ScriptP2WSH, ScriptP2SHP2WSH:
+		return nil, fmt.Errorf("script type %q needs a descriptor", scriptType)
+	default:
+		return nil, fmt.Errorf("unknown script type %q", scriptType)
+	}
+	sum, err := descriptor.Checksum(desc)
+	if err != nil {
+		return nil, err
+	}
+	return descriptor.Parse(desc+"#"+sum, params)
+}
+
+// definitionDescriptors returns the external descriptor of def, its
+// internal (change) descriptor if it has one, and its script type. An
+// xpub definition only has the external chain. A definition by account
+// keys has the chains of account 0.
+func definitionDescriptors(def Definition, params *chaincfg.Params) (external, internal *descriptor.Descriptor, scriptType string, err error) {
+	switch {
+	case len(def.AccountKeys) > 0:
+		if def.XPUB != "" || def.Descriptor != "" || def.ChangeDescriptor != "" {
+			return nil, nil, "", errors.New("account_keys cannot be combined with xpub or descriptor")
+		}
+		if def.ScriptType, err = accountKeyScriptType(def.AccountKeys, def.ScriptType, params); err != nil {
+			return nil, nil, "", err
+		}
+		external, internal, err = accountDescriptors(def, 0, params)
+		return external, internal, def.ScriptType, err
+	case def.XPUB != "" && def.Descriptor != "":
+		return nil, nil, "", errors.New("xpub and descriptor are mutually exclusive")
+	case def.XPUB != "":
+		if def.ChangeDescriptor != "" {
+			return nil, nil, "", errors.New("change_descriptor requires descriptor")
+		}
+		if _, err := parseXPUB(def.XPUB, params); err != nil {
+			return nil, nil, "", err
+		}
+		external, err = xpubDescriptor(def.XPUB, def.ScriptType, params)
+		return external, nil, def.ScriptType, err
+	case def.Descriptor == "":
+		return nil, nil, "", errors.New("xpub, descriptor or account_keys is required")
+	}
+
+	external, err = descriptor.Parse(def.Descriptor, params)
+	if err != nil {
+		return nil, nil, "", fmt.Errorf("invalid descriptor: %v", err)
+	}
+	branches, err := external.Branches()
+	if err != nil {
+		return nil, nil, "", fmt.Errorf("invalid descriptor: %v", err)
+	}
+	switch {
+	case len(branches) == 2 && def.ChangeDescriptor == "":
+		external, internal = branches[0], branches[1]
+	case len(branches) == 2:
+		return nil, nil, "", errors.New("change_descriptor cannot be combined with a multipath descriptor")
+	case len(branches) > 2:
+		return nil, nil, "", errors.New("a multipath descriptor must have two paths, receive and change")
+	}
+	if def.ChangeDescriptor != "" {
+		internal, err = descriptor.Parse(def.ChangeDescriptor, params)
+		if err != nil {
+			return nil, nil, "", fmt.Errorf("invalid change_descriptor: %v", err)
+		}
+		if branches, err := internal.Branches(); err != nil || len(branches) != 1 {
+			return nil, nil, "", errors.New("change_descriptor cannot be multipath")
+		}
+		if !internal.IsRange() {
+			return nil, nil, "", errors.New("change_descriptor must be ranged, ending in /*")
+		}
+	}
+	if !external.IsRange() {
+		return nil, nil, "", errors.New("descriptor must be ranged, ending in /*")
+	}
+
+	scriptType, ok := descriptorScriptTypes[external.Type()]
+	if !ok {
+		return nil, nil, "", fmt.Errorf("%s descriptors are not supported for wallets", external.Type())
+	}
+	if def.ScriptType != "" && def.ScriptType != scriptType {
+		return nil, nil, "", fmt.Errorf("script_type %q does not match the descriptor's %q", def.ScriptType, scriptType)
+	}
+	return external, internal, scriptType, nil
+}
+
+// DeriveAddress derives the external address at index idx from the
+// wallet's descriptor.
+func (w *Wallet) DeriveAddress(idx int) (string, error) {
+	if idx < 0 {
+		return "", fmt.Errorf("invalid derivation index %d", idx)
+	}
+	addr, err := w.external.Address(uint32(idx))
+	if err != nil {
+		return "", err
+	}
+	return addr.EncodeAddress(), nil
+}
+
+// derivationPath is the full path of the external address at idx, from
+// the descriptor's key origin or, without one, relative to the key. For
+// multisig it is the first cosigner's path.
+func (w *Wallet) derivationPath(idx int) string {
+	return chainPath(w.external, idx)
+}
+
+// chainPath is derivationPath for the address at idx of desc.
+func chainPath(desc *descriptor.Descriptor, idx int) string {
+	_, path, err := desc.Keys()[0].Origin(uint32(idx))
+	if err != nil {
+		return ""
+	}
+	return formatPath(path)
+}
+
+// formatPath formats a derivation path from the master key, e.g.
+// m/84h/1h/0h/0/5.
+func formatPath(path []uint32) string {
+	steps := make([]string, len(path))
+	for i, n := range path {
+		steps[i] = descriptor.FormatStep(n)
+	}
+	return "m/" + strings.Join(steps, "/")
+}
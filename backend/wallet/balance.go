@@ -0,0 +1,136 @@
+package wallet
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/btcsuite/btcd/btcjson"
+	"github.com/btcsuite/btcd/btcutil"
+)
+
+// BalanceThresholds are the confirmation counts reported in
+// Balances.ByConfirmations.
+var BalanceThresholds = []int{0, 1, 6}
+
+// Balances breaks the wallet balance down by spendability.
+type Balances struct {
+	// Trusted is confirmed, spendable balance.
+	Trusted btcutil.Amount
+	// UntrustedPending is unconfirmed balance from external transactions.
+	UntrustedPending btcutil.Amount
+	// Immature is coinbase balance that has not reached maturity.
+	Immature btcutil.Amount
+	// ByConfirmations maps each of BalanceThresholds to the balance of
+	// unspent outputs with at least that many confirmations.
+	ByConfirmations map[int]btcutil.Amount
+}
+
+// GetBalances returns the balance breakdown. In wallet mode it is built on
+// getbalances and listunspent; in compact filter mode on processed blocks.
+func (w *Wallet) GetBalances(ctx context.Context) (*Balances, error) {
+	if w.filters != nil {
+		return w.cachedBalances(ctx)
+	}
+
+	type balanceSet struct {
+		Trusted          float64 `json:"trusted"`
+		UntrustedPending float64 `json:"untrusted_pending"`
+		Immature         float64 `json:"immature"`
+	}
+	// Descriptor wallets without private keys report under "mine"; legacy
+	// wallets report imported addresses under "watchonly".
+	var resp struct {
+		Mine      balanceSet  `json:"mine"`
+		WatchOnly *balanceSet `json:"watchonly"`
+	}
+	if err := w.client.call(ctx, "getbalances", &resp); err != nil {
+		return nil, fmt.Errorf("getbalances failed: %v", err)
+	}
+
+	sets := []balanceSet{resp.Mine}
+	if resp.WatchOnly != nil {
+		sets = append(sets, *resp.WatchOnly)
+	}
+
+	b := newBalances()
+	for _, s := range sets {
+		for _, pair := range []struct {
+			dst *btcutil.Amount
+			btc float64
+		}{
+			{&b.Trusted, s.Trusted},
+			{&b.UntrustedPending, s.UntrustedPending},
+			{&b.Immature, s.Immature},
+		} {
+			amt, err := btcutil.NewAmount(pair.btc)
+			if err != nil {
+				return nil, err
+			}
+			*pair.dst += amt
+		}
+	}
+
+	// listunspent 0 9999999 to include unconfirmed outputs in the buckets
+	var utxos []btcjson.ListUnspentResult
+	if err := w.client.call(ctx, "listunspent", &utxos, 0, 9999999); err != nil {
+		return nil, err
+	}
+	for _, u := range utxos {
+		amt, err := btcutil.NewAmount(u.Amount)
+		if err != nil {
+			return nil, err
+		}
+		b.addToBuckets(amt, u.Confirmations)
+	}
+
+	return b, nil
+}
+
+func (w *Wallet) cachedBalances(ctx context.Context) (*Balances, error) {
+	var tip int64
+	if err := w.db.QueryRowContext(ctx, "SELECT COALESCE(MAX(height), 0) FROM block_hashes WHERE wallet_id = $1", w.id).Scan(&tip); err != nil {
+		return nil, err
+	}
+
+	rows, err := w.db.QueryContext(ctx, "SELECT amount_sats, block_height, coinbase FROM wallet_utxos WHERE wallet_id = $1 AND spent_txid IS NULL", w.id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	b := newBalances()
+	for rows.Next() {
+		var sats, height int64
+		var coinbase bool
+		if err := rows.Scan(&sats, &height, &coinbase); err != nil {
+			return nil, err
+		}
+		amt := btcutil.Amount(sats)
+		confs := tip - height + 1
+
+		// Everything in the cache comes from a block, so nothing is pending
+		if coinbase && confs < int64(w.params.CoinbaseMaturity) {
+			b.Immature += amt
+			continue
+		}
+		b.Trusted += amt
+		b.addToBuckets(amt, confs)
+	}
+	return b, rows.Err()
+}
+
+func newBalances() *Balances {
+	b := &Balances{ByConfirmations: make(map[int]btcutil.Amount, len(BalanceThresholds))}
+	for _, threshold := range BalanceThresholds {
+		b.ByConfirmations[threshold] = 0
+	}
+	return b
+}
+
+func (b *Balances) addToBuckets(amt btcutil.Amount, confs int64) {
+	for _, threshold := range BalanceThresholds {
+		if confs >= int64(threshold) {
+			b.ByConfirmations[threshold] += amt
+		}
+	}
+}
@@ -0,0 +1,498 @@
+package wallet
+
+import (
+	"context"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/btcsuite/btcd/btcjson"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// Transaction is a wallet transaction recorded from a processed block.
+type Transaction struct {
+	TxID        string    `json:"txid"`
+	BlockHeight int64     `json:"block_height"`
+	BlockHash   string    `json:"block_hash"`
+	BlockTime   time.Time `json:"block_time"`
+	// FeeSats is only known when every input was spent from this wallet.
+	FeeSats *int64 `json:"fee_sats,omitempty"`
+}
+
+// blockRef is a processed block as stored in block_hashes.
+type blockRef struct {
+	Height int64
+	Hash   string
+}
+
+// SyncChain brings the wallet's block-derived state up to the node's tip.
+// If the blocks we processed are no longer on the active chain, state is
+// rolled back to the fork point before the new branch is applied.
+func (w *Wallet) SyncChain(ctx context.Context) error {
+	tip, err := w.client.getBlockCount(ctx)
+	if err != nil {
+		return err
+	}
+
+	stored, err := w.recentBlocks(ctx)
+	if err != nil {
+		return err
+	}
+
+	// On the first run start from the current tip; addresses are imported
+	// with timestamp "now" so there is no history before it.
+	start := tip
+	if len(stored) > 0 {
+		last := stored[0].Height
+		fork, found, err := forkPoint(stored, func(height int64) (string, error) {
+			if height > tip {
+				return "", nil
+			}
+			hash, err := w.client.getBlockHash(ctx, height)
+			if err != nil {
+				return "", err
+			}
+			return hash.String(), nil
+		})
+		if err != nil {
+			return err
+		}
+		if !found {
+			// None of the tracked blocks is on the active chain. Everything
+			// from the oldest of them is rolled back and rescanned; older
+			// state is kept, as BITCOIN_REORG_DEPTH is the deepest reorg
+			// expected.
+			fork = stored[len(stored)-1].Height - 1
+			slog.ErrorContext(ctx, "Chain reorganization deeper than tracked blocks, rescanning them",
+				"tracked", len(stored), "rescan_from", fork+1)
+		}
+
+		if fork < last {
+			depth := last - fork
+			slog.WarnContext(ctx, "Chain reorganization detected", "fork_height", fork, "depth", depth)
+			if err := w.rollback(ctx, fork); err != nil {
+				return err
+			}
+			w.emit(EventReorg, map[string]interface{}{
+				"fork_height": fork,
+				"depth":       depth,
+				"old_tip":     stored[0].Hash,
+			})
+		}
+		start = fork + 1
+	}
+
+	for height := start; height <= tip; height++ {
+		if err := w.applyBlock(ctx, height); err != nil {
+			return err
+		}
+	}
+	if !w.historyRecorded {
+		if err := w.recordHistoryStart(ctx, start); err != nil {
+			return err
+		}
+		w.historyRecorded = true
+	}
+
+	return w.pruneBlocks(ctx, tip)
+}
+
+// recordHistoryStart stores the first block the wallet processed, height
+// unless one is stored already, with its block time.
+func (w *Wallet) recordHistoryStart(ctx context.Context, height int64) error {
+	var stored sql.NullInt64
+	var known bool
+	err := w.db.QueryRowContext(ctx, "SELECT history_start_height, history_start_time IS NOT NULL FROM wallets WHERE id = $1",
+		w.id).Scan(&stored, &known)
+	if err != nil || known {
+		return err
+	}
+	if stored.Valid {
+		height = stored.Int64
+	}
+	hash, err := w.client.getBlockHash(ctx, height)
+	if err != nil {
+		return err
+	}
+	header, err := w.client.getBlockHeader(ctx, hash)
+	if err != nil {
+		return err
+	}
+	_, err = w.db.ExecContext(ctx, "UPDATE wallets SET history_start_height = $2, history_start_time = $3 WHERE id = $1",
+		w.id, height, header.Timestamp.UTC())
+	if err != nil {
+		return fmt.Errorf("failed to record history start: %v", err)
+	}
+	return nil
+}
+
+// forkPoint returns the highest stored block that is still on the active
+// chain, and false if there is none. stored must be ordered by height
+// descending. hashAt returns the active chain's hash at a height, or "" if
+// the chain is shorter.
+func forkPoint(stored []blockRef, hashAt func(int64) (string, error)) (int64, bool, error) {
+	for _, b := range stored {
+		hash, err := hashAt(b.Height)
+		if err != nil {
+			return 0, false, err
+		}
+		if hash == b.Hash {
+			return b.Height, true, nil
+		}
+	}
+	return 0, false, nil
+}
+
+func (w *Wallet) recentBlocks(ctx context.Context) ([]blockRef, error) {
+	rows, err := w.db.QueryContext(ctx, "SELECT height, hash FROM block_hashes WHERE wallet_id = $1 ORDER BY height DESC", w.id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var blocks []blockRef
+	for rows.Next() {
+		var b blockRef
+		if err := rows.Scan(&b.Height, &b.Hash); err != nil {
+			return nil, err
+		}
+		blocks = append(blocks, b)
+	}
+	return blocks, rows.Err()
+}
+
+// rollback removes everything recorded above the fork height.
+func (w *Wallet) rollback(ctx context.Context, fork int64) error {
+	tx, err := w.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	queries := []string{
+		"DELETE FROM wallet_utxos WHERE wallet_id = $1 AND block_height > $2",
+		"UPDATE wallet_utxos SET spent_txid = NULL, spent_height = NULL, spent_time = NULL WHERE wallet_id = $1 AND spent_height > $2",
+		"DELETE FROM wallet_transactions WHERE wallet_id = $1 AND block_height > $2",
+		"DELETE FROM block_hashes WHERE wallet_id = $1 AND height > $2",
+	}
+	for _, q := range queries {
+		if _, err := tx.ExecContext(ctx, q, w.id, fork); err != nil {
+			return fmt.Errorf("rollback to height %d failed: %v", fork, err)
+		}
+	}
+	return tx.Commit()
+}
+
+// applyBlock fetches the block at height and records it along with any
+// wallet outputs it creates or spends.
+func (w *Wallet) applyBlock(ctx context.Context, height int64) error {
+	hash, err := w.client.getBlockHash(ctx, height)
+	if err != nil {
+		return err
+	}
+
+	// In compact filter mode only blocks whose filter matches are downloaded
+	if w.filters != nil {
+		scripts, err := w.ownScripts(ctx)
+		if err != nil {
+			return err
+		}
+		match, err := w.filterMatches(ctx, hash, scripts)
+		if err != nil {
+			return fmt.Errorf("filter match for block %s failed: %v", hash, err)
+		}
+		if !match {
+			return w.recordBlock(ctx, height, hash)
+		}
+	}
+
+	block, err := w.client.getBlock(ctx, hash)
+	if err != nil {
+		return err
+	}
+	return w.processBlock(ctx, height, hash, block)
+}
+
+func (w *Wallet) processBlock(ctx context.Context, height int64, hash *chainhash.Hash, block *wire.MsgBlock) error {
+	scripts, err := w.ownScripts(ctx)
+	if err != nil {
+		return err
+	}
+
+	tx, err := w.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	blockTime := block.Header.Timestamp.UTC()
+	for _, msgTx := range block.Transactions {
+		txid := msgTx.TxHash().String()
+		touched := false
+		ownInputs := true
+		var inputSats int64
+		coinbase := isCoinbase(msgTx)
+
+		if !coinbase {
+			for _, in := range msgTx.TxIn {
+				var amount int64
+				err := tx.QueryRowContext(ctx, `UPDATE wallet_utxos
+					SET spent_txid = $2, spent_height = $3, spent_time = $4
+					WHERE wallet_id = $1 AND txid = $5 AND vout = $6 AND spent_txid IS NULL
+					RETURNING amount_sats`,
+					w.id, txid, height, blockTime, in.PreviousOutPoint.Hash.String(), in.PreviousOutPoint.Index,
+				).Scan(&amount)
+				if err == sql.ErrNoRows {
+					ownInputs = false
+					continue
+				}
+				if err != nil {
+					return fmt.Errorf("failed to mark spent output: %v", err)
+				}
+				touched = true
+				inputSats += amount
+			}
+		} else {
+			ownInputs = false
+		}
+
+		var outputSats int64
+		for vout, out := range msgTx.TxOut {
+			outputSats += out.Value
+			own, ok := scripts[hex.EncodeToString(out.PkScript)]
+			if !ok {
+				continue
+			}
+			addr, err := w.ownAddress(own)
+			if err != nil {
+				return err
+			}
+			_, err = tx.ExecContext(ctx, `INSERT INTO wallet_utxos
+				(wallet_id, txid, vout, address, derivation_index, internal, amount_sats, block_height, block_hash, block_time, coinbase)
+				VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+				ON CONFLICT (wallet_id, txid, vout) DO UPDATE
+				SET block_height = EXCLUDED.block_height, block_hash = EXCLUDED.block_hash, block_time = EXCLUDED.block_time`,
+				w.id, txid, vout, addr, own.index, own.internal, out.Value, height, hash.String(), blockTime, coinbase)
+			if err != nil {
+				return fmt.Errorf("failed to record output: %v", err)
+			}
+			touched = true
+		}
+
+		if !touched {
+			continue
+		}
+
+		var fee sql.NullInt64
+		if ownInputs {
+			fee = sql.NullInt64{Int64: inputSats - outputSats, Valid: true}
+		}
+		_, err := tx.ExecContext(ctx, `INSERT INTO wallet_transactions (wallet_id, txid, block_height, block_hash, block_time, fee_sats)
+			VALUES ($1, $2, $3, $4, $5, $6)
+			ON CONFLICT (wallet_id, txid) DO UPDATE
+			SET block_height = EXCLUDED.block_height, block_hash = EXCLUDED.block_hash,
+				block_time = EXCLUDED.block_time, fee_sats = EXCLUDED.fee_sats`,
+			w.id, txid, height, hash.String(), blockTime, fee)
+		if err != nil {
+			return fmt.Errorf("failed to record transaction: %v", err)
+		}
+	}
+
+	if _, err := tx.ExecContext(ctx, insertBlockHashQuery, w.id, height, hash.String()); err != nil {
+		return fmt.Errorf("failed to record block hash: %v", err)
+	}
+
+	return tx.Commit()
+}
+
+const insertBlockHashQuery = `INSERT INTO block_hashes (wallet_id, height, hash) VALUES ($1, $2, $3)
+	ON CONFLICT (wallet_id, height) DO UPDATE SET hash = EXCLUDED.hash`
+
+// recordBlock marks a block as processed without touching wallet state.
+func (w *Wallet) recordBlock(ctx context.Context, height int64, hash *chainhash.Hash) error {
+	if _, err := w.db.ExecContext(ctx, insertBlockHashQuery, w.id, height, hash.String()); err != nil {
+		return fmt.Errorf("failed to record block hash: %v", err)
+	}
+	return nil
+}
+
+// pruneBlocks keeps only the last reorgDepth block hashes.
+func (w *Wallet) pruneBlocks(ctx context.Context, tip int64) error {
+	depth := w.reorgDepth
+	if depth <= 0 {
+		depth = 100
+	}
+	_, err := w.db.ExecContext(ctx, "DELETE FROM block_hashes WHERE wallet_id = $1 AND height <= $2", w.id, tip-int64(depth))
+	return err
+}
+
+// scriptSet returns the output scripts of all issued addresses keyed by hex.
+func (w *Wallet) scriptSet(ctx context.Context) (map[string]int, error) {
+	idx, err := w.derivationIndex(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	w.scriptsMu.Lock()
+	defer w.scriptsMu.Unlock()
+
+	if err := w.deriveIssuedLocked(idx); err != nil {
+		return nil, err
+	}
+
+	scripts := make(map[string]int, len(w.scripts))
+	for k, v := range w.scripts {
+		scripts[k] = v
+	}
+	return scripts, nil
+}
+
+// ownScript is where an output script of the wallet is derived: the
+// receive chain, or the change chain if internal.
+type ownScript struct {
+	index    int
+	internal bool
+}
+
+// ownScripts returns the output scripts of issued receive addresses and
+// handed out change addresses keyed by hex, the outputs blocks are
+// matched against.
+func (w *Wallet) ownScripts(ctx context.Context) (map[string]ownScript, error) {
+	external, err := w.scriptSet(ctx)
+	if err != nil {
+		return nil, err
+	}
+	internal, err := w.changeScriptSet(ctx)
+	if err != nil {
+		return nil, err
+	}
+	scripts := make(map[string]ownScript, len(external)+len(internal))
+	for s, idx := range external {
+		scripts[s] = ownScript{index: idx}
+	}
+	for s, idx := range internal {
+		scripts[s] = ownScript{index: idx, internal: true}
+	}
+	return scripts, nil
+}
+
+// ownAddress returns the address of an output script of the wallet.
+func (w *Wallet) ownAddress(s ownScript) (string, error) {
+	if !s.internal {
+		return w.DeriveAddress(s.index)
+	}
+	addr, err := w.internal.Address(uint32(s.index))
+	if err != nil {
+		return "", err
+	}
+	return addr.EncodeAddress(), nil
+}
+
+// deriveIssuedLocked extends the script and address maps up to idx.
+// scriptsMu must be held.
+func (w *Wallet) deriveIssuedLocked(idx int) error {
+	if w.scripts == nil {
+		w.scripts = make(map[string]int)
+		w.addrs = make(map[string]int)
+	}
+	for i := len(w.scripts); i < idx; i++ {
+		addrStr, err := w.DeriveAddress(i)
+		if err != nil {
+			return err
+		}
+		addr, err := btcutil.DecodeAddress(addrStr, w.params)
+		if err != nil {
+			return err
+		}
+		script, err := txscript.PayToAddrScript(addr)
+		if err != nil {
+			return err
+		}
+		w.scripts[hex.EncodeToString(script)] = i
+		w.addrs[addrStr] = i
+	}
+	return nil
+}
+
+// ListTransactions returns wallet transactions from processed blocks, newest first.
+func (w *Wallet) ListTransactions(ctx context.Context) ([]Transaction, error) {
+	rows, err := w.db.QueryContext(ctx, `SELECT txid, block_height, block_hash, block_time, fee_sats
+		FROM wallet_transactions WHERE wallet_id = $1 ORDER BY block_height DESC, txid`, w.id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	txs := []Transaction{}
+	for rows.Next() {
+		var t Transaction
+		var fee sql.NullInt64
+		if err := rows.Scan(&t.TxID, &t.BlockHeight, &t.BlockHash, &t.BlockTime, &fee); err != nil {
+			return nil, err
+		}
+		if fee.Valid {
+			t.FeeSats = &fee.Int64
+		}
+		txs = append(txs, t)
+	}
+	return txs, rows.Err()
+}
+
+func isCoinbase(tx *wire.MsgTx) bool {
+	return len(tx.TxIn) == 1 && tx.TxIn[0].PreviousOutPoint.Index == wire.MaxPrevOutIndex &&
+		tx.TxIn[0].PreviousOutPoint.Hash == (chainhash.Hash{})
+}
+
+// cachedBalance sums unspent wallet outputs from processed blocks.
+func (w *Wallet) cachedBalance(ctx context.Context) (btcutil.Amount, error) {
+	var sats int64
+	err := w.db.QueryRowContext(ctx, "SELECT COALESCE(SUM(amount_sats), 0) FROM wallet_utxos WHERE wallet_id = $1 AND spent_txid IS NULL", w.id).Scan(&sats)
+	if err != nil {
+		return 0, err
+	}
+	return btcutil.Amount(sats), nil
+}
+
+// cachedUTXOs lists unspent wallet outputs from processed blocks in the
+// same shape as listunspent.
+func (w *Wallet) cachedUTXOs(ctx context.Context) ([]btcjson.ListUnspentResult, error) {
+	var tip int64
+	if err := w.db.QueryRowContext(ctx, "SELECT COALESCE(MAX(height), 0) FROM block_hashes WHERE wallet_id = $1", w.id).Scan(&tip); err != nil {
+		return nil, err
+	}
+
+	rows, err := w.db.QueryContext(ctx, `SELECT txid, vout, address, amount_sats, block_height
+		FROM wallet_utxos WHERE wallet_id = $1 AND spent_txid IS NULL ORDER BY block_height, txid, vout`, w.id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	utxos := []btcjson.ListUnspentResult{}
+	for rows.Next() {
+		var u btcjson.ListUnspentResult
+		var sats, height int64
+		if err := rows.Scan(&u.TxID, &u.Vout, &u.Address, &sats, &height); err != nil {
+			return nil, err
+		}
+		addr, err := btcutil.DecodeAddress(u.Address, w.params)
+		if err != nil {
+			return nil, err
+		}
+		script, err := txscript.PayToAddrScript(addr)
+		if err != nil {
+			return nil, err
+		}
+		u.ScriptPubKey = hex.EncodeToString(script)
+		u.Amount = btcutil.Amount(sats).ToBTC()
+		u.Confirmations = tip - height + 1
+		utxos = append(utxos, u)
+	}
+	return utxos, rows.Err()
+}
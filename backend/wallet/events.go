@@ -0,0 +1,55 @@
+package wallet
+
+import (
+	"log/slog"
+	"time"
+)
+
+// Event types emitted by the wallet.
+const (
+	EventReorg = "reorg"
+)
+
+// Event is a notification about a change in wallet state.
+type Event struct {
+	Type string                 `json:"type"`
+	Time time.Time              `json:"time"`
+	Data map[string]interface{} `json:"data"`
+}
+
+// Subscribe returns a channel receiving wallet events and a function to
+// unsubscribe. Slow subscribers miss events rather than block the wallet.
+func (w *Wallet) Subscribe() (<-chan Event, func()) {
+	ch := make(chan Event, 16)
+
+	w.subsMu.Lock()
+	if w.subs == nil {
+		w.subs = make(map[chan Event]struct{})
+	}
+	w.subs[ch] = struct{}{}
+	w.subsMu.Unlock()
+
+	cancel := func() {
+		w.subsMu.Lock()
+		defer w.subsMu.Unlock()
+		if _, ok := w.subs[ch]; ok {
+			delete(w.subs, ch)
+			close(ch)
+		}
+	}
+	return ch, cancel
+}
+
+func (w *Wallet) emit(eventType string, data map[string]interface{}) {
+	e := Event{Type: eventType, Time: time.Now().UTC(), Data: data}
+
+	w.subsMu.Lock()
+	defer w.subsMu.Unlock()
+	for ch := range w.subs {
+		select {
+		case ch <- e:
+		default:
+			slog.Warn("Dropping event for slow subscriber", "type", eventType)
+		}
+	}
+}
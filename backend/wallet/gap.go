@@ -0,0 +1,86 @@
+package wallet
+
+import (
+	"context"
+	"fmt"
+)
+
+// GapLimitError is returned by GetNewAddress when issuing another address
+// would exceed the gap limit.
+type GapLimitError struct {
+	Unused int
+	Limit  int
+}
+
+func (e *GapLimitError) Error() string {
+	return fmt.Sprintf("%d consecutive issued addresses are unused (gap limit %d)", e.Unused, e.Limit)
+}
+
+// SetGapLimit sets the maximum number of consecutive unused issued
+// addresses. 0 disables the check.
+func (w *Wallet) SetGapLimit(limit int) {
+	w.gapLimit = limit
+}
+
+// UnusedGap returns how many addresses were issued after the last one
+// that received funds.
+func (w *Wallet) UnusedGap(ctx context.Context) (int, error) {
+	idx, err := w.derivationIndex(ctx)
+	if err != nil {
+		return 0, err
+	}
+	highest, err := w.highestUsedIndex(ctx, idx)
+	if err != nil {
+		return 0, err
+	}
+	return idx - (highest + 1), nil
+}
+
+func (w *Wallet) checkGap(ctx context.Context, idx int) error {
+	if w.gapLimit <= 0 {
+		return nil
+	}
+	highest, err := w.highestUsedIndex(ctx, idx)
+	if err != nil {
+		return fmt.Errorf("failed to check gap limit: %v", err)
+	}
+	if unused := idx - (highest + 1); unused >= w.gapLimit {
+		return &GapLimitError{Unused: unused, Limit: w.gapLimit}
+	}
+	return nil
+}
+
+// highestUsedIndex returns the highest derivation index below idx that has
+// received funds, or -1 if none has.
+func (w *Wallet) highestUsedIndex(ctx context.Context, idx int) (int, error) {
+	var highest int
+	err := w.db.QueryRowContext(ctx, "SELECT COALESCE(MAX(derivation_index), -1) FROM wallet_utxos WHERE wallet_id = $1 AND NOT internal", w.id).Scan(&highest)
+	if err != nil {
+		return 0, err
+	}
+	if w.filters != nil {
+		return highest, nil
+	}
+
+	// The node's wallet also knows about unconfirmed payments and history
+	// from before we started processing blocks.
+	// listreceivedbyaddress 0 false true
+	var received []struct {
+		Address string `json:"address"`
+	}
+	if err := w.client.call(ctx, "listreceivedbyaddress", &received, 0, false, true); err != nil {
+		return 0, fmt.Errorf("listreceivedbyaddress failed: %v", err)
+	}
+
+	w.scriptsMu.Lock()
+	defer w.scriptsMu.Unlock()
+	if err := w.deriveIssuedLocked(idx); err != nil {
+		return 0, err
+	}
+	for _, r := range received {
+		if i, ok := w.addrs[r.Address]; ok && i > highest {
+			highest = i
+		}
+	}
+	return highest, nil
+}
@@ -0,0 +1,171 @@
+package wallet
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg"
+
+	"github.com/sawdustofmind/bitcoin-wallet/backend/config"
+	"github.com/sawdustofmind/bitcoin-wallet/backend/health"
+)
+
+// Startup retry schedule for reaching bitcoind, doubling the delay after
+// each failed attempt.
+const (
+	nodeRetryAttempts = 12
+	nodeRetryInitial  = time.Second
+	nodeRetryMax      = 30 * time.Second
+)
+
+// syncFailureThreshold is the number of chain syncs in a row that must fail
+// for a wallet to fail readiness, so a single failed poll does not.
+const syncFailureThreshold = 3
+
+// nodeInfo is the part of getblockchaininfo used by readiness checks.
+type nodeInfo struct {
+	Chain                string `json:"chain"`
+	Blocks               int64  `json:"blocks"`
+	InitialBlockDownload bool   `json:"initialblockdownload"`
+	// Time is the tip's block time. Older nodes only report MedianTime.
+	Time       int64 `json:"time"`
+	MedianTime int64 `json:"mediantime"`
+}
+
+// tipTime is the block time of the node's best block.
+func (n *nodeInfo) tipTime() time.Time {
+	if n.Time == 0 {
+		return time.Unix(n.MedianTime, 0)
+	}
+	return time.Unix(n.Time, 0)
+}
+
+func getNodeInfo(ctx context.Context, client *nodeClient) (*nodeInfo, error) {
+	var info nodeInfo
+	if err := client.call(ctx, "getblockchaininfo", &info); err != nil {
+		return nil, fmt.Errorf("getblockchaininfo failed: %v", err)
+	}
+	return &info, nil
+}
+
+// waitForNode retries until bitcoind answers RPCs, since it may still be
+// starting or loading its block index.
+func waitForNode(ctx context.Context, client *nodeClient) error {
+	delay := nodeRetryInitial
+	var err error
+	for attempt := 1; attempt <= nodeRetryAttempts; attempt++ {
+		if _, err = getNodeInfo(ctx, client); err == nil {
+			return nil
+		}
+		if attempt == nodeRetryAttempts {
+			break
+		}
+		slog.WarnContext(ctx, "Failed to reach bitcoind, retrying", "attempt", attempt, "retry_in", delay, "error", err)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return fmt.Errorf("could not reach bitcoind: %v", err)
+		}
+		delay = min(delay*2, nodeRetryMax)
+	}
+	return fmt.Errorf("could not reach bitcoind after %d attempts: %v", nodeRetryAttempts, err)
+}
+
+// chainName is the name bitcoind reports in getblockchaininfo for params.
+func chainName(params *chaincfg.Params) string {
+	switch params.Name {
+	case chaincfg.MainNetParams.Name:
+		return "main"
+	case chaincfg.TestNet3Params.Name:
+		return "test"
+	default:
+		return params.Name
+	}
+}
+
+// ReadinessChecks returns the node and wallet conditions the service needs
+// to serve requests. A tip older than maxTipAge fails readiness; 0 disables
+// that check.
+func (m *Manager) ReadinessChecks(maxTipAge time.Duration) []health.Check {
+	// info runs getblockchaininfo for checks that depend on it
+	info := func(ctx context.Context) (*nodeInfo, error) {
+		info, err := getNodeInfo(ctx, m.root)
+		if err != nil {
+			return nil, health.Fail("bitcoind unreachable", err)
+		}
+		return info, nil
+	}
+
+	checks := []health.Check{
+		{Name: "bitcoind", Run: func(ctx context.Context) error {
+			_, err := info(ctx)
+			return err
+		}},
+		{Name: "initial_block_download", Run: func(ctx context.Context) error {
+			node, err := info(ctx)
+			if err != nil {
+				return err
+			}
+			if node.InitialBlockDownload {
+				return errors.New("node is in initial block download")
+			}
+			return nil
+		}},
+		{Name: "chain", Run: func(ctx context.Context) error {
+			node, err := info(ctx)
+			if err != nil {
+				return err
+			}
+			if want := chainName(m.params); node.Chain != want {
+				return fmt.Errorf("node is on %s, wallet is configured for %s", node.Chain, want)
+			}
+			return nil
+		}},
+	}
+
+	checks = append(checks, health.Check{Name: "sync", Run: func(ctx context.Context) error {
+		for _, w := range m.List() {
+			if failures, err := w.syncHealth(); err != nil {
+				return health.Fail(fmt.Sprintf("chain sync of wallet %d failed %d times in a row", w.id, failures), err)
+			}
+		}
+		return nil
+	}})
+
+	if maxTipAge > 0 {
+		checks = append(checks, health.Check{Name: "tip", Run: func(ctx context.Context) error {
+			node, err := info(ctx)
+			if err != nil {
+				return err
+			}
+			if age := time.Since(node.tipTime()); age > maxTipAge {
+				return fmt.Errorf("tip at height %d is %s old", node.Blocks, age.Round(time.Second))
+			}
+			return nil
+		}})
+	}
+
+	// Compact filter mode does not use node wallets
+	if m.cfg.SyncMode != config.SyncModeFilters {
+		checks = append(checks, health.Check{Name: "wallet", Run: func(ctx context.Context) error {
+			var loaded []string
+			if err := m.root.call(ctx, "listwallets", &loaded); err != nil {
+				return health.Fail("bitcoind unreachable", err)
+			}
+			isLoaded := make(map[string]bool, len(loaded))
+			for _, name := range loaded {
+				isLoaded[name] = true
+			}
+			for _, w := range m.List() {
+				if !isLoaded[w.name] {
+					return fmt.Errorf("wallet %q is not loaded", w.name)
+				}
+			}
+			return nil
+		}})
+	}
+	return checks
+}
@@ -0,0 +1,333 @@
+package wallet
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/btcsuite/btcd/btcutil"
+)
+
+// maxHistoryDays bounds the daily balance series.
+const maxHistoryDays = 3660
+
+// ErrInvalidRange is wrapped by errors about a requested date range.
+var ErrInvalidRange = errors.New("invalid date range")
+
+// ErrBeforeHistory is wrapped by errors about a point before the wallet's
+// history starts.
+var ErrBeforeHistory = errors.New("before wallet history")
+
+// HistoryStart is the first block the wallet processed. Outputs received
+// before it are not known, so there is no balance history before it.
+type HistoryStart struct {
+	Height int64
+	Time   time.Time
+}
+
+// HistoryStart returns the start of the wallet's history, or nil before
+// its first chain sync.
+func (w *Wallet) HistoryStart(ctx context.Context) (*HistoryStart, error) {
+	var height sql.NullInt64
+	var t sql.NullTime
+	err := w.db.QueryRowContext(ctx, "SELECT history_start_height, history_start_time FROM wallets WHERE id = $1",
+		w.id).Scan(&height, &t)
+	if err != nil {
+		return nil, err
+	}
+	if !height.Valid || !t.Valid {
+		return nil, nil
+	}
+	return &HistoryStart{Height: height.Int64, Time: t.Time.UTC()}, nil
+}
+
+// beforeHistory returns an ErrBeforeHistory error for a point before
+// start, which is nil if there is no history yet.
+func beforeHistory(start *HistoryStart, point string) error {
+	if start == nil {
+		return fmt.Errorf("%w: no blocks have been processed yet", ErrBeforeHistory)
+	}
+	return fmt.Errorf("%w: %s is before height %d (%s), where the history starts",
+		ErrBeforeHistory, point, start.Height, start.Time.Format(time.RFC3339))
+}
+
+// BalancePoint is the wallet balance at the end of a UTC day.
+type BalancePoint struct {
+	Date    time.Time
+	Balance btcutil.Amount
+}
+
+// BalanceAtHeight reconstructs the balance after block height was
+// connected: outputs received at or before it, minus those spent at or
+// before it. Only blocks processed by SyncChain are taken into account, so
+// heights before the history start fail with ErrBeforeHistory.
+func (w *Wallet) BalanceAtHeight(ctx context.Context, height int64) (btcutil.Amount, error) {
+	start, err := w.HistoryStart(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if start == nil || height < start.Height {
+		return 0, beforeHistory(start, fmt.Sprintf("height %d", height))
+	}
+	var sats int64
+	err = w.db.QueryRowContext(ctx, `SELECT COALESCE(SUM(amount_sats), 0) FROM wallet_utxos
+		WHERE wallet_id = $1 AND block_height <= $2 AND (spent_height IS NULL OR spent_height > $2)`, w.id, height).Scan(&sats)
+	if err != nil {
+		return 0, err
+	}
+	return btcutil.Amount(sats), nil
+}
+
+// BalanceAtTime reconstructs the balance at t using block timestamps.
+// Times before the history start fail with ErrBeforeHistory.
+func (w *Wallet) BalanceAtTime(ctx context.Context, t time.Time) (btcutil.Amount, error) {
+	start, err := w.HistoryStart(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if start == nil || t.Before(start.Time) {
+		return 0, beforeHistory(start, t.UTC().Format(time.RFC3339))
+	}
+	var sats int64
+	err = w.db.QueryRowContext(ctx, `SELECT COALESCE(SUM(amount_sats), 0) FROM wallet_utxos
+		WHERE wallet_id = $1 AND block_time <= $2 AND (spent_time IS NULL OR spent_time > $2)`, w.id, t).Scan(&sats)
+	if err != nil {
+		return 0, err
+	}
+	return btcutil.Amount(sats), nil
+}
+
+// LedgerBalance is the running balance of the ledger at t, or now if t is
+// zero: what Ledger's BalanceSats shows after the last transaction
+// confirmed by then, zero before the history start.
+func (w *Wallet) LedgerBalance(ctx context.Context, t time.Time) (btcutil.Amount, error) {
+	var at sql.NullTime
+	if !t.IsZero() {
+		at = sql.NullTime{Time: t, Valid: true}
+	}
+	var sats int64
+	err := w.db.QueryRowContext(ctx, `SELECT COALESCE(SUM(amount_sats), 0) FROM wallet_utxos
+		WHERE wallet_id = $1 AND ($2::timestamptz IS NULL OR block_time <= $2)
+			AND (spent_time IS NULL OR ($2::timestamptz IS NOT NULL AND spent_time > $2))`, w.id, at).Scan(&sats)
+	if err != nil {
+		return 0, err
+	}
+	return btcutil.Amount(sats), nil
+}
+
+// DailyBalances returns the end-of-day balance for every UTC day from
+// from to to, inclusive. Days before the one the history starts on are
+// left out.
+func (w *Wallet) DailyBalances(ctx context.Context, from, to time.Time) ([]BalancePoint, error) {
+	from = truncateDay(from)
+	to = truncateDay(to)
+	if to.Before(from) {
+		return nil, fmt.Errorf("%w: end date before start date", ErrInvalidRange)
+	}
+	if days := int(to.Sub(from).Hours()/24) + 1; days > maxHistoryDays {
+		return nil, fmt.Errorf("%w: %d days exceeds limit of %d", ErrInvalidRange, days, maxHistoryDays)
+	}
+	start, err := w.HistoryStart(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if start == nil {
+		return []BalancePoint{}, nil
+	}
+	if day := truncateDay(start.Time); from.Before(day) {
+		from = day
+	}
+	if to.Before(from) {
+		return []BalancePoint{}, nil
+	}
+	end := to.AddDate(0, 0, 1)
+
+	rows, err := w.db.QueryContext(ctx, `SELECT amount_sats, block_time, spent_time FROM wallet_utxos
+		WHERE wallet_id = $1 AND block_time < $2`, w.id, end)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var changes []balanceChange
+	for rows.Next() {
+		var sats int64
+		var received time.Time
+		var spent *time.Time
+		if err := rows.Scan(&sats, &received, &spent); err != nil {
+			return nil, err
+		}
+		changes = append(changes, balanceChange{At: received, Delta: sats})
+		if spent != nil {
+			changes = append(changes, balanceChange{At: *spent, Delta: -sats})
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return dailySeries(changes, from, to), nil
+}
+
+type balanceChange struct {
+	At    time.Time
+	Delta int64
+}
+
+// dailySeries folds balance changes into end-of-day balances.
+func dailySeries(changes []balanceChange, from, to time.Time) []BalancePoint {
+	sort.Slice(changes, func(i, j int) bool { return changes[i].At.Before(changes[j].At) })
+
+	var points []BalancePoint
+	var balance int64
+	i := 0
+	for day := from; !day.After(to); day = day.AddDate(0, 0, 1) {
+		next := day.AddDate(0, 0, 1)
+		for i < len(changes) && changes[i].At.Before(next) {
+			balance += changes[i].Delta
+			i++
+		}
+		points = append(points, BalancePoint{Date: day, Balance: btcutil.Amount(balance)})
+	}
+	return points
+}
+
+func truncateDay(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+// LedgerEntry is one wallet transaction with its effect on the balance.
+type LedgerEntry struct {
+	TxID        string
+	BlockHeight int64
+	BlockTime   time.Time
+	// AmountSats is the net change to the wallet balance.
+	AmountSats int64
+	// FeeSats is only known when every input was spent from this wallet.
+	FeeSats *int64
+	// BalanceSats is the running balance after this transaction.
+	BalanceSats     int64
+	Addresses       []string
+	DerivationPaths []string
+	// Label is the transaction's label, or else the first address label.
+	Label string
+}
+
+// Ledger returns wallet transactions confirmed between from and to
+// (inclusive, zero values meaning unbounded) in chain order. Running
+// balances account for all earlier transactions.
+func (w *Wallet) Ledger(ctx context.Context, from, to time.Time) ([]LedgerEntry, error) {
+	rows, err := w.db.QueryContext(ctx, `SELECT t.txid, t.block_height, t.block_time, t.fee_sats,
+			COALESCE((SELECT SUM(amount_sats) FROM wallet_utxos u WHERE u.wallet_id = t.wallet_id AND u.txid = t.txid), 0),
+			COALESCE((SELECT SUM(amount_sats) FROM wallet_utxos u WHERE u.wallet_id = t.wallet_id AND u.spent_txid = t.txid), 0)
+		FROM wallet_transactions t WHERE t.wallet_id = $1 ORDER BY t.block_height, t.txid`, w.id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []LedgerEntry
+	var balance int64
+	for rows.Next() {
+		var e LedgerEntry
+		var fee *int64
+		var received, spent int64
+		if err := rows.Scan(&e.TxID, &e.BlockHeight, &e.BlockTime, &fee, &received, &spent); err != nil {
+			return nil, err
+		}
+		e.FeeSats = fee
+		e.AmountSats = received - spent
+		balance += e.AmountSats
+		e.BalanceSats = balance
+
+		if !from.IsZero() && e.BlockTime.Before(from) {
+			continue
+		}
+		if !to.IsZero() && e.BlockTime.After(to) {
+			continue
+		}
+		entries = append(entries, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	txLabels, err := w.labelMap(ctx, LabelTx)
+	if err != nil {
+		return nil, err
+	}
+	addrLabels, err := w.labelMap(ctx, LabelAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	addrs, err := w.ledgerAddresses(ctx, from, to)
+	if err != nil {
+		return nil, err
+	}
+	for i := range entries {
+		e := &entries[i]
+		for _, a := range addrs[e.TxID] {
+			e.Addresses = append(e.Addresses, a.address)
+			desc := w.external
+			if a.internal {
+				desc = w.internal
+			}
+			e.DerivationPaths = append(e.DerivationPaths, chainPath(desc, a.index))
+			if e.Label == "" {
+				e.Label = addrLabels[a.address]
+			}
+		}
+		if l, ok := txLabels[e.TxID]; ok && l != "" {
+			e.Label = l
+		}
+	}
+
+	return entries, nil
+}
+
+type ledgerAddress struct {
+	address  string
+	index    int
+	internal bool
+}
+
+// ledgerAddresses returns, by txid, the receive addresses each
+// transaction confirmed between from and to received to, or for spends
+// the ones it spent from, ordered by chain and derivation index. Change is
+// not listed.
+func (w *Wallet) ledgerAddresses(ctx context.Context, from, to time.Time) (map[string][]ledgerAddress, error) {
+	var fromArg, toArg sql.NullTime
+	if !from.IsZero() {
+		fromArg = sql.NullTime{Time: from, Valid: true}
+	}
+	if !to.IsZero() {
+		toArg = sql.NullTime{Time: to, Valid: true}
+	}
+	rows, err := w.db.QueryContext(ctx, `SELECT DISTINCT t.txid, u.address, u.derivation_index, u.internal
+		FROM wallet_transactions t JOIN wallet_utxos u ON u.wallet_id = t.wallet_id AND ((u.txid = t.txid AND NOT u.internal)
+			OR (u.spent_txid = t.txid AND NOT EXISTS (
+				SELECT 1 FROM wallet_utxos r WHERE r.wallet_id = t.wallet_id AND r.txid = t.txid AND NOT r.internal)))
+		WHERE t.wallet_id = $1 AND ($2::timestamptz IS NULL OR t.block_time >= $2)
+			AND ($3::timestamptz IS NULL OR t.block_time <= $3)
+		ORDER BY t.txid, u.internal, u.derivation_index`, w.id, fromArg, toArg)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	addrs := make(map[string][]ledgerAddress)
+	for rows.Next() {
+		var txid string
+		var a ledgerAddress
+		if err := rows.Scan(&txid, &a.address, &a.index, &a.internal); err != nil {
+			return nil, err
+		}
+		addrs[txid] = append(addrs[txid], a)
+	}
+	return addrs, rows.Err()
+}
@@ -0,0 +1,182 @@
+package wallet
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// BIP329 label types.
+const (
+	LabelTx     = "tx"
+	LabelAddr   = "addr"
+	LabelPubkey = "pubkey"
+	LabelInput  = "input"
+	LabelOutput = "output"
+	LabelXpub   = "xpub"
+)
+
+var labelTypes = map[string]bool{
+	LabelTx: true, LabelAddr: true, LabelPubkey: true,
+	LabelInput: true, LabelOutput: true, LabelXpub: true,
+}
+
+// maxLabelLineSize bounds a single JSONL record on import.
+const maxLabelLineSize = 64 * 1024
+
+// maxLabelLines bounds the number of lines of an import, which is stored
+// in one transaction.
+const maxLabelLines = 100_000
+
+// LabelError reports an invalid record in a BIP329 import.
+type LabelError struct {
+	Line int
+	Err  error
+}
+
+func (e *LabelError) Error() string {
+	return fmt.Sprintf("line %d: %v", e.Line, e.Err)
+}
+
+func (e *LabelError) Unwrap() error {
+	return e.Err
+}
+
+// Label is a BIP329 label record.
+type Label struct {
+	Type      string  `json:"type"`
+	Ref       string  `json:"ref"`
+	Label     string  `json:"label"`
+	Origin    *string `json:"origin,omitempty"`
+	Spendable *bool   `json:"spendable,omitempty"`
+}
+
+func (l *Label) validate() error {
+	if !labelTypes[l.Type] {
+		return fmt.Errorf("unknown label type %q", l.Type)
+	}
+	if l.Ref == "" {
+		return fmt.Errorf("label ref is required")
+	}
+	if l.Spendable != nil && l.Type != LabelOutput {
+		return fmt.Errorf("spendable is only valid for output labels")
+	}
+	return nil
+}
+
+// Labels returns all stored labels.
+func (w *Wallet) Labels(ctx context.Context) ([]Label, error) {
+	rows, err := w.db.QueryContext(ctx, "SELECT type, ref, label, origin, spendable FROM labels WHERE wallet_id = $1 ORDER BY type, ref", w.id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	labels := []Label{}
+	for rows.Next() {
+		var l Label
+		var origin sql.NullString
+		var spendable sql.NullBool
+		if err := rows.Scan(&l.Type, &l.Ref, &l.Label, &origin, &spendable); err != nil {
+			return nil, err
+		}
+		if origin.Valid {
+			l.Origin = &origin.String
+		}
+		if spendable.Valid {
+			l.Spendable = &spendable.Bool
+		}
+		labels = append(labels, l)
+	}
+	return labels, rows.Err()
+}
+
+// labelMap returns the label text of each ref of the given type.
+func (w *Wallet) labelMap(ctx context.Context, labelType string) (map[string]string, error) {
+	rows, err := w.db.QueryContext(ctx, "SELECT ref, label FROM labels WHERE wallet_id = $1 AND type = $2", w.id, labelType)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	labels := make(map[string]string)
+	for rows.Next() {
+		var ref, label string
+		if err := rows.Scan(&ref, &label); err != nil {
+			return nil, err
+		}
+		labels[ref] = label
+	}
+	return labels, rows.Err()
+}
+
+// ExportBIP329 writes all labels as BIP329 JSON Lines.
+func (w *Wallet) ExportBIP329(ctx context.Context, out io.Writer) error {
+	labels, err := w.Labels(ctx)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(out)
+	for _, l := range labels {
+		if err := enc.Encode(l); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ImportBIP329 reads BIP329 JSON Lines and upserts every record. The import
+// is all-or-nothing: any invalid line, or more than maxLabelLines lines,
+// aborts it. The caller bounds the size of in.
+func (w *Wallet) ImportBIP329(ctx context.Context, in io.Reader) (int, error) {
+	var labels []Label
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 0, 4096), maxLabelLineSize)
+	line := 0
+	for scanner.Scan() {
+		line++
+		if line > maxLabelLines {
+			return 0, &LabelError{Line: line, Err: fmt.Errorf("import exceeds %d lines", maxLabelLines)}
+		}
+		raw := bytes.TrimSpace(scanner.Bytes())
+		if len(raw) == 0 {
+			continue
+		}
+		var l Label
+		if err := json.Unmarshal(raw, &l); err != nil {
+			return 0, &LabelError{Line: line, Err: err}
+		}
+		if err := l.validate(); err != nil {
+			return 0, &LabelError{Line: line, Err: err}
+		}
+		labels = append(labels, l)
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, &LabelError{Line: line + 1, Err: err}
+	}
+
+	tx, err := w.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	for _, l := range labels {
+		_, err := tx.ExecContext(ctx, `INSERT INTO labels (wallet_id, type, ref, label, origin, spendable)
+			VALUES ($1, $2, $3, $4, $5, $6)
+			ON CONFLICT (wallet_id, type, ref) DO UPDATE
+			SET label = EXCLUDED.label, origin = EXCLUDED.origin, spendable = EXCLUDED.spendable`,
+			w.id, l.Type, l.Ref, l.Label, l.Origin, l.Spendable)
+		if err != nil {
+			return 0, fmt.Errorf("failed to store label: %v", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return len(labels), nil
+}
@@ -0,0 +1,460 @@
+package wallet
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/btcsuite/btcd/btcjson"
+	"github.com/btcsuite/btcd/btcutil/hdkeychain"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/lib/pq"
+
+	"github.com/sawdustofmind/bitcoin-wallet/backend/config"
+	"github.com/sawdustofmind/bitcoin-wallet/backend/descriptor"
+)
+
+// DefaultWalletID is the wallet registered from the XPUB setting. The
+// unscoped API routes serve it.
+const DefaultWalletID int64 = 1
+
+// changeLookahead is how many change addresses of an internal descriptor
+// are imported into the node wallet beyond the next one to hand out, like
+// bitcoind's keypool.
+const changeLookahead = 1000
+
+// defaultNodeWallet is the bitcoind wallet of the default wallet, kept from
+// before wallets could be registered.
+const defaultNodeWallet = "mywallet"
+
+// pqUniqueViolation is Postgres' unique_violation error code.
+const pqUniqueViolation = "23505"
+
+var (
+	// ErrWalletNotFound is returned for an unknown wallet ID.
+	ErrWalletNotFound = errors.New("wallet not found")
+	// ErrWalletExists is returned when registering a wallet whose name,
+	// node wallet, descriptor or xpub and script type is already taken.
+	ErrWalletExists = errors.New("a wallet with this name, node wallet, descriptor or xpub and script type already exists")
+)
+
+// nodeWalletName is what bitcoind accepts as a wallet name in the
+// /wallet/<name> endpoint without escaping.
+var nodeWalletName = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// Definition describes a wallet to register, by either an xpub and script
+// type or an output descriptor.
+type Definition struct {
+	Name string `json:"name"`
+	XPUB string `json:"xpub"`
+	// ScriptType is one of the Script* constants. It defaults to
+	// ScriptP2WPKH for an xpub, and is implied by a descriptor.
+	ScriptType string `json:"script_type"`
+	// Descriptor is a ranged output descriptor with checksum, see package
+	// descriptor. A multipath <0;1> step gives the receive and change
+	// chains.
+	Descriptor string `json:"descriptor"`
+	// ChangeDescriptor optionally gives the change chain of a descriptor
+	// without a multipath step.
+	ChangeDescriptor string `json:"change_descriptor"`
+	// AccountKeys are the xpubs of BIP44/49/84/86 accounts 0, 1, ... with
+	// their origins, e.g. [d34db33f/84h/1h/0h]tpub..., which the wallet
+	// discovers instead of an XPUB or Descriptor. The script type follows
+	// from their purpose. Addresses are issued from account 0.
+	AccountKeys []string `json:"account_keys"`
+	// NodeWallet is the bitcoind wallet addresses are imported into. It
+	// defaults to "wallet-<id>".
+	NodeWallet string `json:"node_wallet"`
+}
+
+// DefinitionError reports an invalid Definition.
+type DefinitionError struct {
+	Msg string
+}
+
+func (e *DefinitionError) Error() string {
+	return e.Msg
+}
+
+// Info describes a registered wallet. The xpub and descriptors are not
+// included.
+type Info struct {
+	ID         int64     `json:"id"`
+	Name       string    `json:"name"`
+	ScriptType string    `json:"script_type"`
+	NodeWallet string    `json:"node_wallet"`
+	CreatedAt  time.Time `json:"created_at"`
+	// AccountDiscovery is set for wallets watching multiple accounts, see
+	// Definition.AccountKeys.
+	AccountDiscovery bool `json:"account_discovery,omitempty"`
+}
+
+// Manager owns the registered wallets. They share one bitcoind connection
+// and database, but each has its own node wallet, derivation index,
+// block-derived state and labels.
+type Manager struct {
+	cfg      config.BitcoinConfig
+	db       *sql.DB
+	params   *chaincfg.Params
+	root     *nodeClient
+	gapLimit int
+	// signer and payjoinFallback enable payjoin, see Wallet.SetPayjoin.
+	signer          Signer
+	payjoinFallback time.Duration
+
+	mu      sync.RWMutex
+	wallets map[int64]*Wallet
+	// ctx is set by Start so wallets registered later are started too.
+	ctx context.Context
+}
+
+// NewManager connects to bitcoind, waiting for it to come up. ctx bounds
+// startup. Wallets are opened by Load.
+func NewManager(ctx context.Context, btcCfg config.BitcoinConfig, db *sql.DB) (*Manager, error) {
+	m := &Manager{
+		cfg: btcCfg,
+		db:  db,
+		// Regtest params
+		params:  &chaincfg.RegressionNetParams,
+		root:    newNodeClient(btcCfg, ""),
+		wallets: make(map[int64]*Wallet),
+	}
+	if err := waitForNode(ctx, m.root); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// SetGapLimit sets the gap limit of every wallet, see Wallet.SetGapLimit.
+// It must be called before Load.
+func (m *Manager) SetGapLimit(limit int) {
+	m.gapLimit = limit
+}
+
+// SetPayjoin enables payjoin for every wallet, see Wallet.SetPayjoin. It
+// must be called before Load.
+func (m *Manager) SetPayjoin(signer Signer, fallback time.Duration) {
+	m.signer = signer
+	m.payjoinFallback = fallback
+}
+
+// RegisterDefault registers def as DefaultWalletID unless it exists. The
+// derivation index carries over from the single-wallet schema. It must be
+// called before Load.
+func (m *Manager) RegisterDefault(ctx context.Context, def Definition) error {
+	if def.XPUB != "" && def.ScriptType == "" {
+		def.ScriptType = ScriptP2PKH
+	}
+	external, internal, scriptType, err := definitionDescriptors(def, m.params)
+	if err != nil {
+		return err
+	}
+	xpub, desc, changeDesc := storedKeys(def, external, internal)
+	_, err = m.db.ExecContext(ctx, `INSERT INTO wallets (id, name, xpub, descriptor, change_descriptor, script_type, node_wallet, derivation_index)
+		SELECT $1, 'default', $2, $3, $4, $5, $6, COALESCE((SELECT derivation_index FROM wallet_state WHERE id = 1), 0)
+		ON CONFLICT (id) DO NOTHING`, DefaultWalletID, xpub, desc, changeDesc, scriptType, defaultNodeWallet)
+	if err != nil {
+		return fmt.Errorf("failed to register default wallet: %v", err)
+	}
+
+	var storedXPUB, storedDesc, storedChange sql.NullString
+	err = m.db.QueryRowContext(ctx, "SELECT xpub, descriptor, change_descriptor FROM wallets WHERE id = $1", DefaultWalletID).
+		Scan(&storedXPUB, &storedDesc, &storedChange)
+	if err != nil {
+		return err
+	}
+	if storedXPUB != xpub || storedDesc != desc || storedChange != changeDesc {
+		return fmt.Errorf("XPUB or DESCRIPTOR does not match the registered default wallet")
+	}
+	return nil
+}
+
+// storedKeys returns the xpub, descriptor and change descriptor columns of
+// a definition. Descriptors are stored normalized, with multipath
+// descriptors split. A definition by account keys stores account 0's, so
+// no two wallets watch it.
+func storedKeys(def Definition, external, internal *descriptor.Descriptor) (xpub, desc, changeDesc sql.NullString) {
+	if def.XPUB != "" {
+		return sql.NullString{String: def.XPUB, Valid: true}, desc, changeDesc
+	}
+	desc = sql.NullString{String: external.String(), Valid: true}
+	if internal != nil {
+		changeDesc = sql.NullString{String: internal.String(), Valid: true}
+	}
+	return xpub, desc, changeDesc
+}
+
+// Load opens every registered wallet, creating or loading its node wallet.
+func (m *Manager) Load(ctx context.Context) error {
+	rows, err := m.db.QueryContext(ctx, `SELECT id, name, xpub, descriptor, change_descriptor, script_type, node_wallet, created_at, change_index,
+		account_discovery, account_keys, accounts
+		FROM wallets ORDER BY id`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	type stored struct {
+		info        Info
+		def         Definition
+		changeIndex int
+		accounts    int
+	}
+	var all []stored
+	for rows.Next() {
+		var s stored
+		var xpub, desc, changeDesc sql.NullString
+		var accountKeys []string
+		err := rows.Scan(&s.info.ID, &s.info.Name, &xpub, &desc, &changeDesc, &s.info.ScriptType, &s.info.NodeWallet, &s.info.CreatedAt, &s.changeIndex,
+			&s.info.AccountDiscovery, pq.Array(&accountKeys), &s.accounts)
+		if err != nil {
+			return err
+		}
+		s.def = Definition{ScriptType: s.info.ScriptType}
+		if s.info.AccountDiscovery {
+			// The descriptor columns hold account 0
+			s.def.AccountKeys = accountKeys
+		} else {
+			s.def.XPUB, s.def.Descriptor, s.def.ChangeDescriptor = xpub.String, desc.String, changeDesc.String
+		}
+		all = append(all, s)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	for _, s := range all {
+		w, err := m.open(ctx, s.info, s.def, s.changeIndex, s.accounts)
+		if err != nil {
+			return fmt.Errorf("failed to open wallet %d: %v", s.info.ID, err)
+		}
+		m.mu.Lock()
+		m.wallets[w.id] = w
+		m.mu.Unlock()
+	}
+	slog.InfoContext(ctx, "Wallets loaded", "count", len(all))
+	return nil
+}
+
+// Create validates and registers a wallet and starts it if the manager is
+// running.
+func (m *Manager) Create(ctx context.Context, def Definition) (*Wallet, error) {
+	if def.ScriptType == "" && def.Descriptor == "" && len(def.AccountKeys) == 0 {
+		def.ScriptType = ScriptP2WPKH
+	}
+	if def.Name == "" {
+		return nil, &DefinitionError{Msg: "name is required"}
+	}
+	if def.ScriptType != "" && !validScriptTypes[def.ScriptType] {
+		return nil, &DefinitionError{Msg: fmt.Sprintf("unknown script type %q", def.ScriptType)}
+	}
+	if def.NodeWallet != "" && !nodeWalletName.MatchString(def.NodeWallet) {
+		return nil, &DefinitionError{Msg: "node_wallet must be 1-64 letters, digits, '-' or '_'"}
+	}
+	if len(def.AccountKeys) > 0 && m.cfg.SyncMode == config.SyncModeFilters {
+		return nil, &DefinitionError{Msg: "account_keys needs BITCOIN_SYNC_MODE=wallet"}
+	}
+	external, internal, scriptType, err := definitionDescriptors(def, m.params)
+	if err != nil {
+		return nil, &DefinitionError{Msg: err.Error()}
+	}
+	// Account keys give the script type
+	def.ScriptType = scriptType
+	xpub, desc, changeDesc := storedKeys(def, external, internal)
+
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// The default node wallet name needs the ID
+	info := Info{Name: def.Name, ScriptType: scriptType, NodeWallet: def.NodeWallet, AccountDiscovery: len(def.AccountKeys) > 0}
+	if err := tx.QueryRowContext(ctx, "SELECT nextval(pg_get_serial_sequence('wallets', 'id'))").Scan(&info.ID); err != nil {
+		return nil, err
+	}
+	if info.NodeWallet == "" {
+		info.NodeWallet = fmt.Sprintf("wallet-%d", info.ID)
+	}
+	var accountKeys interface{}
+	if info.AccountDiscovery {
+		accountKeys = pq.Array(def.AccountKeys)
+	}
+	err = tx.QueryRowContext(ctx, `INSERT INTO wallets (id, name, xpub, descriptor, change_descriptor, script_type, node_wallet, account_discovery, account_keys)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9) RETURNING created_at`,
+		info.ID, def.Name, xpub, desc, changeDesc, scriptType, info.NodeWallet, info.AccountDiscovery, accountKeys).Scan(&info.CreatedAt)
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == pqUniqueViolation {
+		return nil, ErrWalletExists
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Set up the node wallet before committing, so a failure leaves
+	// nothing registered
+	w, err := m.open(ctx, info, def, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	m.wallets[w.id] = w
+	runCtx := m.ctx
+	m.mu.Unlock()
+	if runCtx != nil {
+		w.Start(runCtx)
+	}
+	slog.InfoContext(ctx, "Wallet registered", "wallet_id", w.id, "name", info.Name, "script_type", info.ScriptType)
+	return w, nil
+}
+
+// open builds a Wallet for a registered wallet. In wallet mode it creates
+// the node wallet, or loads it if it exists, and imports the change
+// descriptor past changeIndex, the next change index to hand out. accounts
+// is how many accounts discovery has imported.
+func (m *Manager) open(ctx context.Context, info Info, def Definition, changeIndex, accounts int) (*Wallet, error) {
+	external, internal, _, err := definitionDescriptors(def, m.params)
+	if err != nil {
+		return nil, err
+	}
+	w := &Wallet{
+		id:           info.ID,
+		info:         info,
+		db:           m.db,
+		external:     external,
+		internal:     internal,
+		params:       m.params,
+		pollInterval: m.cfg.PollInterval,
+		reorgDepth:   m.cfg.ReorgDepth,
+		gapLimit:     m.gapLimit,
+
+		signer:          m.signer,
+		payjoinFallback: m.payjoinFallback,
+	}
+	if def.XPUB != "" && internal == nil {
+		// Not used by the wallet, but payments to it are still ours
+		if w.unusedChange, err = keyDescriptor(def.XPUB+"/1/*", def.ScriptType, m.params); err != nil {
+			return nil, err
+		}
+	}
+
+	// In compact filter mode we only use chain RPCs (getblockfilter,
+	// getblock), so no node wallet is created and nothing is imported.
+	// Only the external chain is matched against filters.
+	if m.cfg.SyncMode == config.SyncModeFilters {
+		w.client = m.root
+		w.filters = &rpcFilterSource{client: m.root}
+		return w, nil
+	}
+
+	// Try to create the wallet, loading it if it already exists.
+	// createwallet <name> disable_private_keys=true
+	name := info.NodeWallet
+	err = m.root.call(ctx, "createwallet", nil, name, true)
+	if err != nil {
+		slog.DebugContext(ctx, "Could not create wallet, loading it", "wallet", name, "error", err)
+		loadErr := m.root.call(ctx, "loadwallet", nil, name)
+		var rpcErr *btcjson.RPCError
+		switch {
+		case loadErr == nil:
+		case errors.As(loadErr, &rpcErr) && rpcErr.Code == rpcWalletAlreadyLoaded:
+			slog.DebugContext(ctx, "Wallet already loaded", "wallet", name)
+		default:
+			return nil, fmt.Errorf("failed to create or load wallet %q: %v", name, loadErr)
+		}
+	}
+
+	// Wallet RPCs go to /wallet/<name>, which bitcoind requires once more
+	// than one wallet is loaded
+	w.client = newNodeClient(m.cfg, name)
+	w.name = name
+	if len(def.AccountKeys) > 0 {
+		w.accounts = newAccountSet(def, m.cfg, name, accounts)
+	}
+
+	if internal != nil {
+		if err := w.importDescriptor(ctx, internal, changeIndex+changeLookahead, true); err != nil {
+			w.client.close()
+			return nil, fmt.Errorf("failed to import change descriptor: %v", err)
+		}
+	}
+	return w, nil
+}
+
+// Get returns a registered wallet.
+func (m *Manager) Get(id int64) (*Wallet, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	w, ok := m.wallets[id]
+	if !ok {
+		return nil, ErrWalletNotFound
+	}
+	return w, nil
+}
+
+// List returns all registered wallets ordered by ID.
+func (m *Manager) List() []*Wallet {
+	m.mu.RLock()
+	wallets := make([]*Wallet, 0, len(m.wallets))
+	for _, w := range m.wallets {
+		wallets = append(wallets, w)
+	}
+	m.mu.RUnlock()
+	sort.Slice(wallets, func(i, j int) bool { return wallets[i].id < wallets[j].id })
+	return wallets
+}
+
+// Start starts every wallet, and those registered later, until ctx is
+// cancelled or Stop is called.
+func (m *Manager) Start(ctx context.Context) {
+	m.mu.Lock()
+	m.ctx = ctx
+	wallets := make([]*Wallet, 0, len(m.wallets))
+	for _, w := range m.wallets {
+		wallets = append(wallets, w)
+	}
+	m.mu.Unlock()
+	for _, w := range wallets {
+		w.Start(ctx)
+	}
+}
+
+// Stop stops every wallet, see Wallet.Stop, and releases the node
+// connection.
+func (m *Manager) Stop() {
+	var wg sync.WaitGroup
+	for _, w := range m.List() {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w.Stop()
+		}()
+	}
+	wg.Wait()
+	m.root.close()
+}
+
+func parseXPUB(xpub string, params *chaincfg.Params) (*hdkeychain.ExtendedKey, error) {
+	key, err := hdkeychain.NewKeyFromString(xpub)
+	if err != nil {
+		return nil, fmt.Errorf("invalid xpub: %v", err)
+	}
+	if key.IsPrivate() {
+		return nil, fmt.Errorf("invalid xpub: private keys are not accepted")
+	}
+	if !key.IsForNet(params) {
+		return nil, fmt.Errorf("invalid xpub: not for %s", params.Name)
+	}
+	return key, nil
+}
@@ -0,0 +1,43 @@
+package wallet
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/sawdustofmind/bitcoin-wallet/backend/metrics"
+)
+
+// updateMetrics refreshes the wallet and chain gauges. Start calls it after
+// every sync so scrapes never reach bitcoind.
+func (w *Wallet) updateMetrics(ctx context.Context) error {
+	node, err := getNodeInfo(ctx, w.client)
+	if err != nil {
+		return err
+	}
+	metrics.ChainTipHeight.Set(float64(node.Blocks))
+	metrics.SetLastBlockTime(node.tipTime())
+
+	idx, err := w.derivationIndex(ctx)
+	if err != nil {
+		return err
+	}
+	label := w.metricsLabel()
+	metrics.DerivationIndex.WithLabelValues(label).Set(float64(idx))
+	highest, err := w.highestUsedIndex(ctx, idx)
+	if err != nil {
+		return err
+	}
+	metrics.UnusedGap.WithLabelValues(label).Set(float64(idx - (highest + 1)))
+
+	balances, err := w.GetBalances(ctx)
+	if err != nil {
+		return err
+	}
+	metrics.BalanceSats.WithLabelValues(label).Set(float64(balances.Trusted))
+	return nil
+}
+
+// metricsLabel is the wallet's value of the "wallet" metric label.
+func (w *Wallet) metricsLabel() string {
+	return strconv.FormatInt(w.id, 10)
+}
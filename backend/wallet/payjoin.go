@@ -0,0 +1,528 @@
+package wallet
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"math/rand/v2"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/btcsuite/btcd/btcjson"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/btcutil/psbt"
+	"github.com/btcsuite/btcd/mempool"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// PayjoinVersion is the BIP78 protocol version the receiver speaks.
+const PayjoinVersion = 1
+
+// Error codes of BIP78
+const (
+	PayjoinUnavailable        = "unavailable"
+	PayjoinNotEnoughMoney     = "not-enough-money"
+	PayjoinVersionUnsupported = "version-unsupported"
+	PayjoinOriginalRejected   = "original-psbt-rejected"
+)
+
+// Payjoin request statuses
+const (
+	payjoinPending = "pending"
+	// payjoinSettled is a request whose sender spent its inputs, with the
+	// original, the proposal or another transaction.
+	payjoinSettled = "settled"
+	// payjoinBroadcast is a request whose original was broadcast by the
+	// fallback.
+	payjoinBroadcast = "broadcast"
+	// payjoinFailed is a request whose original the node refused.
+	payjoinFailed = "failed"
+)
+
+// payjoinFallbackInterval is how often the fallback looks for requests
+// past their timeout.
+const payjoinFallbackInterval = 10 * time.Second
+
+// PayjoinError is a BIP78 error, answered to the sender with its Code.
+type PayjoinError struct {
+	Code string
+	Msg  string
+}
+
+func (e *PayjoinError) Error() string {
+	return e.Msg
+}
+
+func payjoinRejected(format string, args ...interface{}) error {
+	return &PayjoinError{Code: PayjoinOriginalRejected, Msg: fmt.Sprintf(format, args...)}
+}
+
+// PayjoinParams are the query parameters of a BIP78 request.
+type PayjoinParams struct {
+	// AdditionalFeeOutputIndex is the sender's output that may pay up to
+	// MaxAdditionalFeeContribution towards the receiver's input, or -1.
+	AdditionalFeeOutputIndex     int
+	MaxAdditionalFeeContribution btcutil.Amount
+	// DisableOutputSubstitution forbids replacing the payment output. The
+	// receiver never does.
+	DisableOutputSubstitution bool
+	// MinFeeRate is the lowest fee rate of the proposal in sat/vB.
+	MinFeeRate float64
+}
+
+// SetPayjoin enables the payjoin receiver. signer signs the wallet's input
+// of proposals, and the original transaction of a request is broadcast
+// fallback after it unless the sender has spent its inputs by then.
+func (w *Wallet) SetPayjoin(signer Signer, fallback time.Duration) {
+	w.signer = signer
+	w.payjoinFallback = fallback
+}
+
+// PayjoinEnabled reports whether the wallet accepts payjoin requests.
+func (w *Wallet) PayjoinEnabled() bool {
+	return w.signer != nil
+}
+
+// payjoinOriginal is a checked original PSBT.
+type payjoinOriginal struct {
+	packet   *psbt.Packet
+	tx       *wire.MsgTx
+	prevOuts []*wire.TxOut
+	fee      btcutil.Amount
+	vsize    int64
+	// class is the script class of every sender input, or
+	// txscript.NonStandardTy if they differ.
+	class txscript.ScriptClass
+	// payment is the output paying the wallet.
+	payment int
+}
+
+// Payjoin answers a BIP78 request: it checks the sender's signed original
+// PSBT against the receiver checklist, adds one of the wallet's coins of
+// the sender's script type and adds its amount to the payment output,
+// which pays the input's fee at the original fee rate unless the sender
+// allowed its fee output to. The proposal is signed by the signer hook
+// and returned in base64, with the sender's inputs stripped for it to sign
+// again. The original of every proposal made is broadcast after the
+// fallback timeout unless the sender spent its inputs; without a proposal
+// the sender broadcasts it, as BIP78 has it do on any error.
+func (w *Wallet) Payjoin(ctx context.Context, original string, params PayjoinParams) (string, error) {
+	if w.signer == nil {
+		return "", &PayjoinError{Code: PayjoinUnavailable, Msg: "payjoin is not enabled for this wallet"}
+	}
+	packet, err := psbt.NewFromRawBytes(strings.NewReader(strings.TrimSpace(original)), true)
+	if err != nil {
+		return "", payjoinRejected("invalid PSBT: %v", err)
+	}
+	o, err := w.checkOriginal(ctx, packet, params)
+	if err != nil {
+		return "", err
+	}
+
+	c, err := w.payjoinCoin(ctx, o)
+	if err != nil {
+		return "", err
+	}
+	if c == nil {
+		return "", &PayjoinError{Code: PayjoinUnavailable, Msg: "no coin of the sender's script type is available"}
+	}
+
+	// Nothing is recorded until the proposal is signed, so a coin is only
+	// claimed once a sender sees it
+	tx, idx, err := payjoinProposal(o, *c, params)
+	if err != nil {
+		return "", err
+	}
+	proposal, err := w.signProposal(ctx, o, tx, idx, *c)
+	if err != nil {
+		return "", err
+	}
+	encoded, err := proposal.B64Encode()
+	if err != nil {
+		return "", err
+	}
+	if err := w.recordPayjoin(ctx, o, *c, tx.TxHash().String()); err != nil {
+		return "", err
+	}
+	slog.InfoContext(ctx, "Payjoin proposal made", "wallet_id", w.id, "original_txid", o.tx.TxHash().String(),
+		"proposal_txid", tx.TxHash().String(), "input", c.outpoint.String())
+	return encoded, nil
+}
+
+// checkOriginal runs the receiver checklist of BIP78 on the original PSBT:
+// it must be fully signed, spend none of the wallet's coins, pay one of
+// its issued addresses and be accepted by the node's mempool.
+func (w *Wallet) checkOriginal(ctx context.Context, packet *psbt.Packet, params PayjoinParams) (*payjoinOriginal, error) {
+	o := &payjoinOriginal{packet: packet, payment: -1}
+	if len(packet.Inputs) == 0 || len(packet.Outputs) == 0 {
+		return nil, payjoinRejected("original PSBT has no inputs or outputs")
+	}
+	external, err := w.scriptSet(ctx)
+	if err != nil {
+		return nil, err
+	}
+	internal, err := w.changeScriptSet(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var in btcutil.Amount
+	for i, pin := range packet.Inputs {
+		op := packet.UnsignedTx.TxIn[i].PreviousOutPoint
+		var prevOut *wire.TxOut
+		switch {
+		case pin.WitnessUtxo != nil:
+			prevOut = pin.WitnessUtxo
+		case pin.NonWitnessUtxo != nil && pin.NonWitnessUtxo.TxHash() == op.Hash && int(op.Index) < len(pin.NonWitnessUtxo.TxOut):
+			prevOut = pin.NonWitnessUtxo.TxOut[op.Index]
+		default:
+			return nil, payjoinRejected("input %d has no previous output", i)
+		}
+		if pin.FinalScriptSig == nil && pin.FinalScriptWitness == nil {
+			return nil, payjoinRejected("input %d is not signed", i)
+		}
+		script := hex.EncodeToString(prevOut.PkScript)
+		if _, ok := external[script]; ok {
+			return nil, payjoinRejected("input %d spends a coin of this wallet", i)
+		}
+		if _, ok := internal[script]; ok {
+			return nil, payjoinRejected("input %d spends a coin of this wallet", i)
+		}
+		class := txscript.GetScriptClass(prevOut.PkScript)
+		if i == 0 {
+			o.class = class
+		} else if class != o.class {
+			o.class = txscript.NonStandardTy
+		}
+		o.prevOuts = append(o.prevOuts, prevOut)
+		in += btcutil.Amount(prevOut.Value)
+	}
+
+	var out btcutil.Amount
+	for i, txOut := range packet.UnsignedTx.TxOut {
+		if _, ok := external[hex.EncodeToString(txOut.PkScript)]; ok && o.payment < 0 {
+			o.payment = i
+		}
+		out += btcutil.Amount(txOut.Value)
+	}
+	if o.payment < 0 {
+		return nil, payjoinRejected("original PSBT does not pay an address of this wallet")
+	}
+	if o.fee = in - out; o.fee <= 0 {
+		return nil, payjoinRejected("original PSBT pays no fee")
+	}
+	if i := params.AdditionalFeeOutputIndex; i >= len(packet.Outputs) || i == o.payment {
+		return nil, payjoinRejected("additionalfeeoutputindex %d is not an output of the sender", i)
+	}
+
+	if o.tx, err = psbt.Extract(packet); err != nil {
+		return nil, payjoinRejected("invalid original transaction: %v", err)
+	}
+	o.vsize = mempool.GetTxVirtualSize(btcutil.NewTx(o.tx))
+	var buf bytes.Buffer
+	if err := o.tx.Serialize(&buf); err != nil {
+		return nil, err
+	}
+	var accepted []struct {
+		Allowed      bool   `json:"allowed"`
+		RejectReason string `json:"reject-reason"`
+	}
+	if err := w.client.call(ctx, "testmempoolaccept", &accepted, []string{hex.EncodeToString(buf.Bytes())}); err != nil {
+		return nil, fmt.Errorf("testmempoolaccept failed: %v", err)
+	}
+	if len(accepted) != 1 || !accepted[0].Allowed {
+		reason := "unknown"
+		if len(accepted) == 1 {
+			reason = accepted[0].RejectReason
+		}
+		return nil, payjoinRejected("original transaction would not be broadcast: %s", reason)
+	}
+	return o, nil
+}
+
+// payjoinCoin picks a random spendable coin of the sender inputs' script
+// type that no proposal has offered, or nil if there is none. Only
+// confirmed coins are spendable. A coin stays claimed in payjoin_inputs
+// once offered, whatever became of the request, since its sender already
+// knows it is ours.
+func (w *Wallet) payjoinCoin(ctx context.Context, o *payjoinOriginal) (*coin, error) {
+	coins, err := w.spendableCoins(ctx)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := w.db.QueryContext(ctx, `SELECT i.outpoint FROM payjoin_inputs i JOIN payjoins p ON p.id = i.payjoin_id
+		WHERE p.wallet_id = $1 AND i.ours`, w.id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	offered := make(map[string]bool)
+	for rows.Next() {
+		var outpoint string
+		if err := rows.Scan(&outpoint); err != nil {
+			return nil, err
+		}
+		offered[outpoint] = true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var eligible []coin
+	for _, c := range coins {
+		if offered[c.outpoint.String()] {
+			continue
+		}
+		// Mixing script types would tell which input is the receiver's
+		if o.class != txscript.NonStandardTy && txscript.GetScriptClass(c.script) != o.class {
+			continue
+		}
+		eligible = append(eligible, c)
+	}
+	if len(eligible) == 0 {
+		return nil, nil
+	}
+	c := eligible[rand.IntN(len(eligible))]
+	return &c, nil
+}
+
+// recordPayjoin stores a request with its signed proposal for the
+// fallback, claims the sender's inputs and the wallet's coin c and
+// reserves c against CreatePSBT until the fallback is due. An input sent
+// before rejects the request, so a sender cannot probe for the wallet's
+// coins by repeating it with the same inputs.
+func (w *Wallet) recordPayjoin(ctx context.Context, o *payjoinOriginal, c coin, proposalTxid string) error {
+	var buf bytes.Buffer
+	if err := o.tx.Serialize(&buf); err != nil {
+		return err
+	}
+	tx, err := w.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	fallbackAt := time.Now().Add(w.payjoinFallback)
+	var id int64
+	err = tx.QueryRowContext(ctx, `INSERT INTO payjoins (wallet_id, original_txid, original_tx, fallback_at, proposal_txid)
+		VALUES ($1, $2, $3, $4, $5) RETURNING id`,
+		w.id, o.tx.TxHash().String(), hex.EncodeToString(buf.Bytes()), fallbackAt, proposalTxid).Scan(&id)
+	if err != nil {
+		return err
+	}
+	claim := func(op wire.OutPoint, ours bool) (bool, error) {
+		res, err := tx.ExecContext(ctx, `INSERT INTO payjoin_inputs (outpoint, payjoin_id, ours) VALUES ($1, $2, $3)
+			ON CONFLICT (outpoint) DO NOTHING`, op.String(), id, ours)
+		if err != nil {
+			return false, err
+		}
+		n, err := res.RowsAffected()
+		return n == 1, err
+	}
+	for _, in := range o.tx.TxIn {
+		ok, err := claim(in.PreviousOutPoint, false)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return payjoinRejected("input %s was sent in an earlier payjoin request", in.PreviousOutPoint)
+		}
+	}
+	ok, err := claim(c.outpoint, true)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return &PayjoinError{Code: PayjoinUnavailable, Msg: "the selected coin is offered by another proposal"}
+	}
+	if ok, err = w.reserve(ctx, tx, c.outpoint, fallbackAt); err != nil {
+		return err
+	}
+	if !ok {
+		return &PayjoinError{Code: PayjoinUnavailable, Msg: "the selected coin is reserved by a PSBT"}
+	}
+	return tx.Commit()
+}
+
+// payjoinProposal adds c to the original transaction at a random position
+// and its amount to the payment output. The added input pays its fee at
+// the original fee rate, raised to params.MinFeeRate for the whole
+// proposal; the sender's fee output pays up to the contribution it
+// allows, and the payment output the rest. It returns the proposal and the
+// index of c.
+func payjoinProposal(o *payjoinOriginal, c coin, params PayjoinParams) (*wire.MsgTx, int, error) {
+	inputVSize := int64(c.desc.InputVSize())
+	feeRate := float64(o.fee) / float64(o.vsize)
+	extra := btcutil.Amount(math.Ceil(feeRate * float64(inputVSize)))
+	if required := btcutil.Amount(math.Ceil(params.MinFeeRate * float64(o.vsize+inputVSize))); o.fee+extra < required {
+		extra = required - o.fee
+	}
+
+	tx := o.packet.UnsignedTx.Copy()
+	receiverPays := extra
+	if i := params.AdditionalFeeOutputIndex; i >= 0 {
+		out := tx.TxOut[i]
+		// The sender's output must stay above the dust limit
+		senderPays := min(params.MaxAdditionalFeeContribution, extra, btcutil.Amount(out.Value-mempool.GetDustThreshold(out)))
+		senderPays = max(senderPays, 0)
+		out.Value -= int64(senderPays)
+		receiverPays -= senderPays
+	}
+	if receiverPays >= c.amount {
+		return nil, 0, &PayjoinError{Code: PayjoinNotEnoughMoney, Msg: "the receiver's input cannot pay its fee"}
+	}
+	tx.TxOut[o.payment].Value += int64(c.amount - receiverPays)
+
+	// BIP78 senders accept the input anywhere; a fixed position would mark
+	// it as the receiver's. It has the same sequence as the sender's.
+	idx := rand.IntN(len(tx.TxIn) + 1)
+	in := wire.NewTxIn(&c.outpoint, nil, nil)
+	in.Sequence = tx.TxIn[0].Sequence
+	tx.TxIn = slices.Insert(tx.TxIn, idx, in)
+	return tx, idx, nil
+}
+
+// signProposal has the signer hook sign input idx, spending c, of the
+// proposal tx and returns the proposal for the sender: the wallet's input
+// finalized with its previous output, and the sender's inputs and the
+// outputs without PSBT fields.
+func (w *Wallet) signProposal(ctx context.Context, o *payjoinOriginal, tx *wire.MsgTx, idx int, c coin) (*psbt.Packet, error) {
+	unsigned, err := psbt.NewFromUnsignedTx(tx)
+	if err != nil {
+		return nil, err
+	}
+	for i := range unsigned.Inputs {
+		switch {
+		case i < idx:
+			// Taproot signatures commit to every spent output
+			unsigned.Inputs[i].WitnessUtxo = o.prevOuts[i]
+		case i > idx:
+			unsigned.Inputs[i].WitnessUtxo = o.prevOuts[i-1]
+		}
+	}
+	if err := w.fillInput(ctx, &unsigned.Inputs[idx], c); err != nil {
+		return nil, err
+	}
+
+	signed, err := w.signer.SignPSBT(ctx, w.id, unsigned)
+	if err != nil {
+		return nil, err
+	}
+	if signed.UnsignedTx.TxHash() != tx.TxHash() {
+		return nil, errors.New("signer hook changed the payjoin proposal")
+	}
+	if ok, err := psbt.MaybeFinalize(signed, idx); err != nil || !ok {
+		return nil, fmt.Errorf("signer hook did not sign the payjoin input: %v", err)
+	}
+
+	proposal, err := psbt.NewFromUnsignedTx(tx)
+	if err != nil {
+		return nil, err
+	}
+	ours := signed.Inputs[idx]
+	proposal.Inputs[idx] = psbt.PInput{
+		WitnessUtxo:        ours.WitnessUtxo,
+		NonWitnessUtxo:     ours.NonWitnessUtxo,
+		FinalScriptSig:     ours.FinalScriptSig,
+		FinalScriptWitness: ours.FinalScriptWitness,
+	}
+	return proposal, nil
+}
+
+// payjoinFallbacks broadcasts the originals of requests past their
+// fallback timeout until ctx is cancelled.
+func (w *Wallet) payjoinFallbacks(ctx context.Context) error {
+	ticker := time.NewTicker(payjoinFallbackInterval)
+	defer ticker.Stop()
+	for {
+		if err := w.broadcastFallbacks(ctx); err != nil && ctx.Err() == nil {
+			slog.WarnContext(ctx, "Payjoin fallback failed", "wallet_id", w.id, "error", err)
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// broadcastFallbacks settles the pending requests past their fallback
+// timeout. A request whose sender spent an input of the original, with it
+// or the proposal, is settled; otherwise the original is broadcast.
+func (w *Wallet) broadcastFallbacks(ctx context.Context) error {
+	rows, err := w.db.QueryContext(ctx, `SELECT id, original_txid, original_tx FROM payjoins
+		WHERE wallet_id = $1 AND status = $2 AND fallback_at <= NOW() ORDER BY id`, w.id, payjoinPending)
+	if err != nil {
+		return err
+	}
+	type request struct {
+		id        int64
+		txid, hex string
+	}
+	var due []request
+	for rows.Next() {
+		var r request
+		if err := rows.Scan(&r.id, &r.txid, &r.hex); err != nil {
+			rows.Close()
+			return err
+		}
+		due = append(due, r)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, r := range due {
+		status, err := w.fallback(ctx, r.hex)
+		if err != nil {
+			return fmt.Errorf("payjoin %d: %v", r.id, err)
+		}
+		if _, err := w.db.ExecContext(ctx, "UPDATE payjoins SET status = $2 WHERE id = $1", r.id, status); err != nil {
+			return err
+		}
+		slog.InfoContext(ctx, "Payjoin request settled", "wallet_id", w.id, "original_txid", r.txid, "status", status)
+	}
+	return nil
+}
+
+// fallback broadcasts the original transaction txHex unless one of its
+// inputs is spent, and returns the request's new status.
+func (w *Wallet) fallback(ctx context.Context, txHex string) (string, error) {
+	raw, err := hex.DecodeString(txHex)
+	if err != nil {
+		return "", err
+	}
+	tx := wire.NewMsgTx(wire.TxVersion)
+	if err := tx.Deserialize(bytes.NewReader(raw)); err != nil {
+		return "", err
+	}
+	for _, in := range tx.TxIn {
+		// gettxout txid n true answers null for outputs spent on chain or
+		// in the mempool
+		var out json.RawMessage
+		if err := w.client.call(ctx, "gettxout", &out, in.PreviousOutPoint.Hash.String(), in.PreviousOutPoint.Index, true); err != nil {
+			return "", fmt.Errorf("gettxout failed: %v", err)
+		}
+		if len(out) == 0 || string(out) == "null" {
+			return payjoinSettled, nil
+		}
+	}
+	err = w.client.call(ctx, "sendrawtransaction", nil, txHex)
+	var rpcErr *btcjson.RPCError
+	if errors.As(err, &rpcErr) {
+		slog.WarnContext(ctx, "Node refused payjoin original", "wallet_id", w.id, "txid", tx.TxHash().String(), "error", err)
+		return payjoinFailed, nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("sendrawtransaction failed: %v", err)
+	}
+	return payjoinBroadcast, nil
+}
@@ -0,0 +1,496 @@
+package wallet
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/btcsuite/btcd/btcec/v2/schnorr"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/btcutil/psbt"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/mempool"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+
+	"github.com/sawdustofmind/bitcoin-wallet/backend/descriptor"
+)
+
+// MaxFeeRate is the highest fee rate CreatePSBT accepts, in sat/vB.
+const MaxFeeRate = 1000
+
+// txOverheadVSize is the virtual size of a segwit transaction without
+// inputs and outputs: version, locktime, counts, marker and flag.
+const txOverheadVSize = 11
+
+// Payment is an output of a PSBT.
+type Payment struct {
+	Address string
+	Amount  btcutil.Amount
+}
+
+// PSBTRequestError reports invalid CreatePSBT arguments.
+type PSBTRequestError struct {
+	Msg string
+}
+
+func (e *PSBTRequestError) Error() string {
+	return e.Msg
+}
+
+// InsufficientFundsError is returned by CreatePSBT when the spendable
+// outputs do not cover the payments and fee.
+type InsufficientFundsError struct {
+	Available btcutil.Amount
+	Required  btcutil.Amount
+}
+
+func (e *InsufficientFundsError) Error() string {
+	return fmt.Sprintf("insufficient funds: %d sats available, %d sats required", int64(e.Available), int64(e.Required))
+}
+
+// PSBT is an unsigned transaction created by CreatePSBT.
+type PSBT struct {
+	// Base64 is the BIP174 serialization.
+	Base64 string
+	Fee    btcutil.Amount
+	// ChangeAddress is empty if the transaction has no change output.
+	ChangeAddress string
+}
+
+// coin is a spendable output with the descriptor and index it was
+// derived at.
+type coin struct {
+	outpoint wire.OutPoint
+	amount   btcutil.Amount
+	script   []byte
+	desc     *descriptor.Descriptor
+	index    uint32
+}
+
+// CreatePSBT builds an unsigned transaction paying payments at feeRate
+// sat/vB from the wallet's outputs, largest first. The selected outputs
+// are reserved for coinReservationTTL, so concurrent requests and payjoin
+// proposals do not spend them again while the PSBT is signed. Every input
+// and the change output carry their scripts and the BIP32 derivations of
+// all keys, so each cosigner can find and check its own. Change goes to
+// the change descriptor, or to the next receive address if there is none
+// or in compact filter mode, which only tracks the receive chain.
+func (w *Wallet) CreatePSBT(ctx context.Context, payments []Payment, feeRate int64) (*PSBT, error) {
+	done, err := w.beginIssue()
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	if len(payments) == 0 {
+		return nil, &PSBTRequestError{Msg: "at least one output is required"}
+	}
+	if feeRate < 1 || feeRate > MaxFeeRate {
+		return nil, &PSBTRequestError{Msg: fmt.Sprintf("fee rate must be between 1 and %d sat/vB", MaxFeeRate)}
+	}
+	var outs []*wire.TxOut
+	var total btcutil.Amount
+	vsize := txOverheadVSize
+	for _, p := range payments {
+		addr, err := btcutil.DecodeAddress(p.Address, w.params)
+		if err != nil || !addr.IsForNet(w.params) {
+			return nil, &PSBTRequestError{Msg: fmt.Sprintf("invalid address %q", p.Address)}
+		}
+		script, err := txscript.PayToAddrScript(addr)
+		if err != nil {
+			return nil, &PSBTRequestError{Msg: fmt.Sprintf("cannot pay to %q", p.Address)}
+		}
+		out := wire.NewTxOut(int64(p.Amount), script)
+		if p.Amount <= 0 || mempool.IsDust(out, mempool.DefaultMinRelayTxFee) {
+			return nil, &PSBTRequestError{Msg: fmt.Sprintf("amount to %s is below the dust limit", p.Address)}
+		}
+		outs = append(outs, out)
+		total += p.Amount
+		vsize += out.SerializeSize()
+	}
+
+	// Change is sized from the change descriptor before its index is
+	// reserved
+	changeDesc := w.changeDescriptor()
+	changeScript, err := changeDesc.Script(0)
+	if err != nil {
+		return nil, err
+	}
+	changeVSize := wire.NewTxOut(0, changeScript).SerializeSize()
+	fee := func(vsize int) btcutil.Amount { return btcutil.Amount(int64(vsize) * feeRate) }
+
+	// Selection starts over if a concurrent request reserved one of the
+	// selected coins first
+	outsVSize := vsize
+	var selected []coin
+	var in btcutil.Amount
+	for attempt := 1; ; attempt++ {
+		coins, err := w.spendableCoins(ctx)
+		if err != nil {
+			return nil, err
+		}
+		sort.Slice(coins, func(i, j int) bool { return coins[i].amount > coins[j].amount })
+
+		selected, in, vsize = nil, 0, outsVSize
+		var available btcutil.Amount
+		for _, c := range coins {
+			available += c.amount
+		}
+		for _, c := range coins {
+			if in >= total+fee(vsize+changeVSize) {
+				break
+			}
+			selected = append(selected, c)
+			in += c.amount
+			vsize += c.desc.InputVSize()
+		}
+		if in < total+fee(vsize) {
+			return nil, &InsufficientFundsError{Available: available, Required: total + fee(vsize)}
+		}
+
+		ok, err := w.reserveCoins(ctx, selected)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			break
+		}
+		if attempt == reserveAttempts {
+			return nil, errors.New("coins kept being reserved by concurrent requests")
+		}
+	}
+	// The coins are free again if the PSBT cannot be built
+	built := false
+	defer func() {
+		if !built {
+			w.releaseCoins(context.WithoutCancel(ctx), selected)
+		}
+	}()
+
+	result := &PSBT{Fee: in - total}
+	var change *coin
+	if amount := in - total - fee(vsize+changeVSize); !mempool.IsDust(wire.NewTxOut(int64(amount), changeScript), mempool.DefaultMinRelayTxFee) {
+		change, err = w.reserveChange(ctx)
+		if err != nil {
+			return nil, err
+		}
+		change.amount = amount
+		outs = append(outs, wire.NewTxOut(int64(amount), change.script))
+		result.Fee = fee(vsize + changeVSize)
+		addr, err := change.desc.Address(change.index)
+		if err != nil {
+			return nil, err
+		}
+		result.ChangeAddress = addr.EncodeAddress()
+	}
+
+	inputs := make([]*wire.OutPoint, len(selected))
+	sequences := make([]uint32, len(selected))
+	for i := range selected {
+		inputs[i] = &selected[i].outpoint
+		// Signal replaceability (BIP125) so a stuck payment can be bumped
+		sequences[i] = wire.MaxTxInSequenceNum - 2
+	}
+	packet, err := psbt.New(inputs, outs, 2, 0, sequences)
+	if err != nil {
+		return nil, err
+	}
+	for i, c := range selected {
+		if err := w.fillInput(ctx, &packet.Inputs[i], c); err != nil {
+			return nil, err
+		}
+	}
+	if change != nil {
+		if err := fillOutput(&packet.Outputs[len(outs)-1], *change); err != nil {
+			return nil, err
+		}
+	}
+
+	if result.Base64, err = packet.B64Encode(); err != nil {
+		return nil, err
+	}
+	built = true
+	return result, nil
+}
+
+// changeDescriptor is the descriptor change is sent to.
+func (w *Wallet) changeDescriptor() *descriptor.Descriptor {
+	if w.internal != nil && w.filters == nil {
+		return w.internal
+	}
+	return w.external
+}
+
+// reserveChange hands out the next change index, importing the change
+// descriptor past it, or issues a receive address if there is no change
+// chain in use.
+func (w *Wallet) reserveChange(ctx context.Context) (*coin, error) {
+	if w.changeDescriptor() == w.external {
+		_, idx, err := w.issueAddress(ctx)
+		if err != nil {
+			return nil, err
+		}
+		script, err := w.external.Script(uint32(idx))
+		if err != nil {
+			return nil, err
+		}
+		return &coin{script: script, desc: w.external, index: uint32(idx)}, nil
+	}
+
+	var idx int
+	err := w.db.QueryRowContext(ctx, "UPDATE wallets SET change_index = change_index + 1 WHERE id = $1 RETURNING change_index - 1", w.id).Scan(&idx)
+	if err != nil {
+		return nil, err
+	}
+	if err := w.importDescriptor(ctx, w.internal, idx+changeLookahead, true); err != nil {
+		return nil, fmt.Errorf("failed to import change descriptor: %v", err)
+	}
+	script, err := w.internal.Script(uint32(idx))
+	if err != nil {
+		return nil, err
+	}
+	return &coin{script: script, desc: w.internal, index: uint32(idx)}, nil
+}
+
+// spendableCoins returns the unspent outputs on issued receive and change
+// addresses that are not reserved.
+func (w *Wallet) spendableCoins(ctx context.Context) ([]coin, error) {
+	utxos, err := w.GetUTXOs(ctx)
+	if err != nil {
+		return nil, err
+	}
+	reserved, err := w.reservedOutpoints(ctx)
+	if err != nil {
+		return nil, err
+	}
+	external, err := w.scriptSet(ctx)
+	if err != nil {
+		return nil, err
+	}
+	internal, err := w.changeScriptSet(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var coins []coin
+	for _, u := range utxos {
+		c := coin{desc: w.external}
+		key := strings.ToLower(u.ScriptPubKey)
+		idx, ok := external[key]
+		if !ok {
+			if idx, ok = internal[key]; !ok {
+				// Not derived from this wallet's descriptors
+				continue
+			}
+			c.desc = w.internal
+		}
+		c.index = uint32(idx)
+		hash, err := chainhash.NewHashFromStr(u.TxID)
+		if err != nil {
+			return nil, err
+		}
+		c.outpoint = wire.OutPoint{Hash: *hash, Index: u.Vout}
+		if reserved[c.outpoint.String()] {
+			continue
+		}
+		if c.amount, err = btcutil.NewAmount(u.Amount); err != nil {
+			return nil, err
+		}
+		if c.script, err = hex.DecodeString(u.ScriptPubKey); err != nil {
+			return nil, err
+		}
+		coins = append(coins, c)
+	}
+	return coins, nil
+}
+
+// changeScriptSet maps hex-encoded output scripts of handed out change
+// addresses to their index.
+func (w *Wallet) changeScriptSet(ctx context.Context) (map[string]int, error) {
+	if w.internal == nil {
+		return nil, nil
+	}
+	var next int
+	if err := w.db.QueryRowContext(ctx, "SELECT change_index FROM wallets WHERE id = $1", w.id).Scan(&next); err != nil {
+		return nil, err
+	}
+
+	w.scriptsMu.Lock()
+	defer w.scriptsMu.Unlock()
+	if w.changeScripts == nil {
+		w.changeScripts = make(map[string]int)
+	}
+	for i := len(w.changeScripts); i < next; i++ {
+		script, err := w.internal.Script(uint32(i))
+		if err != nil {
+			return nil, err
+		}
+		w.changeScripts[hex.EncodeToString(script)] = i
+	}
+	scripts := make(map[string]int, len(w.changeScripts))
+	for k, v := range w.changeScripts {
+		scripts[k] = v
+	}
+	return scripts, nil
+}
+
+// fillInput adds what signers need to spend c.
+func (w *Wallet) fillInput(ctx context.Context, in *psbt.PInput, c coin) error {
+	scripts, err := c.desc.Scripts(c.index)
+	if err != nil {
+		return err
+	}
+	in.RedeemScript = scripts.Redeem
+	in.WitnessScript = scripts.Witness
+	if c.desc.Type() != "pkh" {
+		in.WitnessUtxo = wire.NewTxOut(int64(c.amount), c.script)
+	}
+	// Segwit v0 signers also want the whole previous transaction, since
+	// the amount they sign is otherwise unverified
+	if !isTaproot(c.desc) {
+		if in.NonWitnessUtxo, err = w.previousTx(ctx, &c.outpoint.Hash); err != nil {
+			return err
+		}
+	}
+	d, err := keyDerivations(c.desc, c.index, scripts)
+	if err != nil {
+		return err
+	}
+	in.Bip32Derivation = d.bip32
+	in.TaprootBip32Derivation = d.taproot
+	in.TaprootInternalKey = d.internalKey
+	in.TaprootMerkleRoot = scripts.TapMerkleRoot
+	for _, leaf := range scripts.TapLeaves {
+		in.TaprootLeafScript = append(in.TaprootLeafScript, &psbt.TaprootTapLeafScript{
+			ControlBlock: leaf.ControlBlock,
+			Script:       leaf.Script,
+			LeafVersion:  txscript.BaseLeafVersion,
+		})
+	}
+	return nil
+}
+
+// fillOutput lets signers recognize the change output as their own.
+func fillOutput(out *psbt.POutput, c coin) error {
+	scripts, err := c.desc.Scripts(c.index)
+	if err != nil {
+		return err
+	}
+	out.RedeemScript = scripts.Redeem
+	out.WitnessScript = scripts.Witness
+	d, err := keyDerivations(c.desc, c.index, scripts)
+	if err != nil {
+		return err
+	}
+	out.Bip32Derivation = d.bip32
+	out.TaprootBip32Derivation = d.taproot
+	out.TaprootInternalKey = d.internalKey
+	return nil
+}
+
+type derivations struct {
+	bip32       []*psbt.Bip32Derivation
+	taproot     []*psbt.TaprootBip32Derivation
+	internalKey []byte
+}
+
+// isTaproot reports whether desc describes taproot outputs.
+func isTaproot(desc *descriptor.Descriptor) bool {
+	return strings.HasPrefix(desc.Type(), "tr")
+}
+
+// keyDerivations returns the key origins of every key of desc at index.
+// Taproot keys list the hashes of the script tree leaves they sign in,
+// from scripts.
+func keyDerivations(desc *descriptor.Descriptor, index uint32, scripts *descriptor.Scripts) (*derivations, error) {
+	d := &derivations{}
+	// A taproot key may appear in several leaves but is listed once
+	taproot := make(map[string]*psbt.TaprootBip32Derivation)
+	for j, key := range desc.Keys() {
+		pub, err := key.PubKey(index)
+		if err != nil {
+			return nil, err
+		}
+		fp, path, err := key.Origin(index)
+		if err != nil {
+			return nil, err
+		}
+		// PSBTs store the fingerprint bytes as a little-endian integer
+		fingerprint := binary.LittleEndian.Uint32(fp[:])
+		if !isTaproot(desc) {
+			d.bip32 = append(d.bip32, &psbt.Bip32Derivation{
+				PubKey:               pub.SerializeCompressed(),
+				MasterKeyFingerprint: fingerprint,
+				Bip32Path:            path,
+			})
+			continue
+		}
+
+		xonly := schnorr.SerializePubKey(pub)
+		if j == 0 {
+			d.internalKey = xonly
+		}
+		td, ok := taproot[string(xonly)]
+		if !ok {
+			td = &psbt.TaprootBip32Derivation{
+				XOnlyPubKey:          xonly,
+				MasterKeyFingerprint: fingerprint,
+				Bip32Path:            path,
+			}
+			taproot[string(xonly)] = td
+			d.taproot = append(d.taproot, td)
+		}
+		for _, leaf := range scripts.TapLeaves {
+			for _, k := range leaf.Keys {
+				if k == key {
+					h := txscript.NewBaseTapLeaf(leaf.Script).TapHash()
+					td.LeafHashes = append(td.LeafHashes, h[:])
+				}
+			}
+		}
+	}
+	return d, nil
+}
+
+// previousTx fetches a wallet transaction: from the node wallet, or in
+// compact filter mode from the block it was recorded in.
+func (w *Wallet) previousTx(ctx context.Context, txid *chainhash.Hash) (*wire.MsgTx, error) {
+	var txHex string
+	if w.filters == nil {
+		var res struct {
+			Hex string `json:"hex"`
+		}
+		if err := w.client.call(ctx, "gettransaction", &res, txid.String(), true); err != nil {
+			return nil, fmt.Errorf("gettransaction failed: %v", err)
+		}
+		txHex = res.Hex
+	} else {
+		var blockHash string
+		err := w.db.QueryRowContext(ctx, "SELECT block_hash FROM wallet_utxos WHERE wallet_id = $1 AND txid = $2 LIMIT 1", w.id, txid.String()).Scan(&blockHash)
+		if err != nil {
+			return nil, err
+		}
+		if err := w.client.call(ctx, "getrawtransaction", &txHex, txid.String(), false, blockHash); err != nil {
+			return nil, fmt.Errorf("getrawtransaction failed: %v", err)
+		}
+	}
+
+	raw, err := hex.DecodeString(txHex)
+	if err != nil {
+		return nil, fmt.Errorf("invalid transaction hex: %v", err)
+	}
+	tx := wire.NewMsgTx(wire.TxVersion)
+	if err := tx.Deserialize(bytes.NewReader(raw)); err != nil {
+		return nil, err
+	}
+	if tx.TxHash() != *txid {
+		return nil, errors.New("node returned a different transaction")
+	}
+	return tx, nil
+}
@@ -0,0 +1,88 @@
+package wallet
+
+import (
+	"context"
+	"database/sql"
+	"log/slog"
+	"time"
+
+	"github.com/btcsuite/btcd/wire"
+	"github.com/lib/pq"
+)
+
+// coinReservationTTL is how long the inputs of a created PSBT are kept out
+// of coin selection, for its signers to sign and broadcast it.
+const coinReservationTTL = 10 * time.Minute
+
+// reserveAttempts bounds how often CreatePSBT selects coins again after
+// losing one to a concurrent request.
+const reserveAttempts = 3
+
+// reservedOutpoints returns the outpoints coin selection skips: unexpired
+// reservations and the wallet's coins in pending payjoin proposals, which
+// the sender may still broadcast after their reservation ran out.
+func (w *Wallet) reservedOutpoints(ctx context.Context) (map[string]bool, error) {
+	rows, err := w.db.QueryContext(ctx, `SELECT outpoint FROM coin_reservations WHERE wallet_id = $1 AND expires_at > NOW()
+		UNION SELECT i.outpoint FROM payjoin_inputs i JOIN payjoins p ON p.id = i.payjoin_id
+		WHERE p.wallet_id = $1 AND i.ours AND p.status = $2`, w.id, payjoinPending)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	reserved := make(map[string]bool)
+	for rows.Next() {
+		var outpoint string
+		if err := rows.Scan(&outpoint); err != nil {
+			return nil, err
+		}
+		reserved[outpoint] = true
+	}
+	return reserved, rows.Err()
+}
+
+// reserveCoins reserves coins for coinReservationTTL. It reports false and
+// reserves none of them if one is already reserved.
+func (w *Wallet) reserveCoins(ctx context.Context, coins []coin) (bool, error) {
+	tx, err := w.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM coin_reservations WHERE expires_at <= NOW()"); err != nil {
+		return false, err
+	}
+	until := time.Now().Add(coinReservationTTL)
+	for _, c := range coins {
+		ok, err := w.reserve(ctx, tx, c.outpoint, until)
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+	return true, tx.Commit()
+}
+
+// reserve reserves outpoint until the given time within tx unless it is
+// already reserved.
+func (w *Wallet) reserve(ctx context.Context, tx *sql.Tx, outpoint wire.OutPoint, until time.Time) (bool, error) {
+	res, err := tx.ExecContext(ctx, `INSERT INTO coin_reservations (outpoint, wallet_id, expires_at) VALUES ($1, $2, $3)
+		ON CONFLICT (outpoint) DO UPDATE SET wallet_id = EXCLUDED.wallet_id, expires_at = EXCLUDED.expires_at
+		WHERE coin_reservations.expires_at <= NOW()`, outpoint.String(), w.id, until)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+// releaseCoins drops the reservations of coins.
+func (w *Wallet) releaseCoins(ctx context.Context, coins []coin) {
+	outpoints := make([]string, len(coins))
+	for i, c := range coins {
+		outpoints[i] = c.outpoint.String()
+	}
+	if _, err := w.db.ExecContext(ctx, "DELETE FROM coin_reservations WHERE wallet_id = $1 AND outpoint = ANY($2)",
+		w.id, pq.Array(outpoints)); err != nil {
+		slog.WarnContext(ctx, "Failed to release coin reservations", "wallet_id", w.id, "error", err)
+	}
+}
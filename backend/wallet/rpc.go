@@ -0,0 +1,212 @@
+package wallet
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/btcsuite/btcd/btcjson"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.37.0"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/sawdustofmind/bitcoin-wallet/backend/config"
+	"github.com/sawdustofmind/bitcoin-wallet/backend/metrics"
+	"github.com/sawdustofmind/bitcoin-wallet/backend/tracing"
+)
+
+// walletNameKey is the span attribute naming the bitcoind wallet an RPC
+// targets.
+const walletNameKey = attribute.Key("bitcoin.wallet.name")
+
+// maxErrorBody bounds how much of a non-JSON error response is reported.
+const maxErrorBody = 512
+
+// nodeClient is a JSON-RPC client for bitcoind. Every call takes a context
+// and is bounded by the per-call timeout, so a hung node cannot hold
+// callers forever.
+type nodeClient struct {
+	url  string
+	user string
+	pass string
+	// wallet is the node wallet calls are sent to, or "" for node-level
+	// calls.
+	wallet  string
+	timeout time.Duration
+	http    *http.Client
+	nextID  atomic.Uint64
+}
+
+func newNodeClient(cfg config.BitcoinConfig, wallet string) *nodeClient {
+	url := "http://" + cfg.RPCHost
+	if wallet != "" {
+		url += "/wallet/" + wallet
+	}
+	return &nodeClient{
+		url:     url,
+		user:    cfg.RPCUser,
+		pass:    cfg.RPCPass,
+		wallet:  wallet,
+		timeout: cfg.RPCTimeout,
+		http:    &http.Client{},
+	}
+}
+
+// close releases idle connections to the node.
+func (c *nodeClient) close() {
+	c.http.CloseIdleConnections()
+}
+
+type rpcRequest struct {
+	JSONRPC string        `json:"jsonrpc"`
+	ID      uint64        `json:"id"`
+	Method  string        `json:"method"`
+	Params  []interface{} `json:"params"`
+}
+
+type rpcResponse struct {
+	Result json.RawMessage   `json:"result"`
+	Error  *btcjson.RPCError `json:"error"`
+}
+
+// call runs method with params and decodes its result into result, which
+// may be nil. The call is recorded in metrics and traced as a child of ctx.
+// Errors returned by the node are *btcjson.RPCError.
+func (c *nodeClient) call(ctx context.Context, method string, result interface{}, params ...interface{}) error {
+	attrs := []attribute.KeyValue{
+		semconv.RPCSystemKey.String("jsonrpc"),
+		semconv.RPCService("bitcoind"),
+		semconv.RPCMethod(method),
+	}
+	if c.wallet != "" {
+		attrs = append(attrs, walletNameKey.String(c.wallet))
+	}
+	ctx, span := tracing.Tracer().Start(ctx, method,
+		trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attrs...))
+
+	start := time.Now()
+	err := c.do(ctx, method, result, params)
+	d := time.Since(start)
+	metrics.ObserveRPC(method, d, err)
+	tracing.End(span, err)
+	if err != nil {
+		slog.DebugContext(ctx, "bitcoind RPC failed", "method", method, "wallet", c.wallet, "duration", d, "error", err)
+	} else {
+		slog.DebugContext(ctx, "bitcoind RPC", "method", method, "wallet", c.wallet, "duration", d)
+	}
+	return err
+}
+
+func (c *nodeClient) do(ctx context.Context, method string, result interface{}, params []interface{}) error {
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+	if params == nil {
+		params = []interface{}{}
+	}
+	body, err := json.Marshal(rpcRequest{JSONRPC: "1.0", ID: c.nextID.Add(1), Method: method, Params: params})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(c.user, c.pass)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		if errors.Is(err, context.DeadlineExceeded) && ctx.Err() != nil {
+			return fmt.Errorf("%s timed out: %w", method, ctx.Err())
+		}
+		return err
+	}
+	defer resp.Body.Close()
+	raw, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read %s response: %v", method, err)
+	}
+
+	// bitcoind reports RPC errors with a non-200 status and a JSON body;
+	// anything else, e.g. a 401, has no usable body
+	var rpcResp rpcResponse
+	if err := json.Unmarshal(raw, &rpcResp); err != nil {
+		if len(raw) > maxErrorBody {
+			raw = raw[:maxErrorBody]
+		}
+		return fmt.Errorf("unexpected %s response (%s): %s", method, resp.Status, bytes.TrimSpace(raw))
+	}
+	if rpcResp.Error != nil {
+		return rpcResp.Error
+	}
+	if result == nil {
+		return nil
+	}
+	if err := json.Unmarshal(rpcResp.Result, result); err != nil {
+		return fmt.Errorf("failed to parse %s result: %v", method, err)
+	}
+	return nil
+}
+
+func (c *nodeClient) getBlockCount(ctx context.Context) (int64, error) {
+	var count int64
+	if err := c.call(ctx, "getblockcount", &count); err != nil {
+		return 0, fmt.Errorf("getblockcount failed: %v", err)
+	}
+	return count, nil
+}
+
+func (c *nodeClient) getBlockHash(ctx context.Context, height int64) (*chainhash.Hash, error) {
+	var hash string
+	if err := c.call(ctx, "getblockhash", &hash, height); err != nil {
+		return nil, fmt.Errorf("getblockhash %d failed: %v", height, err)
+	}
+	return chainhash.NewHashFromStr(hash)
+}
+
+// getBlock fetches a block in raw form (verbosity 0).
+func (c *nodeClient) getBlock(ctx context.Context, hash *chainhash.Hash) (*wire.MsgBlock, error) {
+	var blockHex string
+	if err := c.call(ctx, "getblock", &blockHex, hash.String(), 0); err != nil {
+		return nil, fmt.Errorf("getblock %s failed: %v", hash, err)
+	}
+	raw, err := hex.DecodeString(blockHex)
+	if err != nil {
+		return nil, fmt.Errorf("invalid block hex: %v", err)
+	}
+	var block wire.MsgBlock
+	if err := block.Deserialize(bytes.NewReader(raw)); err != nil {
+		return nil, fmt.Errorf("failed to decode block %s: %v", hash, err)
+	}
+	return &block, nil
+}
+
+// getBlockHeader fetches a block header in raw form (verbose false).
+func (c *nodeClient) getBlockHeader(ctx context.Context, hash *chainhash.Hash) (*wire.BlockHeader, error) {
+	var headerHex string
+	if err := c.call(ctx, "getblockheader", &headerHex, hash.String(), false); err != nil {
+		return nil, fmt.Errorf("getblockheader %s failed: %v", hash, err)
+	}
+	raw, err := hex.DecodeString(headerHex)
+	if err != nil {
+		return nil, fmt.Errorf("invalid block header hex: %v", err)
+	}
+	var header wire.BlockHeader
+	if err := header.Deserialize(bytes.NewReader(raw)); err != nil {
+		return nil, fmt.Errorf("failed to decode block header %s: %v", hash, err)
+	}
+	return &header, nil
+}
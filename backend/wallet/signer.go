@@ -0,0 +1,75 @@
+package wallet
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/btcsuite/btcd/btcutil/psbt"
+)
+
+// Signer signs the wallet's inputs of a PSBT. Keys never reach this
+// service, so a payjoin proposal is handed to an external signer.
+type Signer interface {
+	SignPSBT(ctx context.Context, walletID int64, p *psbt.Packet) (*psbt.Packet, error)
+}
+
+// HTTPSigner is a Signer hook called over HTTP. It POSTs
+// {"wallet_id": 1, "psbt": "<base64>"} and expects {"psbt": "<base64>"}
+// back, with the wallet's inputs signed but not necessarily finalized.
+type HTTPSigner struct {
+	url  string
+	http *http.Client
+}
+
+// NewHTTPSigner returns a signer hook at url. timeout bounds each call.
+func NewHTTPSigner(url string, timeout time.Duration) *HTTPSigner {
+	return &HTTPSigner{url: url, http: &http.Client{Timeout: timeout}}
+}
+
+func (s *HTTPSigner) SignPSBT(ctx context.Context, walletID int64, p *psbt.Packet) (*psbt.Packet, error) {
+	b64, err := p.B64Encode()
+	if err != nil {
+		return nil, err
+	}
+	body, err := json.Marshal(map[string]interface{}{"wallet_id": walletID, "psbt": b64})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := s.http.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("signer hook failed: %v", err)
+	}
+	defer resp.Body.Close()
+	raw, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read signer hook response: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		if len(raw) > maxErrorBody {
+			raw = raw[:maxErrorBody]
+		}
+		return nil, fmt.Errorf("signer hook returned %s: %s", resp.Status, bytes.TrimSpace(raw))
+	}
+	var res struct {
+		PSBT string `json:"psbt"`
+	}
+	if err := json.Unmarshal(raw, &res); err != nil {
+		return nil, fmt.Errorf("invalid signer hook response: %v", err)
+	}
+	signed, err := psbt.NewFromRawBytes(strings.NewReader(res.PSBT), true)
+	if err != nil {
+		return nil, fmt.Errorf("signer hook returned an invalid PSBT: %v", err)
+	}
+	return signed, nil
+}
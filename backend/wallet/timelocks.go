@@ -0,0 +1,267 @@
+package wallet
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/btcsuite/btcd/btcutil"
+
+	"github.com/sawdustofmind/bitcoin-wallet/backend/descriptor"
+)
+
+const (
+	// DefaultTimelockWarning is how many blocks ahead SpendingPaths warns
+	// that a timelocked path will open: about 30 days.
+	DefaultTimelockWarning = 4320
+	// blockSeconds is the target block interval, used to compare
+	// time-based timelocks with the warning window.
+	blockSeconds = 600
+
+	// BIP68 relative lock time encoding
+	sequenceTypeFlag    = 1 << 22
+	sequenceMask        = 0x0000ffff
+	sequenceGranularity = 512
+	// lockTimeThreshold separates block heights from unix times in
+	// absolute lock times.
+	lockTimeThreshold = 500000000
+)
+
+// PathSigners is a group of keys, identified by master key fingerprint,
+// of which Threshold must sign.
+type PathSigners struct {
+	Threshold    int      `json:"threshold"`
+	Fingerprints []string `json:"fingerprints"`
+}
+
+// Timelock is a relative (Blocks or Seconds after the coin confirmed) or
+// absolute (Height or unix Time) timelock.
+type Timelock struct {
+	Blocks  int64 `json:"blocks,omitempty"`
+	Seconds int64 `json:"seconds,omitempty"`
+	Height  int64 `json:"height,omitempty"`
+	Time    int64 `json:"time,omitempty"`
+}
+
+// SpendingPath is one way to spend the wallet's coins.
+type SpendingPath struct {
+	// TaprootLeaf is the index of the script tree leaf, if any.
+	TaprootLeaf *int          `json:"taproot_leaf,omitempty"`
+	Signers     []PathSigners `json:"signers"`
+	Relative    *Timelock     `json:"relative_timelock,omitempty"`
+	Absolute    *Timelock     `json:"absolute_timelock,omitempty"`
+	Hashes      []string      `json:"hashes,omitempty"`
+}
+
+func (p *SpendingPath) timelocked() bool {
+	return p.Relative != nil || p.Absolute != nil
+}
+
+// PathStatus tells whether path Path of the report can spend a coin now,
+// or how long until it can.
+type PathStatus struct {
+	Path             int   `json:"path"`
+	Available        bool  `json:"available"`
+	BlocksRemaining  int64 `json:"blocks_remaining,omitempty"`
+	SecondsRemaining int64 `json:"seconds_remaining,omitempty"`
+}
+
+// CoinPaths is an unspent output with the status of each spending path.
+type CoinPaths struct {
+	TxID          string       `json:"txid"`
+	Vout          uint32       `json:"vout"`
+	AmountSats    int64        `json:"amount_sats"`
+	Confirmations int64        `json:"confirmations"`
+	Paths         []PathStatus `json:"paths"`
+}
+
+// TimelockWarning flags a coin that a timelocked path can spend now or
+// soon, e.g. a recovery key that opens unless the coins are moved.
+type TimelockWarning struct {
+	TxID string `json:"txid"`
+	Vout uint32 `json:"vout"`
+	PathStatus
+	Message string `json:"message"`
+}
+
+// SpendingPathReport is the result of SpendingPaths.
+type SpendingPathReport struct {
+	Height   int64             `json:"height"`
+	Paths    []SpendingPath    `json:"paths"`
+	Coins    []CoinPaths       `json:"coins"`
+	Warnings []TimelockWarning `json:"warnings"`
+}
+
+// SpendingPaths lists the ways the wallet's descriptor can be spent and,
+// for each unspent output, which of them are open at the current tip. It
+// warns about coins that a timelocked path can spend within warnBlocks.
+func (w *Wallet) SpendingPaths(ctx context.Context, warnBlocks int64) (*SpendingPathReport, error) {
+	descPaths, err := w.external.SpendingPaths()
+	if err != nil {
+		return nil, err
+	}
+	paths := make([]SpendingPath, len(descPaths))
+	for i, dp := range descPaths {
+		if paths[i], err = spendingPath(dp); err != nil {
+			return nil, err
+		}
+	}
+
+	info, err := getNodeInfo(ctx, w.client)
+	if err != nil {
+		return nil, err
+	}
+	utxos, err := w.GetUTXOs(ctx)
+	if err != nil {
+		return nil, err
+	}
+	report := &SpendingPathReport{
+		Height:   info.Blocks,
+		Paths:    paths,
+		Coins:    make([]CoinPaths, 0, len(utxos)),
+		Warnings: []TimelockWarning{},
+	}
+	tip := chainTip{height: info.Blocks, medianTime: info.MedianTime}
+	for _, u := range utxos {
+		amount, err := btcutil.NewAmount(u.Amount)
+		if err != nil {
+			return nil, err
+		}
+		coin := CoinPaths{TxID: u.TxID, Vout: u.Vout, AmountSats: int64(amount), Confirmations: u.Confirmations}
+		// The median time past the coin's relative time locks count
+		// from, fetched only if a path needs it
+		var confirmedAt int64
+		for i, p := range paths {
+			if p.Relative != nil && p.Relative.Seconds > 0 && u.Confirmations > 0 && confirmedAt == 0 {
+				if confirmedAt, err = w.confirmationTime(ctx, info.Blocks-u.Confirmations+1); err != nil {
+					return nil, err
+				}
+			}
+			status := pathStatus(p, tip, u.Confirmations, confirmedAt)
+			status.Path = i
+			coin.Paths = append(coin.Paths, status)
+			if p.timelocked() && status.within(warnBlocks) {
+				report.Warnings = append(report.Warnings, TimelockWarning{
+					TxID:       u.TxID,
+					Vout:       u.Vout,
+					PathStatus: status,
+					Message:    status.message(amount),
+				})
+			}
+		}
+		report.Coins = append(report.Coins, coin)
+	}
+	return report, nil
+}
+
+// confirmationTime returns the median time past of the block before the
+// one at height, from which BIP68 counts time-based relative locks.
+func (w *Wallet) confirmationTime(ctx context.Context, height int64) (int64, error) {
+	hash, err := w.client.getBlockHash(ctx, height-1)
+	if err != nil {
+		return 0, err
+	}
+	var header struct {
+		MedianTime int64 `json:"mediantime"`
+	}
+	if err := w.client.call(ctx, "getblockheader", &header, hash.String()); err != nil {
+		return 0, fmt.Errorf("getblockheader %s failed: %v", hash, err)
+	}
+	return header.MedianTime, nil
+}
+
+// spendingPath converts a descriptor spending path for the API, naming
+// keys by their master fingerprint.
+func spendingPath(dp descriptor.SpendingPath) (SpendingPath, error) {
+	p := SpendingPath{Signers: make([]PathSigners, len(dp.Signers)), Hashes: dp.Hashes}
+	if dp.Leaf >= 0 {
+		leaf := dp.Leaf
+		p.TaprootLeaf = &leaf
+	}
+	for i, s := range dp.Signers {
+		p.Signers[i].Threshold = s.Threshold
+		for _, k := range s.Keys {
+			fingerprint, _, err := k.Origin(0)
+			if err != nil {
+				return SpendingPath{}, err
+			}
+			p.Signers[i].Fingerprints = append(p.Signers[i].Fingerprints, hex.EncodeToString(fingerprint[:]))
+		}
+	}
+	if dp.Older != 0 {
+		n := int64(dp.Older & sequenceMask)
+		if dp.Older&sequenceTypeFlag != 0 {
+			p.Relative = &Timelock{Seconds: n * sequenceGranularity}
+		} else {
+			p.Relative = &Timelock{Blocks: n}
+		}
+	}
+	if dp.After != 0 {
+		if dp.After >= lockTimeThreshold {
+			p.Absolute = &Timelock{Time: int64(dp.After)}
+		} else {
+			p.Absolute = &Timelock{Height: int64(dp.After)}
+		}
+	}
+	return p, nil
+}
+
+// chainTip is the height and median time past of the best block.
+type chainTip struct {
+	height     int64
+	medianTime int64
+}
+
+// pathStatus tells whether p can spend a coin with confirmations in the
+// next block. confirmedAt is the median time past relative time locks
+// count from.
+func pathStatus(p SpendingPath, tip chainTip, confirmations, confirmedAt int64) PathStatus {
+	var blocks, seconds int64
+	if p.Relative != nil {
+		if p.Relative.Blocks > 0 {
+			// BIP68 lets the next block spend the coin once it is
+			// Blocks deep at the tip
+			blocks = max(blocks, p.Relative.Blocks-confirmations)
+		} else if confirmations == 0 {
+			seconds = max(seconds, p.Relative.Seconds)
+		} else {
+			seconds = max(seconds, p.Relative.Seconds-(tip.medianTime-confirmedAt))
+		}
+	}
+	if p.Absolute != nil {
+		// The lock time must be below the next block's height, or below
+		// the tip's median time past
+		if p.Absolute.Height > 0 {
+			blocks = max(blocks, p.Absolute.Height-tip.height)
+		} else {
+			seconds = max(seconds, p.Absolute.Time+1-tip.medianTime)
+		}
+	}
+	s := PathStatus{Available: blocks <= 0 && seconds <= 0}
+	if blocks > 0 {
+		s.BlocksRemaining = blocks
+	}
+	if seconds > 0 {
+		s.SecondsRemaining = seconds
+	}
+	return s
+}
+
+// within reports whether the path is open or opens within blocks.
+func (s PathStatus) within(blocks int64) bool {
+	return s.BlocksRemaining <= blocks && s.SecondsRemaining <= blocks*blockSeconds
+}
+
+func (s PathStatus) message(amount btcutil.Amount) string {
+	switch {
+	case s.Available:
+		return fmt.Sprintf("timelocked spending path %d can spend this %s output now", s.Path, amount)
+	case s.BlocksRemaining > 0 && s.SecondsRemaining > 0:
+		return fmt.Sprintf("timelocked spending path %d can spend this %s output in %d blocks and %d seconds",
+			s.Path, amount, s.BlocksRemaining, s.SecondsRemaining)
+	case s.BlocksRemaining > 0:
+		return fmt.Sprintf("timelocked spending path %d can spend this %s output in %d blocks", s.Path, amount, s.BlocksRemaining)
+	default:
+		return fmt.Sprintf("timelocked spending path %d can spend this %s output in %d seconds", s.Path, amount, s.SecondsRemaining)
+	}
+}
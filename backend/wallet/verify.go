@@ -0,0 +1,234 @@
+package wallet
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/txscript"
+
+	"github.com/sawdustofmind/bitcoin-wallet/backend/descriptor"
+)
+
+const (
+	// DefaultAddressSearch is how many indices of each chain VerifyAddress
+	// derives by default.
+	DefaultAddressSearch = 1000
+	// MaxAddressSearch bounds the search, which derives every index.
+	MaxAddressSearch = 10000
+)
+
+// Chains of a derivation path
+const (
+	ChainReceive = "receive"
+	ChainChange  = "change"
+)
+
+// addressNetworks are the networks addresses are decoded for.
+var addressNetworks = []*chaincfg.Params{
+	&chaincfg.MainNetParams,
+	&chaincfg.TestNet3Params,
+	&chaincfg.RegressionNetParams,
+	&chaincfg.SigNetParams,
+}
+
+// AddressError reports an address that cannot be decoded for any network.
+type AddressError struct {
+	Msg string
+}
+
+func (e *AddressError) Error() string {
+	return e.Msg
+}
+
+// DecodedAddress describes what an address encodes.
+type DecodedAddress struct {
+	// Networks are those the address is valid for. Testnet, signet and
+	// regtest share base58 prefixes.
+	Networks []string `json:"networks"`
+	// Type is p2pkh, p2sh, p2wpkh, p2wsh, p2tr or p2pk.
+	Type           string `json:"type"`
+	WitnessVersion *byte  `json:"witness_version,omitempty"`
+	WitnessProgram string `json:"witness_program,omitempty"`
+	ScriptPubKey   string `json:"script_pubkey"`
+}
+
+// AddressVerification tells whether an address belongs to the wallet.
+type AddressVerification struct {
+	Address string         `json:"address"`
+	Decoded DecodedAddress `json:"decoded"`
+	// Ours is set if the address was issued or found by the search.
+	Ours bool `json:"ours"`
+	// Issued is set for handed out receive and change addresses.
+	Issued bool `json:"issued"`
+	// Chain, Index and DerivationPath locate an address that is ours.
+	// Account is set for wallets discovering accounts.
+	Chain          string  `json:"chain,omitempty"`
+	Account        *uint32 `json:"account,omitempty"`
+	Index          *int    `json:"index,omitempty"`
+	DerivationPath string  `json:"derivation_path,omitempty"`
+	ScriptType     string  `json:"script_type,omitempty"`
+	// SearchLimit is how many indices of each chain were derived.
+	SearchLimit int `json:"search_limit"`
+}
+
+// DecodeAddress decodes an address for every network it is valid for.
+func DecodeAddress(address string) (*DecodedAddress, btcutil.Address, error) {
+	var d DecodedAddress
+	var decoded btcutil.Address
+	for _, params := range addressNetworks {
+		addr, err := btcutil.DecodeAddress(address, params)
+		if err != nil || !addr.IsForNet(params) {
+			continue
+		}
+		d.Networks = append(d.Networks, params.Name)
+		decoded = addr
+	}
+	if decoded == nil {
+		return nil, nil, &AddressError{Msg: fmt.Sprintf("%q is not a valid address", address)}
+	}
+
+	script, err := txscript.PayToAddrScript(decoded)
+	if err != nil {
+		return nil, nil, &AddressError{Msg: fmt.Sprintf("%q has no output script: %v", address, err)}
+	}
+	d.ScriptPubKey = hex.EncodeToString(script)
+	switch decoded.(type) {
+	case *btcutil.AddressPubKeyHash:
+		d.Type = "p2pkh"
+	case *btcutil.AddressScriptHash:
+		d.Type = "p2sh"
+	case *btcutil.AddressWitnessPubKeyHash:
+		d.Type = "p2wpkh"
+	case *btcutil.AddressWitnessScriptHash:
+		d.Type = "p2wsh"
+	case *btcutil.AddressTaproot:
+		d.Type = "p2tr"
+	case *btcutil.AddressPubKey:
+		d.Type = "p2pk"
+	}
+	if version, program, err := txscript.ExtractWitnessProgramInfo(script); err == nil {
+		v := byte(version)
+		d.WitnessVersion = &v
+		d.WitnessProgram = hex.EncodeToString(program)
+	}
+	return &d, decoded, nil
+}
+
+// VerifyAddress decodes address and looks it up among the issued receive
+// and change addresses. If it is not there, the first limit indices of
+// each chain, and of every account for wallets discovering accounts, are
+// derived.
+func (w *Wallet) VerifyAddress(ctx context.Context, address string, limit int) (*AddressVerification, error) {
+	decoded, addr, err := DecodeAddress(address)
+	if err != nil {
+		return nil, err
+	}
+	v := &AddressVerification{Address: address, Decoded: *decoded, SearchLimit: limit}
+	if !addr.IsForNet(w.params) {
+		return v, nil
+	}
+
+	external, err := w.scriptSet(ctx)
+	if err != nil {
+		return nil, err
+	}
+	internal, err := w.changeScriptSet(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if idx, ok := external[decoded.ScriptPubKey]; ok {
+		v.Issued = true
+		return v, w.locateAddress(v, w.external, ChainReceive, 0, idx)
+	}
+	if idx, ok := internal[decoded.ScriptPubKey]; ok {
+		v.Issued = true
+		return v, w.locateAddress(v, w.internal, ChainChange, 0, idx)
+	}
+
+	type chain struct {
+		desc    *descriptor.Descriptor
+		name    string
+		account uint32
+	}
+	chains := []chain{{w.external, ChainReceive, 0}}
+	if w.internal != nil {
+		chains = append(chains, chain{w.internal, ChainChange, 0})
+	}
+	if w.unusedChange != nil {
+		chains = append(chains, chain{w.unusedChange, ChainChange, 0})
+	}
+	if w.accounts != nil {
+		for n := uint32(1); n < uint32(w.accounts.count()); n++ {
+			receive, change, err := accountDescriptors(w.accounts.def, n, w.params)
+			if err != nil {
+				return nil, err
+			}
+			chains = append(chains, chain{receive, ChainReceive, n}, chain{change, ChainChange, n})
+		}
+	}
+	for _, c := range chains {
+		for i := 0; i < limit; i++ {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+			script, err := c.desc.Script(uint32(i))
+			if err != nil {
+				return nil, err
+			}
+			if hex.EncodeToString(script) == decoded.ScriptPubKey {
+				return v, w.locateAddress(v, c.desc, c.name, c.account, i)
+			}
+		}
+	}
+	return v, nil
+}
+
+// locateAddress fills in where an address of the wallet was derived.
+func (w *Wallet) locateAddress(v *AddressVerification, desc *descriptor.Descriptor, chain string, account uint32, idx int) error {
+	_, path, err := desc.Keys()[0].Origin(uint32(idx))
+	if err != nil {
+		return err
+	}
+	v.Ours = true
+	v.Chain = chain
+	v.Index = &idx
+	v.DerivationPath = formatPath(path)
+	v.ScriptType = w.info.ScriptType
+	if w.accounts != nil {
+		v.Account = &account
+	}
+	return nil
+}
+
+// CheckAddress checks that address is valid on the wallet's network.
+func (w *Wallet) CheckAddress(address string) error {
+	_, addr, err := DecodeAddress(address)
+	if err != nil {
+		return err
+	}
+	if !addr.IsForNet(w.params) {
+		return &AddressError{Msg: fmt.Sprintf("%q is not a %s address", address, w.params.Name)}
+	}
+	return nil
+}
+
+// IsIssued reports whether address is one of the receive addresses the
+// wallet has issued, the ones a payjoin original may pay.
+func (w *Wallet) IsIssued(ctx context.Context, address string) (bool, error) {
+	decoded, addr, err := DecodeAddress(address)
+	if err != nil {
+		return false, err
+	}
+	if !addr.IsForNet(w.params) {
+		return false, nil
+	}
+	external, err := w.scriptSet(ctx)
+	if err != nil {
+		return false, err
+	}
+	_, ok := external[decoded.ScriptPubKey]
+	return ok, nil
+}
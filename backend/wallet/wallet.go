@@ -1,208 +1,308 @@
 package wallet
 
 import (
+	"context"
 	"database/sql"
-	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
+	"sync"
+	"time"
 
 	"github.com/btcsuite/btcd/btcjson"
 	"github.com/btcsuite/btcd/btcutil"
-	"github.com/btcsuite/btcd/btcutil/hdkeychain"
 	"github.com/btcsuite/btcd/chaincfg"
-	"github.com/btcsuite/btcd/rpcclient"
 
-	"github.com/sawdustofmind/bitcoin-wallet/backend/config"
+	"github.com/sawdustofmind/bitcoin-wallet/backend/descriptor"
+	"github.com/sawdustofmind/bitcoin-wallet/backend/metrics"
+	"github.com/sawdustofmind/bitcoin-wallet/backend/tracing"
 )
 
+// rpcWalletAlreadyLoaded is bitcoind's RPC_WALLET_ALREADY_LOADED.
+const rpcWalletAlreadyLoaded btcjson.RPCErrorCode = -35
+
+// Wallet is one registered wallet. Manager creates them.
 type Wallet struct {
-	client *rpcclient.Client
+	// id scopes the wallet's rows in every table.
+	id     int64
+	info   Info
+	client *nodeClient
 	db     *sql.DB
-	xpub   *hdkeychain.ExtendedKey
-	params *chaincfg.Params
+	// external derives the addresses the wallet issues. internal, if set,
+	// is the change chain, imported into the node wallet but not issued.
+	external *descriptor.Descriptor
+	internal *descriptor.Descriptor
+	params   *chaincfg.Params
+	// name is the bitcoind wallet RPCs are sent to. It is empty in compact
+	// filter mode.
+	name string
+
+	pollInterval time.Duration
+	reorgDepth   int
+
+	// filters is set in compact filter mode, where wallet state is built
+	// from matched blocks instead of the node's wallet RPC.
+	filters FilterSource
+
+	// scripts and addrs map hex-encoded output scripts and addresses of
+	// issued addresses to their derivation index. They are filled lazily.
+	scriptsMu sync.Mutex
+	scripts   map[string]int
+	addrs     map[string]int
+	// changeScripts does the same for handed out change addresses.
+	changeScripts map[string]int
+
+	// unusedChange is the change chain m/1/* of an xpub wallet without
+	// one, which VerifyAddress searches.
+	unusedChange *descriptor.Descriptor
+
+	// accounts is set for wallets discovering the accounts of their
+	// Definition.AccountKeys. external and internal are account 0.
+	accounts *accountSet
+
+	// gapLimit is the maximum number of consecutive unused issued
+	// addresses; 0 disables the check.
+	gapLimit int
+
+	// signer signs payjoin proposals, which are disabled when it is nil.
+	// The original of a payjoin request is broadcast payjoinFallback after
+	// it unless the sender spent its inputs.
+	signer          Signer
+	payjoinFallback time.Duration
+
+	// historyRecorded is set by SyncChain once the wallet's history start
+	// is stored.
+	historyRecorded bool
+
+	// syncMu guards syncFailures, the number of chain syncs failed in a
+	// row, and syncErr, the last failure's error.
+	syncMu       sync.Mutex
+	syncFailures int
+	syncErr      error
+
+	subsMu sync.Mutex
+	subs   map[chan Event]struct{}
+
+	// lifecycleMu guards cancel and stopped, which Start and Stop set.
+	lifecycleMu sync.Mutex
+	cancel      context.CancelFunc
+	stopped     bool
+	workers     workerGroup
+	// issuing counts in-flight GetNewAddress calls for Stop to drain.
+	issuing sync.WaitGroup
+	// issueMu serializes issueAddress, so concurrent calls never read the
+	// same derivation index.
+	issueMu sync.Mutex
 }
 
-func New(btcCfg config.BitcoinConfig, xpubStr string, db *sql.DB) (*Wallet, error) {
-	connCfg := &rpcclient.ConnConfig{
-		Host:         btcCfg.RPCHost,
-		User:         btcCfg.RPCUser,
-		Pass:         btcCfg.RPCPass,
-		HTTPPostMode: true, // Bitcoin core only supports HTTP POST mode
-		DisableTLS:   true, // For regtest/local
-	}
+// ID returns the wallet's ID.
+func (w *Wallet) ID() int64 {
+	return w.id
+}
 
-	// Try to create a wallet or load it.
-	// We'll try to connect to the "mywallet" wallet.
-	// If it doesn't exist, we create it.
+// Info describes the wallet.
+func (w *Wallet) Info() Info {
+	return w.info
+}
 
-	// First, connect to root to manage wallets
-	rootClient, err := rpcclient.New(connCfg, nil)
-	if err != nil {
-		return nil, err
+// followChain processes new blocks and handles reorgs until ctx is
+// cancelled.
+func (w *Wallet) followChain(ctx context.Context) error {
+	interval := w.pollInterval
+	if interval <= 0 {
+		interval = 10 * time.Second
 	}
-	defer rootClient.Shutdown()
-
-	walletName := "mywallet"
-	_, err = rootClient.CreateWallet(walletName, rpcclient.WithCreateWalletDisablePrivateKeys())
-	if err != nil {
-		// Try to load it if create failed (likely exists)
-		_, loadErr := rootClient.LoadWallet(walletName)
-		if loadErr != nil {
-			log.Printf("Wallet might already be loaded or failed to load: %v", loadErr)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		w.sync(ctx)
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
 		}
 	}
+}
 
-	// Now create client pointing to the wallet
-	// Copy config and append path
-	// rpcclient implementation doesn't support Path directly in ConnConfig for HTTPPostMode easily
-	// unless we include it in Host or modify library usage.
-	// Actually, btcsuite/btcd/rpcclient handles URL construction.
-	// If Host is "localhost:8332", it posts to "/".
-	// To support wallets, we should probably check if we can pass "localhost:8332/wallet/mywallet".
-	// But rpcclient splits Host.
-
-	// Workaround: Use the root client and LoadWallet/CreateWallet,
-	// but bitcoin core < 0.21 used default wallet. >= 0.21 requires specific endpoints for multi-wallet.
-	// If we only have ONE wallet loaded, requests to root might work if we set valid fallback?
-	// No, modern bitcoind is strict.
-
-	// Let's try appending /wallet/name to Host if the library allows it.
-	// If not, we might need a different library or patch.
-	// Looking at btcd/rpcclient/infrastructure.go, it does `http.NewRequest("POST", "http://" + c.config.Host, ...)`
-	// So if Host contains slash, it might work? "host:port/wallet/name"
-
-	walletHost := fmt.Sprintf("%s/wallet/%s", btcCfg.RPCHost, walletName)
-	walletConnCfg := *connCfg
-	walletConnCfg.Host = walletHost
-
-	client, err := rpcclient.New(&walletConnCfg, nil)
-	if err != nil {
-		return nil, err
+// sync runs one chain sync in its own trace. A sync interrupted by
+// shutdown is not reported as a failure; its block transactions roll back.
+func (w *Wallet) sync(ctx context.Context) {
+	ctx, span := tracing.Tracer().Start(ctx, "wallet.sync")
+	err := w.SyncChain(ctx)
+	switch {
+	case ctx.Err() != nil:
+	case err != nil:
+		slog.ErrorContext(ctx, "Chain sync failed", "error", err)
+		w.recordSync(err)
+	default:
+		w.recordSync(nil)
+		if err := w.discoverAccounts(ctx); err != nil && ctx.Err() == nil {
+			slog.ErrorContext(ctx, "Account discovery failed", "error", err)
+		}
+		if err := w.updateMetrics(ctx); err != nil {
+			slog.ErrorContext(ctx, "Failed to update wallet metrics", "error", err)
+		}
 	}
+	tracing.End(span, err)
+}
 
-	// Parse XPUB
-	xpubKey, err := hdkeychain.NewKeyFromString(xpubStr)
-	if err != nil {
-		return nil, fmt.Errorf("invalid xpub: %v", err)
+// recordSync records the outcome of a chain sync for readiness.
+func (w *Wallet) recordSync(err error) {
+	w.syncMu.Lock()
+	defer w.syncMu.Unlock()
+	if err == nil {
+		w.syncFailures = 0
+	} else {
+		w.syncFailures++
 	}
+	w.syncErr = err
+}
 
-	// Regtest params
-	params := &chaincfg.RegressionNetParams
-
-	// Verify we are connected to bitcoind
-	// Note: might need to retry in a real app if bitcoind is starting
-
-	w := &Wallet{
-		client: client,
-		db:     db,
-		xpub:   xpubKey,
-		params: params,
+// syncHealth returns the last chain sync error if at least
+// syncFailureThreshold syncs failed in a row.
+func (w *Wallet) syncHealth() (int, error) {
+	w.syncMu.Lock()
+	defer w.syncMu.Unlock()
+	if w.syncFailures < syncFailureThreshold {
+		return 0, nil
 	}
-
-	return w, nil
+	return w.syncFailures, w.syncErr
 }
 
-func (w *Wallet) Start() {
-	// Optional: Any background tasks
-	log.Println("Wallet started")
-}
+func (w *Wallet) GetBalance(ctx context.Context) (btcutil.Amount, error) {
+	if w.filters != nil {
+		return w.cachedBalance(ctx)
+	}
 
-func (w *Wallet) GetBalance() (btcutil.Amount, error) {
 	// getbalance "*" 0  (0 confirmations to include unconfirmed)
 	// But getbalance might only show balance of added keys.
 	// Since we import addresses, they should be in the default wallet or the named one.
-	return w.client.GetBalance("*")
+	var btc float64
+	if err := w.client.call(ctx, "getbalance", &btc, "*"); err != nil {
+		return 0, err
+	}
+	return btcutil.NewAmount(btc)
 }
 
-func (w *Wallet) GetNewAddress() (string, error) {
-	// 1. Get next index
-	var idx int
-	err := w.db.QueryRow("SELECT derivation_index FROM wallet_state WHERE id = 1").Scan(&idx)
+func (w *Wallet) GetNewAddress(ctx context.Context) (string, error) {
+	done, err := w.beginIssue()
 	if err != nil {
 		return "", err
 	}
+	defer done()
 
-	// 2. Derive address at m/0/idx
-	addressStr, err := w.DeriveAddress(idx)
-	if err != nil {
-		return "", err
-	}
+	addr, _, err := w.issueAddress(ctx)
+	return addr, err
+}
 
-	// 3. Import into bitcoind using importdescriptors (works with descriptor wallets)
-	// Format: addr(ADDRESS) for a single address descriptor
-	descriptor := fmt.Sprintf("addr(%s)", addressStr)
-	err = w.importDescriptor(descriptor)
-	if err != nil {
-		return "", fmt.Errorf("failed to import address: %v", err)
-	}
+// issueAddress issues the next external address and returns it with its
+// index. The caller must hold beginIssue. Reading the index, the gap check,
+// the import and storing the next index happen under issueMu, so each
+// index is handed out once and persisted before the next is read.
+func (w *Wallet) issueAddress(ctx context.Context) (string, int, error) {
+	w.issueMu.Lock()
+	defer w.issueMu.Unlock()
 
-	// 4. Update index
-	_, err = w.db.Exec("UPDATE wallet_state SET derivation_index = $1 WHERE id = 1", idx+1)
+	// 1. Get next index
+	idx, err := w.derivationIndex(ctx)
 	if err != nil {
-		return "", err
+		return "", 0, err
 	}
 
-	return addressStr, nil
-}
+	// Refuse to run past the gap limit, or wallets restored from the xpub
+	// would not find funds sent to later addresses
+	if err := w.checkGap(ctx, idx); err != nil {
+		return "", 0, err
+	}
 
-func (w *Wallet) DeriveAddress(idx int) (string, error) {
-	// External chain is 0
-	chain, err := w.xpub.Derive(0)
+	// 2. Derive the external address at idx
+	addressStr, err := w.DeriveAddress(idx)
 	if err != nil {
-		return "", err
+		return "", 0, err
 	}
-	child, err := chain.Derive(uint32(idx))
-	if err != nil {
-		return "", err
+
+	// 3. Import the descriptor into bitcoind up to idx. The range only
+	// grows, as bitcoind refuses to shrink it on re-import, so it covers
+	// the addresses account discovery imported.
+	// In compact filter mode the address is watched through block filters instead.
+	if w.filters == nil {
+		end := idx
+		if w.accounts != nil {
+			end = max(end, accountGap-1)
+		}
+		err = w.importDescriptor(ctx, w.external, end, false)
+		if err != nil {
+			return "", 0, fmt.Errorf("failed to import address: %v", err)
+		}
 	}
-	addr, err := child.Address(w.params)
+
+	// 4. Update index. Once the address is imported the index is recorded
+	// even if the caller has gone away, keeping the node and database in
+	// step.
+	_, err = w.db.ExecContext(context.WithoutCancel(ctx), "UPDATE wallets SET derivation_index = $2 WHERE id = $1", w.id, idx+1)
 	if err != nil {
-		return "", err
+		return "", 0, err
 	}
-	return addr.EncodeAddress(), nil
-}
+	metrics.DerivationIndex.WithLabelValues(w.metricsLabel()).Set(float64(idx + 1))
 
-func (w *Wallet) GetUTXOs() ([]btcjson.ListUnspentResult, error) {
-	// listunspent 0 9999999 []
-	return w.client.ListUnspent()
+	return addressStr, idx, nil
 }
 
-// importDescriptor imports a descriptor into the wallet using importdescriptors RPC
-func (w *Wallet) importDescriptor(descriptor string) error {
-	// Get the checksum for the descriptor using getdescriptorinfo
-	getDescInfoParams := []json.RawMessage{
-		json.RawMessage(fmt.Sprintf(`"%s"`, descriptor)),
+func (w *Wallet) GetUTXOs(ctx context.Context) ([]btcjson.ListUnspentResult, error) {
+	if w.filters != nil {
+		return w.cachedUTXOs(ctx)
 	}
-	result, err := w.client.RawRequest("getdescriptorinfo", getDescInfoParams)
-	if err != nil {
-		return fmt.Errorf("getdescriptorinfo failed: %v", err)
+	// listunspent, which defaults to 1 9999999
+	var utxos []btcjson.ListUnspentResult
+	if err := w.client.call(ctx, "listunspent", &utxos); err != nil {
+		return nil, err
 	}
+	return utxos, nil
+}
 
-	var descInfo struct {
-		Descriptor string `json:"descriptor"`
-	}
-	if err := json.Unmarshal(result, &descInfo); err != nil {
-		return fmt.Errorf("failed to parse descriptor info: %v", err)
-	}
+// importDescriptor imports desc with the range [0, end] into the node
+// wallet as watch-only. internal marks outputs to it as change.
+func (w *Wallet) importDescriptor(ctx context.Context, desc *descriptor.Descriptor, end int, internal bool) error {
+	return importDescriptors(ctx, w.client, descriptorImport(desc, end, internal, "now"))
+}
 
-	// Import the descriptor with checksum
-	importReq := []map[string]interface{}{
-		{
-			"desc":      descInfo.Descriptor,
-			"timestamp": "now",
-			"watchonly": true,
-		},
-	}
-	reqJSON, err := json.Marshal(importReq)
-	if err != nil {
-		return fmt.Errorf("failed to marshal import request: %v", err)
+// descriptorImport is an importdescriptors request for desc with the range
+// [0, end]. timestamp is "now", or the unix time to rescan from.
+func descriptorImport(desc *descriptor.Descriptor, end int, internal bool, timestamp interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"desc":      desc.String(),
+		"range":     []int{0, end},
+		"timestamp": timestamp,
+		"watchonly": true,
+		"internal":  internal,
 	}
+}
 
-	importParams := []json.RawMessage{json.RawMessage(reqJSON)}
-	_, err = w.client.RawRequest("importdescriptors", importParams)
-	if err != nil {
+// importDescriptors runs importdescriptors with requests in one call, so
+// at most one rescan is done.
+func importDescriptors(ctx context.Context, client *nodeClient, requests ...map[string]interface{}) error {
+	var results []struct {
+		Success bool              `json:"success"`
+		Error   *btcjson.RPCError `json:"error"`
+	}
+	if err := client.call(ctx, "importdescriptors", &results, requests); err != nil {
 		return fmt.Errorf("importdescriptors failed: %v", err)
 	}
-
+	for _, r := range results {
+		if !r.Success {
+			if r.Error != nil {
+				return fmt.Errorf("importdescriptors failed: %v", r.Error)
+			}
+			return errors.New("importdescriptors failed")
+		}
+	}
 	return nil
 }
+
+// derivationIndex returns the next external index to issue.
+func (w *Wallet) derivationIndex(ctx context.Context) (int, error) {
+	var idx int
+	err := w.db.QueryRowContext(ctx, "SELECT derivation_index FROM wallets WHERE id = $1", w.id).Scan(&idx)
+	return idx, err
+}
@@ -1,11 +1,34 @@
 package wallet
 
 import (
+	"bytes"
+	"context"
 	"database/sql"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/btcsuite/btcd/btcec/v2/schnorr"
+	"github.com/btcsuite/btcd/btcjson"
+	"github.com/btcsuite/btcd/btcutil"
 	"github.com/btcsuite/btcd/btcutil/hdkeychain"
+	"github.com/btcsuite/btcd/btcutil/psbt"
 	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+
+	"github.com/sawdustofmind/bitcoin-wallet/backend/config"
+	"github.com/sawdustofmind/bitcoin-wallet/backend/descriptor"
+	"github.com/sawdustofmind/bitcoin-wallet/backend/health"
 )
 
 func TestDeriveAddress(t *testing.T) {
@@ -22,17 +45,10 @@ func TestDeriveAddress(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Failed to neuter key: %v", err)
 	}
-	xpubStr := neuter.String()
-
-	xpubKey, err := hdkeychain.NewKeyFromString(xpubStr)
-	if err != nil {
-		t.Fatalf("Failed to parse xpub: %v", err)
-	}
-
 	w := &Wallet{
-		xpub:   xpubKey,
-		params: &chaincfg.RegressionNetParams,
-		db:     &sql.DB{}, // Mock or nil, not used in DeriveAddress
+		external: testDescriptor(t, neuter.String(), ScriptP2PKH, &chaincfg.RegressionNetParams),
+		params:   &chaincfg.RegressionNetParams,
+		db:       &sql.DB{}, // Mock or nil, not used in DeriveAddress
 	}
 
 	// Test index 0
@@ -53,3 +69,918 @@ func TestDeriveAddress(t *testing.T) {
 		t.Fatal("Addresses should be different")
 	}
 }
+
+// testDescriptor returns the external descriptor of xpub for scriptType.
+func testDescriptor(t *testing.T, xpub, scriptType string, params *chaincfg.Params) *descriptor.Descriptor {
+	t.Helper()
+	d, err := xpubDescriptor(xpub, scriptType, params)
+	if err != nil {
+		t.Fatalf("Failed to build descriptor: %v", err)
+	}
+	return d
+}
+
+func TestDeriveAddressScriptTypes(t *testing.T) {
+	// Account key and first receive address from the BIP84 test vectors
+	const (
+		zpub     = "zpub6rFR7y4Q2AijBEqTUquhVz398htDFrtymD9xYYfG1m4wAcvPhXNfE3EfH1r1ADqtfSdVCToUG868RvUUkgDKf31mGDtKsAYz2oz2AGutZYs"
+		wantWPKH = "bc1qcr8te4kr609gcawutmrza0j4xv80jy8z306fyu"
+	)
+	xpubKey, err := hdkeychain.NewKeyFromString(zpub)
+	if err == nil {
+		// Descriptors take the xpub encoding
+		xpubKey, err = xpubKey.CloneWithVersion(chaincfg.MainNetParams.HDPublicKeyID[:])
+	}
+	if err != nil {
+		t.Fatalf("Failed to parse xpub: %v", err)
+	}
+	params := &chaincfg.MainNetParams
+	w := &Wallet{external: testDescriptor(t, xpubKey.String(), ScriptP2WPKH, params), params: params}
+	if got, err := w.DeriveAddress(0); err != nil || got != wantWPKH {
+		t.Errorf("p2wpkh DeriveAddress(0) = %s, %v, want %s", got, err, wantWPKH)
+	}
+
+	// The other types use the same key, so check that they commit to it
+	child, err := xpubKey.Derive(0)
+	if err == nil {
+		child, err = child.Derive(0)
+	}
+	if err != nil {
+		t.Fatalf("Failed to derive key: %v", err)
+	}
+	pubKey, err := child.ECPubKey()
+	if err != nil {
+		t.Fatalf("Failed to get public key: %v", err)
+	}
+
+	w.external = testDescriptor(t, xpubKey.String(), ScriptP2TR, params)
+	taproot, err := w.DeriveAddress(0)
+	if err != nil {
+		t.Fatalf("DeriveAddress failed: %v", err)
+	}
+	outputKey := schnorr.SerializePubKey(txscript.ComputeTaprootKeyNoScript(pubKey))
+	if addr, err := btcutil.DecodeAddress(taproot, w.params); err != nil || !bytes.Equal(addr.ScriptAddress(), outputKey) {
+		t.Errorf("p2tr address %s does not commit to the tweaked key", taproot)
+	}
+
+	w.external = testDescriptor(t, xpubKey.String(), ScriptP2SHP2WPKH, params)
+	nested, err := w.DeriveAddress(0)
+	if err != nil {
+		t.Fatalf("DeriveAddress failed: %v", err)
+	}
+	native, err := btcutil.DecodeAddress(wantWPKH, w.params)
+	if err != nil {
+		t.Fatalf("Failed to decode address: %v", err)
+	}
+	redeem, err := txscript.PayToAddrScript(native)
+	if err != nil {
+		t.Fatalf("Failed to build script: %v", err)
+	}
+	want, err := btcutil.NewAddressScriptHash(redeem, w.params)
+	if err != nil {
+		t.Fatalf("Failed to build address: %v", err)
+	}
+	if nested != want.EncodeAddress() || !strings.HasPrefix(nested, "3") {
+		t.Errorf("p2sh-p2wpkh address = %s, want %s", nested, want.EncodeAddress())
+	}
+
+	if got := w.derivationPath(7); got != "m/0/7" {
+		t.Errorf("derivationPath(7) = %s, want m/0/7", got)
+	}
+	if _, err := xpubDescriptor(xpubKey.String(), "p2wsh", params); err == nil {
+		t.Error("Expected an error for an unknown script type")
+	}
+}
+
+func TestForkPoint(t *testing.T) {
+	stored := []blockRef{
+		{Height: 105, Hash: "e"},
+		{Height: 104, Hash: "d"},
+		{Height: 103, Hash: "c"},
+		{Height: 102, Hash: "b"},
+	}
+
+	tests := []struct {
+		name     string
+		active   map[int64]string
+		want     int64
+		notFound bool
+	}{
+		{
+			name:   "no reorg",
+			active: map[int64]string{105: "e", 104: "d", 103: "c", 102: "b"},
+			want:   105,
+		},
+		{
+			name:   "two block reorg",
+			active: map[int64]string{105: "e2", 104: "d2", 103: "c", 102: "b"},
+			want:   103,
+		},
+		{
+			name:   "chain got shorter",
+			active: map[int64]string{104: "d", 103: "c", 102: "b"},
+			want:   104,
+		},
+		{
+			name:     "deeper than tracked",
+			active:   map[int64]string{105: "x", 104: "x", 103: "x", 102: "x"},
+			notFound: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, found, err := forkPoint(stored, func(h int64) (string, error) {
+				return tt.active[h], nil
+			})
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if tt.notFound {
+				if found {
+					t.Fatalf("Expected no fork point, got %d", got)
+				}
+				return
+			}
+			if !found || got != tt.want {
+				t.Fatalf("Expected fork at %d, got %d (found %v)", tt.want, got, found)
+			}
+		})
+	}
+}
+
+func TestFilterMatches(t *testing.T) {
+	xpubStr := "tpubD6NzVbkrYhZ4XNsDrPgErrqxTmaiY343QwdZmi6RMgU3p4qjY77xXcb15pX6cRa2fX6Vpxz7h16BWmsXyZKUsp1nULcVb2WLAuMQfGKVoQr"
+	w := &Wallet{external: testDescriptor(t, xpubStr, ScriptP2PKH, &chaincfg.RegressionNetParams), params: &chaincfg.RegressionNetParams}
+
+	scriptFor := func(idx int) string {
+		addrStr, err := w.DeriveAddress(idx)
+		if err != nil {
+			t.Fatalf("Failed to derive address %d: %v", idx, err)
+		}
+		addr, err := btcutil.DecodeAddress(addrStr, w.params)
+		if err != nil {
+			t.Fatalf("Failed to decode address: %v", err)
+		}
+		script, err := txscript.PayToAddrScript(addr)
+		if err != nil {
+			t.Fatalf("Failed to build script: %v", err)
+		}
+		return hex.EncodeToString(script)
+	}
+
+	// A block paying to address 0
+	paid, _ := hex.DecodeString(scriptFor(0))
+	tx := wire.NewMsgTx(wire.TxVersion)
+	tx.AddTxIn(wire.NewTxIn(&wire.OutPoint{Hash: chainhash.Hash{1}, Index: 0}, nil, nil))
+	tx.AddTxOut(wire.NewTxOut(50000, paid))
+	block := &wire.MsgBlock{Header: wire.BlockHeader{Timestamp: time.Unix(1700000000, 0)}}
+	block.AddTransaction(tx)
+	hash := block.BlockHash()
+
+	src := NewMemoryFilterSource()
+	if err := src.AddBlock(block, nil); err != nil {
+		t.Fatalf("Failed to build filter: %v", err)
+	}
+	w.SetFilterSource(src)
+
+	match, err := w.filterMatches(context.Background(), &hash, map[string]ownScript{scriptFor(0): {index: 0}, scriptFor(1): {index: 1}})
+	if err != nil {
+		t.Fatalf("Filter match failed: %v", err)
+	}
+	if !match {
+		t.Fatal("Expected filter to match script of address 0")
+	}
+
+	match, err = w.filterMatches(context.Background(), &hash, map[string]ownScript{scriptFor(2): {index: 2}, scriptFor(3): {index: 3}})
+	if err != nil {
+		t.Fatalf("Filter match failed: %v", err)
+	}
+	if match {
+		t.Fatal("Expected filter not to match unrelated scripts")
+	}
+}
+
+func TestDailySeries(t *testing.T) {
+	day := func(d, h int) time.Time { return time.Date(2024, 1, d, h, 0, 0, 0, time.UTC) }
+
+	changes := []balanceChange{
+		{At: day(2, 10), Delta: 100000},
+		{At: day(2, 23), Delta: 50000},
+		{At: day(4, 1), Delta: -100000},
+		{At: day(1, 12), Delta: 7},
+	}
+
+	points := dailySeries(changes, day(2, 0), day(5, 0))
+
+	want := []int64{150007, 150007, 50007, 50007}
+	if len(points) != len(want) {
+		t.Fatalf("Expected %d points, got %d", len(want), len(points))
+	}
+	for i, p := range points {
+		if !p.Date.Equal(day(2+i, 0)) {
+			t.Errorf("Point %d: expected date %s, got %s", i, day(2+i, 0), p.Date)
+		}
+		if int64(p.Balance) != want[i] {
+			t.Errorf("Point %d: expected balance %d, got %d", i, want[i], int64(p.Balance))
+		}
+	}
+}
+
+func TestImportBIP329Limits(t *testing.T) {
+	w := &Wallet{}
+	record := `{"type":"addr","ref":"bcrt1qexample","label":"x"}` + "\n"
+
+	_, err := w.ImportBIP329(context.Background(), strings.NewReader(strings.Repeat(record, maxLabelLines+1)))
+	var labelErr *LabelError
+	if !errors.As(err, &labelErr) || labelErr.Line != maxLabelLines+1 {
+		t.Fatalf("Expected an error on line %d, got %v", maxLabelLines+1, err)
+	}
+
+	// A size limit imposed by the caller is reported as such
+	body := http.MaxBytesReader(httptest.NewRecorder(), io.NopCloser(strings.NewReader(strings.Repeat(record, 10))), 100)
+	_, err = w.ImportBIP329(context.Background(), body)
+	var tooLarge *http.MaxBytesError
+	if !errors.As(err, &tooLarge) {
+		t.Fatalf("Expected a MaxBytesError, got %v", err)
+	}
+}
+
+func TestReadinessChecks(t *testing.T) {
+	info := map[string]interface{}{
+		"chain":                "regtest",
+		"blocks":               120,
+		"initialblockdownload": false,
+		"time":                 time.Now().Add(-time.Minute).Unix(),
+	}
+	loaded := []string{"mywallet"}
+	node := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		var req struct {
+			ID     json.RawMessage `json:"id"`
+			Method string          `json:"method"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		var result interface{}
+		switch req.Method {
+		case "getblockchaininfo":
+			result = info
+		case "listwallets":
+			result = loaded
+		}
+		json.NewEncoder(rw).Encode(map[string]interface{}{"result": result, "error": nil, "id": req.ID})
+	}))
+	defer node.Close()
+
+	cfg := config.BitcoinConfig{
+		RPCHost: strings.TrimPrefix(node.URL, "http://"),
+		RPCUser: "user",
+		RPCPass: "pass",
+	}
+	w := &Wallet{id: DefaultWalletID, name: "mywallet"}
+	m := &Manager{
+		cfg:     cfg,
+		params:  &chaincfg.RegressionNetParams,
+		root:    newNodeClient(cfg, ""),
+		wallets: map[int64]*Wallet{DefaultWalletID: w},
+	}
+
+	run := func() map[string]health.Result {
+		return health.NewChecker(time.Second, m.ReadinessChecks(time.Hour)...).Run(context.Background()).Checks
+	}
+
+	// A single failed sync does not fail readiness
+	w.recordSync(errors.New("getblockhash failed"))
+	for name, res := range run() {
+		if res.Status != health.StatusOK {
+			t.Errorf("%s = %+v on a healthy node", name, res)
+		}
+	}
+	w.recordSync(errors.New("getblockhash failed"))
+	w.recordSync(errors.New("getblockhash failed"))
+
+	info["initialblockdownload"] = true
+	info["chain"] = "main"
+	info["time"] = time.Now().Add(-3 * time.Hour).Unix()
+	loaded = []string{}
+	want := map[string]string{
+		"bitcoind":               "",
+		"initial_block_download": "node is in initial block download",
+		"chain":                  "node is on main, wallet is configured for regtest",
+		// The block time has whole seconds, so the age may round up
+		"tip":    "tip at height 120 is 3h0m",
+		"wallet": `wallet "mywallet" is not loaded`,
+		"sync":   "chain sync of wallet 1 failed 3 times in a row",
+	}
+	checks := run()
+	for name, msg := range want {
+		if got := checks[name].Error; got != msg && (msg == "" || !strings.HasPrefix(got, msg)) {
+			t.Errorf("%s error = %q, want %q", name, got, msg)
+		}
+	}
+}
+
+func TestNodeClient(t *testing.T) {
+	release := make(chan struct{})
+	node := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if user, pass, _ := r.BasicAuth(); user != "user" || pass != "pass" {
+			rw.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		var req struct {
+			ID     json.RawMessage   `json:"id"`
+			Method string            `json:"method"`
+			Params []json.RawMessage `json:"params"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		switch req.Method {
+		case "getblockhash":
+			if r.URL.Path != "/wallet/mywallet" {
+				t.Errorf("getblockhash sent to %q", r.URL.Path)
+			}
+			if len(req.Params) != 1 || string(req.Params[0]) != "7" {
+				t.Errorf("getblockhash params = %s", req.Params)
+			}
+			json.NewEncoder(rw).Encode(map[string]interface{}{"result": strings.Repeat("ab", 32), "error": nil, "id": req.ID})
+		case "loadwallet":
+			rw.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(rw).Encode(map[string]interface{}{
+				"result": nil,
+				"error":  map[string]interface{}{"code": -35, "message": "Wallet already loaded"},
+				"id":     req.ID,
+			})
+		case "getblockcount":
+			// Hang like an overloaded node until the test is done
+			<-release
+		}
+	}))
+	defer node.Close()
+	defer close(release)
+
+	cfg := config.BitcoinConfig{
+		RPCHost:    strings.TrimPrefix(node.URL, "http://"),
+		RPCUser:    "user",
+		RPCPass:    "pass",
+		RPCTimeout: 100 * time.Millisecond,
+	}
+	client := newNodeClient(cfg, "mywallet")
+	ctx := context.Background()
+
+	hash, err := client.getBlockHash(ctx, 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hash.String() != strings.Repeat("ab", 32) {
+		t.Errorf("getblockhash = %s", hash)
+	}
+
+	var rpcErr *btcjson.RPCError
+	if err := client.call(ctx, "loadwallet", nil, "mywallet"); !errors.As(err, &rpcErr) || rpcErr.Code != rpcWalletAlreadyLoaded {
+		t.Errorf("loadwallet error = %v, want RPC error %d", err, rpcWalletAlreadyLoaded)
+	}
+
+	start := time.Now()
+	_, err = client.getBlockCount(ctx)
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Errorf("getblockcount error = %v, want timeout", err)
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("getblockcount took %s with a %s timeout", d, cfg.RPCTimeout)
+	}
+
+	// A caller's deadline applies even without a per-call timeout
+	cfg.RPCTimeout = 0
+	ctx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	if _, err := newNodeClient(cfg, "").getBlockCount(ctx); err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Errorf("getblockcount error = %v, want timeout", err)
+	}
+
+	cfg.RPCPass = "wrong"
+	if _, err := newNodeClient(cfg, "").getBlockCount(context.Background()); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("getblockcount error = %v, want 401", err)
+	}
+}
+
+func TestWorkerGroup(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	runs := make(chan int, 2)
+	n := 0
+	var g workerGroup
+	g.Go(ctx, "test", func(ctx context.Context) error {
+		n++
+		runs <- n
+		if n == 1 {
+			panic("boom")
+		}
+		<-ctx.Done()
+		return ctx.Err()
+	})
+
+	for want := 1; want <= 2; want++ {
+		select {
+		case got := <-runs:
+			if got != want {
+				t.Fatalf("run %d, want %d", got, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("worker was not restarted after a panic")
+		}
+	}
+
+	cancel()
+	done := make(chan struct{})
+	go func() {
+		g.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Wait did not return after cancel")
+	}
+}
+
+func TestStopDrainsIssuance(t *testing.T) {
+	w := &Wallet{client: newNodeClient(config.BitcoinConfig{}, "")}
+
+	done, err := w.beginIssue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stopped := make(chan struct{})
+	go func() {
+		w.Stop()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+		t.Fatal("Stop returned with issuance in flight")
+	case <-time.After(100 * time.Millisecond):
+	}
+	if _, err := w.beginIssue(); !errors.Is(err, ErrStopped) {
+		t.Errorf("beginIssue after Stop = %v, want ErrStopped", err)
+	}
+
+	done()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Stop did not return after issuance finished")
+	}
+}
+
+func withChecksum(desc string) string {
+	sum, err := descriptor.Checksum(desc)
+	if err != nil {
+		panic(err)
+	}
+	return desc + "#" + sum
+}
+
+func TestDefinitionDescriptors(t *testing.T) {
+	const tpub = "tpubD6NzVbkrYhZ4XNsDrPgErrqxTmaiY343QwdZmi6RMgU3p4qjY77xXcb15pX6cRa2fX6Vpxz7h16BWmsXyZKUsp1nULcVb2WLAuMQfGKVoQr"
+	params := &chaincfg.RegressionNetParams
+
+	external, internal, scriptType, err := definitionDescriptors(Definition{
+		Descriptor: withChecksum("sh(wpkh([d34db33f/49h/1h/0h]" + tpub + "/<0;1>/*))"),
+	}, params)
+	if err != nil {
+		t.Fatalf("definitionDescriptors failed: %v", err)
+	}
+	if scriptType != ScriptP2SHP2WPKH || internal == nil {
+		t.Fatalf("script type = %s, internal = %v", scriptType, internal)
+	}
+
+	w := &Wallet{external: external, params: params}
+	want := testDescriptor(t, tpub, ScriptP2SHP2WPKH, params)
+	for idx := 0; idx < 3; idx++ {
+		got, err := w.DeriveAddress(idx)
+		if err != nil {
+			t.Fatalf("DeriveAddress failed: %v", err)
+		}
+		wantAddr, err := want.Address(uint32(idx))
+		if err != nil {
+			t.Fatalf("Address failed: %v", err)
+		}
+		if got != wantAddr.EncodeAddress() {
+			t.Errorf("DeriveAddress(%d) = %s, want %s", idx, got, wantAddr)
+		}
+	}
+	if got := w.derivationPath(2); got != "m/49h/1h/0h/0/2" {
+		t.Errorf("derivationPath(2) = %s", got)
+	}
+	if !strings.Contains(internal.String(), "/1/*))#") {
+		t.Errorf("internal descriptor = %s", internal)
+	}
+
+	// A separate change descriptor
+	_, internal, _, err = definitionDescriptors(Definition{
+		Descriptor:       withChecksum("tr(" + tpub + "/0/*)"),
+		ChangeDescriptor: withChecksum("tr(" + tpub + "/1/*)"),
+	}, params)
+	if err != nil || internal == nil || internal.Type() != "tr" {
+		t.Errorf("definitionDescriptors with change = %v, %v", internal, err)
+	}
+}
+
+func TestCreateValidation(t *testing.T) {
+	const tpub = "tpubD6NzVbkrYhZ4XNsDrPgErrqxTmaiY343QwdZmi6RMgU3p4qjY77xXcb15pX6cRa2fX6Vpxz7h16BWmsXyZKUsp1nULcVb2WLAuMQfGKVoQr"
+	m := &Manager{params: &chaincfg.RegressionNetParams}
+
+	seed := bytes.Repeat([]byte{1}, hdkeychain.RecommendedSeedLen)
+	master, err := hdkeychain.NewMaster(seed, &chaincfg.RegressionNetParams)
+	if err != nil {
+		t.Fatalf("Failed to create master key: %v", err)
+	}
+	mainMaster, err := hdkeychain.NewMaster(seed, &chaincfg.MainNetParams)
+	if err != nil {
+		t.Fatalf("Failed to create master key: %v", err)
+	}
+	mainXPUB, err := mainMaster.Neuter()
+	if err != nil {
+		t.Fatalf("Failed to neuter key: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		def  Definition
+		want string
+	}{
+		{"no name", Definition{XPUB: tpub}, "name is required"},
+		{"unknown script type", Definition{Name: "a", XPUB: tpub, ScriptType: "p2pk"}, `unknown script type "p2pk"`},
+		{"multisig from xpub", Definition{Name: "a", XPUB: tpub, ScriptType: ScriptP2WSH}, "needs a descriptor"},
+		{"bare multisig", Definition{Name: "a", Descriptor: withChecksum("sh(sortedmulti(1," + tpub + "/0/*))")}, "not supported for wallets"},
+		{"bad node wallet", Definition{Name: "a", XPUB: tpub, NodeWallet: "../mywallet"}, "node_wallet must be"},
+		{"private key", Definition{Name: "a", XPUB: master.String()}, "private keys are not accepted"},
+		{"wrong network", Definition{Name: "a", XPUB: mainXPUB.String()}, "not for regtest"},
+		{"garbage", Definition{Name: "a", XPUB: "xpub"}, "invalid xpub"},
+		{"xpub and descriptor", Definition{Name: "a", XPUB: tpub, Descriptor: withChecksum("wpkh(" + tpub + "/0/*)")}, "mutually exclusive"},
+		{"change without descriptor", Definition{Name: "a", XPUB: tpub, ChangeDescriptor: withChecksum("wpkh(" + tpub + "/1/*)")}, "requires descriptor"},
+		{"no key", Definition{Name: "a", ScriptType: ScriptP2WPKH}, "xpub, descriptor or account_keys is required"},
+		{"no checksum", Definition{Name: "a", Descriptor: "wpkh(" + tpub + "/0/*)"}, "missing checksum"},
+		{"not ranged", Definition{Name: "a", Descriptor: withChecksum("wpkh(" + tpub + "/0/0)")}, "must be ranged"},
+		{"script type mismatch", Definition{Name: "a", Descriptor: withChecksum("tr(" + tpub + "/0/*)"), ScriptType: ScriptP2WPKH}, "does not match"},
+		{"multipath and change", Definition{Name: "a", Descriptor: withChecksum("wpkh(" + tpub + "/<0;1>/*)"), ChangeDescriptor: withChecksum("wpkh(" + tpub + "/1/*)")}, "cannot be combined"},
+		{"three paths", Definition{Name: "a", Descriptor: withChecksum("wpkh(" + tpub + "/<0;1;2>/*)")}, "two paths"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := m.Create(context.Background(), tt.def)
+			var defErr *DefinitionError
+			if !errors.As(err, &defErr) {
+				t.Fatalf("Expected a DefinitionError, got %v", err)
+			}
+			if !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("error = %q, want it to contain %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestCreatePSBTValidation(t *testing.T) {
+	w := &Wallet{params: &chaincfg.RegressionNetParams}
+	const addr = "bcrt1qkpad42v3wkkt9hfww7vs7udr72pm32vyz5kgphkjm5m3z57pgz0swjhzs8"
+
+	tests := []struct {
+		name     string
+		payments []Payment
+		feeRate  int64
+		want     string
+	}{
+		{"no outputs", nil, 1, "at least one output"},
+		{"zero fee rate", []Payment{{addr, 10000}}, 0, "fee rate must be"},
+		{"fee rate too high", []Payment{{addr, 10000}}, MaxFeeRate + 1, "fee rate must be"},
+		{"mainnet address", []Payment{{"bc1qcr8te4kr609gcawutmrza0j4xv80jy8z306fyu", 10000}}, 1, "invalid address"},
+		{"dust", []Payment{{addr, 100}}, 1, "dust limit"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := w.CreatePSBT(context.Background(), tt.payments, tt.feeRate)
+			var reqErr *PSBTRequestError
+			if !errors.As(err, &reqErr) {
+				t.Fatalf("Expected a PSBTRequestError, got %v", err)
+			}
+			if !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("error = %q, want it to contain %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestKeyDerivations(t *testing.T) {
+	desc, err := descriptor.Parse(withChecksum("wsh(sortedmulti(2,"+
+		"[4ba43603/48h/1h/0h/2h]tpubDDwf2gdFxFahr9RUtDQCuZmsx34CfdZ7RALAirwC2FGeLBzW1TDiEpqFeRdxLdZD7rfsbZHYwSaT6CLM3TAcYRw6xfRv4U6KCQt4Zuhvjkz/0/*,"+
+		"[8dfc9b34/48h/1h/0h/2h]tpubDEXiq2SVhhqALktxfVFgj3C9M3T2G7xL11iezYg2LJAf245YkNyqp2K9TrvHABDCp2232k34UegU4aKEtUZNigit8EEqoLNe2JKMzMiLwYq/0/*,"+
+		"[56c4fac3/48h/1h/0h/2h]tpubDEg3kqr2jo5ergkJbFqRHvCpiob7wR7Hi44J7y987G1JZfbzBND77XKTyPZzGvh3uyDf8kexMJnFD9W8FuraJ4wLMsx6YuZVXRSRRcx6QdD/0/*))"), &chaincfg.RegressionNetParams)
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+
+	scripts, err := desc.Scripts(5)
+	if err != nil {
+		t.Fatalf("Scripts failed: %v", err)
+	}
+	d, err := keyDerivations(desc, 5, scripts)
+	if err != nil {
+		t.Fatalf("keyDerivations failed: %v", err)
+	}
+	if len(d.bip32) != 3 || d.taproot != nil {
+		t.Fatalf("got %d BIP32 and %d taproot derivations, want 3 and 0", len(d.bip32), len(d.taproot))
+	}
+	h := uint32(hdkeychain.HardenedKeyStart)
+	wantPath := []uint32{48 + h, 1 + h, 0 + h, 2 + h, 0, 5}
+	for i, fp := range []string{"4ba43603", "8dfc9b34", "56c4fac3"} {
+		got := d.bip32[i]
+		var b [4]byte
+		binary.LittleEndian.PutUint32(b[:], got.MasterKeyFingerprint)
+		if hex.EncodeToString(b[:]) != fp {
+			t.Errorf("key %d fingerprint = %x, want %s", i, b, fp)
+		}
+		if fmt.Sprint(got.Bip32Path) != fmt.Sprint(wantPath) {
+			t.Errorf("key %d path = %v, want %v", i, got.Bip32Path, wantPath)
+		}
+		// Every cosigner key is in the witness script
+		if !bytes.Contains(scripts.Witness, got.PubKey) {
+			t.Errorf("key %d is not in the witness script", i)
+		}
+	}
+}
+
+func TestSpendingPathStatus(t *testing.T) {
+	const tpub = "tpubD6NzVbkrYhZ4XNsDrPgErrqxTmaiY343QwdZmi6RMgU3p4qjY77xXcb15pX6cRa2fX6Vpxz7h16BWmsXyZKUsp1nULcVb2WLAuMQfGKVoQr"
+	key := func(account int) string {
+		return fmt.Sprintf("[d34db33f/48h/1h/%dh/2h]%s/%d/<0;1>/*", account, tpub, account)
+	}
+	external, _, scriptType, err := definitionDescriptors(Definition{
+		Descriptor: withChecksum(fmt.Sprintf("wsh(or_d(multi(2,%s,%s,%s),and_v(v:pk(%s),older(52560))))",
+			key(0), key(1), key(2), key(3))),
+	}, &chaincfg.RegressionNetParams)
+	if err != nil {
+		t.Fatalf("definitionDescriptors failed: %v", err)
+	}
+	if scriptType != ScriptP2WSH {
+		t.Fatalf("script type = %s", scriptType)
+	}
+	descPaths, err := external.SpendingPaths()
+	if err != nil || len(descPaths) != 2 {
+		t.Fatalf("SpendingPaths = %v, %v", descPaths, err)
+	}
+	multi, err := spendingPath(descPaths[0])
+	if err != nil {
+		t.Fatalf("spendingPath failed: %v", err)
+	}
+	recovery, err := spendingPath(descPaths[1])
+	if err != nil {
+		t.Fatalf("spendingPath failed: %v", err)
+	}
+	if multi.timelocked() || multi.Signers[0].Threshold != 2 || len(multi.Signers[0].Fingerprints) != 3 {
+		t.Errorf("multisig path = %+v", multi)
+	}
+	if recovery.Relative == nil || recovery.Relative.Blocks != 52560 || recovery.Signers[0].Fingerprints[0] != "d34db33f" {
+		t.Errorf("recovery path = %+v", recovery)
+	}
+
+	tip := chainTip{height: 800000, medianTime: 1700000000}
+	tests := []struct {
+		name          string
+		path          SpendingPath
+		confirmations int64
+		confirmedAt   int64
+		want          PathStatus
+		warn          bool
+	}{
+		{"no timelock", multi, 0, 0, PathStatus{Available: true}, true},
+		{"unconfirmed", recovery, 0, 0, PathStatus{BlocksRemaining: 52560}, false},
+		{"far off", recovery, 1000, 0, PathStatus{BlocksRemaining: 51560}, false},
+		{"near expiry", recovery, 50000, 0, PathStatus{BlocksRemaining: 2560}, true},
+		{"expired", recovery, 52560, 0, PathStatus{Available: true}, true},
+		{"height not reached", SpendingPath{Absolute: &Timelock{Height: 800100}}, 1, 0, PathStatus{BlocksRemaining: 100}, true},
+		{"height reached", SpendingPath{Absolute: &Timelock{Height: 800000}}, 1, 0, PathStatus{Available: true}, true},
+		{"relative time", SpendingPath{Relative: &Timelock{Seconds: 512 * 10000}}, 10, 1700000000 - 5120, PathStatus{SecondsRemaining: 512 * 9990}, false},
+		{"absolute time", SpendingPath{Absolute: &Timelock{Time: 1700000000 + 600}}, 1, 0, PathStatus{SecondsRemaining: 601}, true},
+	}
+	for _, tt := range tests {
+		got := pathStatus(tt.path, tip, tt.confirmations, tt.confirmedAt)
+		if got != tt.want {
+			t.Errorf("%s: pathStatus = %+v, want %+v", tt.name, got, tt.want)
+		}
+		if warn := got.within(DefaultTimelockWarning); warn != tt.warn {
+			t.Errorf("%s: within = %v, want %v", tt.name, warn, tt.warn)
+		}
+	}
+}
+
+func TestAccountDescriptors(t *testing.T) {
+	params := &chaincfg.RegressionNetParams
+	seed := bytes.Repeat([]byte{0x2a}, hdkeychain.RecommendedSeedLen)
+	master, err := hdkeychain.NewMaster(seed, params)
+	if err != nil {
+		t.Fatalf("NewMaster failed: %v", err)
+	}
+	masterPub, err := master.ECPubKey()
+	if err != nil {
+		t.Fatalf("ECPubKey failed: %v", err)
+	}
+	fingerprint := hex.EncodeToString(btcutil.Hash160(masterPub.SerializeCompressed())[:4])
+	// accountKey is the xpub of m/purpose'/1'/n' with its origin
+	accountKey := func(purpose, n uint32) string {
+		key := master
+		for _, step := range []uint32{purpose, 1, n} {
+			if key, err = key.Derive(hdkeychain.HardenedKeyStart + step); err != nil {
+				t.Fatalf("Derive failed: %v", err)
+			}
+		}
+		pub, err := key.Neuter()
+		if err != nil {
+			t.Fatalf("Neuter failed: %v", err)
+		}
+		return fmt.Sprintf("[%s/%dh/1h/%dh]%s", fingerprint, purpose, n, pub)
+	}
+	def := Definition{AccountKeys: []string{accountKey(84, 0), accountKey(84, 1), accountKey(84, 2)}}
+
+	external, internal, scriptType, err := definitionDescriptors(def, params)
+	if err != nil || scriptType != ScriptP2WPKH || internal == nil {
+		t.Fatalf("definitionDescriptors = %v, %v, %s, %v", external, internal, scriptType, err)
+	}
+	def.ScriptType = scriptType
+	_, change, err := accountDescriptors(def, 2, params)
+	if err != nil {
+		t.Fatalf("accountDescriptors failed: %v", err)
+	}
+	// Account 2 change address 5 is m/84h/1h/2h/1/5
+	key := master
+	for _, step := range []uint32{hdkeychain.HardenedKeyStart + 84, hdkeychain.HardenedKeyStart + 1, hdkeychain.HardenedKeyStart + 2, 1, 5} {
+		if key, err = key.Derive(step); err != nil {
+			t.Fatalf("Derive failed: %v", err)
+		}
+	}
+	pub, err := key.ECPubKey()
+	if err != nil {
+		t.Fatalf("ECPubKey failed: %v", err)
+	}
+	want, err := btcutil.NewAddressWitnessPubKeyHash(btcutil.Hash160(pub.SerializeCompressed()), params)
+	if err != nil {
+		t.Fatalf("NewAddressWitnessPubKeyHash failed: %v", err)
+	}
+	got, err := change.Address(5)
+	if err != nil || got.EncodeAddress() != want.EncodeAddress() {
+		t.Errorf("account 2 change address 5 = %v, %v, want %s", got, err, want)
+	}
+	if prefix := "wpkh([" + fingerprint + "/84h/1h/2h]"; !strings.HasPrefix(change.String(), prefix) {
+		t.Errorf("change descriptor = %s, want prefix %s", change, prefix)
+	}
+
+	// The account is found in the origin bitcoind reports for an output
+	accounts := newAccountSet(def, config.BitcoinConfig{}, "w", 3)
+	account, path, ok := accounts.locate("wpkh([2ac0ffee/84h/1h/2h/1/5]02aabb)#abcdefgh")
+	if !ok || account != 2 || path != "m/84h/1h/2h/1/5" {
+		t.Errorf("locate = %d, %s, %v", account, path, ok)
+	}
+	if _, _, ok := accounts.locate("addr(bcrt1qxyz)#abcdefgh"); ok {
+		t.Error("locate placed an output without key origin")
+	}
+
+	unprefixed := accountKey(84, 0)
+	unprefixed = unprefixed[strings.IndexByte(unprefixed, ']')+1:]
+	deeper := accountKey(84, 0)
+	deeper = strings.Replace(deeper, "/0h]", "/0h/0]", 1)
+	for _, tt := range []struct {
+		name string
+		def  Definition
+		want string
+	}{
+		{"no origin", Definition{AccountKeys: []string{unprefixed}}, "must start with its key origin"},
+		{"mainnet coin", Definition{AccountKeys: []string{strings.Replace(accountKey(84, 0), "/1h/", "/0h/", 1)}}, "purpose'/1'/0'"},
+		{"wrong order", Definition{AccountKeys: []string{accountKey(84, 1)}}, "purpose'/1'/0'"},
+		{"origin deeper than key", Definition{AccountKeys: []string{deeper}}, "purpose'/1'/0'"},
+		{"mixed purposes", Definition{AccountKeys: []string{accountKey(84, 0), accountKey(86, 1)}}, "share their master fingerprint and purpose"},
+		{"script type mismatch", Definition{AccountKeys: []string{accountKey(84, 0)}, ScriptType: ScriptP2TR}, "purpose 84 is for script type"},
+		{"multisig", Definition{AccountKeys: []string{accountKey(48, 0)}}, "does not support purpose 48"},
+		{"with xpub", Definition{AccountKeys: []string{accountKey(84, 0)}, XPUB: unprefixed}, "cannot be combined"},
+	} {
+		if _, _, _, err := definitionDescriptors(tt.def, params); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: err = %v, want %q", tt.name, err, tt.want)
+		}
+	}
+	// A key below its account does not pass for one
+	child, err := master.Derive(hdkeychain.HardenedKeyStart + 84)
+	if err != nil {
+		t.Fatalf("Derive failed: %v", err)
+	}
+	childPub, err := child.Neuter()
+	if err != nil {
+		t.Fatalf("Neuter failed: %v", err)
+	}
+	shallow := fmt.Sprintf("[%s/84h/1h/0h]%s", fingerprint, childPub)
+	if _, _, _, err := definitionDescriptors(Definition{AccountKeys: []string{shallow}}, params); err == nil || !strings.Contains(err.Error(), "depth 1") {
+		t.Errorf("key at depth 1: err = %v", err)
+	}
+}
+
+func TestDecodeAddress(t *testing.T) {
+	tests := []struct {
+		address  string
+		networks []string
+		typ      string
+		version  int
+		program  string
+	}{
+		{"1BvBMSEYstWetqTFn5Au4m4GFg7xJaNVN2", []string{"mainnet"}, "p2pkh", -1, ""},
+		{"3J98t1WpEZ73CNmQviecrnyiWrnqRhWNLy", []string{"mainnet"}, "p2sh", -1, ""},
+		{"mipcBbFg9gMiCh81Kj8tqqdgoZub1ZJRfn", []string{"testnet3", "regtest", "signet"}, "p2pkh", -1, ""},
+		{"bc1qw508d6qejxtdg4y5r3zarvary0c5xw7kv8f3t4", []string{"mainnet"}, "p2wpkh", 0, "751e76e8199196d454941c45d1b3a323f1433bd6"},
+		{"bcrt1qw508d6qejxtdg4y5r3zarvary0c5xw7kygt080", []string{"regtest"}, "p2wpkh", 0, "751e76e8199196d454941c45d1b3a323f1433bd6"},
+		{"bc1p0xlxvlhemja6c4dqv22uapctqupfhlxm9h8z3k2e72q4k9hcz7vqzk5jj0", []string{"mainnet"}, "p2tr", 1, "79be667ef9dcbbac55a06295ce870b07029bfcdb2dce28d959f2815b16f81798"},
+	}
+	for _, tt := range tests {
+		d, _, err := DecodeAddress(tt.address)
+		if err != nil {
+			t.Errorf("DecodeAddress(%s) failed: %v", tt.address, err)
+			continue
+		}
+		if strings.Join(d.Networks, ",") != strings.Join(tt.networks, ",") || d.Type != tt.typ {
+			t.Errorf("DecodeAddress(%s) = %v %s, want %v %s", tt.address, d.Networks, d.Type, tt.networks, tt.typ)
+		}
+		if tt.version < 0 {
+			if d.WitnessVersion != nil {
+				t.Errorf("DecodeAddress(%s) witness version = %d", tt.address, *d.WitnessVersion)
+			}
+			continue
+		}
+		if d.WitnessVersion == nil || int(*d.WitnessVersion) != tt.version || d.WitnessProgram != tt.program {
+			t.Errorf("DecodeAddress(%s) witness = %v %s", tt.address, d.WitnessVersion, d.WitnessProgram)
+		}
+	}
+
+	var addrErr *AddressError
+	if _, _, err := DecodeAddress("bc1qw508d6qejxtdg4y5r3zarvary0c5xw7kv8f3t5"); !errors.As(err, &addrErr) {
+		t.Errorf("DecodeAddress with a bad checksum = %v", err)
+	}
+}
+
+func TestPayjoinProposal(t *testing.T) {
+	const tpub = "tpubD6NzVbkrYhZ4XNsDrPgErrqxTmaiY343QwdZmi6RMgU3p4qjY77xXcb15pX6cRa2fX6Vpxz7h16BWmsXyZKUsp1nULcVb2WLAuMQfGKVoQr"
+	desc := testDescriptor(t, tpub, ScriptP2WPKH, &chaincfg.RegressionNetParams)
+	script, err := desc.Script(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inputVSize := int64(desc.InputVSize())
+
+	// The sender pays 50000 sats to the wallet and keeps 48590 in change
+	// at 10 sat/vB
+	tx := wire.NewMsgTx(2)
+	tx.LockTime = 100
+	senderIn := wire.NewTxIn(&wire.OutPoint{Index: 1}, nil, nil)
+	senderIn.Sequence = wire.MaxTxInSequenceNum - 1
+	tx.AddTxIn(senderIn)
+	tx.AddTxOut(wire.NewTxOut(50000, script))
+	tx.AddTxOut(wire.NewTxOut(48590, []byte{txscript.OP_0, txscript.OP_DATA_20, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20}))
+	o := &payjoinOriginal{packet: &psbt.Packet{UnsignedTx: tx}, fee: 1410, vsize: 141, payment: 0}
+	c := coin{outpoint: wire.OutPoint{Index: 7}, amount: 20000, script: script, desc: desc}
+	inputFee := 10 * inputVSize
+
+	tests := []struct {
+		name            string
+		params          PayjoinParams
+		payment, change int64
+	}{
+		{"receiver pays", PayjoinParams{AdditionalFeeOutputIndex: -1}, 50000 + 20000 - inputFee, 48590},
+		{"sender contributes", PayjoinParams{AdditionalFeeOutputIndex: 1, MaxAdditionalFeeContribution: 300},
+			50000 + 20000 - (inputFee - 300), 48590 - 300},
+		{"sender pays all", PayjoinParams{AdditionalFeeOutputIndex: 1, MaxAdditionalFeeContribution: 10000},
+			50000 + 20000, 48590 - inputFee},
+		{"min fee rate", PayjoinParams{AdditionalFeeOutputIndex: -1, MinFeeRate: 20},
+			50000 + 20000 - (20*(141+inputVSize) - 1410), 48590},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proposal, idx, err := payjoinProposal(o, c, tt.params)
+			if err != nil {
+				t.Fatalf("payjoinProposal failed: %v", err)
+			}
+			if len(proposal.TxIn) != 2 || proposal.TxIn[idx].PreviousOutPoint != c.outpoint {
+				t.Fatalf("input %d of %v is not the wallet's", idx, proposal.TxIn)
+			}
+			if proposal.TxIn[idx].Sequence != senderIn.Sequence || proposal.Version != 2 || proposal.LockTime != 100 {
+				t.Errorf("sequence, version or lock time changed")
+			}
+			if got := proposal.TxOut[0].Value; got != tt.payment {
+				t.Errorf("payment = %d, want %d", got, tt.payment)
+			}
+			if got := proposal.TxOut[1].Value; got != tt.change {
+				t.Errorf("change = %d, want %d", got, tt.change)
+			}
+		})
+	}
+	if tx.TxOut[0].Value != 50000 || len(tx.TxIn) != 1 {
+		t.Error("payjoinProposal modified the original")
+	}
+
+	c.amount = btcutil.Amount(inputFee)
+	var pjErr *PayjoinError
+	if _, _, err := payjoinProposal(o, c, PayjoinParams{AdditionalFeeOutputIndex: -1}); !errors.As(err, &pjErr) || pjErr.Code != PayjoinNotEnoughMoney {
+		t.Errorf("payjoinProposal with a coin below its fee = %v, want %s", err, PayjoinNotEnoughMoney)
+	}
+}
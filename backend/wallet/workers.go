@@ -0,0 +1,115 @@
+package wallet
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+// ErrStopped is returned by operations started after Stop.
+var ErrStopped = errors.New("wallet is stopped")
+
+// Restart schedule for a background worker that failed, doubling the
+// delay after each consecutive failure.
+const (
+	workerRestartInitial = time.Second
+	workerRestartMax     = time.Minute
+)
+
+// workerGroup runs background workers until their context is cancelled.
+// A worker that returns an error or panics is logged and restarted.
+type workerGroup struct {
+	wg sync.WaitGroup
+}
+
+// Go starts fn as the worker called name.
+func (g *workerGroup) Go(ctx context.Context, name string, fn func(ctx context.Context) error) {
+	g.wg.Add(1)
+	go func() {
+		defer g.wg.Done()
+		delay := workerRestartInitial
+		for {
+			err := runWorker(ctx, fn)
+			if ctx.Err() != nil {
+				return
+			}
+			if err == nil {
+				err = errors.New("returned unexpectedly")
+			}
+			slog.ErrorContext(ctx, "Wallet worker failed, restarting", "worker", name, "retry_in", delay, "error", err)
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+				return
+			}
+			delay = min(delay*2, workerRestartMax)
+		}
+	}()
+}
+
+// Wait blocks until every worker has returned.
+func (g *workerGroup) Wait() {
+	g.wg.Wait()
+}
+
+// runWorker runs fn, turning a panic into an error.
+func runWorker(ctx context.Context, fn func(ctx context.Context) error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v\n%s", r, debug.Stack())
+		}
+	}()
+	return fn(ctx)
+}
+
+// Start runs the wallet's background workers until ctx is cancelled or
+// Stop is called. It returns immediately.
+func (w *Wallet) Start(ctx context.Context) {
+	ctx, cancel := context.WithCancel(ctx)
+	w.lifecycleMu.Lock()
+	w.cancel = cancel
+	w.lifecycleMu.Unlock()
+
+	slog.Info("Wallet started", "wallet_id", w.id, "node_wallet", w.name, "filters", w.filters != nil)
+	w.workers.Go(ctx, "chain sync", w.followChain)
+	if w.signer != nil {
+		w.workers.Go(ctx, "payjoin fallback", w.payjoinFallbacks)
+	}
+}
+
+// Stop cancels the background workers and waits for them to return. It
+// also waits for in-flight address issuance, so every index handed out is
+// persisted before the database is closed. Later issuance fails with
+// ErrStopped.
+func (w *Wallet) Stop() {
+	w.lifecycleMu.Lock()
+	w.stopped = true
+	if w.cancel != nil {
+		w.cancel()
+	}
+	w.lifecycleMu.Unlock()
+
+	w.workers.Wait()
+	w.issuing.Wait()
+	w.client.close()
+	if w.accounts != nil {
+		w.accounts.client.close()
+	}
+	slog.Info("Wallet stopped", "wallet_id", w.id)
+}
+
+// beginIssue registers an address issuance so Stop waits for it. The
+// returned func must be called when it is done.
+func (w *Wallet) beginIssue() (func(), error) {
+	w.lifecycleMu.Lock()
+	defer w.lifecycleMu.Unlock()
+	if w.stopped {
+		return nil, ErrStopped
+	}
+	w.issuing.Add(1)
+	return w.issuing.Done, nil
+}
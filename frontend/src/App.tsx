@@ -1,9 +1,9 @@
 import { useState, useEffect } from 'react'
 import axios from 'axios'
 
-// Configure axios base URL
+// API calls go through the /api proxy, which adds the UI's API key
 const api = axios.create({
-  baseURL: 'http://localhost:8080'
+  baseURL: '/api'
 })
 
 interface UTXO {
@@ -15,7 +15,7 @@ interface UTXO {
 }
 
 function App() {
-  const [balance, setBalance] = useState<number | null>(null)
+  const [balance, setBalance] = useState<string | null>(null)
   const [address, setAddress] = useState<string>('')
   const [utxos, setUtxos] = useState<UTXO[]>([])
   const [loading, setLoading] = useState(false)
@@ -23,8 +23,8 @@ function App() {
 
   const fetchBalance = async () => {
     try {
-      const res = await api.get('/balance')
-      setBalance(res.data.balance)
+      const res = await api.get('/v1/balance')
+      setBalance(res.data.balance_btc)
     } catch (err: any) {
       console.error(err)
       setError('Failed to fetch balance')
@@ -33,7 +33,7 @@ function App() {
 
   const fetchUTXOs = async () => {
     try {
-      const res = await api.get('/utxos')
+      const res = await api.get('/v1/utxos')
       setUtxos(res.data.utxos)
     } catch (err: any) {
       console.error(err)
@@ -44,7 +44,7 @@ function App() {
   const getNewAddress = async () => {
     setLoading(true)
     try {
-      const res = await api.get('/address')
+      const res = await api.post('/v1/addresses')
       setAddress(res.data.address)
       // Refresh list as we added an address? No, address doesn't affect list until funds received.
     } catch (err: any) {
@@ -1,15 +1,26 @@
-import { defineConfig } from 'vite'
+import { defineConfig, loadEnv } from 'vite'
 import react from '@vitejs/plugin-react'
 
 // https://vitejs.dev/config/
-export default defineConfig({
-  plugins: [react()],
-  server: {
-    host: true,
-    port: 3000,
-    watch: {
-      usePolling: true
+export default defineConfig(({ mode }) => {
+  // Like the nginx proxy in production, the dev server adds the API key to
+  // /api requests so it stays out of the bundle.
+  const env = loadEnv(mode, '.', 'UI_')
+  return {
+    plugins: [react()],
+    server: {
+      host: true,
+      port: 3000,
+      watch: {
+        usePolling: true
+      },
+      proxy: {
+        '/api': {
+          target: 'http://localhost:8080',
+          rewrite: (path) => path.replace(/^\/api/, ''),
+          headers: { 'X-API-Key': env.UI_API_KEY || '' }
+        }
+      }
     }
   }
 })
-
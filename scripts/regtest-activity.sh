@@ -7,6 +7,11 @@ set -e
 # Load config
 source "$(dirname "$0")/../config.env"
 
+if [ -z "$ADMIN_API_KEY" ]; then
+    echo "ADMIN_API_KEY must be set in config.env"
+    exit 1
+fi
+
 RPC_USER="${BITCOIN_RPC_USER:-user}"
 RPC_PASS="${BITCOIN_RPC_PASSWORD:-password}"
 RPC_PORT="${BITCOIN_RPC_PORT:-18443}"
@@ -53,7 +58,7 @@ echo "   Miner balance: $MINER_BALANCE BTC"
 # Get an address from the watch-only wallet via the backend API
 echo ""
 echo "3. Getting address from your wallet via API..."
-API_RESPONSE=$(curl -s http://localhost:8080/address)
+API_RESPONSE=$(curl -s -X POST -H "X-API-Key: ${ADMIN_API_KEY}" http://localhost:8080/v1/addresses)
 WALLET_ADDRESS=$(echo "$API_RESPONSE" | jq -r '.address // empty')
 
 if [ -z "$WALLET_ADDRESS" ]; then
@@ -86,6 +91,6 @@ echo "  - Address: $WALLET_ADDRESS"
 echo "  - Balance: $AMOUNT BTC (confirmed)"
 echo ""
 echo "Test your API endpoints:"
-echo "  curl http://localhost:8080/balance"
-echo "  curl http://localhost:8080/utxos"
+echo "  curl -H \"X-API-Key: \$ADMIN_API_KEY\" http://localhost:8080/v1/balance"
+echo "  curl -H \"X-API-Key: \$ADMIN_API_KEY\" http://localhost:8080/v1/utxos"
 echo ""